@@ -0,0 +1,67 @@
+package main
+
+// AcceleratorReading is a single sample of an accelerator backend
+type AcceleratorReading struct {
+	// Utilization averaged over the devices
+	Util  float64
+	Count int
+
+	// Usage attributed to the command's process tree
+	ChildUtil    float64
+	ChildMemUsed uint64
+
+	// Interconnect throughput in bytes/s, host is PCIe-like and peer is NVLink-like
+	HostTx float64
+	HostRx float64
+	PeerTx float64
+	PeerRx float64
+
+	// Power draw in watts, summed over the devices
+	Power float64
+}
+
+// Accelerator is a backend that samples GPUs, TPUs or other accelerators
+type Accelerator interface {
+	Name() string
+	// Sample reads the current usage, pids is the command's process tree
+	// (nil before the command started)
+	Sample(pids []int) (AcceleratorReading, error)
+}
+
+// acceleratorBackends lists the known backends. A backend returns nil when
+// it is not available on this machine.
+var acceleratorBackends = []func(opts *Options) Accelerator{
+	newNvidiaAccelerator,
+}
+
+func detectAccelerators(opts *Options) []Accelerator {
+	var accelerators []Accelerator
+	for _, backend := range acceleratorBackends {
+		if accelerator := backend(opts); accelerator != nil {
+			accelerators = append(accelerators, accelerator)
+		}
+	}
+	return accelerators
+}
+
+// combineReadings merges the readings of several backends as if all
+// devices came from a single backend
+func combineReadings(readings []AcceleratorReading) AcceleratorReading {
+	combined := AcceleratorReading{}
+	for _, reading := range readings {
+		combined.Util += reading.Util * float64(reading.Count)
+		combined.ChildUtil += reading.ChildUtil * float64(reading.Count)
+		combined.Count += reading.Count
+		combined.ChildMemUsed += reading.ChildMemUsed
+		combined.HostTx += reading.HostTx
+		combined.HostRx += reading.HostRx
+		combined.PeerTx += reading.PeerTx
+		combined.PeerRx += reading.PeerRx
+		combined.Power += reading.Power
+	}
+	if combined.Count > 0 {
+		combined.Util /= float64(combined.Count)
+		combined.ChildUtil /= float64(combined.Count)
+	}
+	return combined
+}
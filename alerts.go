@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// alertRule is a parsed --alert: the metric has to cross the enter
+// threshold for minEnter to start an alert and the exit threshold for
+// minExit to end it, the gap between the two keeps a value hovering around
+// a single threshold from flapping
+type alertRule struct {
+	source string
+	metric sampleColumn
+	above  bool
+
+	enter, exit       float64
+	minEnter, minExit time.Duration
+}
+
+// alertRuleList is a flag value for the repeated
+// --alert metric>value[,exit=value][,for=duration][,clear=duration]
+type alertRuleList []alertRule
+
+func (a *alertRuleList) String() string {
+	var values []string
+	for _, rule := range *a {
+		values = append(values, rule.source)
+	}
+	return strings.Join(values, " ")
+}
+
+func (a *alertRuleList) Set(value string) error {
+	rule, err := parseAlertRule(value)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, rule)
+	return nil
+}
+
+func parseAlertRule(source string) (alertRule, error) {
+	rule := alertRule{source: source}
+	parts := strings.Split(source, ",")
+	i := strings.IndexAny(parts[0], "<>")
+	if i < 0 {
+		return rule, fmt.Errorf("expected metric>value or metric<value, got %q", parts[0])
+	}
+	name := strings.TrimSpace(parts[0][:i])
+	metric, ok := lookupMetric(name)
+	if !ok || metric.kind == metricLabel {
+		return rule, fmt.Errorf("unknown metric %q (see the metrics table of go-profile query)", name)
+	}
+	rule.metric = metric
+	rule.above = parts[0][i] == '>'
+	enter, err := parseMetricValue(metric.unit, parts[0][i+1:])
+	if err != nil {
+		return rule, err
+	}
+	rule.enter, rule.exit = enter, enter
+
+	for _, option := range parts[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch strings.TrimSpace(key) {
+		case "exit":
+			rule.exit, err = parseMetricValue(metric.unit, value)
+		case "for":
+			rule.minEnter, err = time.ParseDuration(strings.TrimSpace(value))
+		case "clear":
+			rule.minExit, err = time.ParseDuration(strings.TrimSpace(value))
+		default:
+			return rule, fmt.Errorf("unknown option %q (exit, for, clear)", option)
+		}
+		if err != nil {
+			return rule, err
+		}
+	}
+	if (rule.above && rule.exit > rule.enter) || (!rule.above && rule.exit < rule.enter) {
+		return rule, fmt.Errorf("the exit threshold of %q has to be on the other side of the enter threshold", source)
+	}
+	return rule, nil
+}
+
+// parseMetricValue parses a threshold, sizes may have a unit (e.g. 8GiB)
+func parseMetricValue(unit metricUnit, text string) (float64, error) {
+	text = strings.TrimSpace(text)
+	if unit == unitBytes || unit == unitBytesPerSecond {
+		size, err := humanize.ParseBytes(strings.TrimSuffix(text, "/s"))
+		return float64(size), err
+	}
+	if unit == unitWatts {
+		text = strings.TrimSpace(strings.TrimSuffix(text, "W"))
+	}
+	return strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64)
+}
+
+// metricFloat converts the value of a sample column to a number
+func metricFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// condition describes the enter threshold, e.g. "mem_percent above 90.00%"
+func (r *alertRule) condition() string {
+	direction := "below"
+	if r.above {
+		direction = "above"
+	}
+	return fmt.Sprintf("%s %s %s", r.metric.name, direction, r.metric.unit.format(r.enter))
+}
+
+// AlertEvent is a stretch of the run in which an --alert was active
+type AlertEvent struct {
+	Alert     string        `json:"alert"`
+	Metric    string        `json:"metric"`
+	Condition string        `json:"condition"`
+	Start     time.Time     `json:"start"`
+	End       time.Time     `json:"end"`
+	Duration  time.Duration `json:"duration"`
+
+	// The highest (or for a lower limit the lowest) value of the metric
+	Peak float64 `json:"peak"`
+
+	// The alert was still active at the end of the run
+	Open bool `json:"open,omitempty"`
+}
+
+func (e AlertEvent) String() string {
+	metric, _ := lookupMetric(e.Metric)
+	end := "to " + e.End.Format("15:04:05")
+	if e.Open {
+		end = "until the end"
+	}
+	return fmt.Sprintf("%s from %s %s (%s, peak %s)",
+		e.Condition,
+		e.Start.Format("15:04:05"),
+		end,
+		e.Duration.Round(time.Second),
+		metric.unit.format(e.Peak))
+}
+
+// alertState is the state of the hysteresis of a rule
+type alertState struct {
+	rule *alertRule
+
+	// Since when the enter (or, when active, the exit) threshold is crossed
+	crossed time.Time
+	active  bool
+	start   time.Time
+	peak    float64
+}
+
+// alertEngine evaluates the --alert rules on every sample, onChange is
+// called with the message and the event (open while it lasts) when an alert
+// starts or ends. All methods do nothing on a nil engine.
+type alertEngine struct {
+	states   []alertState
+	onChange func(string, AlertEvent)
+	events   []AlertEvent
+	last     time.Time
+}
+
+// newAlertEngine returns nil if there are no rules
+func newAlertEngine(rules []alertRule, onChange func(string, AlertEvent)) *alertEngine {
+	if len(rules) == 0 {
+		return nil
+	}
+	e := &alertEngine{onChange: onChange}
+	for i := range rules {
+		e.states = append(e.states, alertState{rule: &rules[i]})
+	}
+	return e
+}
+
+func (e *alertEngine) add(sample Sample) {
+	if e == nil {
+		return
+	}
+	now := sample.Time
+	e.last = now
+	for i := range e.states {
+		s := &e.states[i]
+		rule := s.rule
+		value := metricFloat(rule.metric.value(sample))
+
+		if !s.active {
+			if (rule.above && value <= rule.enter) || (!rule.above && value >= rule.enter) {
+				s.crossed = time.Time{}
+				continue
+			}
+			if s.crossed.IsZero() {
+				s.crossed, s.peak = now, value
+			}
+			s.peak = s.extreme(value)
+			if now.Sub(s.crossed) >= rule.minEnter {
+				s.active, s.start, s.crossed = true, s.crossed, time.Time{}
+				event := AlertEvent{
+					Alert:     rule.source,
+					Metric:    rule.metric.name,
+					Condition: rule.condition(),
+					Start:     s.start,
+					Duration:  now.Sub(s.start),
+					Peak:      s.peak,
+					Open:      true,
+				}
+				e.onChange(fmt.Sprintf("ALERT %s since %s", rule.condition(), s.start.Format("15:04:05")), event)
+			}
+			continue
+		}
+
+		s.peak = s.extreme(value)
+		if (rule.above && value > rule.exit) || (!rule.above && value < rule.exit) {
+			s.crossed = time.Time{}
+			continue
+		}
+		if s.crossed.IsZero() {
+			s.crossed = now
+		}
+		if now.Sub(s.crossed) >= rule.minExit {
+			event := s.end(s.crossed, false)
+			e.events = append(e.events, event)
+			e.onChange("ALERT ended: "+event.String(), event)
+		}
+	}
+}
+
+// extreme returns the new peak of an active (or entering) alert
+func (s *alertState) extreme(value float64) float64 {
+	if s.rule.above {
+		return max(s.peak, value)
+	}
+	return min(s.peak, value)
+}
+
+func (s *alertState) end(end time.Time, open bool) AlertEvent {
+	event := AlertEvent{
+		Alert:     s.rule.source,
+		Metric:    s.rule.metric.name,
+		Condition: s.rule.condition(),
+		Start:     s.start,
+		End:       end,
+		Duration:  end.Sub(s.start),
+		Peak:      s.peak,
+		Open:      open,
+	}
+	s.active, s.crossed = false, time.Time{}
+	return event
+}
+
+// result ends the alerts that are still active and returns the events in
+// the order they started
+func (e *alertEngine) result() []AlertEvent {
+	if e == nil {
+		return nil
+	}
+	for i := range e.states {
+		if s := &e.states[i]; s.active {
+			e.events = append(e.events, s.end(e.last, true))
+		}
+	}
+	sort.SliceStable(e.events, func(i, j int) bool {
+		return e.events[i].Start.Before(e.events[j].Start)
+	})
+	return e.events
+}
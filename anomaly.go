@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// CPU usage at or above anomalyCPUPercent for anomalyCPUDuration is reported
+	anomalyCPUPercent  = 99.0
+	anomalyCPUDuration = 30 * time.Second
+
+	// Memory growing steadily (R² of a linear fit of at least anomalyMemFit)
+	// over anomalyMemWindow by at least anomalyMemGrowth percent of the total
+	// memory is reported as a leak
+	anomalyMemWindow = 30 * time.Second
+	anomalyMemGrowth = 5.0
+	anomalyMemFit    = 0.9
+)
+
+// Anomaly is a suspicious part of the run
+type Anomaly struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Kind     string        `json:"kind"`
+	Message  string        `json:"message"`
+}
+
+// memoryPoint is the used memory at a point in time
+type memoryPoint struct {
+	time time.Time
+	used uint64
+}
+
+// anomalyDetector looks for anomalies while the samples come in
+type anomalyDetector struct {
+	gpuIdleGap       time.Duration
+	gpuIdleThreshold float64
+	anomalies        []Anomaly
+
+	// Start of the current stretch of full CPU usage and idle GPU (zero if none)
+	cpuBusySince time.Time
+	gpuIdleSince time.Time
+	last         time.Time
+
+	memory     []memoryPoint
+	memLeaking bool
+}
+
+func newAnomalyDetector(gpuIdleGap time.Duration, gpuIdleThreshold float64) *anomalyDetector {
+	return &anomalyDetector{gpuIdleGap: gpuIdleGap, gpuIdleThreshold: gpuIdleThreshold}
+}
+
+func (d *anomalyDetector) add(now time.Time, stats Stats) {
+	d.last = now
+
+	if stats.CpuPercent >= anomalyCPUPercent {
+		if d.cpuBusySince.IsZero() {
+			d.cpuBusySince = now
+		}
+	} else {
+		d.endCPUBusy(now)
+	}
+
+	if stats.GpuCount > 0 && stats.GpuPercent < d.gpuIdleThreshold {
+		if d.gpuIdleSince.IsZero() {
+			d.gpuIdleSince = now
+		}
+	} else {
+		d.endGPUIdle(now)
+	}
+
+	d.addMemory(now, stats)
+}
+
+func (d *anomalyDetector) endCPUBusy(now time.Time) {
+	if !d.cpuBusySince.IsZero() && now.Sub(d.cpuBusySince) >= anomalyCPUDuration {
+		d.anomalies = append(d.anomalies, Anomaly{
+			Time:     d.cpuBusySince,
+			Duration: now.Sub(d.cpuBusySince),
+			Kind:     "cpu-saturated",
+			Message:  fmt.Sprintf("CPU at 100%% for %s", now.Sub(d.cpuBusySince).Round(time.Second)),
+		})
+	}
+	d.cpuBusySince = time.Time{}
+}
+
+func (d *anomalyDetector) endGPUIdle(now time.Time) {
+	if d.gpuIdleGap > 0 && !d.gpuIdleSince.IsZero() && now.Sub(d.gpuIdleSince) >= d.gpuIdleGap {
+		d.anomalies = append(d.anomalies, Anomaly{
+			Time:     d.gpuIdleSince,
+			Duration: now.Sub(d.gpuIdleSince),
+			Kind:     "gpu-idle",
+			Message:  fmt.Sprintf("GPU idle for %s", now.Sub(d.gpuIdleSince).Round(time.Second)),
+		})
+	}
+	d.gpuIdleSince = time.Time{}
+}
+
+// addMemory reports a leak when the memory grew steadily (a linear fit
+// explains most of the window) and by a significant amount, once per episode
+func (d *anomalyDetector) addMemory(now time.Time, stats Stats) {
+	if stats.MemTotal == 0 {
+		return
+	}
+	d.memory = append(d.memory, memoryPoint{time: now, used: stats.MemUsed})
+	for len(d.memory) > 1 && now.Sub(d.memory[0].time) > anomalyMemWindow {
+		d.memory = d.memory[1:]
+	}
+	first := d.memory[0]
+	window := now.Sub(first.time)
+	if window < anomalyMemWindow*9/10 {
+		return
+	}
+
+	x := make([]float64, len(d.memory))
+	y := make([]float64, len(d.memory))
+	for i, point := range d.memory {
+		x[i] = point.time.Sub(first.time).Seconds()
+		y[i] = float64(point.used)
+	}
+	slope, r2 := linearFit(x, y)
+	growth := slope * window.Seconds()
+	growing := r2 >= anomalyMemFit && growth/float64(stats.MemTotal)*100.0 >= anomalyMemGrowth
+	if growing && !d.memLeaking {
+		d.anomalies = append(d.anomalies, Anomaly{
+			Time:     first.time,
+			Duration: window,
+			Kind:     "memory-growth",
+			Message: fmt.Sprintf("memory grew by %s in %s (%s/s)",
+				formatBytes(uint64(growth)),
+				window.Round(time.Second),
+				formatBytes(uint64(slope))),
+		})
+	}
+	d.memLeaking = growing
+}
+
+// linearFit returns the slope of the least squares line through the points
+// and the coefficient of determination (R²) of the fit
+func linearFit(x, y []float64) (float64, float64) {
+	n := float64(len(x))
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy, syy float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0, 0
+	}
+	return sxy / sxx, sxy * sxy / (sxx * syy)
+}
+
+// result closes the open stretches and returns the anomalies in order
+func (d *anomalyDetector) result() []Anomaly {
+	d.endCPUBusy(d.last)
+	d.endGPUIdle(d.last)
+	sort.SliceStable(d.anomalies, func(i, j int) bool {
+		return d.anomalies[i].Time.Before(d.anomalies[j].Time)
+	})
+	return d.anomalies
+}
+
+// formatOffset formats the time relative to the start of the command, the
+// baseline is before the start
+func formatOffset(t, start time.Time) string {
+	offset := t.Sub(start).Round(time.Millisecond)
+	if offset < 0 {
+		return "-" + (-offset).String()
+	}
+	return "+" + offset.String()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+const (
+	// bootstrapResamples is the number of resamples of the confidence intervals
+	bootstrapResamples = 10000
+	// benchmarkConfidence is the confidence level of the intervals
+	benchmarkConfidence = 0.95
+)
+
+// Estimate is the mean of a measurement over the runs with a bootstrap
+// confidence interval
+type Estimate struct {
+	Mean       float64 `json:"mean"`
+	Low        float64 `json:"low"`
+	High       float64 `json:"high"`
+	Confidence float64 `json:"confidence"`
+}
+
+// bootstrapMean estimates the confidence interval of the mean by resampling
+// the values with replacement (percentile bootstrap). The seed is fixed, so
+// the same values always give the same interval.
+func bootstrapMean(values []float64) Estimate {
+	estimate := Estimate{Mean: mean(values), Confidence: benchmarkConfidence}
+	rng := rand.New(rand.NewSource(1))
+	means := make([]float64, bootstrapResamples)
+	for i := range means {
+		sum := 0.0
+		for range values {
+			sum += values[rng.Intn(len(values))]
+		}
+		means[i] = sum / float64(len(values))
+	}
+	sort.Float64s(means)
+	tail := (1 - benchmarkConfidence) / 2
+	estimate.Low = means[int(tail*float64(len(means)))]
+	estimate.High = means[min(int((1-tail)*float64(len(means))), len(means)-1)]
+	return estimate
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+// quartiles returns the first and third quartile of the values
+func quartiles(values []float64) (float64, float64) {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	quantile := func(q float64) float64 {
+		position := q * float64(len(sorted)-1)
+		i := int(position)
+		if i+1 >= len(sorted) {
+			return sorted[i]
+		}
+		return sorted[i] + (sorted[i+1]-sorted[i])*(position-float64(i))
+	}
+	return quantile(0.25), quantile(0.75)
+}
+
+// outlierFences are Tukey's fences: values more than 1.5 interquartile
+// ranges outside of the quartiles are outliers
+func outlierFences(values []float64) (float64, float64) {
+	q1, q3 := quartiles(values)
+	iqr := q3 - q1
+	return q1 - 1.5*iqr, q3 + 1.5*iqr
+}
+
+// minOutlierRuns is the number of runs below which the quartiles say too
+// little to call a run an outlier
+const minOutlierRuns = 4
+
+// BenchmarkOutlier is a run with a duration or peak RSS far from the others
+// (a thermal event, a cron job in the background...)
+type BenchmarkOutlier struct {
+	RunID  string `json:"run_id"`
+	Reason string `json:"reason"`
+}
+
+// BenchmarkSummary aggregates the runs of --runs, the estimates only cover
+// the runs that succeeded and, with --discard-outliers, were no outliers
+type BenchmarkSummary struct {
+	Schema int      `json:"schema"`
+	Runs   []string `json:"runs"`
+	Failed int      `json:"failed"`
+
+	Outliers          []BenchmarkOutlier `json:"outliers,omitempty"`
+	OutliersDiscarded bool               `json:"outliers_discarded,omitempty"`
+
+	// Duration in seconds
+	Duration *Estimate `json:"duration,omitempty"`
+	// Peak RSS of the command in bytes
+	PeakRSS *Estimate `json:"peak_rss,omitempty"`
+}
+
+func summarizeBenchmark(summaries []*Summary, discardOutliers bool) *BenchmarkSummary {
+	benchmark := &BenchmarkSummary{Schema: profileio.SchemaVersion, OutliersDiscarded: discardOutliers}
+	var succeeded []*Summary
+	for _, summary := range summaries {
+		benchmark.Runs = append(benchmark.Runs, summary.RunID)
+		if summary.Error != "" {
+			benchmark.Failed++
+			continue
+		}
+		succeeded = append(succeeded, summary)
+	}
+
+	outliers := findOutliers(succeeded)
+	for _, summary := range succeeded {
+		if reason, ok := outliers[summary.RunID]; ok {
+			benchmark.Outliers = append(benchmark.Outliers, BenchmarkOutlier{RunID: summary.RunID, Reason: reason})
+		}
+	}
+
+	var durations, peaks []float64
+	for _, summary := range succeeded {
+		if _, ok := outliers[summary.RunID]; ok && discardOutliers {
+			continue
+		}
+		durations = append(durations, summary.Duration.Seconds())
+		if summary.ChildRSS != nil {
+			peaks = append(peaks, summary.ChildRSS.Max)
+		}
+	}
+	if len(durations) > 0 {
+		duration := bootstrapMean(durations)
+		benchmark.Duration = &duration
+	}
+	if len(peaks) > 0 {
+		peak := bootstrapMean(peaks)
+		benchmark.PeakRSS = &peak
+	}
+	return benchmark
+}
+
+// findOutliers returns why a run is an outlier by its run ID
+func findOutliers(summaries []*Summary) map[string]string {
+	outliers := map[string]string{}
+	if len(summaries) < minOutlierRuns {
+		return outliers
+	}
+	var durations []float64
+	for _, summary := range summaries {
+		durations = append(durations, summary.Duration.Seconds())
+	}
+	low, high := outlierFences(durations)
+	for _, summary := range summaries {
+		if seconds := summary.Duration.Seconds(); seconds < low || seconds > high {
+			outliers[summary.RunID] = fmt.Sprintf("duration %s outside of %s - %s",
+				summary.Duration.Round(time.Millisecond),
+				formatSeconds(max(low, 0)),
+				formatSeconds(high))
+		}
+	}
+
+	var peaks []float64
+	for _, summary := range summaries {
+		if summary.ChildRSS != nil {
+			peaks = append(peaks, summary.ChildRSS.Max)
+		}
+	}
+	if len(peaks) < minOutlierRuns {
+		return outliers
+	}
+	low, high = outlierFences(peaks)
+	for _, summary := range summaries {
+		if summary.ChildRSS == nil || (summary.ChildRSS.Max >= low && summary.ChildRSS.Max <= high) {
+			continue
+		}
+		reason := fmt.Sprintf("peak RSS %s outside of %s - %s",
+			formatBytes(uint64(summary.ChildRSS.Max)),
+			formatBytes(uint64(max(low, 0))),
+			formatBytes(uint64(high)))
+		if outliers[summary.RunID] != "" {
+			reason = outliers[summary.RunID] + ", " + reason
+		}
+		outliers[summary.RunID] = reason
+	}
+	return outliers
+}
+
+// formatSeconds rounds seconds to a duration in milliseconds
+func formatSeconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second)).Round(time.Millisecond)
+}
+
+func (b *BenchmarkSummary) print(logPrintf func(format string, a ...interface{})) {
+	logPrintf("Benchmark (%d runs, %d failed, %d outliers)", len(b.Runs), b.Failed, len(b.Outliers))
+	if d := b.Duration; d != nil {
+		logPrintf("  duration: mean %s (%.0f%% CI %s - %s)", formatSeconds(d.Mean), d.Confidence*100, formatSeconds(d.Low), formatSeconds(d.High))
+	}
+	if p := b.PeakRSS; p != nil {
+		logPrintf("  peak RSS: mean %s (%.0f%% CI %s - %s)", formatBytes(uint64(p.Mean)), p.Confidence*100, formatBytes(uint64(p.Low)), formatBytes(uint64(p.High)))
+	}
+	for _, outlier := range b.Outliers {
+		state := "included"
+		if b.OutliersDiscarded {
+			state = "discarded"
+		}
+		logPrintf("  outlier %s (%s): %s", outlier.RunID, state, outlier.Reason)
+	}
+}
+
+// benchmarkMain profiles the command opts.Runs times, every run gets its own
+// run ID, directory and summary, and summarizes the runs
+func benchmarkMain(opts *Options) {
+	var summaries []*Summary
+	failed := false
+	for i := 0; i < opts.Runs && !interrupted.Load(); i++ {
+		fmt.Fprintf(os.Stderr, "[go-profile] Run %d of %d\n", i+1, opts.Runs)
+		// The paths of the outputs are moved into the run directory
+		runOpts := *opts
+		runOpts.Outputs = append(outputList(nil), opts.Outputs...)
+		summary, err := profileRun(&runOpts)
+		failed = failed || err != nil
+		if summary != nil {
+			summaries = append(summaries, summary)
+		}
+	}
+
+	benchmark := summarizeBenchmark(summaries, opts.DiscardOutliers)
+	benchmark.print(func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "[go-profile] "+format+"\n", a...)
+	})
+	if opts.BenchmarkJSON != "" {
+		data, err := json.MarshalIndent(benchmark, "", "  ")
+		if err == nil {
+			err = os.WriteFile(opts.BenchmarkJSON, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write benchmark summary: %s\n", err)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
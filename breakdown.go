@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// breakdownMaxLines is how many process names the summary prints, the
+// summary JSON has all of them
+const breakdownMaxLines = 10
+
+// ProcessGroup is the usage of the command's processes with the same name
+// (--process-breakdown)
+type ProcessGroup struct {
+	Name       string  `json:"name"`
+	Processes  int     `json:"processes"`
+	CpuSeconds float64 `json:"cpu_seconds"`
+	// Bytes read from and written to storage, by the processes and the
+	// children they waited for
+	IOBytes uint64 `json:"io_bytes"`
+	// Largest RSS of a single process
+	MaxRSS uint64 `json:"max_rss"`
+}
+
+// processKey tells apart the processes that reused a pid by their start
+// time
+type processKey struct {
+	pid   int
+	start uint64
+}
+
+// processUsage is what a process used up to the last sample
+type processUsage struct {
+	name  string
+	ticks uint64
+	io    uint64
+	rss   uint64
+}
+
+// processBreakdown keeps the CPU time, storage I/O and peak RSS of every
+// process of the tree. What a process used after the last sample before it
+// exited is lost, processes that live shorter than a tick are not seen.
+type processBreakdown struct {
+	processes map[processKey]*processUsage
+}
+
+// newProcessBreakdown returns nil if it is not enabled
+func newProcessBreakdown(enabled bool) *processBreakdown {
+	if !enabled {
+		return nil
+	}
+	return &processBreakdown{processes: map[processKey]*processUsage{}}
+}
+
+// sample reads the counters of every process of the tree
+func (b *processBreakdown) sample(pids []int) {
+	if b == nil {
+		return
+	}
+	for _, pid := range pids {
+		data, err := os.ReadFile(pidPath(pid, "stat"))
+		if err != nil {
+			continue
+		}
+		stat := string(data)
+		open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+		if open < 0 || end < open {
+			continue
+		}
+		fields := strings.Fields(stat[end+1:])
+		if len(fields) < 20 {
+			continue
+		}
+		// starttime is field 22 of the stat file
+		start, _ := strconv.ParseUint(fields[19], 10, 64)
+		key := processKey{pid: pid, start: start}
+		usage, ok := b.processes[key]
+		if !ok {
+			usage = &processUsage{}
+			b.processes[key] = usage
+		}
+
+		// The name changes when the process execs, the CPU time it used
+		// before goes to the new name
+		usage.name = stat[open+1 : end]
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		usage.ticks = max(usage.ticks, utime+stime)
+		usage.io = max(usage.io, getProcessIO([]int{pid}))
+		usage.rss = max(usage.rss, getProcessRSS([]int{pid}))
+	}
+}
+
+// result groups the processes by name, the ones that used the most CPU time
+// first
+func (b *processBreakdown) result() []ProcessGroup {
+	if b == nil || len(b.processes) == 0 {
+		return nil
+	}
+	groups := map[string]*ProcessGroup{}
+	for _, usage := range b.processes {
+		group, ok := groups[usage.name]
+		if !ok {
+			group = &ProcessGroup{Name: usage.name}
+			groups[usage.name] = group
+		}
+		group.Processes++
+		group.CpuSeconds += float64(usage.ticks) / clockTicks
+		group.IOBytes += usage.io
+		group.MaxRSS = max(group.MaxRSS, usage.rss)
+	}
+	result := make([]ProcessGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CpuSeconds != result[j].CpuSeconds {
+			return result[i].CpuSeconds > result[j].CpuSeconds
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
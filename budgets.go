@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+/*
+	A budget file is a list of budgets in a small subset of YAML, the first
+	budget whose command pattern (* matches anything) matches the command
+	line applies:
+
+	# profile-budgets.yaml
+	- command: make test*
+	  max_duration: 10m
+	  max_peak_rss: 4GiB
+	  max_gpu_idle: 30%
+*/
+
+// defaultBudgets is the budget file in the working directory that is used
+// when it exists, so a repository can own the budgets of its commands
+const defaultBudgets = "profile-budgets.yaml"
+
+// budget is a performance contract for the commands matching pattern,
+// limits that are zero are not checked
+type budget struct {
+	pattern     string
+	re          *regexp.Regexp
+	maxDuration time.Duration
+	maxPeakRSS  uint64
+	maxGPUIdle  float64
+}
+
+// BudgetResult is how the run did against its budget
+type BudgetResult struct {
+	File       string   `json:"file"`
+	Command    string   `json:"command"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+// readBudgets parses a budget file
+func readBudgets(path string) ([]budget, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var budgets []budget
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") {
+			budgets = append(budgets, budget{})
+			trimmed = strings.TrimSpace(trimmed[2:])
+		} else if len(budgets) == 0 || line[0] != ' ' {
+			return nil, fmt.Errorf("%s:%d: expected a list of budgets (- command: ...)", path, number)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, number)
+		}
+		if err := budgets[len(budgets)-1].set(strings.TrimSpace(key), unquote(strings.TrimSpace(value))); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, b := range budgets {
+		if b.re == nil {
+			return nil, fmt.Errorf("%s: budget %d has no command", path, i+1)
+		}
+	}
+	return budgets, nil
+}
+
+// unquote removes the quotes of a YAML string
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func (b *budget) set(key, value string) error {
+	var err error
+	switch key {
+	case "command":
+		b.pattern = value
+		b.re, err = regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(value), `\*`, ".*") + "$")
+	case "max_duration":
+		b.maxDuration, err = time.ParseDuration(value)
+	case "max_peak_rss":
+		b.maxPeakRSS, err = humanize.ParseBytes(value)
+	case "max_gpu_idle":
+		// A fraction (0.3) or a percentage (30%)
+		if percent, ok := strings.CutSuffix(value, "%"); ok {
+			b.maxGPUIdle, err = strconv.ParseFloat(percent, 64)
+			b.maxGPUIdle /= 100
+		} else {
+			b.maxGPUIdle, err = strconv.ParseFloat(value, 64)
+		}
+	default:
+		return fmt.Errorf("unknown key %q (command, max_duration, max_peak_rss, max_gpu_idle)", key)
+	}
+	return err
+}
+
+// matchBudget returns the first budget for the command, nil if none matches
+func matchBudget(budgets []budget, command []string) *budget {
+	line := strings.Join(command, " ")
+	for i := range budgets {
+		if budgets[i].re.MatchString(line) {
+			return &budgets[i]
+		}
+	}
+	return nil
+}
+
+// check returns the limits of the budget the run exceeded
+func (b *budget) check(summary *Summary) []string {
+	var violations []string
+	if b.maxDuration > 0 && summary.Duration > b.maxDuration {
+		violations = append(violations, fmt.Sprintf("duration %s exceeds %s", summary.Duration.Round(time.Millisecond), b.maxDuration))
+	}
+	if b.maxPeakRSS > 0 && summary.ChildRSS != nil && uint64(summary.ChildRSS.Max) > b.maxPeakRSS {
+		violations = append(violations, fmt.Sprintf("peak RSS %s exceeds %s", formatBytes(uint64(summary.ChildRSS.Max)), formatBytes(b.maxPeakRSS)))
+	}
+	if b.maxGPUIdle > 0 && summary.GPUIdle != nil && summary.GPUIdle.IdleFraction > b.maxGPUIdle {
+		violations = append(violations, fmt.Sprintf("GPU idle %.1f%% of the run exceeds %.1f%%", summary.GPUIdle.IdleFraction*100, b.maxGPUIdle*100))
+	}
+	return violations
+}
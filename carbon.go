@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// carbonRegions are approximate annual averages of the carbon intensity of
+// the electricity grid in gCO2e/kWh, for when the actual intensity of the
+// grid (e.g. from the provider or Electricity Maps) is not known
+var carbonRegions = map[string]float64{
+	"world": 480,
+	"eu":    250,
+	"us":    370,
+	"ca":    130,
+	"br":    100,
+	"gb":    210,
+	"ie":    280,
+	"fr":    55,
+	"de":    380,
+	"nl":    330,
+	"be":    150,
+	"at":    110,
+	"ch":    45,
+	"it":    330,
+	"es":    170,
+	"pl":    660,
+	"dk":    150,
+	"fi":    80,
+	"se":    40,
+	"no":    30,
+	"in":    710,
+	"cn":    580,
+	"jp":    480,
+	"kr":    430,
+	"sg":    470,
+	"au":    550,
+	"za":    710,
+}
+
+func carbonRegionNames() string {
+	var names []string
+	for name := range carbonRegions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// carbonIntensity is the carbon intensity of the electricity the run
+// consumed (--carbon-intensity gCO2e/kWh or region)
+type carbonIntensity struct {
+	text string
+	// gCO2e/kWh
+	grams float64
+	// Region the intensity was looked up for, empty if given as a number
+	region string
+}
+
+func (c *carbonIntensity) String() string {
+	return c.text
+}
+
+func (c *carbonIntensity) Set(value string) error {
+	if grams, err := strconv.ParseFloat(value, 64); err == nil {
+		if grams < 0 {
+			return fmt.Errorf("the carbon intensity can not be negative")
+		}
+		*c = carbonIntensity{text: value, grams: grams}
+		return nil
+	}
+	region := strings.ToLower(value)
+	grams, ok := carbonRegions[region]
+	if !ok {
+		return fmt.Errorf("expected gCO2e/kWh or a region (%s)", carbonRegionNames())
+	}
+	*c = carbonIntensity{text: value, grams: grams, region: region}
+	return nil
+}
+
+func (c *carbonIntensity) enabled() bool {
+	return c.text != ""
+}
+
+// CarbonSummary is the estimated emissions of the energy of the run
+type CarbonSummary struct {
+	// gCO2e/kWh
+	Intensity float64 `json:"intensity"`
+	Region    string  `json:"region,omitempty"`
+	// Emissions of the run in grams of CO2 equivalent
+	Grams float64 `json:"grams"`
+
+	// Emissions per unit of work of the --event patterns
+	PerEvent []CarbonPerEvent `json:"per_event,omitempty"`
+}
+
+type CarbonPerEvent struct {
+	Event   string  `json:"event"`
+	PerUnit float64 `json:"grams_per_unit"`
+}
+
+func (c *CarbonSummary) String() string {
+	source := fmt.Sprintf("%g gCO2e/kWh", c.Intensity)
+	if c.Region != "" {
+		source += " in " + c.Region
+	}
+	return fmt.Sprintf("%s CO2e (at %s)", formatGrams(c.Grams), source)
+}
+
+// formatGrams formats a mass with a metric prefix, e.g. "1.23 kg"
+func formatGrams(grams float64) string {
+	switch {
+	case grams >= 1e6:
+		return fmt.Sprintf("%.2f t", grams/1e6)
+	case grams >= 1e3:
+		return fmt.Sprintf("%.2f kg", grams/1e3)
+	case grams >= 1:
+		return fmt.Sprintf("%.2f g", grams)
+	default:
+		return fmt.Sprintf("%.2f mg", grams*1e3)
+	}
+}
+
+// estimateCarbon converts the energy of the run into emissions, nil
+// without an energy measurement
+func estimateCarbon(intensity carbonIntensity, energy *EnergySummary) *CarbonSummary {
+	if energy == nil {
+		return nil
+	}
+	perJoule := intensity.grams / 3.6e6
+	summary := &CarbonSummary{Intensity: intensity.grams, Region: intensity.region, Grams: energy.Total * perJoule}
+	for _, event := range energy.PerEvent {
+		summary.PerEvent = append(summary.PerEvent, CarbonPerEvent{Event: event.Event, PerUnit: event.PerUnit * perJoule})
+	}
+	return summary
+}
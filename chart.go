@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	chartWidth       = 800
+	chartPanelHeight = 150
+	chartMargin      = 40
+)
+
+// chartSeries is one panel of the chart, values are percentages
+type chartSeries struct {
+	title  string
+	color  color.RGBA
+	values []float64
+}
+
+// chartPanels returns the panels to draw for the samples, the GPU panel is
+// only included when a GPU was sampled
+func chartPanels(samples []Sample) []chartSeries {
+	cpu := chartSeries{color: color.RGBA{0x1f, 0x77, 0xb4, 0xff}}
+	memory := chartSeries{color: color.RGBA{0x2c, 0xa0, 0x2c, 0xff}}
+	gpu := chartSeries{color: color.RGBA{0xd6, 0x27, 0x28, 0xff}}
+	var cpuMax, gpuMax float64
+	var memMax uint64
+	hasGpu := false
+	for _, sample := range samples {
+		cpu.values = append(cpu.values, sample.CpuPercent)
+		memory.values = append(memory.values, sample.MemPercent)
+		gpu.values = append(gpu.values, sample.GpuPercent)
+		cpuMax = max(cpuMax, sample.CpuPercent)
+		memMax = max(memMax, sample.MemUsed)
+		gpuMax = max(gpuMax, sample.GpuPercent)
+		hasGpu = hasGpu || sample.GpuCount > 0
+	}
+	cpu.title = fmt.Sprintf("CPU %% (max: %.2f%%)", cpuMax)
+	memory.title = fmt.Sprintf("Memory %% (max: %s)", formatBytes(memMax))
+	gpu.title = fmt.Sprintf("GPU %% (max: %.2f%%)", gpuMax)
+
+	panels := []chartSeries{cpu, memory}
+	if hasGpu {
+		panels = append(panels, gpu)
+	}
+	return panels
+}
+
+// chartPoint maps the i-th of n values to a pixel inside the panel
+func chartPoint(panel, i, n int, value float64) (float64, float64) {
+	plotWidth := float64(chartWidth - 2*chartMargin)
+	x := float64(chartMargin)
+	if n > 1 {
+		x += plotWidth * float64(i) / float64(n-1)
+	}
+	value = min(max(value, 0), 100)
+	top := float64(panel*chartPanelHeight + chartMargin/2)
+	plotHeight := float64(chartPanelHeight - chartMargin)
+	return x, top + plotHeight*(1-value/100)
+}
+
+// writeChart renders the CPU, memory and GPU time series of the samples as
+// an SVG or PNG image, depending on the extension of path
+func writeChart(path string, samples []Sample) error {
+	if len(samples) == 0 {
+		return fmt.Errorf("no samples were recorded")
+	}
+	panels := chartPanels(samples)
+	var duration time.Duration
+	if len(samples) > 1 {
+		duration = samples[len(samples)-1].Time.Sub(samples[0].Time)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".svg":
+		return os.WriteFile(path, []byte(renderChartSVG(panels, duration)), 0644)
+	case ".png":
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(file, renderChartImage(panels)); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	default:
+		return fmt.Errorf("unsupported chart format %q (use .svg or .png)", filepath.Ext(path))
+	}
+}
+
+func renderChartSVG(panels []chartSeries, duration time.Duration) string {
+	height := len(panels) * chartPanelHeight
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`+"\n", chartWidth, height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="white"/>`+"\n", chartWidth, height)
+	for p, panel := range panels {
+		left, top := chartPoint(p, 0, 1, 100)
+		right, bottom := chartPoint(p, 1, 2, 0)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f">%s</text>`+"\n", left, top-4, panel.title)
+		for _, percent := range []float64{0, 50, 100} {
+			_, y := chartPoint(p, 0, 1, percent)
+			fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", left, y, right, y)
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="end">%.0f</text>`+"\n", left-4, y+4, percent)
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="end">%s</text>`+"\n", right, bottom+14, duration.Round(time.Millisecond))
+
+		points := make([]string, len(panel.values))
+		for i, value := range panel.values {
+			x, y := chartPoint(p, i, len(panel.values), value)
+			points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="#%02x%02x%02x" stroke-width="1.5" points="%s"/>`+"\n",
+			panel.color.R, panel.color.G, panel.color.B, strings.Join(points, " "))
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// renderChartImage draws the panels without text, the grid lines are at 0%,
+// 50% and 100%
+func renderChartImage(panels []chartSeries) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, len(panels)*chartPanelHeight))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	grid := color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	for p, panel := range panels {
+		for _, percent := range []float64{0, 50, 100} {
+			x0, y := chartPoint(p, 0, 2, percent)
+			x1, _ := chartPoint(p, 1, 2, percent)
+			drawLine(img, x0, y, x1, y, grid)
+		}
+		for i := 1; i < len(panel.values); i++ {
+			x0, y0 := chartPoint(p, i-1, len(panel.values), panel.values[i-1])
+			x1, y1 := chartPoint(p, i, len(panel.values), panel.values[i])
+			drawLine(img, x0, y0, x1, y1, panel.color)
+		}
+	}
+	return img
+}
+
+// drawLine draws a line by stepping one pixel at a time along the longest axis
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA) {
+	steps := int(max(math.Abs(x1-x0), math.Abs(y1-y0))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		img.SetRGBA(int(x0+(x1-x0)*t+0.5), int(y0+(y1-y0)*t+0.5), c)
+	}
+}
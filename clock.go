@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ClockInfo describes the clock the samples are timed with
+type ClockInfo struct {
+	// Clock source of the kernel (tsc, hpet, kvm-clock, arch_sys_counter...)
+	Source    string   `json:"source,omitempty"`
+	Available []string `json:"available,omitempty"`
+
+	// Resolution of CLOCK_MONOTONIC (clock_getres) and the measured
+	// granularity of a short sleep, which includes the timer slack
+	Resolution      time.Duration `json:"resolution"`
+	SleepResolution time.Duration `json:"sleep_resolution"`
+
+	// Offset from NTP time, nil without chrony or ntpd
+	Sync *ClockSync `json:"sync,omitempty"`
+}
+
+// ClockSync is the offset of the system clock from NTP time as estimated by
+// the time daemon, to line up the samples of several hosts
+type ClockSync struct {
+	// chrony or ntpd
+	Daemon string `json:"daemon"`
+	// How far the system clock is ahead of NTP time (negative: behind)
+	Offset time.Duration `json:"offset"`
+}
+
+// Intervals should be at least this many times the timer granularity
+const clockMarginFactor = 10
+
+// getClockInfo reads the clock source and measures the timer resolution
+func getClockInfo() *ClockInfo {
+	info := &ClockInfo{}
+	const clocksource = "/sys/devices/system/clocksource/clocksource0/"
+	info.Source, _ = readSysctl(clocksource + "current_clocksource")
+	if available, err := readSysctl(clocksource + "available_clocksource"); err == nil {
+		info.Available = strings.Fields(available)
+	}
+
+	const CLOCK_MONOTONIC = 1
+	var ts syscall.Timespec
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CLOCK_GETRES, CLOCK_MONOTONIC, uintptr(unsafe.Pointer(&ts)), 0); errno == 0 {
+		info.Resolution = time.Duration(ts.Nano())
+	}
+
+	// Median of a few of the shortest possible sleeps
+	sleeps := make([]time.Duration, 9)
+	for i := range sleeps {
+		start := time.Now()
+		time.Sleep(time.Microsecond)
+		sleeps[i] = time.Since(start)
+	}
+	sort.Slice(sleeps, func(i, j int) bool { return sleeps[i] < sleeps[j] })
+	info.SleepResolution = sleeps[len(sleeps)/2]
+	info.Sync = getClockSync()
+	return info
+}
+
+// getClockSync asks chrony and then ntpd for the offset of the clock
+func getClockSync() *ClockSync {
+	// The fifth field of the CSV is the correction chrony applies to the
+	// clock in seconds, positive when the clock is slow
+	if out, err := exec.Command("chronyc", "-c", "tracking").Output(); err == nil {
+		fields := strings.Split(strings.TrimSpace(string(out)), ",")
+		if len(fields) > 4 {
+			if correction, err := strconv.ParseFloat(fields[4], 64); err == nil {
+				return &ClockSync{Daemon: "chrony", Offset: -time.Duration(correction * float64(time.Second))}
+			}
+		}
+	}
+
+	// ntpq prints "offset=1.234" in milliseconds, the offset of the NTP
+	// servers from the clock
+	if out, err := exec.Command("ntpq", "-c", "rv 0 offset").Output(); err == nil {
+		_, value, ok := strings.Cut(strings.TrimSpace(string(out)), "offset=")
+		if ok {
+			if offset, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				return &ClockSync{Daemon: "ntpd", Offset: -time.Duration(offset * float64(time.Millisecond))}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *ClockSync) String() string {
+	if s.Offset < 0 {
+		return fmt.Sprintf("%s behind NTP time (%s)", (-s.Offset).Round(time.Microsecond), s.Daemon)
+	}
+	return fmt.Sprintf("%s ahead of NTP time (%s)", s.Offset.Round(time.Microsecond), s.Daemon)
+}
+
+// minInterval is the shortest interval the clock can reliably deliver
+func (c *ClockInfo) minInterval() time.Duration {
+	return max(c.Resolution, c.SleepResolution) * clockMarginFactor
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// columnType is the type of a flat sample column
+type columnType int
+
+const (
+	columnInt32 columnType = iota
+	columnInt64
+	columnDouble
+	columnString
+)
+
+// metricKind tells how a metric behaves over time
+type metricKind int
+
+const (
+	// A gauge is read as is, e.g. the CPU utilization
+	metricGauge metricKind = iota
+	// A counter only increases (see counter), e.g. the bytes received
+	metricCounter
+	// A label identifies the sample, e.g. the time or the run
+	metricLabel
+)
+
+func (k metricKind) String() string {
+	switch k {
+	case metricCounter:
+		return "counter"
+	case metricLabel:
+		return "label"
+	}
+	return "gauge"
+}
+
+// metricUnit is the unit of a metric, machine outputs (exports, JSON) have
+// the raw value and the log and the reports show it with format
+type metricUnit string
+
+const (
+	unitNone           metricUnit = ""
+	unitPercent        metricUnit = "percent"
+	unitBytes          metricUnit = "bytes"
+	unitBytesPerSecond metricUnit = "bytes/s"
+	unitMicroseconds   metricUnit = "microseconds"
+	unitSeconds        metricUnit = "seconds"
+	unitWatts          metricUnit = "watts"
+)
+
+// format formats a value for humans, sizes in --units
+func (u metricUnit) format(value float64) string {
+	switch u {
+	case unitPercent:
+		return fmt.Sprintf("%.2f%%", value)
+	case unitBytes:
+		return formatBytes(uint64(value))
+	case unitBytesPerSecond:
+		return formatBytes(uint64(value)) + "/s"
+	case unitWatts:
+		return fmt.Sprintf("%.1f W", value)
+	case unitSeconds:
+		return fmt.Sprintf("%.2fs", value)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// perSecond is the unit of the rate of a counter in the unit, CPU seconds
+// per second are cores
+func (u metricUnit) perSecond() metricUnit {
+	if u == unitBytes {
+		return unitBytesPerSecond
+	}
+	return unitNone
+}
+
+// sampleColumn is a column of the flat (tabular) form of the samples, used
+// by the Parquet and SQLite exports
+type sampleColumn struct {
+	name        string
+	typ         columnType
+	kind        metricKind
+	unit        metricUnit
+	description string
+	value       func(sample Sample) interface{}
+}
+
+// sampleColumns returns the flat schema of a sample, which is also the
+// registry of the metrics with their unit and description. The time is in
+// microseconds since the epoch and the lists (cores, filesystems and
+// directories) are left out
+func sampleColumns() []sampleColumn {
+	return []sampleColumn{
+		{"time", columnInt64, metricLabel, unitMicroseconds, "Time of the sample since the epoch", func(s Sample) interface{} { return s.Time.UnixMicro() }},
+		{"run_id", columnString, metricLabel, unitNone, "Identifier of the run", func(s Sample) interface{} { return s.RunID }},
+		{"schema", columnInt32, metricLabel, unitNone, "Version of the schema of the sample", func(s Sample) interface{} { return int32(s.Schema) }},
+		{"cpu_percent", columnDouble, metricGauge, unitPercent, "CPU utilization of the system", func(s Sample) interface{} { return s.CpuPercent }},
+		{"mem_used", columnInt64, metricGauge, unitBytes, "Memory in use on the system", func(s Sample) interface{} { return int64(s.MemUsed) }},
+		{"mem_total", columnInt64, metricGauge, unitBytes, "Memory of the system", func(s Sample) interface{} { return int64(s.MemTotal) }},
+		{"mem_percent", columnDouble, metricGauge, unitPercent, "Memory in use in percent of the memory of the system", func(s Sample) interface{} { return s.MemPercent }},
+		{"gpu_percent", columnDouble, metricGauge, unitPercent, "Utilization of the GPUs", func(s Sample) interface{} { return s.GpuPercent }},
+		{"gpu_count", columnInt32, metricGauge, unitNone, "Number of GPUs", func(s Sample) interface{} { return int32(s.GpuCount) }},
+		{"child_gpu_percent", columnDouble, metricGauge, unitPercent, "GPU utilization of the command", func(s Sample) interface{} { return s.ChildGpuPercent }},
+		{"child_gpu_mem_used", columnInt64, metricGauge, unitBytes, "GPU memory used by the command", func(s Sample) interface{} { return int64(s.ChildGpuMemUsed) }},
+		{"gpu_pcie_tx", columnInt64, metricGauge, unitBytesPerSecond, "PCIe throughput from the GPUs to the host", func(s Sample) interface{} { return int64(s.GpuPcieTx) }},
+		{"gpu_pcie_rx", columnInt64, metricGauge, unitBytesPerSecond, "PCIe throughput from the host to the GPUs", func(s Sample) interface{} { return int64(s.GpuPcieRx) }},
+		{"gpu_nvlink_tx", columnInt64, metricGauge, unitBytesPerSecond, "NVLink throughput sent by the GPUs", func(s Sample) interface{} { return int64(s.GpuNvlinkTx) }},
+		{"gpu_nvlink_rx", columnInt64, metricGauge, unitBytesPerSecond, "NVLink throughput received by the GPUs", func(s Sample) interface{} { return int64(s.GpuNvlinkRx) }},
+		{"cpu_power", columnDouble, metricGauge, unitWatts, "Power draw of the CPU packages (RAPL)", func(s Sample) interface{} { return s.CpuPower }},
+		{"gpu_power", columnDouble, metricGauge, unitWatts, "Power draw of the GPUs", func(s Sample) interface{} { return s.GpuPower }},
+		{"ib_tx", columnInt64, metricGauge, unitBytesPerSecond, "InfiniBand/RDMA throughput sent by the host", func(s Sample) interface{} { return int64(s.IbTx) }},
+		{"ib_rx", columnInt64, metricGauge, unitBytesPerSecond, "InfiniBand/RDMA throughput received by the host", func(s Sample) interface{} { return int64(s.IbRx) }},
+		{"child_cpu_percent", columnDouble, metricGauge, unitPercent, "CPU usage of the command in percent of one core", func(s Sample) interface{} { return s.ChildCpuPercent }},
+		{"child_rss", columnInt64, metricGauge, unitBytes, "Resident memory of the command", func(s Sample) interface{} { return int64(s.ChildRSS) }},
+		{"child_pss", columnInt64, metricGauge, unitBytes, "Proportional set size of the command, shared pages split between its processes", func(s Sample) interface{} { return int64(s.ChildPSS) }},
+		{"child_uss", columnInt64, metricGauge, unitBytes, "Unique set size of the command, the memory only its processes use", func(s Sample) interface{} { return int64(s.ChildUSS) }},
+		{"child_net_rx", columnInt64, metricGauge, unitBytesPerSecond, "Network throughput received by the command (--net-capture)", func(s Sample) interface{} { return int64(s.ChildNetRx) }},
+		{"child_net_tx", columnInt64, metricGauge, unitBytesPerSecond, "Network throughput sent by the command (--net-capture)", func(s Sample) interface{} { return int64(s.ChildNetTx) }},
+		{"child_cpu_seconds", columnDouble, metricCounter, unitSeconds, "CPU time the command used since it started", func(s Sample) interface{} { return s.ChildCpuSeconds }},
+		{"child_io_bytes", columnInt64, metricCounter, unitBytes, "Bytes the command read from and wrote to storage since it started", func(s Sample) interface{} { return int64(s.ChildIOBytes) }},
+		{"sockets_open", columnInt64, metricGauge, unitNone, "Open sockets of the command", func(s Sample) interface{} {
+			if s.Sockets == nil {
+				return int64(0)
+			}
+			return int64(s.Sockets.Open())
+		}},
+	}
+}
+
+// lookupMetric returns the column of the metric name
+func lookupMetric(name string) (sampleColumn, bool) {
+	for _, column := range sampleColumns() {
+		if column.name == name {
+			return column, true
+		}
+	}
+	return sampleColumn{}, false
+}
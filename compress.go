@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// compressionSuffixes are the file extensions of the --compress methods
+var compressionSuffixes = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+func validCompression(method string) error {
+	if _, ok := compressionSuffixes[method]; method != "" && !ok {
+		return fmt.Errorf("unsupported compression %q (gzip, zstd)", method)
+	}
+	return nil
+}
+
+// compressedPath appends the extension of the method to path, unless it
+// already has it
+func compressedPath(path string, method string) string {
+	if strings.HasSuffix(path, compressionSuffixes[method]) {
+		return path
+	}
+	return path + compressionSuffixes[method]
+}
+
+// gzipFile compresses to a file with compress/gzip
+type gzipFile struct {
+	*gzip.Writer
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Writer.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// zstdFile compresses to a file with the zstd command, there is no zstd in
+// the standard library
+type zstdFile struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (z *zstdFile) Close() error {
+	err := z.WriteCloser.Close()
+	if waitErr := z.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// compressFile takes ownership of file and compresses what is written to it
+// with method, file is returned as is without a method. Appending works with
+// both methods, a file of several gzip members or zstd frames decompresses
+// to the concatenation.
+func compressFile(file *os.File, method string) (io.WriteCloser, error) {
+	switch method {
+	case "gzip":
+		return &gzipFile{Writer: gzip.NewWriter(file), file: file}, nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdout = file
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		err = cmd.Start()
+		// The child has its own copy of the file
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		return &zstdFile{WriteCloser: stdin, cmd: cmd}, nil
+	}
+	return file, nil
+}
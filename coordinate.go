@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+	"google.golang.org/grpc"
+)
+
+/*
+	go-profile coordinate starts the same command on several hosts at once
+	and gathers their runs, for distributed jobs such as multi-node
+	training. A node is either a go-profile serve instance (the gRPC API) or
+	a host that is reached with ssh and has go-profile installed.
+
+	Every node gets a run directory (metrics.jsonl and summary.json) in the
+	output directory, named after the node, and the coordinator writes a
+	report that overlays the nodes and their average.
+*/
+
+// coordinatedNode is a host taking part in a coordinated run
+type coordinatedNode struct {
+	name string
+	// run starts the command on the node and writes its samples and summary
+	// to dir
+	run func(ctx context.Context, dir string) error
+	err error
+}
+
+// CoordinatedSummary is the summary of a coordinated run (summary.json in
+// the output directory)
+type CoordinatedSummary struct {
+	RunID   string            `json:"run_id"`
+	Command []string          `json:"command"`
+	Nodes   []CoordinatedNode `json:"nodes"`
+	// Averages over the nodes sampled at the same time
+	CPU Aggregate `json:"cpu"`
+	GPU Aggregate `json:"gpu"`
+	// Sum of the resident memory of the command on every node
+	ChildRSS *Aggregate `json:"child_rss,omitempty"`
+}
+
+type CoordinatedNode struct {
+	Node     string        `json:"node"`
+	Dir      string        `json:"dir"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	ExitCode int           `json:"exit_code"`
+	CPU      *Aggregate    `json:"cpu,omitempty"`
+	Memory   *Aggregate    `json:"memory,omitempty"`
+	GPU      *Aggregate    `json:"gpu,omitempty"`
+
+	// Offset of the clock of the node from NTP time, the samples in the
+	// report and the averages are shifted by it. ClockSkewed is set when the
+	// offset is above --max-clock-offset or unknown.
+	Clock       *ClockSync `json:"clock,omitempty"`
+	ClockSkewed bool       `json:"clock_skewed,omitempty"`
+}
+
+// agentNode runs the command through the gRPC API of go-profile serve
+func agentNode(address string, security agentSecurity, command []string, tags map[string]string) *coordinatedNode {
+	return &coordinatedNode{
+		name: address,
+		run: func(ctx context.Context, dir string) error {
+			options, err := security.dialOptions()
+			if err != nil {
+				return err
+			}
+			conn, err := grpc.Dial(address, append(options, grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))...)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			var started StartRunResponse
+			err = conn.Invoke(ctx, "/goprofile.Profiler/StartRun", &StartRunRequest{Command: command, Tags: tags}, &started)
+			if err != nil {
+				return err
+			}
+
+			stream, err := conn.NewStream(ctx, &profilerServiceDesc.Streams[0], "/goprofile.Profiler/StreamSamples")
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(&RunRequest{RunID: started.RunID}); err != nil {
+				return err
+			}
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			metrics, err := os.Create(filepath.Join(dir, "metrics.jsonl"))
+			if err != nil {
+				return err
+			}
+			defer metrics.Close()
+			for {
+				var sample Sample
+				err := stream.RecvMsg(&sample)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if err := profileio.WriteSample(metrics, sample); err != nil {
+					return err
+				}
+			}
+
+			var summary Summary
+			err = conn.Invoke(ctx, "/goprofile.Profiler/GetSummary", &RunRequest{RunID: started.RunID}, &summary)
+			if err != nil {
+				return err
+			}
+			return writeSummaryJSON(filepath.Join(dir, "summary.json"), &summary)
+		},
+	}
+}
+
+// sshNode runs go-profile on the host with ssh, the samples are streamed
+// back over stdout and the summary is copied from the run directory on the
+// host once the command exited
+func sshNode(host string, goProfile string, runID string, command []string, tags map[string]string) *coordinatedNode {
+	// A runs directory of its own, so the latest symlink is this run
+	runs := "go-profile-runs/coordinated-" + runID
+	remote := []string{goProfile, "--stream", "json", "--no-mirror", "--quiet", "--runs-dir", runs}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		remote = append(remote, "--tag", key+"="+tags[key])
+	}
+	remote = append(remote, "--")
+	remote = append(remote, command...)
+
+	return &coordinatedNode{
+		name: host,
+		run: func(ctx context.Context, dir string) error {
+			metrics, err := os.Create(filepath.Join(dir, "metrics.jsonl"))
+			if err != nil {
+				return err
+			}
+			defer metrics.Close()
+
+			cmd := exec.CommandContext(ctx, "ssh", host, shellJoin(remote))
+			cmd.Stdout = metrics
+			stderr, err := cmd.StderrPipe()
+			if err != nil {
+				return err
+			}
+			if err := cmd.Start(); err != nil {
+				return err
+			}
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				fmt.Fprintf(os.Stderr, "[%s] %s\n", host, scanner.Text())
+			}
+			// go-profile exits with 1 when the command failed, the summary
+			// has its exit code
+			if err := cmd.Wait(); ctx.Err() != nil {
+				return err
+			}
+
+			summary, err := exec.CommandContext(ctx, "ssh", host, shellJoin([]string{"cat", runs + "/" + latestRun + "/summary.json"})).Output()
+			if err != nil {
+				return fmt.Errorf("failed to copy the summary: %w", err)
+			}
+			return os.WriteFile(filepath.Join(dir, "summary.json"), summary, 0644)
+		},
+	}
+}
+
+// shellJoin quotes the arguments for the remote shell, ssh joins its
+// arguments with spaces
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// averageNodes resamples the runs of the nodes on the sampling interval and
+// averages the CPU, memory and GPU usage of the nodes that were running at
+// the time, the resident memory of the command is summed
+func averageNodes(runs []*recordedRun, interval time.Duration) []Sample {
+	var first, last time.Time
+	for _, run := range runs {
+		if start := run.samples[0].Time; first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if end := run.samples[len(run.samples)-1].Time; end.After(last) {
+			last = end
+		}
+	}
+
+	var samples []Sample
+	next := make([]int, len(runs))
+	for now := first; !now.After(last); now = now.Add(interval) {
+		sample := Sample{Schema: profileio.SchemaVersion, Time: now}
+		nodes, gpuNodes := 0, 0
+		for r, run := range runs {
+			// The last sample of the node at or before now
+			for next[r] < len(run.samples) && !run.samples[next[r]].Time.After(now) {
+				next[r]++
+			}
+			if next[r] == 0 || next[r] == len(run.samples) && now.Sub(run.samples[len(run.samples)-1].Time) > interval {
+				continue
+			}
+			current := run.samples[next[r]-1]
+			nodes++
+			sample.CpuPercent += current.CpuPercent
+			sample.MemPercent += current.MemPercent
+			sample.MemUsed += current.MemUsed
+			sample.MemTotal += current.MemTotal
+			sample.ChildRSS += current.ChildRSS
+			if current.GpuCount > 0 {
+				gpuNodes++
+				sample.GpuPercent += current.GpuPercent
+				sample.GpuCount += current.GpuCount
+			}
+		}
+		if nodes == 0 {
+			continue
+		}
+		sample.CpuPercent /= float64(nodes)
+		sample.MemPercent /= float64(nodes)
+		if gpuNodes > 0 {
+			sample.GpuPercent /= float64(gpuNodes)
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func coordinateMain(args []string) {
+	flags := flag.NewFlagSet("go-profile coordinate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile coordinate [options] -- <command> [arguments]\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	var agents, hosts stringList
+	var tagFlags tagList
+	flags.Var(&agents, "agent", "`address` of a go-profile serve instance to run the command on (repeatable)")
+	flags.Var(&hosts, "ssh", "`host` to run the command on with ssh and go-profile (repeatable)")
+	goProfile := flags.String("remote-go-profile", "go-profile", "`path` of go-profile on the ssh hosts")
+	out := flags.String("out", "go-profile-coordinated", "write a run directory per node and the report to a new directory per run in `dir`")
+	flags.Var(&tagFlags, "tag", "attach a `key=value` label to the runs of all nodes (repeatable)")
+	var security agentSecurity
+	flags.StringVar(&security.ca, "agent-ca", "", "connect to the agents over TLS and verify them with the CAs in `file` (PEM)")
+	flags.StringVar(&security.certFile, "agent-cert", "", "connect to the agents over TLS with the client certificate in `file` (PEM)")
+	flags.StringVar(&security.keyFile, "agent-key", "", "private key `file` of --agent-cert (PEM)")
+	maxClockOffset := flags.Duration("max-clock-offset", 10*time.Millisecond, "warn about nodes whose clock is further than this `duration` from NTP time (or unknown), their samples can not be correlated with the other nodes")
+	flags.Parse(args)
+	security.token = os.Getenv(serveTokenEnv)
+
+	command := flags.Args()
+	if len(command) == 0 || len(agents)+len(hosts) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	runID := newRunID(time.Now())
+	tags := map[string]string{"coordinated_run": runID}
+	for _, tag := range tagFlags {
+		tags[tag.Key] = tag.Value
+	}
+
+	var nodes []*coordinatedNode
+	for _, address := range agents {
+		nodes = append(nodes, agentNode(address, security, command, withTag(tags, "node", address)))
+	}
+	for _, host := range hosts {
+		nodes = append(nodes, sshNode(host, *goProfile, runID, command, withTag(tags, "node", host)))
+	}
+
+	dir := filepath.Join(*out, runID)
+	for _, node := range nodes {
+		if err := os.MkdirAll(filepath.Join(dir, nodeDirName(node.name)), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to create the run directory: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Ctrl+C stops the ssh sessions and stops following the agents
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "[go-profile] Coordinated run %s on %d nodes: %s\n", runID, len(nodes), strings.Join(command, " "))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *coordinatedNode) {
+			defer wg.Done()
+			node.err = node.run(ctx, filepath.Join(dir, nodeDirName(node.name)))
+		}(node)
+	}
+	wg.Wait()
+
+	summary := &CoordinatedSummary{RunID: runID, Command: command}
+	var runs []*recordedRun
+	failed := 0
+	for _, node := range nodes {
+		nodeDir := filepath.Join(dir, nodeDirName(node.name))
+		result := CoordinatedNode{Node: node.name, Dir: nodeDir}
+		var run *recordedRun
+		if node.err == nil {
+			run, node.err = readRunDir(nodeDir)
+		}
+		if node.err != nil {
+			result.Error = node.err.Error()
+			result.ExitCode = -1
+			fmt.Fprintf(os.Stderr, "[go-profile] Node %s failed: %s\n", node.name, node.err)
+			failed++
+		} else {
+			run.label = node.name
+			runs = append(runs, run)
+			result.Clock, result.ClockSkewed = alignNodeClock(node.name, run, *maxClockOffset)
+			if s := run.summary; s != nil {
+				result.Duration = s.Duration
+				result.ExitCode = s.ExitCode
+				result.Error = s.Error
+				result.CPU, result.Memory, result.GPU = &s.CPU, &s.Memory, &s.GPU
+				if s.ExitCode != 0 {
+					failed++
+				}
+				fmt.Fprintf(os.Stderr, "[go-profile] Node %s: %s, exit code %d, CPU avg %.2f%% max %.2f%%, memory max %s, GPU avg %.2f%% max %.2f%%\n",
+					node.name, s.Duration.Round(time.Millisecond), s.ExitCode, s.CPU.Avg, s.CPU.Max, formatBytes(uint64(s.Memory.Max)), s.GPU.Avg, s.GPU.Max)
+			}
+		}
+		summary.Nodes = append(summary.Nodes, result)
+	}
+
+	if len(runs) > 0 {
+		average := averageNodes(runs, 250*time.Millisecond)
+		var cpuAgg, gpuAgg, rssAgg aggregator
+		for _, sample := range average {
+			cpuAgg.add(sample.CpuPercent)
+			gpuAgg.add(sample.GpuPercent)
+			if sample.ChildRSS > 0 {
+				rssAgg.add(float64(sample.ChildRSS))
+			}
+		}
+		summary.CPU, summary.GPU, summary.ChildRSS = cpuAgg.result(), gpuAgg.result(), rssAgg.optional()
+		fmt.Fprintf(os.Stderr, "[go-profile] All nodes: CPU avg %.2f%% max %.2f%%, GPU avg %.2f%% max %.2f%%\n",
+			summary.CPU.Avg, summary.CPU.Max, summary.GPU.Avg, summary.GPU.Max)
+		if summary.ChildRSS != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] All nodes: command RSS max %s, avg %s\n",
+				formatBytes(uint64(summary.ChildRSS.Max)), formatBytes(uint64(summary.ChildRSS.Avg)))
+		}
+
+		all := &recordedRun{label: "all nodes (average)", samples: average}
+		for _, run := range append(runs, all) {
+			run.origin = average[0].Time
+		}
+		report := filepath.Join(dir, "report.html")
+		if err := writeMergedReport(report, append(runs, all)); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write the report: %s\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "[go-profile] Report: %s\n", report)
+		}
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "summary.json"), append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to write the summary: %s\n", err)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "[go-profile] %d of %d nodes failed\n", failed, len(nodes))
+		os.Exit(1)
+	}
+}
+
+// alignNodeClock shifts the samples of the node to NTP time with the clock
+// offset recorded in its summary, it returns the offset and whether it is
+// unknown or too large for the samples to be correlated
+func alignNodeClock(node string, run *recordedRun, maxOffset time.Duration) (*ClockSync, bool) {
+	var clock ClockInfo
+	if run.summary != nil && run.summary.Sections["clock"] != nil {
+		json.Unmarshal(run.summary.Sections["clock"], &clock)
+	}
+	if clock.Sync == nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] WARNING: the clock offset of node %s is unknown (no chrony or ntpd), its samples may not line up with the other nodes\n", node)
+		return nil, true
+	}
+
+	for i := range run.samples {
+		run.samples[i].Time = run.samples[i].Time.Add(-clock.Sync.Offset)
+	}
+	offset := clock.Sync.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+	if offset > maxOffset {
+		fmt.Fprintf(os.Stderr, "[go-profile] WARNING: the clock of node %s is %s, above --max-clock-offset %s, correlate its samples with care\n", node, clock.Sync, maxOffset)
+		return clock.Sync, true
+	}
+	return clock.Sync, false
+}
+
+// withTag returns a copy of the tags with one more
+func withTag(tags map[string]string, key string, value string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range tags {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
+
+// nodeDirName turns the address of a node into a directory name
+func nodeDirName(name string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(name)
+}
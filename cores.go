@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// getCoreTimes returns the CPU time and the number of every online core
+// from /proc/stat
+func getCoreTimes() ([]CPUTime, []int, error) {
+	data, err := os.ReadFile(procPath("stat"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cores []CPUTime
+	var ids []int
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// The first line is the total of all cores ("cpu")
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		core, err := parseCPUTime(fields)
+		if err != nil {
+			return nil, nil, err
+		}
+		id, err := strconv.Atoi(fields[0][len("cpu"):])
+		if err != nil {
+			return nil, nil, err
+		}
+		cores = append(cores, *core)
+		ids = append(ids, id)
+	}
+	return cores, ids, nil
+}
+
+// coreUsage calculates the utilization of every core between samples
+type coreUsage struct {
+	prev []CPUTime
+	// Numbers of the cores of the last sample
+	ids []int
+}
+
+// sample returns the utilization of every core in percent since the last
+// sample, nil on the first call or when the number of cores changed
+func (c *coreUsage) sample() []float64 {
+	cores, ids, err := getCoreTimes()
+	if err != nil {
+		return nil
+	}
+	prev := c.prev
+	c.prev, c.ids = cores, ids
+	if len(prev) != len(cores) {
+		return nil
+	}
+
+	usage := make([]float64, len(cores))
+	for i, core := range cores {
+		diffIdle := float64(core.idle - prev[i].idle)
+		diffTotal := float64(core.total - prev[i].total)
+		if diffTotal > 0 {
+			usage[i] = (diffTotal - diffIdle) / diffTotal * 100.0
+		}
+	}
+	return usage
+}
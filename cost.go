@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instancePrices are approximate on-demand prices in dollars per hour of
+// common cloud instance types (us-east-1 and us-central1), for when the
+// actual (reserved, spot or negotiated) price is not known
+var instancePrices = map[string]float64{
+	// AWS
+	"p5.48xlarge":   98.32,
+	"p4d.24xlarge":  32.77,
+	"p3.2xlarge":    3.06,
+	"p3.8xlarge":    12.24,
+	"p3.16xlarge":   24.48,
+	"g6.xlarge":     0.805,
+	"g5.xlarge":     1.006,
+	"g5.12xlarge":   5.672,
+	"g5.48xlarge":   16.288,
+	"g4dn.xlarge":   0.526,
+	"g4dn.12xlarge": 3.912,
+	"c7i.xlarge":    0.1785,
+	"c6i.xlarge":    0.17,
+	"m7i.xlarge":    0.2016,
+	"m6i.xlarge":    0.192,
+	"r6i.xlarge":    0.252,
+	// Google Cloud
+	"a3-highgpu-8g":  88.25,
+	"a2-highgpu-1g":  3.67,
+	"a2-highgpu-8g":  29.39,
+	"g2-standard-4":  0.71,
+	"n2-standard-4":  0.194,
+	"c3-standard-4":  0.209,
+	"n1-standard-4":  0.19,
+	"e2-standard-4":  0.134,
+	"n2-highmem-4":   0.262,
+	"a2-ultragpu-1g": 5.07,
+}
+
+func instanceTypeNames() string {
+	var names []string
+	for name := range instancePrices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// hourlyCost is the price of the machine the run occupies (--hourly-cost
+// dollars or instance type)
+type hourlyCost struct {
+	text    string
+	dollars float64
+	// Instance type the price was looked up for, empty if given as a number
+	instanceType string
+}
+
+func (h *hourlyCost) String() string {
+	return h.text
+}
+
+func (h *hourlyCost) Set(value string) error {
+	if dollars, err := strconv.ParseFloat(strings.TrimPrefix(value, "$"), 64); err == nil {
+		if dollars < 0 {
+			return fmt.Errorf("the hourly cost can not be negative")
+		}
+		*h = hourlyCost{text: value, dollars: dollars}
+		return nil
+	}
+	instanceType := strings.ToLower(value)
+	dollars, ok := instancePrices[instanceType]
+	if !ok {
+		return fmt.Errorf("expected dollars per hour or an instance type (%s)", instanceTypeNames())
+	}
+	*h = hourlyCost{text: value, dollars: dollars, instanceType: instanceType}
+	return nil
+}
+
+func (h *hourlyCost) enabled() bool {
+	return h.text != ""
+}
+
+// CostSummary is the cost of the machine for the duration of the run and
+// the part of it paid for idle resources
+type CostSummary struct {
+	HourlyRate   float64 `json:"hourly_rate"`
+	InstanceType string  `json:"instance_type,omitempty"`
+	// Dollars
+	Cost float64 `json:"cost"`
+
+	// The resource the machine is paid for: the GPUs if there are any,
+	// the CPUs otherwise
+	Resource string `json:"resource"`
+	// Fraction of the run the GPUs were idle, or the average unused CPU
+	// capacity, and the cost of it
+	IdleFraction float64 `json:"idle_fraction"`
+	IdleCost     float64 `json:"idle_cost"`
+}
+
+func (c *CostSummary) String() string {
+	rate := fmt.Sprintf("$%g/h", c.HourlyRate)
+	if c.InstanceType != "" {
+		rate += " for " + c.InstanceType
+	}
+	return fmt.Sprintf("%s (at %s), %s (%.1f%%) wasted on idle %ss",
+		formatDollars(c.Cost), rate, formatDollars(c.IdleCost), c.IdleFraction*100, c.Resource)
+}
+
+// formatDollars formats an amount with cents, or more decimals below a cent
+func formatDollars(dollars float64) string {
+	if dollars > 0 && dollars < 0.01 {
+		return fmt.Sprintf("$%.4f", dollars)
+	}
+	return fmt.Sprintf("$%.2f", dollars)
+}
+
+// estimateCost prices the duration of the run, the idle fraction is the
+// time the GPUs were idle (--gpu-idle-threshold) or the unused CPU capacity
+// of the machine without GPUs
+func estimateCost(cost hourlyCost, duration time.Duration, cpu Aggregate, gpuIdle *GPUIdleSummary) *CostSummary {
+	summary := &CostSummary{
+		HourlyRate:   cost.dollars,
+		InstanceType: cost.instanceType,
+		Cost:         cost.dollars * duration.Hours(),
+	}
+	if gpuIdle != nil {
+		summary.Resource = "GPU"
+		summary.IdleFraction = gpuIdle.IdleFraction
+	} else {
+		summary.Resource = "CPU"
+		summary.IdleFraction = min(max(1-cpu.Avg/100, 0), 1)
+	}
+	summary.IdleCost = summary.Cost * summary.IdleFraction
+	return summary
+}
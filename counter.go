@@ -0,0 +1,64 @@
+package main
+
+import "time"
+
+/*
+	Collectors read two kinds of metrics:
+
+	- gauges, such as the CPU utilization or the memory in use, are reported
+	  as read and aggregated over the run with an aggregator
+	- counters, such as CPU ticks, captured bytes, garbage collections or
+	  energy, only increase; a counter remembers the previous reading so the
+	  collector reports the increase (or the rate) since the previous sample
+*/
+
+// counter is a monotonically increasing metric
+type counter struct {
+	// The previous reading, valid once sampled is set
+	sampled bool
+	value   uint64
+	time    time.Time
+
+	// total is the first reading plus the increases since, it keeps going
+	// up when the counter goes backwards
+	total uint64
+
+	// wrap is the value a hardware counter wraps around at (e.g. the range
+	// of a RAPL energy counter), 0 if it does not
+	wrap uint64
+}
+
+// delta records the reading and returns the increase since the previous
+// one, false for the first reading and when the counter went backwards
+// (e.g. the program restarted) without wrapping around
+func (c *counter) delta(value uint64) (uint64, bool) {
+	previous, sampled := c.value, c.sampled
+	c.value, c.sampled = value, true
+	if !sampled {
+		c.total = value
+		return 0, false
+	}
+	if value < previous {
+		if c.wrap <= previous {
+			return 0, false
+		}
+		increase := c.wrap - previous + value
+		c.total += increase
+		return increase, true
+	}
+	c.total += value - previous
+	return value - previous, true
+}
+
+// rate records the reading and returns the increase per second since the
+// previous one, false like delta
+func (c *counter) rate(now time.Time, value uint64) (float64, bool) {
+	last := c.time
+	c.time = now
+	delta, ok := c.delta(value)
+	elapsed := now.Sub(last).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0, false
+	}
+	return float64(delta) / elapsed, true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CPUFreqInfo is the frequency scaling state of the CPUs during the run
+type CPUFreqInfo struct {
+	// Scaling governors in use, usually a single one
+	Governors []string `json:"governors,omitempty"`
+	// Turbo boost: "on", "off" or empty when unknown
+	Turbo string `json:"turbo,omitempty"`
+}
+
+func (c *CPUFreqInfo) String() string {
+	governors := "unknown"
+	if len(c.Governors) > 0 {
+		governors = strings.Join(c.Governors, ",")
+	}
+	turbo := c.Turbo
+	if turbo == "" {
+		turbo = "unknown"
+	}
+	return fmt.Sprintf("governor: %s, turbo: %s", governors, turbo)
+}
+
+const (
+	cpufreqGovernors = "/sys/devices/system/cpu/cpu[0-9]*/cpufreq/scaling_governor"
+	// intel_pstate has the inverse of a boost switch
+	intelNoTurbo   = "/sys/devices/system/cpu/intel_pstate/no_turbo"
+	cpufreqBoost   = "/sys/devices/system/cpu/cpufreq/boost"
+	turboOn        = "on"
+	turboOff       = "off"
+	turboUnchanged = ""
+)
+
+// readCPUFreq returns nil without cpufreq (most VMs and containers)
+func readCPUFreq() *CPUFreqInfo {
+	info := &CPUFreqInfo{}
+	paths, _ := filepath.Glob(cpufreqGovernors)
+	seen := map[string]bool{}
+	for _, path := range paths {
+		governor, err := readSysctl(path)
+		if err == nil && !seen[governor] {
+			seen[governor] = true
+			info.Governors = append(info.Governors, governor)
+		}
+	}
+	sort.Strings(info.Governors)
+
+	if value, err := readSysctl(intelNoTurbo); err == nil {
+		info.Turbo = map[bool]string{true: turboOff, false: turboOn}[value == "1"]
+	} else if value, err := readSysctl(cpufreqBoost); err == nil {
+		info.Turbo = map[bool]string{true: turboOn, false: turboOff}[value == "1"]
+	}
+
+	if len(info.Governors) == 0 && info.Turbo == "" {
+		return nil
+	}
+	return info
+}
+
+// sysfsWrites changes sysfs files and remembers their previous values
+type sysfsWrites struct {
+	previous map[string]string
+	order    []string
+}
+
+func (w *sysfsWrites) write(path string, value string) error {
+	old, err := readSysctl(path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return err
+	}
+	if w.previous == nil {
+		w.previous = map[string]string{}
+	}
+	if _, ok := w.previous[path]; !ok {
+		w.previous[path] = old
+		w.order = append(w.order, path)
+	}
+	return nil
+}
+
+// restore writes the previous values back, in reverse order
+func (w *sysfsWrites) restore() error {
+	var firstErr error
+	for i := len(w.order) - 1; i >= 0; i-- {
+		path := w.order[i]
+		if err := os.WriteFile(path, []byte(w.previous[path]), 0644); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	w.previous, w.order = nil, nil
+	return firstErr
+}
+
+// setCPUFreq sets the governor of every CPU and the turbo boost (empty
+// values are left alone), this needs root. The changes are kept in writes
+// for restoring them, also when an error is returned.
+func setCPUFreq(governor string, turbo string, writes *sysfsWrites) error {
+	if governor != "" {
+		paths, _ := filepath.Glob(cpufreqGovernors)
+		if len(paths) == 0 {
+			return fmt.Errorf("no cpufreq governors (%s)", cpufreqGovernors)
+		}
+		for _, path := range paths {
+			if err := writes.write(path, governor); err != nil {
+				return fmt.Errorf("set governor: %w", err)
+			}
+		}
+	}
+	if turbo != turboUnchanged {
+		var err error
+		if _, statErr := os.Stat(intelNoTurbo); statErr == nil {
+			err = writes.write(intelNoTurbo, map[bool]string{true: "0", false: "1"}[turbo == turboOn])
+		} else {
+			err = writes.write(cpufreqBoost, map[bool]string{true: "1", false: "0"}[turbo == turboOn])
+		}
+		if err != nil {
+			return fmt.Errorf("set turbo: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// CPUTimeSummary is the CPU time the command and the children it waited for
+// used (rusage), orphans that were reaped by go-profile are not included
+type CPUTimeSummary struct {
+	User   time.Duration `json:"user"`
+	System time.Duration `json:"system"`
+	// CPU time per wall-clock time, e.g. 9 for a build that kept 9 cores
+	// busy on average
+	Parallelism float64 `json:"parallelism"`
+}
+
+// newCPUTimeSummary returns nil if the command used no CPU time, which is
+// the case when it was not a child of go-profile
+func newCPUTimeSummary(user, system, wall time.Duration) *CPUTimeSummary {
+	if user+system == 0 {
+		return nil
+	}
+	summary := &CPUTimeSummary{User: user, System: system}
+	if wall > 0 {
+		summary.Parallelism = float64(user+system) / float64(wall)
+	}
+	return summary
+}
+
+// String is e.g. "1h30m (user: 1h20m, system: 10m), 900% CPU"
+func (c *CPUTimeSummary) String() string {
+	return fmt.Sprintf("%s (user: %s, system: %s), %.0f%% CPU",
+		(c.User + c.System).Round(time.Millisecond),
+		c.User.Round(time.Millisecond),
+		c.System.Round(time.Millisecond),
+		c.Parallelism*100)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// commandUser is the user and group the command runs as (--user and
+// --group), go-profile itself keeps running as root so it can still read
+// the process tree and the system statistics
+type commandUser struct {
+	credential syscall.Credential
+	// Set for --user, HOME, USER and LOGNAME of the command are the user's
+	name string
+	home string
+}
+
+// lookupCommandUser resolves the names (or numeric IDs) of --user and
+// --group, the group defaults to the primary group of the user and the
+// supplementary groups are the user's. With only --group the command keeps
+// root as user but loses root's supplementary groups. nil if neither is set.
+func lookupCommandUser(userName, groupName string) (*commandUser, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("--user and --group need go-profile to run as root")
+	}
+	result := &commandUser{}
+	result.credential.Uid = uint32(os.Getuid())
+	result.credential.Gid = uint32(os.Getgid())
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, atoiErr := strconv.Atoi(userName); err != nil && atoiErr == nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("--user: %w", err)
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		result.credential.Uid = uint32(uid)
+		result.credential.Gid = uint32(gid)
+		groups, _ := u.GroupIds()
+		for _, group := range groups {
+			if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+				result.credential.Groups = append(result.credential.Groups, uint32(id))
+			}
+		}
+		result.name = u.Username
+		result.home = u.HomeDir
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, atoiErr := strconv.Atoi(groupName); err != nil && atoiErr == nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("--group: %w", err)
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		result.credential.Gid = uint32(gid)
+	}
+	return result, nil
+}
+
+func (u *commandUser) String() string {
+	return fmt.Sprintf("uid %d, gid %d", u.credential.Uid, u.credential.Gid)
+}
+
+// env returns the variables of the user's login environment
+func (u *commandUser) env() []string {
+	if u == nil || u.name == "" {
+		return nil
+	}
+	return []string{"HOME=" + u.home, "USER=" + u.name, "LOGNAME=" + u.name}
+}
+
+// args are the flags of sandbox-init to start the command as the user
+func (u *commandUser) args() []string {
+	if u == nil {
+		return nil
+	}
+	args := []string{"--uid", strconv.FormatUint(uint64(u.credential.Uid), 10), "--gid", strconv.FormatUint(uint64(u.credential.Gid), 10)}
+	if !u.credential.NoSetGroups {
+		var groups []string
+		for _, group := range u.credential.Groups {
+			groups = append(groups, strconv.FormatUint(uint64(group), 10))
+		}
+		args = append(args, "--groups", strings.Join(groups, ","))
+	}
+	return args
+}
+
+// switchUser changes the user of go-profile itself, for go-profile exec
+// before it executes the command
+func (u *commandUser) switchUser() error {
+	if u == nil {
+		return nil
+	}
+	if !u.credential.NoSetGroups {
+		groups := make([]int, len(u.credential.Groups))
+		for i, group := range u.credential.Groups {
+			groups[i] = int(group)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgid(int(u.credential.Gid)); err != nil {
+		return err
+	}
+	return syscall.Setuid(int(u.credential.Uid))
+}
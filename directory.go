@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+type DirectoryUsage = profileio.DirectoryUsage
+
+// getDirectoryUsage returns the disk usage of everything below path, up to
+// maxDepth directories deep
+func getDirectoryUsage(path string, maxDepth int) DirectoryUsage {
+	usage := DirectoryUsage{Path: path}
+	root := filepath.Clean(path)
+	filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files disappear while walking, just skip them
+			return nil
+		}
+		if entry.IsDir() && name != root && strings.Count(name[len(root):], string(filepath.Separator)) > maxDepth {
+			return filepath.SkipDir
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		// Count allocated blocks instead of the apparent size (sparse files)
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage.Size += uint64(stat.Blocks) * 512
+		} else {
+			usage.Size += uint64(info.Size())
+		}
+		if !entry.IsDir() {
+			usage.Files++
+		}
+		return nil
+	})
+	return usage
+}
+
+type DirectorySummary struct {
+	Path   string `json:"path"`
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`
+	Peak   uint64 `json:"peak"`
+	Growth int64  `json:"growth"`
+	Files  uint64 `json:"files"`
+}
+
+// directoryWatcher periodically measures directory sizes in the background,
+// walking large trees every tick would be too expensive
+type directoryWatcher struct {
+	mu        sync.Mutex
+	paths     []string
+	maxDepth  int
+	latest    []DirectoryUsage
+	summaries []DirectorySummary
+}
+
+func newDirectoryWatcher(paths []string, maxDepth int) *directoryWatcher {
+	w := &directoryWatcher{paths: paths, maxDepth: maxDepth}
+	for _, path := range paths {
+		w.summaries = append(w.summaries, DirectorySummary{Path: path})
+	}
+	return w
+}
+
+func (w *directoryWatcher) measure(logPrintf func(format string, a ...interface{})) {
+	var usages []DirectoryUsage
+	for _, path := range w.paths {
+		usages = append(usages, getDirectoryUsage(path, w.maxDepth))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	first := w.latest == nil
+	w.latest = usages
+	for i, usage := range usages {
+		s := &w.summaries[i]
+		if first {
+			s.Start = usage.Size
+		}
+		s.End = usage.Size
+		s.Peak = max(s.Peak, usage.Size)
+		s.Growth = int64(s.End) - int64(s.Start)
+		s.Files = usage.Files
+		logPrintf("Directory %s: %s (%d files, %s since start)", usage.Path, formatBytes(usage.Size), usage.Files, formatGrowth(s.Growth))
+	}
+}
+
+// run measures every interval until done is closed
+func (w *directoryWatcher) run(interval time.Duration, done <-chan struct{}, logPrintf func(format string, a ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.measure(logPrintf)
+		case <-done:
+			return
+		}
+	}
+}
+
+// current returns the most recent measurement
+func (w *directoryWatcher) current() []DirectoryUsage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.latest
+}
+
+func (w *directoryWatcher) result() []DirectorySummary {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.summaries
+}
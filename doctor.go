@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// doctorCheck tells if something go-profile (or a collector) needs is
+// available on this machine, hint is how to make it available
+type doctorCheck struct {
+	name  string
+	check func() (string, error)
+	hint  string
+}
+
+// readSysctl returns the trimmed contents of a /proc or /sys file
+func readSysctl(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	return strings.TrimSpace(string(data)), err
+}
+
+// lookPathCheck checks that a tool is in the PATH
+func lookPathCheck(name string) func() (string, error) {
+	return func() (string, error) {
+		return exec.LookPath(name)
+	}
+}
+
+// checkPacketSocket opens the socket used by --net-capture
+func checkPacketSocket() error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPAll)))
+	if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+var doctorChecks = []doctorCheck{
+	{
+		name: "proc",
+		check: func() (string, error) {
+			_, err := getCPUTime()
+			return "/proc/stat", err
+		},
+		hint: "go-profile needs a mounted /proc",
+	},
+	{
+		name:  "nvidia-smi",
+		check: lookPathCheck("nvidia-smi"),
+		hint:  "install the NVIDIA driver utilities, without nvidia-smi the GPU usage is reported as 0",
+	},
+	{
+		name: "nvml",
+		check: func() (string, error) {
+			for _, dir := range []string{"/usr/lib/x86_64-linux-gnu", "/usr/lib/aarch64-linux-gnu", "/usr/lib64", "/usr/lib", "/usr/local/nvidia/lib64"} {
+				path := dir + "/libnvidia-ml.so.1"
+				if _, err := os.Stat(path); err == nil {
+					return path, nil
+				}
+			}
+			return "", errors.New("libnvidia-ml.so.1 not found")
+		},
+		hint: "NVML ships with the NVIDIA driver, nvidia-smi needs it",
+	},
+	{
+		name: "packet capture",
+		check: func() (string, error) {
+			return "AF_PACKET socket", checkPacketSocket()
+		},
+		hint: "--net-capture needs root or CAP_NET_RAW: sudo setcap cap_net_raw+ep $(which go-profile)",
+	},
+	{
+		name:  "strace",
+		check: lookPathCheck("strace"),
+		hint:  "--syscalls needs strace: apt install strace",
+	},
+	{
+		name: "ptrace",
+		check: func() (string, error) {
+			scope, err := readSysctl("/proc/sys/kernel/yama/ptrace_scope")
+			if err != nil {
+				return "no Yama restrictions", nil
+			}
+			if scope != "0" && os.Geteuid() != 0 {
+				return "", fmt.Errorf("kernel.yama.ptrace_scope is %s", scope)
+			}
+			return "kernel.yama.ptrace_scope " + scope, nil
+		},
+		hint: "--py-spy attaches to the command: sudo sysctl kernel.yama.ptrace_scope=0, or run as root",
+	},
+	{
+		name:  "py-spy",
+		check: lookPathCheck("py-spy"),
+		hint:  "--py-spy needs py-spy: pip install py-spy",
+	},
+	{
+		name:  "zstd",
+		check: lookPathCheck("zstd"),
+		hint:  "--compress zstd needs the zstd command line tool: apt install zstd",
+	},
+	{
+		name:  "sqlite3",
+		check: lookPathCheck("sqlite3"),
+		hint:  "export and query need the sqlite3 command line tool: apt install sqlite3",
+	},
+	{
+		name: "namespaces",
+		check: func() (string, error) {
+			return "pid, mount", checkSandbox(namespaceList{"pid", "mount"})
+		},
+		hint: "--unshare without root needs unprivileged user namespaces: sudo sysctl kernel.unprivileged_userns_clone=1 user.max_user_namespaces=15000",
+	},
+	{
+		name: "perf events",
+		check: func() (string, error) {
+			value, err := readSysctl("/proc/sys/kernel/perf_event_paranoid")
+			if err != nil {
+				return "", err
+			}
+			level, _ := strconv.Atoi(value)
+			if level > 2 && os.Geteuid() != 0 {
+				return "", fmt.Errorf("kernel.perf_event_paranoid is %d", level)
+			}
+			return "kernel.perf_event_paranoid " + value, nil
+		},
+		hint: "perf needs kernel.perf_event_paranoid <= 2 for its own processes (1 for CPU-wide events): sudo sysctl kernel.perf_event_paranoid=1",
+	},
+	{
+		name: "psi",
+		check: func() (string, error) {
+			_, err := readSysctl("/proc/pressure/cpu")
+			return "/proc/pressure", err
+		},
+		hint: "pressure stall information needs a kernel with CONFIG_PSI, booted with psi=1 if it is disabled by default",
+	},
+	{
+		name: "cgroup v2",
+		check: func() (string, error) {
+			controllers, err := readSysctl("/sys/fs/cgroup/cgroup.controllers")
+			if err != nil {
+				return "", errors.New("/sys/fs/cgroup is not a cgroup2 mount")
+			}
+			return "controllers: " + controllers, nil
+		},
+		hint: "boot with systemd.unified_cgroup_hierarchy=1 to use the unified hierarchy",
+	},
+	{
+		name: "rapl",
+		check: func() (string, error) {
+			_, err := readSysctl("/sys/class/powercap/intel-rapl:0/energy_uj")
+			return "/sys/class/powercap/intel-rapl:0", err
+		},
+		hint: "RAPL energy counters are only readable by root since Linux 5.10: run as root or sudo chmod o+r /sys/class/powercap/intel-rapl:*/energy_uj",
+	},
+}
+
+// doctorMain reports what can be collected on this machine
+func doctorMain(args []string) {
+	flags := flag.NewFlagSet("go-profile doctor", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile doctor\n\nReports which collectors can run on this machine and how to enable the others.\n")
+	}
+	flags.Parse(args)
+
+	for _, check := range doctorChecks {
+		detail, err := check.check()
+		if err != nil {
+			fmt.Printf("no   %-15s %s\n", check.name, err)
+			fmt.Printf("     %-15s %s\n", "", check.hint)
+		} else {
+			fmt.Printf("ok   %-15s %s\n", check.name, detail)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dryRun checks the options and the environment without running the
+// command, it prints what would be collected and returns false if a check
+// failed
+func dryRun(opts *Options) bool {
+	ok := true
+	check := func(name string, err error, detail string) {
+		status := "ok  "
+		if err != nil {
+			status, detail = "FAIL", err.Error()
+			ok = false
+		}
+		fmt.Fprintf(os.Stderr, "[go-profile] %s %s: %s\n", status, name, detail)
+	}
+	warn := func(name string, detail string) {
+		fmt.Fprintf(os.Stderr, "[go-profile] warn %s: %s\n", name, detail)
+	}
+
+	path, err := exec.LookPath(opts.Command[0])
+	check("command", err, path)
+
+	_, err = getCPUTime()
+	check("cpu, memory", err, "/proc/stat and /proc/meminfo")
+	if opts.RunsDir != "" {
+		check("runs", checkWritable(opts.RunsDir), opts.RunsDir)
+	}
+	check("log", checkWritable(opts.LogPath), opts.LogPath)
+	if opts.MetricsLog != "" {
+		check("metrics", checkWritable(opts.MetricsLog), opts.MetricsLog)
+	}
+
+	accelerators := detectAccelerators(opts)
+	if len(accelerators) == 0 {
+		warn("gpu", "no accelerators found (nvidia-smi is not in the PATH), GPU usage will be 0")
+	}
+	for _, accelerator := range accelerators {
+		reading, err := accelerator.Sample(nil)
+		check("gpu", err, fmt.Sprintf("%d %s GPUs", reading.Count, accelerator.Name()))
+	}
+
+	if opts.NetCapture {
+		check("net-capture", checkPacketSocket(), "packet socket (CAP_NET_RAW)")
+	}
+	if opts.Syscalls {
+		path, err := exec.LookPath("strace")
+		check("syscalls", err, path)
+	}
+	if opts.PySpy {
+		path, err := exec.LookPath("py-spy")
+		check("py-spy", err, path)
+	}
+	if opts.StackOnCPU > 0 {
+		if path, err := exec.LookPath("eu-stack"); err == nil {
+			check("stack-on-cpu", nil, path)
+		} else {
+			warn("stack-on-cpu", "eu-stack is not installed, only Python (py-spy) and kernel stacks are captured")
+		}
+	}
+	if opts.Compress == "zstd" {
+		path, err := exec.LookPath("zstd")
+		check("compress", err, path)
+	}
+	if len(opts.Unshare) > 0 {
+		check("unshare", checkSandbox(opts.Unshare), opts.Unshare.String())
+	}
+	if opts.GoMetrics != "" {
+		warn("go-metrics", opts.GoMetrics+" is only sampled once the command serves it")
+	}
+	if opts.JMX != "" {
+		warn("jmx", newJVMMetrics(opts.JMX).base+" is only sampled once the command serves it")
+	}
+
+	for _, path := range opts.Filesystems {
+		usage, err := getFilesystemUsage(path)
+		check("fs", err, fmt.Sprintf("%s (%.1f%% used)", path, usage.Percent))
+	}
+	for _, path := range opts.WatchDirs {
+		if _, err := os.Stat(path); err != nil {
+			warn("watch-dir", fmt.Sprintf("%s does not exist yet", path))
+		} else {
+			check("watch-dir", nil, path)
+		}
+	}
+
+	outputs := map[string]string{
+		"timeline": opts.Timeline,
+		"chart":    opts.Chart,
+		"html":     opts.HTML,
+		"summary":  opts.SummaryJSON,
+	}
+	for _, name := range []string{"timeline", "chart", "html", "summary"} {
+		path := outputs[name]
+		if path == "" {
+			continue
+		}
+		err := checkWritable(path)
+		if ext := strings.ToLower(filepath.Ext(path)); name == "chart" && ext != ".svg" && ext != ".png" {
+			err = fmt.Errorf("unsupported chart format %q (.svg, .png)", ext)
+		}
+		check(name, err, path)
+	}
+
+	for _, output := range opts.Outputs {
+		switch {
+		case output.format == "log" || output.target == "-":
+		case output.format == "prometheus":
+			listener, err := net.Listen("tcp", output.target)
+			if err == nil {
+				listener.Close()
+			}
+			check("output", err, output.String())
+		default:
+			check("output", checkWritable(output.target), output.String())
+		}
+	}
+
+	if opts.Upload != "" {
+		scheme, _, _ := strings.Cut(opts.Upload, "://")
+		path, err := exec.LookPath(uploadTools[scheme])
+		check("upload", err, fmt.Sprintf("%s to %s", path, uploadDestination(opts.Upload, "<run id>")))
+	}
+	if len(opts.EmailTo) > 0 {
+		conn, err := net.DialTimeout("tcp", opts.SMTP, 5*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		check("email", err, fmt.Sprintf("%s to %s", opts.SMTP, opts.EmailTo.String()))
+	}
+
+	if len(opts.Events) > 0 {
+		check("events", nil, fmt.Sprintf("%d patterns", len(opts.Events)))
+	}
+	if len(opts.MetricExprs) > 0 {
+		check("metrics", nil, fmt.Sprintf("%d expressions", len(opts.MetricExprs)))
+	}
+	if opts.Budget != nil {
+		check("budget", nil, fmt.Sprintf("%q from %s", opts.Budget.pattern, opts.Budgets))
+	}
+	if len(opts.ExpectFiles) > 0 {
+		check("expect-file", nil, fmt.Sprintf("%d files are checked after the run", len(opts.ExpectFiles)))
+	}
+
+	if ok {
+		fmt.Fprintf(os.Stderr, "[go-profile] Dry run passed\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "[go-profile] Dry run failed\n")
+	}
+	return ok
+}
+
+// W_OK of access(2)
+const accessWrite = 2
+
+// checkWritable returns an error if the file can not be created or appended
+// to, without creating it
+func checkWritable(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return syscall.Access(path, accessWrite)
+	}
+	dir := filepath.Dir(path)
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	return nil
+}
+
+// checkSandbox creates the namespaces of --unshare once, to see if the
+// kernel allows it
+func checkSandbox(namespaces namespaceList) error {
+	// go-profile -h exits with 0, the path of the binary may be hidden by
+	// the private /tmp
+	command, attr, err := sandboxCommand([]string{"/proc/self/exe", "-h"}, namespaces, nil)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.SysProcAttr = attr
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The SMTP password is taken from the environment, so it doesn't end up in
+// the shell history and the run metadata
+const smtpPasswordEnv = "GO_PROFILE_SMTP_PASSWORD"
+
+// emailSubject is e.g. "[go-profile] make test failed (exit code 2) in 1m3s"
+func emailSubject(summary *Summary, failed bool) string {
+	command := strings.Join(summary.Command, " ")
+	if len(command) > 60 {
+		command = command[:57] + "..."
+	}
+	status := "finished"
+	if failed {
+		status = fmt.Sprintf("failed (exit code %d)", summary.ExitCode)
+	}
+	return fmt.Sprintf("[go-profile] %s %s in %s", command, status, summary.Duration.Round(time.Second))
+}
+
+// buildEmail returns the message with the printed summary as the text and
+// the HTML report (if any) attached
+func buildEmail(from string, to []string, subject string, summary *Summary, report string) ([]byte, error) {
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "Command: %s\n\n", strings.Join(summary.Command, " "))
+	summary.print(func(format string, a ...interface{}) {
+		fmt.Fprintf(&text, format+"\n", a...)
+	})
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write(text.Bytes())
+	qp.Close()
+
+	if report != "" {
+		data, err := os.ReadFile(report)
+		if err != nil {
+			return nil, err
+		}
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/html; charset=utf-8"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filepath.Base(report))},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Lines of base64 are limited to 76 characters
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// sendEmail mails the summary of the run to --email-to through the --smtp
+// server, STARTTLS is used when the server offers it
+func sendEmail(opts *Options, summary *Summary, failed bool) error {
+	from := opts.EmailFrom
+	if from == "" {
+		host, _ := os.Hostname()
+		from = "go-profile@" + host
+	}
+	report := ""
+	if _, err := os.Stat(opts.HTML); opts.HTML != "" && err == nil {
+		report = opts.HTML
+	}
+	message, err := buildEmail(from, opts.EmailTo, emailSubject(summary, failed), summary, report)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if opts.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(opts.SMTP)
+		auth = smtp.PlainAuth("", opts.SMTPUser, os.Getenv(smtpPasswordEnv), host)
+	}
+	return smtp.SendMail(opts.SMTP, auth, from, opts.EmailTo, message)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Package domains of RAPL, the subdomains (intel-rapl:0:0, core and
+// uncore) are part of their package
+var raplPackages = "/sys/class/powercap/intel-rapl:[0-9]*"
+
+// raplZone is the energy counter of a CPU package in microjoules
+type raplZone struct {
+	name   string
+	path   string
+	energy counter
+}
+
+// raplCounters reads the energy the CPU packages consumed, system wide
+type raplCounters struct {
+	zones []*raplZone
+}
+
+// newRAPLCounters returns nil without readable RAPL counters (AMD before
+// Zen, virtual machines, or not root since Linux 5.10)
+func newRAPLCounters() *raplCounters {
+	paths, _ := filepath.Glob(raplPackages)
+	counters := &raplCounters{}
+	for _, path := range paths {
+		// Skip the subdomains matched by the glob
+		if strings.Count(filepath.Base(path), ":") != 1 {
+			continue
+		}
+		energy, err := readMicrojoules(filepath.Join(path, "energy_uj"))
+		if err != nil {
+			continue
+		}
+		zone := &raplZone{path: path}
+		zone.name, _ = readSysctl(filepath.Join(path, "name"))
+		// The counter wraps around at the end of its range
+		zone.energy.wrap, _ = readMicrojoules(filepath.Join(path, "max_energy_range_uj"))
+		zone.energy.rate(time.Now(), energy)
+		counters.zones = append(counters.zones, zone)
+	}
+	if len(counters.zones) == 0 {
+		return nil
+	}
+	return counters
+}
+
+func (c *raplCounters) names() []string {
+	var names []string
+	for _, zone := range c.zones {
+		names = append(names, zone.name)
+	}
+	return names
+}
+
+// sample returns the power of the CPU packages in watts since the previous
+// sample
+func (c *raplCounters) sample(now time.Time) float64 {
+	var watts float64
+	for _, zone := range c.zones {
+		energy, err := readMicrojoules(filepath.Join(zone.path, "energy_uj"))
+		if err != nil {
+			continue
+		}
+		if microwatts, ok := zone.energy.rate(now, energy); ok {
+			watts += microwatts / 1e6
+		}
+	}
+	return watts
+}
+
+func readMicrojoules(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// EnergySummary is the energy the CPU packages (RAPL) and the GPUs consumed
+// during the run in joules, system wide
+type EnergySummary struct {
+	CPU   float64 `json:"cpu"`
+	GPU   float64 `json:"gpu"`
+	Total float64 `json:"total"`
+	// Average power draw in watts
+	Power float64 `json:"power"`
+
+	// Energy per unit of work of the --event patterns
+	PerEvent []EnergyPerEvent `json:"per_event,omitempty"`
+}
+
+// EnergyPerEvent is the energy per unit of an event, the units are the
+// sum of the event's numbers when its pattern has a group (e.g. items) and
+// its count otherwise (e.g. epochs or requests)
+type EnergyPerEvent struct {
+	Event   string  `json:"event"`
+	Units   float64 `json:"units"`
+	PerUnit float64 `json:"joules_per_unit"`
+}
+
+func (e *EnergySummary) String() string {
+	return fmt.Sprintf("%s (CPU: %s, GPU: %s), average power: %.1f W",
+		formatJoules(e.Total), formatJoules(e.CPU), formatJoules(e.GPU), e.Power)
+}
+
+// formatJoules formats energy with a metric prefix, e.g. "12.3 kJ"
+func formatJoules(joules float64) string {
+	switch {
+	case joules >= 1e6:
+		return fmt.Sprintf("%.2f MJ", joules/1e6)
+	case joules >= 1e3:
+		return fmt.Sprintf("%.2f kJ", joules/1e3)
+	default:
+		return fmt.Sprintf("%.2f J", joules)
+	}
+}
+
+// energyTracker integrates the power of the samples over time
+type energyTracker struct {
+	last     time.Time
+	cpu, gpu float64
+	elapsed  time.Duration
+	sampled  bool
+}
+
+func (t *energyTracker) add(now time.Time, stats Stats) {
+	if stats.CpuPower == 0 && stats.GpuPower == 0 {
+		t.last = time.Time{}
+		return
+	}
+	if !t.last.IsZero() {
+		elapsed := now.Sub(t.last)
+		t.cpu += stats.CpuPower * elapsed.Seconds()
+		t.gpu += stats.GpuPower * elapsed.Seconds()
+		t.elapsed += elapsed
+		t.sampled = true
+	}
+	t.last = now
+}
+
+// result returns nil without power readings
+func (t *energyTracker) result(events []EventSummary) *EnergySummary {
+	if !t.sampled {
+		return nil
+	}
+	summary := &EnergySummary{CPU: t.cpu, GPU: t.gpu, Total: t.cpu + t.gpu}
+	summary.Power = summary.Total / t.elapsed.Seconds()
+	for _, event := range events {
+		units := event.Sum
+		if units == 0 {
+			units = float64(event.Count)
+		}
+		if units > 0 {
+			summary.PerEvent = append(summary.PerEvent, EnergyPerEvent{Event: event.Name, Units: units, PerUnit: summary.Total / units})
+		}
+	}
+	return summary
+}
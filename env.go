@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envList collects repeated --env KEY=VALUE flags in the order they were
+// given
+type envList []string
+
+func (e *envList) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *envList) Set(value string) error {
+	key, _, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+// envFileList collects the variables of repeated --env-file flags, the
+// files are read when the flag is parsed so errors show up before the run
+type envFileList struct {
+	paths []string
+	env   []string
+}
+
+func (e *envFileList) String() string {
+	return strings.Join(e.paths, ",")
+}
+
+func (e *envFileList) Set(path string) error {
+	env, err := readEnvFile(path)
+	if err != nil {
+		return err
+	}
+	e.paths = append(e.paths, path)
+	e.env = append(e.env, env...)
+	return nil
+}
+
+// readEnvFile reads KEY=VALUE lines, like those of docker --env-file and
+// systemd EnvironmentFile: blank lines and # comments are skipped, an
+// "export " prefix is allowed and quoted values are unquoted
+func readEnvFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, number)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				} else {
+					value = value[1 : len(value)-1]
+				}
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, scanner.Err()
+}
+
+// commandEnv is the environment of the command: go-profile's, the login
+// variables of --user, the variables of --env-file and --env (later ones take precedence) and
+// GO_PROFILE_RUN_ID, so the command can label what it writes with the run
+func commandEnv(opts *Options, runID string) []string {
+	env := append(os.Environ(), opts.RunAs.env()...)
+	env = append(env, opts.EnvFiles.env...)
+	env = append(env, opts.Env...)
+	env = append(env, "GO_PROFILE_RUN_ID="+runID)
+	if opts.RunDir != "" {
+		env = append(env, "GO_PROFILE_RUN_DIR="+opts.RunDir)
+	}
+	return dedupEnv(env)
+}
+
+// dedupEnv keeps the last value of every variable, exec.Cmd does that
+// itself but execve passes the duplicates on and getenv finds the first
+func dedupEnv(env []string) []string {
+	index := map[string]int{}
+	var result []string
+	for _, variable := range env {
+		key, _, _ := strings.Cut(variable, "=")
+		if i, ok := index[key]; ok {
+			result[i] = variable
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, variable)
+	}
+	return result
+}
+
+// umaskValue is the file mode creation mask of the command (--umask), in
+// octal like the umask of the shell
+type umaskValue struct {
+	mask  int
+	isSet bool
+}
+
+func (u *umaskValue) String() string {
+	if !u.isSet {
+		return ""
+	}
+	return fmt.Sprintf("%04o", u.mask)
+}
+
+func (u *umaskValue) Set(value string) error {
+	mask, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mask > 0777 {
+		return fmt.Errorf("expected an octal mask, e.g. 022 or 0077")
+	}
+	*u = umaskValue{mask: int(mask), isSet: true}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eventPattern extracts an event from the command's output
+type eventPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// eventPatternList is a flag value for the repeated --event name=regex
+type eventPatternList []eventPattern
+
+func (e *eventPatternList) String() string {
+	var values []string
+	for _, pattern := range *e {
+		values = append(values, pattern.name+"="+pattern.re.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (e *eventPatternList) Set(value string) error {
+	name, pattern, ok := strings.Cut(value, "=")
+	if !ok || !isIdentifier(name) {
+		return fmt.Errorf("expected name=regex, got %q", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, eventPattern{name: name, re: re})
+	return nil
+}
+
+// EventSummary counts the output lines matching an --event pattern. When the
+// pattern has a group, the group is parsed as a number for the sum and last
+// value.
+type EventSummary struct {
+	Name  string  `json:"name"`
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Last  float64 `json:"last"`
+}
+
+// eventCounter matches the output lines of stdout and stderr
+type eventCounter struct {
+	mu       sync.Mutex
+	patterns []eventPattern
+	events   []EventSummary
+}
+
+// newEventCounter returns nil if there are no patterns
+func newEventCounter(patterns []eventPattern) *eventCounter {
+	if len(patterns) == 0 {
+		return nil
+	}
+	c := &eventCounter{patterns: patterns}
+	for _, pattern := range patterns {
+		c.events = append(c.events, EventSummary{Name: pattern.name})
+	}
+	return c
+}
+
+func (c *eventCounter) match(line string) {
+	if c == nil {
+		return
+	}
+	for i, pattern := range c.patterns {
+		match := pattern.re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		c.mu.Lock()
+		event := &c.events[i]
+		event.Count++
+		if len(match) > 1 {
+			if value, err := strconv.ParseFloat(match[1], 64); err == nil {
+				event.Sum += value
+				event.Last = value
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *eventCounter) result() []EventSummary {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]EventSummary(nil), c.events...)
+}
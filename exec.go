@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	go-profile exec [options] [--] <command> [arguments]
+
+	For container entrypoints: the command replaces go-profile (execve), so it
+	keeps the pid (1 in a container), receives the signals and its exit code
+	is the container's. A separate monitor process (go-profile monitor) is
+	started first and samples the command until it exits, so nothing of
+	go-profile runs inside the command's process.
+
+	Except when go-profile exec is pid 1 itself: the kernel kills everything
+	in the container when pid 1 exits, the monitor would go down with the
+	command before it wrote the summary. go-profile stays pid 1 then and
+	runs the command as its child like go-profile does without exec: it
+	forwards the signals, reaps the orphans and exits with the command's
+	exit code once the outputs are written.
+*/
+
+func execMain(args []string) {
+	// Validate the options before replacing ourselves
+	opts := parseOptions(args)
+	// The command is executed once, in place of go-profile
+	if opts.Runs > 1 {
+		fmt.Fprintf(os.Stderr, "[go-profile] --runs can not be combined with exec\n")
+		os.Exit(1)
+	}
+	// Unless go-profile is pid 1 the command replaces it, nothing is left
+	// in between to set these up
+	if os.Getpid() != 1 {
+		if unsupported := execUnsupported(opts); len(unsupported) > 0 {
+			fmt.Fprintf(os.Stderr, "[go-profile] %s can not be combined with exec\n", strings.Join(unsupported, ", "))
+			os.Exit(1)
+		}
+	}
+	if opts.DryRun {
+		byteUnits = opts.Units
+		if !dryRun(opts) {
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Getpid() == 1 {
+		initMain(opts)
+		return
+	}
+
+	// The monitor stays in the working directory, the relative paths of
+	// the outputs are relative to it
+	wd, _ := os.Getwd()
+	if opts.Chdir != "" {
+		if err := os.Chdir(opts.Chdir); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to change directory: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	path, err := exec.LookPath(opts.Command[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to find command: %s\n", err)
+		os.Exit(127)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		self = "/proc/self/exe"
+	}
+	// The monitor profiles the run, the command gets its run ID up front
+	runID := newRunID(time.Now())
+	// Our options follow the --, they are not the monitor's own flags
+	monitorArgs := append([]string{"monitor", "--pid", strconv.Itoa(os.Getpid()), "--run-id", runID, "--"}, args...)
+	monitor := exec.Command(self, monitorArgs...)
+	monitor.Stdout = os.Stdout
+	monitor.Stderr = os.Stderr
+	monitor.Dir = wd
+	// Own session, so a Ctrl+C for the command does not stop the monitor
+	monitor.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := monitor.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to start monitor: %s\n", err)
+		os.Exit(1)
+	}
+
+	// After the monitor started, its outputs keep our umask and it keeps
+	// running as root
+	if opts.Umask.isSet {
+		syscall.Umask(opts.Umask.mask)
+	}
+	if err := opts.RunAs.switchUser(); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to switch to --user: %s\n", err)
+		monitor.Process.Kill()
+		os.Exit(126)
+	}
+	// The filter is per thread, the command is executed from this one
+	runtime.LockOSThread()
+	if err := harden(opts.NoNewPrivs, opts.Seccomp); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to harden the command: %s\n", err)
+		monitor.Process.Kill()
+		os.Exit(126)
+	}
+	err = syscall.Exec(path, opts.Command, commandEnv(opts, runID))
+	fmt.Fprintf(os.Stderr, "[go-profile] Failed to execute command: %s\n", err)
+	monitor.Process.Kill()
+	os.Exit(126)
+}
+
+// execUnsupported returns the options that need go-profile to start the
+// command as its child
+func execUnsupported(opts *Options) []string {
+	var unsupported []string
+	if len(opts.Unshare) > 0 {
+		// The namespaces are set up by go-profile sandbox-init
+		unsupported = append(unsupported, "--unshare")
+	}
+	if opts.Syscalls {
+		// strace starts the command
+		unsupported = append(unsupported, "--syscalls")
+	}
+
+	// The output of the command goes straight to the container's, these
+	// work on the captured output
+	outputOptions := []struct {
+		name string
+		set  bool
+	}{
+		{"--redact", len(opts.Redact) > 0},
+		{"--drop", len(opts.Drop) > 0},
+		{"--severity", opts.Severity},
+		{"--max-output-lines-per-sec", opts.MaxOutputLinesPerSec > 0},
+		{"--event", len(opts.Events) > 0},
+		{"--phase", len(opts.Phases) > 0},
+		{"--start-when", opts.StartWhen.re != nil},
+		{"--stop-when", opts.StopWhen.re != nil},
+	}
+	for _, option := range outputOptions {
+		if option.set {
+			unsupported = append(unsupported, option.name)
+		}
+	}
+	return unsupported
+}
+
+// initMain profiles the command as pid 1 of a container
+func initMain(opts *Options) {
+	byteUnits = opts.Units
+	if err := becomeSubreaper(); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to become a subreaper: %s\n", err)
+	}
+	forwardSignals()
+	go reapOrphans()
+	summary, err := profileRun(opts)
+	if summary != nil && summary.ExitCode > 0 {
+		os.Exit(summary.ExitCode)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// monitorMain profiles a command started by execMain
+func monitorMain(args []string) {
+	flags := flag.NewFlagSet("go-profile monitor", flag.ExitOnError)
+	pid := flags.Int("pid", 0, "`pid` of the command to profile")
+	runID := flags.String("run-id", "", "`id` of the run, as given to the command")
+	flags.Parse(args)
+	if *pid <= 0 {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile monitor --pid <pid> [options] <command> [arguments]\n")
+		os.Exit(1)
+	}
+
+	opts := parseOptions(flags.Args())
+	opts.AttachPid = *pid
+	opts.RunID = *runID
+	profileMain(opts)
+}
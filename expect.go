@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// fileExpectation is a file the command should produce
+type fileExpectation struct {
+	path    string
+	minSize uint64
+}
+
+// expectFileList is a flag value for the repeated --expect-file path[:size]
+type expectFileList []fileExpectation
+
+func (e *expectFileList) String() string {
+	var values []string
+	for _, expectation := range *e {
+		values = append(values, expectation.path)
+	}
+	return strings.Join(values, ",")
+}
+
+func (e *expectFileList) Set(value string) error {
+	expectation := fileExpectation{path: value}
+	// The size is optional and the path can contain colons
+	if i := strings.LastIndexByte(value, ':'); i > 0 {
+		if size, err := humanize.ParseBytes(value[i+1:]); err == nil {
+			expectation = fileExpectation{path: value[:i], minSize: size}
+		}
+	}
+	if expectation.path == "" {
+		return fmt.Errorf("empty path")
+	}
+	*e = append(*e, expectation)
+	return nil
+}
+
+// ExpectedFile is the result of an --expect-file check
+type ExpectedFile struct {
+	Path    string `json:"path"`
+	MinSize uint64 `json:"min_size,omitempty"`
+	Size    uint64 `json:"size"`
+	OK      bool   `json:"ok"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// checkExpectedFiles checks that every file exists, has the minimum size and
+// was modified after start
+func checkExpectedFiles(expectations []fileExpectation, start time.Time) []ExpectedFile {
+	var results []ExpectedFile
+	for _, expectation := range expectations {
+		result := ExpectedFile{Path: expectation.path, MinSize: expectation.minSize}
+		info, err := os.Stat(expectation.path)
+		switch {
+		case err != nil:
+			result.Problem = "missing"
+		case info.IsDir():
+			result.Problem = "is a directory"
+		case info.ModTime().Before(start):
+			result.Size = uint64(info.Size())
+			result.Problem = "not written during the run (modified " + info.ModTime().Format(time.StampMilli) + ")"
+		case uint64(info.Size()) < expectation.minSize:
+			result.Size = uint64(info.Size())
+			result.Problem = "too small (" + formatBytes(result.Size) + ")"
+		default:
+			result.Size = uint64(info.Size())
+			result.OK = true
+		}
+		results = append(results, result)
+	}
+	return results
+}
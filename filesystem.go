@@ -0,0 +1,104 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+type FilesystemUsage = profileio.FilesystemUsage
+
+// getFilesystemUsage returns the usage of the filesystem containing path
+func getFilesystemUsage(path string) (FilesystemUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return FilesystemUsage{}, err
+	}
+
+	blockSize := uint64(stat.Bsize)
+	used := (stat.Blocks - stat.Bfree) * blockSize
+	available := stat.Bavail * blockSize
+	usage := FilesystemUsage{
+		Path:  path,
+		Total: stat.Blocks * blockSize,
+		Used:  used,
+	}
+	// Same as df, reserved blocks don't count as available
+	if used+available > 0 {
+		usage.Percent = float64(used) / float64(used+available) * 100.0
+	}
+	return usage, nil
+}
+
+type FilesystemSummary struct {
+	Path        string  `json:"path"`
+	Start       uint64  `json:"start"`
+	End         uint64  `json:"end"`
+	Peak        uint64  `json:"peak"`
+	PeakPercent float64 `json:"peak_percent"`
+	Growth      int64   `json:"growth"`
+}
+
+type filesystemTracker struct {
+	summary FilesystemSummary
+	sampled bool
+	warned  bool
+}
+
+// filesystemTrackers follows the usage of a set of mount points over the run
+type filesystemTrackers struct {
+	trackers    []*filesystemTracker
+	warnPercent float64
+}
+
+func newFilesystemTrackers(paths []string, warnPercent float64) *filesystemTrackers {
+	f := &filesystemTrackers{warnPercent: warnPercent}
+	for _, path := range paths {
+		f.trackers = append(f.trackers, &filesystemTracker{summary: FilesystemSummary{Path: path}})
+	}
+	return f
+}
+
+// sample reads the current usage and warns (once per crossing) when a
+// filesystem goes above the warning threshold
+func (f *filesystemTrackers) sample(logPrintf func(format string, a ...interface{})) []FilesystemUsage {
+	var usages []FilesystemUsage
+	for _, tracker := range f.trackers {
+		usage, err := getFilesystemUsage(tracker.summary.Path)
+		if err != nil {
+			continue
+		}
+		usages = append(usages, usage)
+
+		s := &tracker.summary
+		if !tracker.sampled {
+			s.Start = usage.Used
+			tracker.sampled = true
+		}
+		s.End = usage.Used
+		s.Growth = int64(s.End) - int64(s.Start)
+		s.Peak = max(s.Peak, usage.Used)
+		s.PeakPercent = max(s.PeakPercent, usage.Percent)
+
+		if usage.Percent >= f.warnPercent && !tracker.warned {
+			logPrintf("WARNING: filesystem %s is %.2f%% full (%s free)",
+				usage.Path,
+				usage.Percent,
+				formatBytes(usage.Total-usage.Used))
+			tracker.warned = true
+		} else if usage.Percent < f.warnPercent {
+			tracker.warned = false
+		}
+	}
+	return usages
+}
+
+func (f *filesystemTrackers) summaries() []FilesystemSummary {
+	var summaries []FilesystemSummary
+	for _, tracker := range f.trackers {
+		if tracker.sampled {
+			summaries = append(summaries, tracker.summary)
+		}
+	}
+	return summaries
+}
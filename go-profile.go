@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"os"
@@ -9,15 +8,19 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
-	"github.com/dustin/go-humanize"
-	nvidiasmijson "github.com/fffaraz/nvidia-smi-json"
+	"github.com/mrexodia/go-profile/profileio"
 )
 
 type CPUTime struct {
 	idle  uint64
 	total uint64
+	// Time the hypervisor ran other guests while we wanted to run
+	steal uint64
 }
 
 type MemoryInfo struct {
@@ -28,75 +31,539 @@ type MemoryInfo struct {
 	Cached    uint64
 }
 
-type Stats struct {
-	CpuPercent float64
-	MemUsed    uint64
-	MemTotal   uint64
-	MemPercent float64
-	GpuPercent float64
-}
+type Stats = profileio.Stats
+
+// stdoutWriter is shared between the mirrored command output and the stream
+var stdoutWriter = &syncWriter{w: os.Stdout}
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: go-profile <command> [arguments]\n")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serveMain(os.Args[2:])
+			return
+		case "report":
+			reportMain(os.Args[2:])
+			return
+		case "export":
+			exportMain(os.Args[2:])
+			return
+		case "query":
+			queryMain(os.Args[2:])
+			return
+		case "doctor":
+			doctorMain(os.Args[2:])
+			return
+		case "exec":
+			execMain(os.Args[2:])
+			return
+		case "monitor":
+			monitorMain(os.Args[2:])
+			return
+		case "coordinate":
+			coordinateMain(os.Args[2:])
+			return
+		case "sandbox-init":
+			sandboxInitMain(os.Args[2:])
+			return
+		case "harden":
+			hardenMain(os.Args[2:])
+			return
+		}
+	}
+
+	profileMain(parseOptions(os.Args[1:]))
+}
+
+// profileMain profiles the command and writes the requested outputs, it
+// exits with 1 if the command failed
+func profileMain(opts *Options) {
+	byteUnits = opts.Units
+	// An attached process runs once, it can not be restarted for the
+	// benchmark
+	if opts.AttachPid != 0 && opts.Runs > 1 {
+		fmt.Fprintf(os.Stderr, "[go-profile] --pid can not be combined with --runs\n")
+		os.Exit(1)
+	}
+	if opts.DryRun {
+		if !dryRun(opts) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.AttachPid == 0 {
+		if err := becomeSubreaper(); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to become a subreaper: %s\n", err)
+		}
+	}
+	forwardSignals()
+	if opts.Runs > 1 {
+		benchmarkMain(opts)
+		return
+	}
+	if _, err := profileRun(opts); err != nil {
 		os.Exit(1)
 	}
+}
+
+// profileRun profiles the command once and writes the requested outputs
+func profileRun(opts *Options) (*Summary, error) {
+	start := time.Now()
+	runID := opts.RunID
+	if runID == "" {
+		runID = newRunID(start)
+	}
+
+	if opts.RunsDir != "" {
+		if opts.UTC {
+			start = start.UTC()
+		}
+		dir, err := createRunDir(opts.RunsDir, start, opts.Command[0])
+		if dir == "" {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to create the run directory: %s\n", err)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to link the latest run: %s\n", err)
+		}
+		opts.inRunDir(dir)
+		if err := writeRunMetadata(dir, newRunMetadata(opts, runID, start)); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write the run metadata: %s\n", err)
+		}
+		if opts.KeepRuns > 0 || opts.KeepDays > 0 {
+			removed, err := pruneRuns(opts.RunsDir, dir, opts.KeepRuns, time.Duration(opts.KeepDays)*24*time.Hour)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[go-profile] Failed to remove old runs: %s\n", err)
+			}
+			if len(removed) > 0 {
+				fmt.Fprintf(os.Stderr, "[go-profile] Removed %d old runs from %s\n", len(removed), opts.RunsDir)
+			}
+		}
+	}
+
+	// Every sample is passed to each of the sinks
+	var sinks sinkMux
+	for _, output := range opts.Outputs {
+		sink, err := openSink(output)
+		if err != nil {
+			sinks.close()
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to open output %s: %s\n", output, err)
+			os.Exit(1)
+		}
+		if sink != nil {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	for _, output := range opts.Outputs {
+		if output.format != "prometheus" || opts.Grafana == "" {
+			continue
+		}
+		dashboard := newGrafanaDashboard(opts.Command, runID, opts.TagMap())
+		if err := writeGrafanaDashboard(opts.Grafana, dashboard); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write the Grafana dashboard: %s\n", err)
+		}
+		break
+	}
 
+	if opts.MetricsLog != "" {
+		sink, err := openMetricsLog(opts.MetricsLog, opts.Compress)
+		if err != nil {
+			sinks.close()
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to open metrics log: %s\n", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	// Keep the samples in memory for the chart and the report
+	memory := &memorySink{}
+	if opts.Chart != "" || opts.HTML != "" {
+		sinks = append(sinks, memory)
+	}
+
+	var onSample func(Sample)
+	if len(sinks) > 0 && opts.Downsample > 0 {
+		sinks = sinkMux{&downsampleSink{sink: sinks, interval: opts.Downsample}}
+	}
+	if len(sinks) > 0 {
+		onSample = sinks.write
+	}
+
+	hooks := newHooks(opts, runID)
+	if err := hooks.start(newRunMetadata(opts, runID, start)); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Hook failed: %s\n", err)
+	}
+
+	summary, err := profile(opts, runID, onSample)
+	if err := sinks.close(); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to write output: %s\n", err)
+	}
+	samples := memory.samples
+	if summary != nil && opts.SummaryJSON != "" {
+		if err := writeSummaryJSON(opts.SummaryJSON, summary); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write summary: %s\n", err)
+		}
+	}
+	if summary != nil && opts.Chart != "" {
+		if err := writeChart(opts.Chart, samples); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write chart: %s\n", err)
+		}
+	}
+	if summary != nil && opts.HTML != "" {
+		if err := writeHTMLReport(opts.HTML, summary, samples, opts.Bucket); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write HTML report: %s\n", err)
+		}
+	}
+	if opts.Upload != "" {
+		destination, err := uploadRun(opts.Upload, opts.RunDir, runID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to upload the run: %s\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "[go-profile] Uploaded the run to %s\n", destination)
+		}
+	}
+	if summary != nil && len(opts.EmailTo) > 0 && (err != nil || opts.EmailOn == "always") {
+		if err := sendEmail(opts, summary, err != nil); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to send the email: %s\n", err)
+		}
+	}
+	for _, err := range hooks.finish(summary, err != nil) {
+		fmt.Fprintf(os.Stderr, "[go-profile] Hook failed: %s\n", err)
+	}
+	return summary, err
+}
+
+// profile runs the command from opts while sampling the system, onSample
+// (if set) is called for every tick. The returned summary is nil if the
+// command could not be started.
+func profile(opts *Options, runID string, onSample func(Sample)) (*Summary, error) {
 	// Channel to signal when the command has finished
 	done := make(chan struct{})
+	tickerDone := make(chan struct{})
 
 	// CPU usage statistics
 	prev, err := getCPUTime()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[go-profile] Failed to get CPU time: %s\n", err)
-		os.Exit(1)
+		return nil, err
+	}
+
+	// Recorded samples to replay instead of running the command
+	var replay []Sample
+	var recorded *profileio.Summary
+	if opts.Replay != "" {
+		if replay, recorded, err = readReplay(opts.Replay); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to read the samples to replay: %s\n", err)
+			return nil, err
+		}
 	}
 
 	// Aggregate statistics
-	totalTicks := uint64(0)
-	minCpu, maxCpu, sumCpu := 100.0, 0.0, 0.0
-	minRam, maxRam, sumRam := ^uint64(0), uint64(0), uint64(0)
-	minGpu, maxGpu, sumGpu := 100.0, 0.0, 0.0
+	var cpuAgg, ramAgg, gpuAgg, rssAgg, pssAgg, ussAgg aggregator
+	cores := &coreUsage{}
+	clusters := newClusterTracker()
+	stealTime := &stealTracker{threshold: opts.StealWarnPercent}
+	anomalies := newAnomalyDetector(opts.GpuIdleGap, opts.GpuIdleThreshold)
+	gpuIdle := &gpuIdleTracker{threshold: opts.GpuIdleThreshold}
+	energy := &energyTracker{}
+	leak := &leakEstimator{}
+	steady := newSteadyStateTracker(opts.SteadyState)
+	childCPU := &processCPU{}
+	childIO := &counter{}
+	var goRuntime *goMetrics
+	if opts.GoMetrics != "" {
+		goRuntime = newGoMetrics(opts.GoMetrics)
+	}
+	var pythonStacks *pySpy
+	if opts.PySpy {
+		pythonStacks = &pySpy{}
+	}
+	var jvm *jvmMetrics
+	if opts.JMX != "" {
+		jvm = newJVMMetrics(opts.JMX)
+	}
+	startup := &startupTracker{}
+	stamps := newTimestampFormat(opts)
+	phases := newPhaseTracker(opts.Phases, stamps)
+	rolling := newRollingSummary(opts.RollingSummary, runID)
+	mpi := newMPITracker(opts.Command)
+	cores.sample()
+	var childGpuAgg, childGpuMemAgg aggregator
+	var pcieTxAgg, pcieRxAgg, nvlinkTxAgg, nvlinkRxAgg aggregator
+	var ibTxAgg, ibRxAgg aggregator
+	filesystems := newFilesystemTrackers(opts.Filesystems, opts.FsWarnPercent)
+	directories := newDirectoryWatcher(opts.WatchDirs, opts.WatchDepth)
+	sockets := &socketTracker{}
+	var netRxAgg, netTxAgg aggregator
+	var capture *netCapture
+	// The captured totals start at 0 with the capture
+	var netRx, netTx counter
+	netRx.rate(time.Now(), 0)
+	netTx.rate(time.Now(), 0)
+	heartbeats := 0
+
+	// Pid of the command once it has started
+	var childPid atomic.Int64
 
 	// Create the log file (append)
-	log, err := os.OpenFile("go-profile.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0644)
+	logPath := opts.LogPath
+	if logPath == "" {
+		logPath = "output.log"
+	}
+	log, err := openLogWriter(logPath, opts.SyncLog, opts.Compress)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[go-profile] Failed to open log file: %s\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 	defer log.Close()
 
+	var tickFormat *template.Template
+	if opts.Format != "" {
+		if tickFormat, err = parseTickFormat(opts.Format); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Invalid --format: %s\n", err)
+			return nil, err
+		}
+	}
+
+	// Combined timeline (optional)
+	var events *timeline
+	if opts.Timeline != "" {
+		events, err = createTimeline(opts.Timeline, opts.SyncLog, stamps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to create timeline: %s\n", err)
+			return nil, err
+		}
+		defer events.close()
+	}
+
+	formatLine := func(message string) string {
+		return fmt.Sprintf("[%s][go-profile] %s\n",
+			stamps.format(time.Now()),
+			message)
+	}
+	// logLine writes a message to the log and, unless terminal is false,
+	// to stderr, it returns the offset of the line in the log
+	logLine := func(terminal bool, message string) int64 {
+		str := formatLine(message)
+		offset, _, _ := log.writeAt([]byte(str))
+		if terminal {
+			os.Stderr.WriteString(str)
+		}
+		events.record("go-profile", message, nil)
+		return offset
+	}
+	// Only the summary is printed to the terminal with --summary-only
+	var muted atomic.Bool
+	muted.Store(opts.SummaryOnly)
 	logPrintf := func(format string, a ...interface{}) {
-		str := fmt.Sprintf("[%s][go-profile] %s\n",
-			time.Now().Format(time.StampMilli),
-			fmt.Sprintf(format, a...))
-		log.WriteString(str)
-		os.Stderr.WriteString(str)
+		logLine(!muted.Load(), fmt.Sprintf(format, a...))
 	}
 
+	tags := opts.TagMap()
+	alertHooks := newHooks(opts, runID)
+	outputLines := newOutputTail(snapshotOutputLines)
+	snapshots := newSnapshotter(&childPid, outputLines, stamps, logPrintf)
+	stacks := newStackSampler(opts.StackOnCPU, events, logPrintf)
+	breakdown := newProcessBreakdown(opts.ProcessBreakdown)
+	alerts := newAlertEngine(opts.Alerts, func(message string, event AlertEvent) {
+		logPrintf("%s", message)
+		alertHooks.alert(message, event, logPrintf)
+		if event.Open && opts.Replay == "" {
+			snapshots.background("alert " + event.Condition)
+		}
+	})
+	gate := newMeasurementGate(opts, stamps, logPrintf)
+	stopSignals := gate.listen()
+	defer stopSignals()
+
+	// Offsets of the run in the log for the index
+	index := logIndexEntry{RunID: runID}
+
 	log.WriteString("\n")
-	logPrintf("=========================================")
-	logPrintf("Starting command: %s", strings.Join(os.Args[1:], " "))
+	index.Start = log.mark()
+	logPrintf(runMarker)
+	logPrintf("Starting command: %s", strings.Join(opts.Command, " "))
+	logPrintf("Run ID: %s", runID)
+	if opts.RunDir != "" {
+		logPrintf("Run directory: %s", opts.RunDir)
+	}
+	if len(opts.Tags) > 0 {
+		logPrintf("Tags: %s", opts.Tags.String())
+	}
+	if len(opts.GPUs) > 0 {
+		logPrintf("Sampling GPUs: %s", strings.Join(opts.GPUs, ","))
+	}
+
+	// Frequency scaling, it is restored before the summary is printed
+	var cpufreqWrites sysfsWrites
+	restoreCPUFreq := func() {
+		if err := cpufreqWrites.restore(); err != nil {
+			logPrintf("Failed to restore the CPU frequency settings: %s", err)
+		}
+	}
+	defer restoreCPUFreq()
+	if opts.Governor != "" || opts.Turbo != turboUnchanged {
+		if err := setCPUFreq(opts.Governor, opts.Turbo, &cpufreqWrites); err != nil {
+			logPrintf("Failed to change the CPU frequency settings: %s", err)
+		}
+	}
+	cpufreq := readCPUFreq()
+	if cpufreq != nil {
+		logPrintf("CPU frequency scaling: %s", cpufreq)
+	}
+
+	clock := getClockInfo()
+	logPrintf("Clock source: %s, resolution: %s, sleep resolution: %s", clock.Source, clock.Resolution, clock.SleepResolution.Round(time.Microsecond))
+	if clock.Sync != nil {
+		logPrintf("Clock offset: %s", clock.Sync)
+	}
+	slurm := getSlurmJob()
+	if slurm != nil {
+		logPrintf("SLURM %s", describeSlurmJob(slurm))
+	}
+	slurmTasks := newSlurmTracker(slurm)
+
+	if opts.NetCapture {
+		capture, err = startNetCapture(opts.NetAudit)
+		if err != nil {
+			logPrintf("Network capture unavailable (requires CAP_NET_RAW): %s", err)
+		} else {
+			defer capture.close()
+		}
+	}
+
+	if goRuntime != nil {
+		logPrintf("Sampling Go runtime metrics: %s/debug/vars", goRuntime.base)
+	}
+
+	if jvm != nil {
+		logPrintf("Sampling JMX metrics through Jolokia: %s", jvm.base)
+	}
+
+	var accelerators []Accelerator
+	var infiniband *infinibandCounters
+	var rapl *raplCounters
+	if opts.Replay == "" {
+		accelerators = detectAccelerators(opts)
+		infiniband = newInfinibandCounters()
+		rapl = newRAPLCounters()
+	}
+	for _, accelerator := range accelerators {
+		logPrintf("Sampling accelerator: %s", accelerator.Name())
+	}
+	if infiniband != nil {
+		logPrintf("Sampling InfiniBand ports: %s", strings.Join(infiniband.names(), ", "))
+	}
+	if rapl != nil {
+		logPrintf("Sampling RAPL energy: %s", strings.Join(rapl.names(), ", "))
+	}
+	gpuFaults := newGPUFaultMonitor(accelerators, opts.GPUs)
+	if gpuFaults != nil {
+		gpuFaults.start(done, logPrintf)
+	}
 
 	// Start the ticker in the background
 	tick := time.Millisecond * 250
+	if tick < clock.minInterval() {
+		logPrintf("WARNING: the sampling interval %s is below what the clock can reliably deliver (%s)", tick, clock.minInterval().Round(time.Microsecond))
+	}
 	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
+	if opts.Replay == "" {
+		stopSnapshots := snapshots.listen()
+		defer stopSnapshots()
+	}
+	if opts.Interactive && opts.Replay == "" && opts.AttachPid == 0 {
+		keyboard := startKeyboardControl(gate, ticker, tick, snapshots, events, stamps, logPrintf)
+		defer keyboard.stop()
+	}
 
-	go func() {
+	// measure aggregates a sample and checks it for alerts and anomalies,
+	// running is false before the command started
+	measure := func(now time.Time, stats Stats, running bool, stolen time.Duration) {
+		cpuAgg.add(stats.CpuPercent)
+		stealTime.add(stats.CpuStealPercent, stolen)
+		ramAgg.add(float64(stats.MemUsed))
+		if running {
+			rssAgg.add(float64(stats.ChildRSS))
+			if stats.ChildPSS > 0 {
+				pssAgg.add(float64(stats.ChildPSS))
+				ussAgg.add(float64(stats.ChildUSS))
+			}
+			leak.add(now, stats.ChildRSS)
+			rolling.add(now, stats, logPrintf)
+		}
+		if stats.GpuCount > 0 {
+			gpuAgg.add(stats.GpuPercent)
+			childGpuAgg.add(stats.ChildGpuPercent)
+			childGpuMemAgg.add(float64(stats.ChildGpuMemUsed))
+			pcieTxAgg.add(float64(stats.GpuPcieTx))
+			pcieRxAgg.add(float64(stats.GpuPcieRx))
+			nvlinkTxAgg.add(float64(stats.GpuNvlinkTx))
+			nvlinkRxAgg.add(float64(stats.GpuNvlinkRx))
+		}
+		ibTxAgg.add(float64(stats.IbTx))
+		ibRxAgg.add(float64(stats.IbRx))
+		if stats.Sockets != nil {
+			sockets.add(*stats.Sockets)
+		}
+		anomalies.add(now, stats)
+		alerts.add(Sample{Time: stamps.zone(now), RunID: runID, Stats: stats})
+		steady.add(stamps.since(now), stats, running)
+		gpuIdle.add(now, stats)
+		energy.add(now, stats)
+	}
+
+	// record measures a sample once the measurement started (--start-when,
+	// --start-after) and writes it to the outputs either way
+	record := func(now time.Time, stats Stats, running bool, stolen time.Duration) {
+		// The startup latency includes the setup
+		if running {
+			startup.add(now, stats.ChildCpuPercent)
+		}
+		if gate.measuring(now, running) {
+			measure(now, stats, running, stolen)
+		}
+
+		// The samples are in the metrics log, the log only has
+		// them with --combined-log
+		if !opts.SummaryOnly {
+			line := stamps.prefix(now) + formatTick(tickFormat, runID, stamps, now, stats)
+			if opts.CombinedLog {
+				index.Samples = append(index.Samples, logLine(!opts.Quiet, line))
+			} else if !opts.Quiet {
+				os.Stderr.WriteString(formatLine(line))
+			}
+		}
+		events.record("sample", "", &stats)
+
+		// Keep-alive for CI systems that kill silent jobs
+		if elapsed := stamps.since(now); opts.Heartbeat > 0 && running && elapsed >= time.Duration(heartbeats+1)*opts.Heartbeat {
+			logLine(true, fmt.Sprintf("Heartbeat %s | CPU:%.1f%% | RSS:%s", formatElapsed(elapsed), stats.ChildCpuPercent, formatBytes(stats.ChildRSS)))
+			heartbeats = int(elapsed / opts.Heartbeat)
+		}
+
+		if onSample != nil {
+			onSample(Sample{Schema: profileio.SchemaVersion, Time: stamps.zone(now), RunID: runID, Tags: tags, Stats: stats})
+		}
+	}
+
+	// sampleTicks collects a sample every tick until the run is done
+	sampleTicks := func() {
+		defer close(tickerDone)
 		for {
 			select {
 			case <-ticker.C:
-				totalTicks++
-
 				stats := Stats{}
-				usage, err := getCPUUsage(prev)
+				usage, steal, stolen, err := getCPUUsage(prev)
 				if err == nil {
 					stats.CpuPercent = usage * 100.0
+					stats.CpuStealPercent = steal * 100.0
 				}
-				minCpu = min(minCpu, stats.CpuPercent)
-				maxCpu = max(maxCpu, stats.CpuPercent)
-				sumCpu += stats.CpuPercent
+				stats.CpuCores = cores.sample()
+				clusters.add(cores.ids, stats.CpuCores)
 
 				memory, err := getMemoryInfo()
 				if err == nil {
@@ -106,142 +573,559 @@ func main() {
 					stats.MemTotal = memory.Total
 					stats.MemUsed = used
 				}
-				minRam = min(minRam, stats.MemUsed)
-				maxRam = max(maxRam, stats.MemUsed)
-				sumRam += stats.MemUsed
-
-				if nvidiasmijson.HasNvidiaSmi() {
-					log := nvidiasmijson.XmlToObject(nvidiasmijson.RunNvidiaSmi())
-					total := 0.0
-					for _, gpu := range log.GPUS {
-						s := strings.Split(gpu.GpuUtil, " ")
-						util, err := strconv.ParseFloat(s[0], 64)
-						if err != nil {
-							// Pretend the GPU is at 0% utilization
-							util = 0.0
+
+				// Process tree of the command, nil until it started
+				var pids []int
+				if pid := int(childPid.Load()); pid != 0 && opts.WaitForTree {
+					// Include the daemons that left the tree
+					pids = getProcessForest(append([]int{pid}, leftoverProcesses(pid)...))
+				} else if pid != 0 {
+					pids = getProcessTree(pid)
+				}
+
+				if pids != nil {
+					now := time.Now()
+					stats.ChildCpuPercent = childCPU.sample(now, pids)
+					stats.ChildCpuSeconds = childCPU.seconds()
+					childIO.delta(getProcessIO(pids))
+					stats.ChildIOBytes = childIO.total
+					pythonStacks.sample(now, stats.ChildCpuPercent, pids, logPrintf)
+					stacks.sample(now, pids)
+					breakdown.sample(pids)
+					stats.ChildRSS = getProcessRSS(pids)
+					leak.setProcesses(pids)
+					stats.ChildPSS, stats.ChildUSS = getProcessMemory(pids)
+				}
+
+				if len(accelerators) > 0 {
+					var readings []AcceleratorReading
+					for _, accelerator := range accelerators {
+						reading, err := accelerator.Sample(pids)
+						if err == nil {
+							readings = append(readings, reading)
 						}
-						total += util
 					}
-					stats.GpuPercent = total / float64(len(log.GPUS))
-					minGpu = min(minGpu, stats.GpuPercent)
-					maxGpu = max(maxGpu, stats.GpuPercent)
-					sumGpu += stats.GpuPercent
+
+					if len(readings) > 0 {
+						reading := combineReadings(readings)
+						stats.GpuPercent = reading.Util
+						stats.GpuCount = reading.Count
+						stats.ChildGpuPercent = reading.ChildUtil
+						stats.ChildGpuMemUsed = reading.ChildMemUsed
+						stats.GpuPcieTx = uint64(reading.HostTx)
+						stats.GpuPcieRx = uint64(reading.HostRx)
+						stats.GpuNvlinkTx = uint64(reading.PeerTx)
+						stats.GpuNvlinkRx = uint64(reading.PeerRx)
+						stats.GpuPower = reading.Power
+					}
 				}
 
-				// TODO: write to a separate log JSON?
-				logPrintf("CPU:%.2f%% | Memory:%.2f%% (%s/%s) | GPU:%.2f%%",
-					stats.CpuPercent,
-					stats.MemPercent,
-					humanize.IBytes(stats.MemUsed),
-					humanize.IBytes(stats.MemTotal),
-					stats.GpuPercent)
+				if pids != nil {
+					counts, err := getSocketCounts(pids)
+					if err == nil {
+						stats.Sockets = &counts
+					}
+				}
+
+				if capture != nil && pids != nil {
+					capture.update(pids)
+					rx, tx := capture.totals()
+					now := time.Now()
+					rxRate, _ := netRx.rate(now, rx)
+					txRate, _ := netTx.rate(now, tx)
+					stats.ChildNetRx = uint64(rxRate)
+					stats.ChildNetTx = uint64(txRate)
+					netRxAgg.add(float64(stats.ChildNetRx))
+					netTxAgg.add(float64(stats.ChildNetTx))
+				}
+
+				if goRuntime != nil && pids != nil {
+					runtimeStats, err := goRuntime.sample()
+					if err == nil {
+						stats.GoRuntime = runtimeStats
+					}
+				}
+
+				if jvm != nil && pids != nil {
+					jvmStats, err := jvm.sample()
+					if err == nil {
+						stats.JVM = jvmStats
+					}
+				}
+
+				if rapl != nil {
+					stats.CpuPower = rapl.sample(time.Now())
+				}
+
+				if infiniband != nil {
+					if tx, rx, ok := infiniband.sample(time.Now()); ok {
+						stats.IbTx = uint64(tx)
+						stats.IbRx = uint64(rx)
+					}
+				}
+
+				stats.Filesystems = filesystems.sample(logPrintf)
+				stats.Directories = directories.current()
+				if phases != nil && pids != nil {
+					phases.add(stats, childIO.value)
+				}
+				if mpi != nil && pids != nil {
+					mpi.sample(pids)
+				}
+				if pids != nil {
+					slurmTasks.sample(pids)
+				}
+				record(time.Now(), stats, pids != nil, stolen)
 
 			case <-done:
 				return
 			}
 		}
-	}()
+	}
+	if opts.Replay == "" {
+		go sampleTicks()
+	} else {
+		close(tickerDone)
+	}
+
+	stopTicker := func() {
+		close(done)
+		<-tickerDone
+	}
+
+	if len(opts.WatchDirs) > 0 {
+		directories.measure(logPrintf)
+		go directories.run(opts.WatchInterval, done, logPrintf)
+	}
+
+	output := &outputCapture{
+		log:      log,
+		filter:   &outputFilter{redact: opts.Redact, drop: opts.Drop},
+		limiter:  &outputLimiter{maxLinesPerSec: opts.MaxOutputLinesPerSec, maxBytes: uint64(opts.MaxLogOutputBytes)},
+		timeline: events,
+		events:   newEventCounter(opts.Events),
+		phases:   phases,
+		gate:     gate,
+		severity: newSeverityClassifier(opts.Severity, opts.SeverityPatterns, opts.Color, logPath),
+		stamps:   stamps,
+		tail:     outputLines,
+	}
+
+	var result commandResult
+	straceOutput := ""
+	if opts.Replay != "" {
+		// Nothing runs, the recorded samples go through record instead
+		result = replaySamples(replay, recorded, record, stamps, logPrintf)
+	} else if opts.AttachPid != 0 {
+		// go-profile exec: the command replaced go-profile and already runs
+		if opts.Syscalls {
+			logPrintf("Syscall counting is not supported with exec")
+		}
+		stamps.commandStarted(time.Now())
+		result = attachCommand(opts.AttachPid, &childPid, logPrintf)
+	} else {
+		// Collect a baseline
+		logPrintf("Collecting baseline...")
+		time.Sleep(time.Second + tick + 1)
+
+		// Execute the command
+		command := opts.Command
+		if opts.NoNewPrivs || opts.Seccomp != "" || opts.Umask.isSet {
+			hardened, err := hardenCommand(command, opts.NoNewPrivs, opts.Seccomp, opts.Umask)
+			if err != nil {
+				logPrintf("Failed to set up the hardening: %s", err)
+				stopTicker()
+				return nil, err
+			}
+			command = hardened
+			if opts.Seccomp != "" {
+				logPrintf("Restricting the syscalls of the command with the seccomp profile %s", opts.Seccomp)
+			}
+		}
+		if opts.Syscalls {
+			output, err := os.CreateTemp("", "go-profile-strace-*.txt")
+			if err == nil {
+				output.Close()
+				defer os.Remove(output.Name())
+				command, err = straceCommand(command, output.Name())
+			}
+			if err != nil {
+				logPrintf("Failed to set up syscall counting: %s", err)
+				stopTicker()
+				return nil, err
+			}
+			straceOutput = output.Name()
+			logPrintf("Counting syscalls with strace, the command will run slower")
+		}
+
+		cmd := exec.Command(command[0], command[1:]...)
+		if len(opts.Unshare) > 0 {
+			sandbox, attr, err := sandboxCommand(command, opts.Unshare, opts.RunAs)
+			if err != nil {
+				logPrintf("Failed to set up namespaces: %s", err)
+				stopTicker()
+				return nil, err
+			}
+			cmd = exec.Command(sandbox[0], sandbox[1:]...)
+			cmd.SysProcAttr = attr
+			logPrintf("Running the command in new namespaces: %s", opts.Unshare.String())
+		} else if opts.RunAs != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &opts.RunAs.credential}
+		}
+		if opts.RunAs != nil {
+			logPrintf("Running the command as %s", opts.RunAs)
+		}
+		cmd.Env = commandEnv(opts, runID)
+		cmd.Dir = opts.Chdir
+
+		result, err = runCommand(cmd, opts, output, &childPid, logPrintf)
+		if err != nil {
+			stopTicker()
+			return nil, err
+		}
+	}
+	start := result.start
+	err = result.err
+
+	// Stop the ticker and wait for the last tick to be recorded
+	stopTicker()
+	if result.end.IsZero() {
+		result.end = time.Now()
+	}
+	if gpuFaults != nil {
+		gpuFaults.stop(logPrintf)
+	}
+	alertHooks.wait()
+	snapshots.wait()
+
+	if len(opts.WatchDirs) > 0 {
+		directories.measure(logPrintf)
+	}
+
+	summary := &Summary{
+		Summary: profileio.Summary{
+			Schema:   profileio.SchemaVersion,
+			RunID:    runID,
+			Tags:     tags,
+			Command:  opts.Command,
+			Start:    stamps.zone(start),
+			ExitCode: result.exitCode,
+			CPU:      cpuAgg.result(),
+			Memory:   ramAgg.result(),
+			GPU:      gpuAgg.result(),
+			ChildRSS: rssAgg.optional(),
+			ChildPSS: pssAgg.optional(),
+			ChildUSS: ussAgg.optional(),
+		},
 
-	// Collect a baseline
-	logPrintf("Collecting baseline...")
-	time.Sleep(time.Second + tick + 1)
+		CPUClusters: clusters.result(),
+		Measurement: gate.result(result.end),
+		CPUTime:     newCPUTimeSummary(result.userTime, result.systemTime, result.end.Sub(start)),
+		Steal:       stealTime.result(),
+		Clock:       clock,
+		CPUFreq:     cpufreq,
 
-	// Execute the command
-	cmd := exec.Command(os.Args[1], os.Args[2:]...)
+		Filesystems: filesystems.summaries(),
+		Directories: directories.result(),
+		Sockets:     sockets.result(),
 
-	// Create pipes to capture stdout and stderr
-	stdout, err := cmd.StdoutPipe()
+		Anomalies:    anomalies.result(),
+		Alerts:       alerts.result(),
+		Rolling:      rolling.result(),
+		MemoryTrend:  leak.result(),
+		GPUIdle:      gpuIdle.result(),
+		GPUFaults:    gpuFaults.result(),
+		Startup:      startup.result(start, output.firstLine),
+		GoRuntime:    goRuntime.result(),
+		JVM:          jvm.result(),
+		PythonStacks: pythonStacks.result(),
+		Stacks:       stacks.result(),
+		Processes:    breakdown.result(),
+
+		SuppressedOutputLines: output.limiter.total(),
+	}
+	summary.setDuration(result.end.Sub(start), opts.DurationPrecision)
+	if straceOutput != "" {
+		syscalls, err := parseStraceSummary(straceOutput)
+		if err != nil {
+			logPrintf("Failed to read the syscall summary: %s", err)
+		}
+		if len(syscalls) > syscallTopCount {
+			syscalls = syscalls[:syscallTopCount]
+		}
+		summary.Syscalls = syscalls
+	}
+	if capture != nil {
+		rx, tx := capture.totals()
+		summary.ChildNetwork = &NetworkSummary{
+			Received:    rx,
+			Transmitted: tx,
+			RxRate:      netRxAgg.result(),
+			TxRate:      netTxAgg.result(),
+		}
+		if capture.audit != nil {
+			summary.NetworkAudit = capture.audit.result()
+		}
+	}
+	if gpuAgg.count > 0 {
+		childGpu, childGpuMem := childGpuAgg.result(), childGpuMemAgg.result()
+		summary.ChildGPU = &childGpu
+		summary.ChildGPUMemory = &childGpuMem
+		pcieTx, pcieRx := pcieTxAgg.result(), pcieRxAgg.result()
+		summary.PcieTx = &pcieTx
+		summary.PcieRx = &pcieRx
+	}
+	if nvlinkTxAgg.max > 0 || nvlinkRxAgg.max > 0 {
+		nvlinkTx, nvlinkRx := nvlinkTxAgg.result(), nvlinkRxAgg.result()
+		summary.NvlinkTx = &nvlinkTx
+		summary.NvlinkRx = &nvlinkRx
+	}
+	if ibTxAgg.max > 0 || ibRxAgg.max > 0 {
+		ibTx, ibRx := ibTxAgg.result(), ibRxAgg.result()
+		summary.IbTx = &ibTx
+		summary.IbRx = &ibRx
+	}
+	steady.apply(summary, logPrintf)
+	summary.Events = output.events.result()
+	summary.Energy = energy.result(summary.Events)
+	if opts.CarbonIntensity.enabled() {
+		summary.Carbon = estimateCarbon(opts.CarbonIntensity, summary.Energy)
+		if summary.Carbon == nil {
+			logPrintf("WARNING: no energy was measured (RAPL or GPUs), the CO2 emissions can not be estimated")
+		}
+	}
+	if opts.HourlyCost.enabled() {
+		// Over the whole run, the steady state window does not change what
+		// the machine costs
+		summary.Cost = estimateCost(opts.HourlyCost, summary.Duration, cpuAgg.result(), summary.GPUIdle)
+	}
+	summary.Phases = phases.result(summary.Duration, gpuAgg.count > 0)
+	summary.MPI = mpi.result()
+	summary.Severity = output.severity.result()
+	if len(opts.MetricExprs) > 0 {
+		summary.Metrics = evaluateMetrics(opts.MetricExprs, summary)
+	}
+	if slurm != nil && opts.Replay == "" {
+		summary.Slurm = reconcileSlurm(slurm, start, slurmTasks)
+	}
+	if len(opts.ExpectFiles) > 0 {
+		summary.ExpectedFiles = checkExpectedFiles(opts.ExpectFiles, start)
+		for _, file := range summary.ExpectedFiles {
+			if !file.OK && err == nil {
+				err = fmt.Errorf("expected file %s: %s", file.Path, file.Problem)
+			}
+		}
+	}
+	if opts.Budget != nil {
+		summary.Budget = &BudgetResult{
+			File:       opts.Budgets,
+			Command:    opts.Budget.pattern,
+			Violations: opts.Budget.check(summary),
+		}
+		if len(summary.Budget.Violations) > 0 && err == nil {
+			err = fmt.Errorf("budget exceeded: %s", strings.Join(summary.Budget.Violations, ", "))
+		}
+	}
 	if err != nil {
-		logPrintf("Error creating stdout pipe: %v", err)
-		os.Exit(1)
+		summary.Error = err.Error()
 	}
-	stderr, err := cmd.StderrPipe()
+
+	restoreCPUFreq()
+
+	// Print the aggregate stats
+	muted.Store(false)
+	index.Summary = log.mark()
+	logPrintf(summaryMarker)
+	summary.print(logPrintf)
+	logPrintf(finishedMarker)
+	index.End = log.mark()
+	// The offsets of a compressed log can not be seeked to
+	if opts.Compress == "" {
+		if err := appendLogIndex(logPath, index); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write the log index: %s\n", err)
+		}
+	}
+
+	// Check the exit code
 	if err != nil {
-		logPrintf("Error creating stderr pipe: %v", err)
-		os.Exit(1)
+		logPrintf("Command execution failed: %s", err)
 	}
 
+	return summary, err
+}
+
+// commandResult is how the command ran, err is set if it failed. end is
+// only set for replayed runs, otherwise the run ends after the last tick.
+type commandResult struct {
+	start    time.Time
+	end      time.Time
+	exitCode int
+	err      error
+
+	// CPU time of the command (rusage), only known for children
+	userTime, systemTime time.Duration
+}
+
+// runCommand starts the command with its output captured and waits for it,
+// the error is only returned if the command could not be started
+func runCommand(cmd *exec.Cmd, opts *Options, output *outputCapture, childPid *atomic.Int64, logPrintf func(format string, a ...interface{})) (commandResult, error) {
+	// Create pipes to capture stdout and stderr. These are not
+	// cmd.StdoutPipe(), so the command can be waited for while leftover
+	// processes still hold the pipes open. With --combine-output both
+	// share a single pipe, which keeps the order of their lines.
+	stdout, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		logPrintf("Error creating stdout pipe: %v", err)
+		return commandResult{}, err
+	}
+	defer stdout.Close()
+	cmd.Stdout = stdoutWrite
+	cmd.Stderr = stdoutWrite
+	var stderr, stderrWrite *os.File
+	if !opts.CombineOutput {
+		stderr, stderrWrite, err = os.Pipe()
+		if err != nil {
+			stdoutWrite.Close()
+			logPrintf("Error creating stderr pipe: %v", err)
+			return commandResult{}, err
+		}
+		defer stderr.Close()
+		cmd.Stderr = stderrWrite
+	}
+	setupProcessGroup(cmd)
+
 	start := time.Now()
 	err = cmd.Start()
+	stdoutWrite.Close()
+	if stderrWrite != nil {
+		stderrWrite.Close()
+	}
 	if err != nil {
 		logPrintf("Failed to start command: %s", err)
-		os.Exit(1)
+		return commandResult{}, err
 	}
 
+	childPid.Store(int64(cmd.Process.Pid))
+	output.stamps.commandStarted(start)
+	commandGroups.Store(cmd.Process.Pid, struct{}{})
+	defer commandGroups.Delete(cmd.Process.Pid)
 	logPrintf("Started command!")
 
 	// Create wait group to wait for output goroutines
 	var wg sync.WaitGroup
 
+	var stdoutMirror, stderrMirror io.Writer
+	if !opts.NoMirror {
+		stdoutMirror = stdoutWriter
+		stderrMirror = os.Stderr
+	}
+
 	// Handle stdout
+	stdoutName := "stdout"
+	if opts.CombineOutput {
+		stdoutName = "output"
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		handleOutput(stdout, "stdout", os.Stdout, log)
+		output.handle(stdout, stdoutName, stdoutMirror)
 	}()
 
 	// Handle stderr
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		handleOutput(stderr, "stderr", os.Stderr, log)
-	}()
-
-	// Wait for output goroutines to finish
-	wg.Wait()
+	if stderr != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output.handle(stderr, "stderr", stderrMirror)
+		}()
+	}
 
-	// Wait for the command to finish
+	// Wait for the command to finish, then for the output of everything it
+	// left behind to end
 	err = cmd.Wait()
-
-	// Send signal to stop the ticker
-	close(done)
-
-	// Print the total execution time
-	elapsed := time.Since(start)
-	logPrintf("-----------------------------------------")
-
-	// Print the aggregate stats
-	logPrintf("CPU (min: %.2f%%, max: %.2f%%, range: %.2f%%, avg: %.2f%%)",
-		minCpu,
-		maxCpu,
-		maxCpu-minCpu,
-		sumCpu/float64(totalTicks))
-	logPrintf("Memory (min: %s, max: %s, range: %s, avg: %s)",
-		humanize.IBytes(minRam),
-		humanize.IBytes(maxRam),
-		humanize.IBytes(maxRam-minRam),
-		humanize.IBytes(sumRam/totalTicks))
-	logPrintf("GPU (min: %.2f%%, max: %.2f%%, range: %.2f%% avg: %.2f%%)",
-		minGpu,
-		maxGpu,
-		maxGpu-minGpu,
-		sumGpu/float64(totalTicks))
-	logPrintf("Total Execution Time: %s", elapsed)
-	logPrintf("=============== FINISHED ================")
-
-	// Check the exit code
-	if err != nil {
-		logPrintf("Command execution failed: %s", err)
-		os.Exit(1)
+	if opts.WaitForTree {
+		waitForLeftovers(cmd.Process.Pid, logPrintf)
 	}
+	killLeftovers(cmd.Process.Pid, logPrintf)
+	wg.Wait()
+	return commandResult{
+		start:      start,
+		exitCode:   cmd.ProcessState.ExitCode(),
+		err:        err,
+		userTime:   cmd.ProcessState.UserTime(),
+		systemTime: cmd.ProcessState.SystemTime(),
+	}, nil
 }
 
-func handleOutput(output io.Reader, name string, mirror *os.File, log *os.File) {
-	scanner := bufio.NewScanner(output)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		timestamp := time.Now().Format(time.StampMilli)
-
-		// Log to original output
-		fmt.Fprintf(mirror, "[%s][cmd-%s] %s\n", timestamp, name, line)
+// attachCommand watches a command that is not a child of go-profile until
+// it exits, its exit code is unknown (-1)
+func attachCommand(pid int, childPid *atomic.Int64, logPrintf func(format string, a ...interface{})) commandResult {
+	start := time.Now()
+	childPid.Store(int64(pid))
+	logPrintf("Attached to command (pid %d)", pid)
+	for processRunning(pid) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return commandResult{start: start, exitCode: -1}
+}
 
-		// Write to the log
-		fmt.Fprintf(log, "[%s][cmd-%s] %s\n", timestamp, name, line)
+// formatStats formats a tick for the log
+func formatStats(stats Stats) string {
+	line := fmt.Sprintf("CPU:%s | Memory:%s (%s/%s) | GPU:%s",
+		unitPercent.format(stats.CpuPercent),
+		unitPercent.format(stats.MemPercent),
+		unitBytes.format(float64(stats.MemUsed)),
+		unitBytes.format(float64(stats.MemTotal)),
+		unitPercent.format(stats.GpuPercent))
+	if stats.GpuCount > 0 {
+		line += fmt.Sprintf(" (child:%s, %s) | PCIe TX:%s RX:%s | NVLink TX:%s RX:%s",
+			unitPercent.format(stats.ChildGpuPercent),
+			unitBytes.format(float64(stats.ChildGpuMemUsed)),
+			unitBytesPerSecond.format(float64(stats.GpuPcieTx)),
+			unitBytesPerSecond.format(float64(stats.GpuPcieRx)),
+			unitBytesPerSecond.format(float64(stats.GpuNvlinkTx)),
+			unitBytesPerSecond.format(float64(stats.GpuNvlinkRx)))
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(log, "[go-profile] Error reading %s: %v\n", name, err)
+	if stats.CpuPower > 0 || stats.GpuPower > 0 {
+		line += fmt.Sprintf(" | Power CPU:%s GPU:%s", unitWatts.format(stats.CpuPower), unitWatts.format(stats.GpuPower))
 	}
+	if stats.IbTx > 0 || stats.IbRx > 0 {
+		line += fmt.Sprintf(" | InfiniBand TX:%s RX:%s",
+			unitBytesPerSecond.format(float64(stats.IbTx)),
+			unitBytesPerSecond.format(float64(stats.IbRx)))
+	}
+	if stats.Sockets != nil {
+		line += fmt.Sprintf(" | Sockets:%d (established:%d, time_wait:%d)",
+			stats.Sockets.Open(),
+			stats.Sockets.Established,
+			stats.Sockets.TimeWait)
+	}
+	if stats.ChildNetRx > 0 || stats.ChildNetTx > 0 {
+		line += fmt.Sprintf(" | Net RX:%s TX:%s",
+			unitBytesPerSecond.format(float64(stats.ChildNetRx)),
+			unitBytesPerSecond.format(float64(stats.ChildNetTx)))
+	}
+	if stats.GoRuntime != nil {
+		line += fmt.Sprintf(" | Go heap:%s goroutines:%d GC:%d (%s)",
+			formatBytes(stats.GoRuntime.HeapAlloc),
+			stats.GoRuntime.Goroutines,
+			stats.GoRuntime.NumGC,
+			stats.GoRuntime.GCPause)
+	}
+	if stats.JVM != nil {
+		line += fmt.Sprintf(" | JVM heap:%s/%s GC:%d (%s)",
+			formatBytes(stats.JVM.HeapUsed),
+			formatBytes(stats.JVM.HeapMax),
+			stats.JVM.GCCount,
+			stats.JVM.GCTime)
+	}
+	if stats.CpuStealPercent > 0 {
+		line += fmt.Sprintf(" | Steal:%s", unitPercent.format(stats.CpuStealPercent))
+	}
+	for _, fs := range stats.Filesystems {
+		line += fmt.Sprintf(" | %s:%.2f%% (%s)", fs.Path, fs.Percent, formatBytes(fs.Used))
+	}
+	return line
 }
 
 /*
@@ -252,61 +1136,100 @@ func handleOutput(output io.Reader, name string, mirror *os.File, log *os.File)
 */
 func getCPUTime() (*CPUTime, error) {
 	// Read the procfile
-	data, err := os.ReadFile("/proc/stat")
+	data, err := os.ReadFile(procPath("stat"))
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the fields from the first line
-	lines := strings.Split(string(data), "\n")
-	fields := strings.Fields(lines[0])
+	// Find the line with the total of all cores, it is normally the first
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "cpu" {
+			return parseCPUTime(fields)
+		}
+	}
+	return nil, fmt.Errorf("no cpu line in /proc/stat")
+}
 
-	// Get the idle time
-	idle, err := strconv.ParseUint(fields[4], 10, 64)
-	if err != nil {
-		return nil, err
+// parseCPUTime parses the fields of a cpu line in /proc/stat. The number of
+// fields depends on the kernel version:
+//
+//	cpu user nice system idle [iowait irq softirq [steal [guest [guest_nice]]]]
+//
+// guest and guest_nice are already part of user and nice, fields added by
+// future kernels are ignored.
+func parseCPUTime(fields []string) (*CPUTime, error) {
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("unexpected /proc/stat line: %s", strings.Join(fields, " "))
 	}
 
-	// Get the total time
-	result := &CPUTime{idle: idle, total: 0}
-	for _, field := range fields[1:] {
+	result := &CPUTime{}
+	for i, field := range fields[1:min(len(fields), 9)] {
 		value, err := strconv.ParseUint(field, 10, 64)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("unexpected /proc/stat line: %s", strings.Join(fields, " "))
 		}
 		result.total += value
+
+		// Waiting for I/O (iowait) counts as idle
+		if i == 3 || i == 4 {
+			result.idle += value
+		}
+		if i == 7 {
+			result.steal = value
+		}
 	}
 
 	return result, nil
 }
 
-func getCPUUsage(prev *CPUTime) (float64, error) {
+// getCPUUsage returns the utilization and the steal time (both 0-1) since
+// prev, and the CPU time that was stolen
+func getCPUUsage(prev *CPUTime) (float64, float64, time.Duration, error) {
 	// Get CPU times
 	stats, err := getCPUTime()
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, err
+	}
+
+	// The counters can go backwards when CPUs are hot-unplugged (and iowait
+	// does on some kernels), skip the sample
+	previous := *prev
+	*prev = *stats
+	if stats.total <= previous.total || stats.idle < previous.idle || stats.steal < previous.steal {
+		return 0, 0, 0, fmt.Errorf("cpu time counters went backwards")
 	}
 
 	// Calculate the usage
-	diffIdle := float64(stats.idle - prev.idle)
-	diffTotal := float64(stats.total - prev.total)
+	diffIdle := float64(stats.idle - previous.idle)
+	diffTotal := float64(stats.total - previous.total)
 	usage := (diffTotal - diffIdle) / diffTotal
+	steal := float64(stats.steal-previous.steal) / diffTotal
+	stolen := time.Duration(stats.steal-previous.steal) * time.Second / clockTicks
 
-	// Update the previous data
-	*prev = *stats
-
-	return usage, nil
+	return min(max(usage, 0), 1), min(steal, 1), stolen, nil
 }
 
+// getMemoryInfo reads /proc/meminfo, or uses sysinfo(2) when /proc is not
+// available or in an unexpected format
 func getMemoryInfo() (MemoryInfo, error) {
-	memInfo := MemoryInfo{}
-
-	data, err := os.ReadFile("/proc/meminfo")
-	if err != nil {
-		return memInfo, err
+	data, err := os.ReadFile(procPath("meminfo"))
+	if err == nil {
+		memInfo, err := parseMemoryInfo(string(data))
+		if err == nil {
+			return memInfo, nil
+		}
 	}
+	return getSysinfoMemory()
+}
+
+// parseMemoryInfo parses /proc/meminfo, lines it does not understand are
+// skipped
+func parseMemoryInfo(data string) (MemoryInfo, error) {
+	memInfo := MemoryInfo{}
+	hasAvailable := false
 
-	lines := strings.Split(string(data), "\n")
+	lines := strings.Split(data, "\n")
 	for _, line := range lines {
 		fields := strings.Fields(line)
 		if len(fields) < 2 {
@@ -315,7 +1238,7 @@ func getMemoryInfo() (MemoryInfo, error) {
 		key := fields[0]
 		value, err := strconv.ParseUint(fields[1], 10, 64)
 		if err != nil {
-			return memInfo, err
+			continue
 		}
 		switch key {
 		case "MemTotal:":
@@ -324,12 +1247,38 @@ func getMemoryInfo() (MemoryInfo, error) {
 			memInfo.Free = value * 1024
 		case "MemAvailable:":
 			memInfo.Available = value * 1024
+			hasAvailable = true
 		case "Buffers:":
 			memInfo.Buffers = value * 1024
 		case "Cached:":
 			memInfo.Cached = value * 1024
 		}
 	}
+	if memInfo.Total == 0 {
+		return memInfo, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
 
+	// MemAvailable was added in Linux 3.14, estimate it like free(1) did
+	if !hasAvailable {
+		memInfo.Available = min(memInfo.Free+memInfo.Buffers+memInfo.Cached, memInfo.Total)
+	}
+
+	return memInfo, nil
+}
+
+// getSysinfoMemory is the fallback for /proc/meminfo, sysinfo(2) does not
+// report the page cache so the available memory is underestimated
+func getSysinfoMemory() (MemoryInfo, error) {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return MemoryInfo{}, err
+	}
+	unit := uint64(max(info.Unit, 1))
+	memInfo := MemoryInfo{
+		Total:   uint64(info.Totalram) * unit,
+		Free:    uint64(info.Freeram) * unit,
+		Buffers: uint64(info.Bufferram) * unit,
+	}
+	memInfo.Available = memInfo.Free + memInfo.Buffers
 	return memInfo, nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mrexodia/go-profile/proctest"
+)
+
+func TestParseCPUTime(t *testing.T) {
+	tests := []struct {
+		line               string
+		total, idle, steal uint64
+	}{
+		// Linux < 2.6: no iowait, irq and softirq
+		{"cpu 10 20 30 40", 100, 40, 0},
+		{"cpu 10 20 30 40 5 1 2", 108, 45, 0},
+		{"cpu 10 20 30 40 5 1 2 7", 115, 45, 7},
+		// guest and guest_nice are part of user and nice already
+		{"cpu 10 20 30 40 5 1 2 7 8 9", 115, 45, 7},
+		{"cpu 10 20 30 40 5 1 2 7 8 9 1000", 115, 45, 7},
+	}
+	for _, test := range tests {
+		result, err := parseCPUTime(strings.Fields(test.line))
+		if err != nil {
+			t.Errorf("parseCPUTime(%q): %s", test.line, err)
+			continue
+		}
+		if result.total != test.total || result.idle != test.idle || result.steal != test.steal {
+			t.Errorf("parseCPUTime(%q) = %+v, want total %d, idle %d, steal %d", test.line, *result, test.total, test.idle, test.steal)
+		}
+	}
+
+	for _, line := range []string{"cpu", "cpu 1 2 3", "cpu 1 2 x 4", "cpu 1 2 3 -4"} {
+		if _, err := parseCPUTime(strings.Fields(line)); err == nil {
+			t.Errorf("parseCPUTime(%q) succeeded", line)
+		}
+	}
+}
+
+func TestGetCPUUsage(t *testing.T) {
+	proc := fakeProc(t)
+	if err := proc.SetCPU(proctest.CPUTime{User: 100, Idle: 100}, proctest.CPUTime{Idle: 200}); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := getCPUTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.total != 400 || prev.idle != 300 {
+		t.Fatalf("getCPUTime = %+v, want the total of all cores", *prev)
+	}
+
+	// 100 of the 200 ticks since were busy, 20 of them stolen
+	if err := proc.SetCPU(proctest.CPUTime{User: 180, Idle: 100, Steal: 20}, proctest.CPUTime{Idle: 300}); err != nil {
+		t.Fatal(err)
+	}
+	usage, steal, _, err := getCPUUsage(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != 0.5 || steal != 0.1 {
+		t.Errorf("getCPUUsage = %v, %v, want 0.5, 0.1", usage, steal)
+	}
+
+	// Counters that went backwards skip the sample
+	if err := proc.SetCPU(proctest.CPUTime{Idle: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := getCPUUsage(prev); err == nil {
+		t.Errorf("getCPUUsage with counters that went backwards succeeded")
+	}
+}
+
+func TestParseMemoryInfo(t *testing.T) {
+	memInfo, err := parseMemoryInfo("MemTotal:       16000000 kB\nMemFree:         1000000 kB\nMemAvailable:    8000000 kB\nBuffers:          500000 kB\nCached:          4000000 kB\nSwapCached:            0 kB\nHugePages_Total:       0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MemoryInfo{Total: 16000000 << 10, Free: 1000000 << 10, Available: 8000000 << 10, Buffers: 500000 << 10, Cached: 4000000 << 10}
+	if memInfo != want {
+		t.Errorf("parseMemoryInfo = %+v, want %+v", memInfo, want)
+	}
+
+	// Linux < 3.14 has no MemAvailable, it is estimated
+	memInfo, err = parseMemoryInfo("MemTotal: 1000 kB\nMemFree: 100 kB\nBuffers: 50 kB\nCached: 200 kB\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memInfo.Available != 350<<10 {
+		t.Errorf("estimated MemAvailable = %d, want %d", memInfo.Available, 350<<10)
+	}
+
+	for _, data := range []string{"", "MemFree: 100 kB\n", "MemTotal: lots\n"} {
+		if _, err := parseMemoryInfo(data); err == nil {
+			t.Errorf("parseMemoryInfo(%q) succeeded", data)
+		}
+	}
+}
+
+func TestGetMemoryInfo(t *testing.T) {
+	proc := fakeProc(t)
+	if err := proc.SetMemory(proctest.Memory{Total: 8 << 30, Free: 1 << 30, Available: 3 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	memInfo, err := getMemoryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memInfo.Total != 8<<30 || memInfo.Free != 1<<30 || memInfo.Available != 3<<30 {
+		t.Errorf("getMemoryInfo = %+v", memInfo)
+	}
+}
+
+// TestProcFixtures reads /proc/stat and /proc/meminfo as written by several
+// kernel versions, see testdata/proc
+func TestProcFixtures(t *testing.T) {
+	tests := []struct {
+		kernel             string
+		total, idle, steal uint64
+		memory             MemoryInfo
+	}{
+		// No guest time and no MemAvailable
+		{"linux-2.6.18", 101402713, 98028741, 0, MemoryInfo{Total: 4043952 << 10, Free: 183204 << 10, Available: 3466052 << 10, Buffers: 261388 << 10, Cached: 3021460 << 10}},
+		// guest and guest_nice, still no MemAvailable
+		{"linux-3.2", 322586298, 311877745, 12087, MemoryInfo{Total: 8178652 << 10, Free: 922316 << 10, Available: 6390440 << 10, Buffers: 371492 << 10, Cached: 5096632 << 10}},
+		{"linux-6.18", 1024303, 792914, 1758, MemoryInfo{Total: 6158152 << 10, Free: 1341772 << 10, Available: 5394332 << 10, Buffers: 436888 << 10, Cached: 3783176 << 10}},
+	}
+	previous := procRoot
+	t.Cleanup(func() { procRoot = previous })
+	for _, test := range tests {
+		procRoot = filepath.Join("testdata", "proc", test.kernel)
+
+		cpuTime, err := getCPUTime()
+		if err != nil {
+			t.Errorf("%s: getCPUTime: %s", test.kernel, err)
+		} else if cpuTime.total != test.total || cpuTime.idle != test.idle || cpuTime.steal != test.steal {
+			t.Errorf("%s: getCPUTime = %+v, want total %d, idle %d, steal %d", test.kernel, *cpuTime, test.total, test.idle, test.steal)
+		}
+
+		memInfo, err := getMemoryInfo()
+		if err != nil {
+			t.Errorf("%s: getMemoryInfo: %s", test.kernel, err)
+		} else if memInfo != test.memory {
+			t.Errorf("%s: getMemoryInfo = %+v, want %+v", test.kernel, memInfo, test.memory)
+		}
+	}
+}
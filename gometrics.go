@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// GoRuntimeStats are the runtime metrics of a Go command (--go-metrics)
+type GoRuntimeStats = profileio.GoRuntimeStats
+
+// GoRuntimeSummary aggregates the runtime metrics over the run
+type GoRuntimeSummary struct {
+	HeapAlloc    Aggregate     `json:"heap_alloc"`
+	Goroutines   Aggregate     `json:"goroutines"`
+	NumGC        uint32        `json:"num_gc"`
+	GCPauseTotal time.Duration `json:"gc_pause_total"`
+	GCPauseMax   time.Duration `json:"gc_pause_max"`
+}
+
+// goMetrics samples expvar (/debug/vars) and, when net/http/pprof is
+// registered, the goroutine count of a Go program
+type goMetrics struct {
+	base   string
+	client *http.Client
+
+	numGC, pauseTotal counter
+
+	heapAgg, goroutinesAgg aggregator
+	gcCount                uint32
+	gcPauseTotal           time.Duration
+	gcPauseMax             time.Duration
+}
+
+func newGoMetrics(base string) *goMetrics {
+	return &goMetrics{
+		base:   strings.TrimSuffix(base, "/"),
+		client: &http.Client{Timeout: 200 * time.Millisecond},
+	}
+}
+
+// expvarMemStats is the part of runtime.MemStats used from /debug/vars
+type expvarMemStats struct {
+	Memstats struct {
+		HeapAlloc    uint64
+		HeapSys      uint64
+		NumGC        uint32
+		PauseTotalNs uint64
+		PauseNs      [256]uint64
+	} `json:"memstats"`
+}
+
+// goroutines reads the total from the first line of the goroutine profile
+// ("goroutine profile: total 12"), 0 if pprof is not registered
+func (g *goMetrics) goroutines() int {
+	resp, err := g.client.Get(g.base + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0
+	}
+	line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	var total int
+	fmt.Sscanf(line, "goroutine profile: total %d", &total)
+	return total
+}
+
+// sample returns the runtime metrics, the program may not be serving yet
+func (g *goMetrics) sample() (*GoRuntimeStats, error) {
+	resp, err := g.client.Get(g.base + "/debug/vars")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	var vars expvarMemStats
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		return nil, err
+	}
+	m := vars.Memstats
+
+	stats := &GoRuntimeStats{
+		HeapAlloc:  m.HeapAlloc,
+		HeapSys:    m.HeapSys,
+		Goroutines: g.goroutines(),
+	}
+	numGC, gcOK := g.numGC.delta(uint64(m.NumGC))
+	pause, pauseOK := g.pauseTotal.delta(m.PauseTotalNs)
+	if gcOK && pauseOK {
+		stats.NumGC = uint32(numGC)
+		stats.GCPause = time.Duration(pause)
+
+		// PauseNs is a ring buffer of the most recent pauses
+		for i := uint32(0); i < min(stats.NumGC, 256); i++ {
+			pause := time.Duration(m.PauseNs[(m.NumGC-i+255)%256])
+			g.gcPauseMax = max(g.gcPauseMax, pause)
+		}
+	}
+
+	g.heapAgg.add(float64(stats.HeapAlloc))
+	if stats.Goroutines > 0 {
+		g.goroutinesAgg.add(float64(stats.Goroutines))
+	}
+	g.gcCount += stats.NumGC
+	g.gcPauseTotal += stats.GCPause
+	return stats, nil
+}
+
+// result returns nil if the program was never sampled
+func (g *goMetrics) result() *GoRuntimeSummary {
+	if g == nil || !g.numGC.sampled {
+		return nil
+	}
+	return &GoRuntimeSummary{
+		HeapAlloc:    g.heapAgg.result(),
+		Goroutines:   g.goroutinesAgg.result(),
+		NumGC:        g.gcCount,
+		GCPauseTotal: g.gcPauseTotal,
+		GCPauseMax:   g.gcPauseMax,
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the ECC error counters are read, nvidia-smi is slow to query
+const eccCheckInterval = 10 * time.Second
+
+// GPUFault is an ECC error counter increase or an Xid event (an error the
+// NVIDIA driver reported in the kernel log) during the run
+type GPUFault struct {
+	Time time.Time `json:"time"`
+	// nvidia-smi index of the GPU, -1 if the PCI address of an Xid event
+	// could not be matched
+	GPU int `json:"gpu"`
+	// "ecc" or "xid"
+	Kind string `json:"kind"`
+	// Xid error code, e.g. 79 (GPU has fallen off the bus)
+	Xid int `json:"xid,omitempty"`
+	// Increase of the corrected and uncorrected ECC error counters
+	Corrected   uint64 `json:"corrected,omitempty"`
+	Uncorrected uint64 `json:"uncorrected,omitempty"`
+	Message     string `json:"message"`
+}
+
+func (f GPUFault) String() string {
+	gpu := "GPU ?"
+	if f.GPU >= 0 {
+		gpu = fmt.Sprintf("GPU %d", f.GPU)
+	}
+	if f.Kind == "xid" {
+		return fmt.Sprintf("%s: Xid %d: %s", gpu, f.Xid, f.Message)
+	}
+	return fmt.Sprintf("%s: %s", gpu, f.Message)
+}
+
+type eccCounts struct {
+	corrected, uncorrected uint64
+}
+
+// gpuFaultMonitor watches the ECC error counters of the GPUs and the Xid
+// events in the kernel log (/dev/kmsg, what dmesg reads), silent GPU faults
+// regularly invalidate long training runs
+type gpuFaultMonitor struct {
+	filter gpuFilter
+	// The GPUs by PCI bus and device ("65:00")
+	buses map[string]gpuBus
+	kmsg  *os.File
+
+	// The ECC counters are checked by the ticker and at the end
+	eccMu    sync.Mutex
+	baseline map[int]eccCounts
+
+	mu     sync.Mutex
+	faults []GPUFault
+}
+
+// newGPUFaultMonitor returns nil without NVIDIA GPUs
+func newGPUFaultMonitor(accelerators []Accelerator, filter gpuFilter) *gpuFaultMonitor {
+	for _, accelerator := range accelerators {
+		if accelerator.Name() == "nvidia" {
+			return &gpuFaultMonitor{filter: filter, buses: getGPUBuses()}
+		}
+	}
+	return nil
+}
+
+// start reads the initial ECC error counters and starts following the
+// kernel log, Xid events from before the run are ignored
+func (m *gpuFaultMonitor) start(done <-chan struct{}, logPrintf func(format string, a ...interface{})) {
+	counts, err := getECCCounts(m.filter)
+	if err != nil {
+		logPrintf("ECC errors are not monitored: %s", err)
+	}
+	m.baseline = counts
+
+	kmsg, err := os.Open("/dev/kmsg")
+	if err == nil {
+		_, err = kmsg.Seek(0, io.SeekEnd)
+		if err != nil {
+			kmsg.Close()
+		}
+	}
+	if err != nil {
+		logPrintf("Xid events are not monitored: %s", err)
+	} else {
+		m.kmsg = kmsg
+		go m.followKernelLog(kmsg, logPrintf)
+	}
+
+	go func() {
+		ticker := time.NewTicker(eccCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.checkECC(logPrintf)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stop does a last check of the ECC error counters and stops following the
+// kernel log
+func (m *gpuFaultMonitor) stop(logPrintf func(format string, a ...interface{})) {
+	m.checkECC(logPrintf)
+	if m.kmsg != nil {
+		m.kmsg.Close()
+	}
+}
+
+func (m *gpuFaultMonitor) report(fault GPUFault, logPrintf func(format string, a ...interface{})) {
+	m.mu.Lock()
+	m.faults = append(m.faults, fault)
+	m.mu.Unlock()
+	logPrintf("WARNING: GPU fault: %s", fault)
+}
+
+func (m *gpuFaultMonitor) checkECC(logPrintf func(format string, a ...interface{})) {
+	m.eccMu.Lock()
+	defer m.eccMu.Unlock()
+	if m.baseline == nil {
+		return
+	}
+	counts, err := getECCCounts(m.filter)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for gpu, current := range counts {
+		previous, ok := m.baseline[gpu]
+		if !ok {
+			continue
+		}
+		m.baseline[gpu] = current
+		if current.corrected <= previous.corrected && current.uncorrected <= previous.uncorrected {
+			continue
+		}
+		fault := GPUFault{Time: now, GPU: gpu, Kind: "ecc"}
+		if current.corrected > previous.corrected {
+			fault.Corrected = current.corrected - previous.corrected
+		}
+		if current.uncorrected > previous.uncorrected {
+			fault.Uncorrected = current.uncorrected - previous.uncorrected
+		}
+		fault.Message = fmt.Sprintf("%d corrected and %d uncorrected ECC errors (total %d and %d)",
+			fault.Corrected, fault.Uncorrected, current.corrected, current.uncorrected)
+		m.report(fault, logPrintf)
+	}
+}
+
+// xidPattern matches the Xid events of the NVIDIA driver, e.g.
+// "NVRM: Xid (PCI:0000:65:00): 79, pid=1234, name=python, GPU has fallen off the bus."
+var xidPattern = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+),\s*(.*)`)
+
+// followKernelLog reads the kernel log until the file is closed, every
+// read returns a single record like "4,1234,5678901,-;message"
+func (m *gpuFaultMonitor) followKernelLog(kmsg *os.File, logPrintf func(format string, a ...interface{})) {
+	buf := make([]byte, 8192)
+	for {
+		n, err := kmsg.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.EPIPE) {
+				// Records were overwritten before we read them
+				continue
+			}
+			return
+		}
+		_, message, ok := strings.Cut(string(buf[:n]), ";")
+		if !ok {
+			continue
+		}
+		// Continuation lines follow the message
+		message, _, _ = strings.Cut(message, "\n")
+		match := xidPattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		gpu := -1
+		if bus, ok := m.buses[pciBusDevice(match[1])]; ok {
+			if !m.filter.matches(bus.index, bus.uuid) {
+				continue
+			}
+			gpu = bus.index
+		}
+		xid, _ := strconv.Atoi(match[2])
+		m.report(GPUFault{Time: time.Now(), GPU: gpu, Kind: "xid", Xid: xid, Message: strings.TrimSpace(match[3])}, logPrintf)
+	}
+}
+
+func (m *gpuFaultMonitor) result() []GPUFault {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.faults
+}
+
+// pciBusDevice returns the bus and device of a PCI address, the kernel log
+// has "0000:65:00" and nvidia-smi "00000000:65:00.0"
+func pciBusDevice(address string) string {
+	address, _, _ = strings.Cut(address, ".")
+	parts := strings.Split(address, ":")
+	if len(parts) < 2 {
+		return strings.ToLower(address)
+	}
+	return strings.ToLower(parts[len(parts)-2] + ":" + parts[len(parts)-1])
+}
+
+type gpuBus struct {
+	index int
+	uuid  string
+}
+
+// getGPUBuses maps the PCI bus and device of every GPU to its nvidia-smi
+// index and UUID
+func getGPUBuses() map[string]gpuBus {
+	buses := map[string]gpuBus{}
+	out, err := exec.Command("nvidia-smi", "--query-gpu=index,uuid,pci.bus_id", "--format=csv,noheader").Output()
+	if err != nil {
+		return buses
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			continue
+		}
+		if index, err := strconv.Atoi(strings.TrimSpace(fields[0])); err == nil {
+			buses[pciBusDevice(strings.TrimSpace(fields[2]))] = gpuBus{index, strings.TrimSpace(fields[1])}
+		}
+	}
+	return buses
+}
+
+// getECCCounts returns the volatile (since the driver loaded) ECC error
+// counters of the selected GPUs by nvidia-smi index, GPUs without ECC are
+// left out
+func getECCCounts(filter gpuFilter) (map[int]eccCounts, error) {
+	out, err := exec.Command("nvidia-smi",
+		"--query-gpu=index,uuid,ecc.errors.corrected.volatile.total,ecc.errors.uncorrected.volatile.total",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, err
+	}
+	counts := map[int]eccCounts{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil || !filter.matches(index, strings.TrimSpace(fields[1])) {
+			continue
+		}
+		// "[N/A]" when ECC is disabled or not supported
+		corrected, err1 := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 64)
+		uncorrected, err2 := strconv.ParseUint(strings.TrimSpace(fields[3]), 10, 64)
+		if err1 == nil && err2 == nil {
+			counts[index] = eccCounts{corrected, uncorrected}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+)
+
+// The CPU counts as busy (e.g. loading data) at or above this usage
+const gpuStallCPUPercent = 50.0
+
+// GPUIdleSummary is how much of the run the GPUs were waiting
+type GPUIdleSummary struct {
+	Threshold float64 `json:"threshold"`
+
+	// Fraction of the sampled time the GPUs were idle, and idle while the
+	// CPU was busy (data-loading stalls)
+	IdleFraction  float64 `json:"idle_fraction"`
+	StallFraction float64 `json:"stall_fraction"`
+
+	LongestGap      time.Duration `json:"longest_gap"`
+	LongestGapStart time.Time     `json:"longest_gap_start,omitempty"`
+}
+
+// gpuIdleTracker accumulates the time the GPUs spent below the threshold
+type gpuIdleTracker struct {
+	threshold float64
+	last      time.Time
+
+	sampled, idle, stall time.Duration
+	gapStart             time.Time
+	longest              time.Duration
+	longestStart         time.Time
+}
+
+func (t *gpuIdleTracker) add(now time.Time, stats Stats) {
+	if stats.GpuCount == 0 {
+		return
+	}
+	if t.last.IsZero() {
+		t.last = now
+		return
+	}
+	elapsed := now.Sub(t.last)
+	t.last = now
+	t.sampled += elapsed
+
+	if stats.GpuPercent >= t.threshold {
+		t.gapStart = time.Time{}
+		return
+	}
+	t.idle += elapsed
+	if stats.CpuPercent >= gpuStallCPUPercent {
+		t.stall += elapsed
+	}
+
+	// The gap started at the previous sample
+	if t.gapStart.IsZero() {
+		t.gapStart = now.Add(-elapsed)
+	}
+	if gap := now.Sub(t.gapStart); gap > t.longest {
+		t.longest = gap
+		t.longestStart = t.gapStart
+	}
+}
+
+// result returns nil if no GPU was sampled
+func (t *gpuIdleTracker) result() *GPUIdleSummary {
+	if t.sampled == 0 {
+		return nil
+	}
+	return &GPUIdleSummary{
+		Threshold:       t.threshold,
+		IdleFraction:    float64(t.idle) / float64(t.sampled),
+		StallFraction:   float64(t.stall) / float64(t.sampled),
+		LongestGap:      t.longest,
+		LongestGapStart: t.longestStart,
+	}
+}
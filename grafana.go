@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// grafanaUnits maps the units of the metrics to the units of Grafana
+var grafanaUnits = map[metricUnit]string{
+	unitNone:           "short",
+	unitPercent:        "percent",
+	unitBytes:          "bytes",
+	unitBytesPerSecond: "Bps",
+	unitWatts:          "watt",
+	unitSeconds:        "s",
+}
+
+// The panels refer to the data source picked in the dashboard variable
+var grafanaDatasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+type grafanaDashboard struct {
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          map[string]string `json:"time"`
+	Templating    struct {
+		List []grafanaVariable `json:"list"`
+	} `json:"templating"`
+	Panels []grafanaPanel `json:"panels"`
+}
+
+type grafanaVariable struct {
+	Name       string            `json:"name"`
+	Label      string            `json:"label"`
+	Type       string            `json:"type"`
+	Query      string            `json:"query"`
+	Datasource map[string]string `json:"datasource,omitempty"`
+	Current    map[string]string `json:"current,omitempty"`
+	Refresh    int               `json:"refresh,omitempty"`
+}
+
+type grafanaPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Description string            `json:"description"`
+	Datasource  map[string]string `json:"datasource"`
+	GridPos     map[string]int    `json:"gridPos"`
+	FieldConfig struct {
+		Defaults struct {
+			Unit string `json:"unit"`
+		} `json:"defaults"`
+	} `json:"fieldConfig"`
+	Targets []grafanaTarget `json:"targets"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// newGrafanaDashboard returns a dashboard with a panel for every metric the
+// prometheus output serves, the run and its tags are pre-filled in the
+// queries (the run ID is a variable, so the dashboard works for the next
+// run as well)
+func newGrafanaDashboard(command []string, runID string, tags map[string]string) grafanaDashboard {
+	dashboard := grafanaDashboard{
+		Title:         "go-profile: " + strings.Join(command, " "),
+		Tags:          []string{"go-profile"},
+		SchemaVersion: 39,
+		Refresh:       "5s",
+		Time:          map[string]string{"from": "now-1h", "to": "now"},
+	}
+	dashboard.Templating.List = []grafanaVariable{
+		{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		{
+			Name:       "run_id",
+			Label:      "Run",
+			Type:       "query",
+			Query:      "label_values(go_profile_cpu_percent, run_id)",
+			Datasource: grafanaDatasource,
+			Current:    map[string]string{"text": runID, "value": runID},
+			Refresh:    2,
+		},
+	}
+
+	// The tags are labels of every metric
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	selector := `run_id="$run_id"`
+	for _, key := range keys {
+		selector += fmt.Sprintf(",%s=%q", prometheusName(key), tags[key])
+	}
+
+	for _, column := range sampleColumns() {
+		if column.kind == metricLabel {
+			continue
+		}
+		expr := fmt.Sprintf("%s{%s}", prometheusMetric(column), selector)
+		unit := column.unit
+		if column.kind == metricCounter {
+			// Counters are plotted as their rate
+			expr = fmt.Sprintf("rate(%s[$__rate_interval])", expr)
+			unit = unit.perSecond()
+		}
+		i := len(dashboard.Panels)
+		panel := grafanaPanel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       column.name,
+			Description: column.description,
+			Datasource:  grafanaDatasource,
+			GridPos:     map[string]int{"x": i % 2 * 12, "y": i / 2 * 8, "w": 12, "h": 8},
+			Targets: []grafanaTarget{{
+				RefID:        "A",
+				Expr:         expr,
+				LegendFormat: column.name,
+			}},
+		}
+		panel.FieldConfig.Defaults.Unit = grafanaUnits[unit]
+		dashboard.Panels = append(dashboard.Panels, panel)
+	}
+	return dashboard
+}
+
+// writeGrafanaDashboard writes the dashboard JSON, ready to import
+func writeGrafanaDashboard(path string, dashboard grafanaDashboard) error {
+	data, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	StartRun runs any command as the user of go-profile serve, so the API is
+	only open to everyone on loopback addresses. Other addresses need TLS
+	(--tls-cert and --tls-key) and a way to authenticate the clients: a
+	client certificate signed by --tls-client-ca (mutual TLS) and/or the
+	shared token in GO_PROFILE_TOKEN, which clients send as
+	"authorization: Bearer <token>". go-profile coordinate sends the same
+	variable to its agents.
+*/
+
+// The token is taken from the environment, so it doesn't end up in the
+// shell history and the process list
+const serveTokenEnv = "GO_PROFILE_TOKEN"
+
+// serveSecurity configures the server's TLS and client authentication
+type serveSecurity struct {
+	certFile, keyFile string
+	clientCA          string
+	token             string
+}
+
+// serverOptions returns the gRPC options of the configuration, it fails if
+// address is not a loopback address and the clients are not authenticated
+func (s serveSecurity) serverOptions(address string) ([]grpc.ServerOption, error) {
+	if (s.certFile == "") != (s.keyFile == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key have to be given together")
+	}
+	if s.clientCA != "" && s.certFile == "" {
+		return nil, fmt.Errorf("--tls-client-ca needs --tls-cert and --tls-key")
+	}
+	if !loopbackAddress(address) && (s.certFile == "" || (s.clientCA == "" && s.token == "")) {
+		return nil, fmt.Errorf("%s is not a loopback address, anyone who reaches it could run commands: serve it with --tls-cert and --tls-key, and authenticate the clients with --tls-client-ca or %s", address, serveTokenEnv)
+	}
+
+	var options []grpc.ServerOption
+	if s.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if s.clientCA != "" {
+			pool, err := loadCertPool(s.clientCA)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+	if s.token != "" {
+		options = append(options,
+			grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := s.checkToken(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := s.checkToken(stream.Context()); err != nil {
+					return err
+				}
+				return handler(srv, stream)
+			}))
+	}
+	return options, nil
+}
+
+func (s serveSecurity) checkToken(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong token")
+}
+
+// loopbackAddress returns true if the listen address only accepts
+// connections from this machine
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// agentSecurity configures how go-profile coordinate connects to agents
+type agentSecurity struct {
+	// TLS is used when any of them is set, the agent's certificate is
+	// verified with the CA or the system's roots
+	ca, certFile, keyFile string
+	token                 string
+}
+
+// dialOptions returns the gRPC options of the configuration
+func (a agentSecurity) dialOptions() ([]grpc.DialOption, error) {
+	var options []grpc.DialOption
+	if a.ca == "" && a.certFile == "" && a.keyFile == "" {
+		options = append(options, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if a.ca != "" {
+			pool, err := loadCertPool(a.ca)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = pool
+		}
+		if (a.certFile == "") != (a.keyFile == "") {
+			return nil, fmt.Errorf("--agent-cert and --agent-key have to be given together")
+		}
+		if a.certFile != "" {
+			cert, err := tls.LoadX509KeyPair(a.certFile, a.keyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	}
+	if a.token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(tokenCredentials(a.token)))
+	}
+	return options, nil
+}
+
+// tokenCredentials sends the token of GO_PROFILE_TOKEN with every call
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity is false for agents on loopback addresses, agents
+// on other addresses refuse to serve without TLS
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
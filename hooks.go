@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hooks that take longer are killed, so a stuck integration can't keep the
+// run from finishing
+const hookTimeout = 5 * time.Minute
+
+// hooks runs the --on-start, --on-finish, --on-alert and --on-failure
+// commands with sh -c. The command gets the JSON of the event (the run
+// metadata, the summary or the alert) on stdin and the run in the
+// GO_PROFILE_* environment variables. All methods do nothing for hooks that
+// are not set.
+type hooks struct {
+	opts  *Options
+	runID string
+
+	// Alerts come from the sampling loop, their hooks run in the background
+	alerts sync.WaitGroup
+}
+
+func newHooks(opts *Options, runID string) *hooks {
+	return &hooks{opts: opts, runID: runID}
+}
+
+// run runs a hook and waits for it, env is added to the GO_PROFILE_* variables
+func (h *hooks) run(event, command string, payload interface{}, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GO_PROFILE_EVENT="+event,
+		"GO_PROFILE_RUN_ID="+h.runID,
+		"GO_PROFILE_RUN_DIR="+h.opts.RunDir,
+		"GO_PROFILE_SUMMARY_JSON="+h.opts.SummaryJSON,
+		"GO_PROFILE_HTML="+h.opts.HTML,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--on-%s: %w", event, err)
+	}
+	return nil
+}
+
+// start runs --on-start before the command is started
+func (h *hooks) start(metadata RunMetadata) error {
+	return h.run("start", h.opts.OnStart, metadata)
+}
+
+// alert runs --on-alert in the background when an alert starts or ends
+func (h *hooks) alert(message string, event AlertEvent, logPrintf func(string, ...interface{})) {
+	if h.opts.OnAlert == "" {
+		return
+	}
+	h.alerts.Add(1)
+	go func() {
+		defer h.alerts.Done()
+		if err := h.run("alert", h.opts.OnAlert, event, "GO_PROFILE_ALERT="+message); err != nil {
+			logPrintf("Hook failed: %s", err)
+		}
+	}()
+}
+
+// wait waits for the alert hooks that are still running
+func (h *hooks) wait() {
+	h.alerts.Wait()
+}
+
+// finish runs --on-failure if the run failed and then --on-finish, the
+// summary is nil if the command didn't start
+func (h *hooks) finish(summary *Summary, failed bool) []error {
+	exitCode := -1
+	if summary != nil {
+		exitCode = summary.ExitCode
+	}
+	env := "GO_PROFILE_EXIT_CODE=" + strconv.Itoa(exitCode)
+
+	var errs []error
+	if failed {
+		if err := h.run("failure", h.opts.OnFailure, summary, env); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := h.run("finish", h.opts.OnFinish, summary, env); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
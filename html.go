@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	heatmapCellHeight = 8
+	heatmapLabelWidth = 50
+)
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-profile {{.Summary.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td, th { padding: 2px 12px 2px 0; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Command}}</h1>
+<table>
+{{range .Rows}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+{{if .Summary.Anomalies}}<h2>Anomalies</h2>
+<ul>
+{{range .Anomalies}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{if .Summary.Alerts}}<h2>Alerts</h2>
+<ul>
+{{range .Summary.Alerts}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}<h2>Usage</h2>
+{{.Chart}}
+{{if .Buckets}}<h2>Per {{.Interval}}</h2>
+<p>Average / maximum of the samples in every interval.</p>
+<table>
+<tr><th>Time</th><th>Samples</th><th>CPU</th><th>Memory</th><th>GPU</th><th>Command RSS</th></tr>
+{{range .Buckets}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}{{if .Heatmap}}<h2>CPU cores</h2>
+<p>Utilization of every core over time, from white (idle) to red (busy).</p>
+{{.Heatmap}}
+{{end}}</body>
+</html>
+`))
+
+// renderHeatmapSVG draws the utilization of every core (rows) over time
+// (columns), empty if the cores were not sampled
+func renderHeatmapSVG(samples []Sample) string {
+	cores := 0
+	for _, sample := range samples {
+		cores = max(cores, len(sample.CpuCores))
+	}
+	if cores == 0 {
+		return ""
+	}
+
+	cellWidth := float64(chartWidth-heatmapLabelWidth) / float64(len(samples))
+	height := cores * heatmapCellHeight
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="%d">`+"\n", chartWidth, height, heatmapCellHeight)
+	for core := 0; core < cores; core++ {
+		y := core * heatmapCellHeight
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">cpu%d</text>`+"\n", heatmapLabelWidth-4, y+heatmapCellHeight-1, core)
+		for i, sample := range samples {
+			if core >= len(sample.CpuCores) {
+				continue
+			}
+			// Fade from white to red with the utilization
+			shade := 255 - int(min(max(sample.CpuCores[core], 0), 100)*2.55)
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="#ff%02x%02x"/>`+"\n",
+				float64(heatmapLabelWidth)+float64(i)*cellWidth, y, cellWidth+0.5, heatmapCellHeight, shade, shade)
+		}
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// writeHTMLReport writes a self-contained HTML page with the summary, the
+// usage chart, the rollup of the samples per interval (unless it is 0) and
+// the per-core heatmap of the run
+func writeHTMLReport(path string, summary *Summary, samples []Sample, interval time.Duration) error {
+	rows := [][2]string{
+		{"Run ID", summary.RunID},
+		{"Start", summary.Start.Format(time.RFC3339)},
+		{"Duration", summary.Duration.Round(time.Millisecond).String()},
+		{"Exit code", fmt.Sprint(summary.ExitCode)},
+		{"CPU", fmt.Sprintf("min: %.2f%%, max: %.2f%%, avg: %.2f%%", summary.CPU.Min, summary.CPU.Max, summary.CPU.Avg)},
+		{"Memory", fmt.Sprintf("min: %s, max: %s, avg: %s",
+			formatBytes(uint64(summary.Memory.Min)),
+			formatBytes(uint64(summary.Memory.Max)),
+			formatBytes(uint64(summary.Memory.Avg)))},
+		{"GPU", fmt.Sprintf("min: %.2f%%, max: %.2f%%, avg: %.2f%%", summary.GPU.Min, summary.GPU.Max, summary.GPU.Avg)},
+	}
+	if summary.CPUTime != nil {
+		rows = append(rows, [2]string{"Command CPU time", summary.CPUTime.String()})
+	}
+	for _, file := range summary.ExpectedFiles {
+		result := "OK (" + formatBytes(file.Size) + ")"
+		if !file.OK {
+			result = "FAILED, " + file.Problem
+		}
+		rows = append(rows, [2]string{"Expected file " + file.Path, result})
+	}
+	if startup := summary.Startup; startup != nil {
+		rows = append(rows, [2]string{"Startup", fmt.Sprintf("first output: %s, first CPU activity: %s, steady state: %s",
+			formatStartup(startup.FirstOutput),
+			formatStartup(startup.FirstCPU),
+			formatStartup(startup.SteadyState))})
+	}
+	if idle := summary.GPUIdle; idle != nil {
+		rows = append(rows, [2]string{"GPU idle", fmt.Sprintf("%.1f%% of the run (%.1f%% while the CPU was busy), longest gap: %s at %s",
+			idle.IdleFraction*100.0,
+			idle.StallFraction*100.0,
+			idle.LongestGap.Round(time.Millisecond),
+			formatOffset(idle.LongestGapStart, summary.Start))})
+	}
+	for _, fault := range summary.GPUFaults {
+		rows = append(rows, [2]string{"GPU fault", formatOffset(fault.Time, summary.Start) + ": " + fault.String()})
+	}
+	if summary.MemoryTrend != nil {
+		rows = append(rows, [2]string{"Memory trend", summary.MemoryTrend.String()})
+	}
+	for _, phase := range summary.Phases {
+		rows = append(rows, [2]string{"Phase", phase.String(summary.ChildGPU != nil)})
+	}
+	if summary.Energy != nil {
+		rows = append(rows, [2]string{"Energy", summary.Energy.String()})
+		for _, event := range summary.Energy.PerEvent {
+			rows = append(rows, [2]string{"Energy per " + event.Event, formatJoules(event.PerUnit)})
+		}
+	}
+	if summary.Carbon != nil {
+		rows = append(rows, [2]string{"Carbon", summary.Carbon.String()})
+		for _, event := range summary.Carbon.PerEvent {
+			rows = append(rows, [2]string{"Carbon per " + event.Event, formatGrams(event.PerUnit) + " CO2e"})
+		}
+	}
+	if summary.Cost != nil {
+		rows = append(rows, [2]string{"Cost", summary.Cost.String()})
+	}
+	if summary.MPI != nil {
+		rows = append(rows, [2]string{"MPI", summary.MPI.String()})
+		for _, rank := range summary.MPI.Ranks {
+			rows = append(rows, [2]string{fmt.Sprintf("MPI rank %d", rank.Rank), fmt.Sprintf("CPU time %s, RSS max %s, avg %s",
+				rank.CPUTime.Round(time.Millisecond), formatBytes(uint64(rank.RSS.Max)), formatBytes(uint64(rank.RSS.Avg)))})
+		}
+	}
+	if len(summary.Tags) > 0 {
+		rows = append(rows, [2]string{"Tags", formatTags(summary.Tags)})
+	}
+	if summary.Error != "" {
+		rows = append(rows, [2]string{"Error", summary.Error})
+	}
+
+	var anomalies []string
+	for _, anomaly := range summary.Anomalies {
+		anomalies = append(anomalies, fmt.Sprintf("%s: %s", formatOffset(anomaly.Time, summary.Start), anomaly.Message))
+	}
+
+	var chart string
+	if len(samples) > 0 {
+		var duration time.Duration
+		if len(samples) > 1 {
+			duration = samples[len(samples)-1].Time.Sub(samples[0].Time)
+		}
+		chart = renderChartSVG(chartPanels(samples), duration)
+	}
+
+	var buckets [][]string
+	if interval > 0 && len(samples) > 0 {
+		buckets = bucketTable(rollupSamples(samples, interval), samples[0].Time)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = htmlReportTemplate.Execute(file, map[string]interface{}{
+		"Summary":   summary,
+		"Command":   strings.Join(summary.Command, " "),
+		"Rows":      rows,
+		"Anomalies": anomalies,
+		"Interval":  interval,
+		"Buckets":   buckets,
+		// Both are generated by go-profile and contain no user input
+		"Chart":   template.HTML(chart),
+		"Heatmap": template.HTML(renderHeatmapSVG(samples)),
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port counters of the InfiniBand (and RoCE) devices
+var infinibandPorts = "/sys/class/infiniband/*/ports/*"
+
+// infinibandCounters samples the interconnect throughput of multi-node
+// jobs (e.g. NCCL over RDMA), which bypasses the network stack of the
+// kernel and is missing from the socket statistics
+type infinibandCounters struct {
+	ports  []string
+	tx, rx counter
+}
+
+// newInfinibandCounters returns nil without InfiniBand devices
+func newInfinibandCounters() *infinibandCounters {
+	ports, _ := filepath.Glob(infinibandPorts)
+	if len(ports) == 0 {
+		return nil
+	}
+	return &infinibandCounters{ports: ports}
+}
+
+// names returns the ports as device/port, e.g. "mlx5_0/1"
+func (c *infinibandCounters) names() []string {
+	var names []string
+	for _, port := range c.ports {
+		names = append(names, filepath.Base(filepath.Dir(filepath.Dir(port)))+"/"+filepath.Base(port))
+	}
+	return names
+}
+
+// sample returns the throughput in bytes/s summed over the ports, false for
+// the first sample
+func (c *infinibandCounters) sample(now time.Time) (tx float64, rx float64, ok bool) {
+	var sent, received uint64
+	for _, port := range c.ports {
+		sent += readPortCounter(port, "port_xmit_data")
+		received += readPortCounter(port, "port_rcv_data")
+	}
+	tx, txOk := c.tx.rate(now, sent)
+	rx, rxOk := c.rx.rate(now, received)
+	return tx, rx, txOk && rxOk
+}
+
+// readPortCounter returns a data counter of the port in bytes, the kernel
+// reports them in units of 4 bytes (one per lane)
+func readPortCounter(port string, name string) uint64 {
+	data, err := os.ReadFile(filepath.Join(port, "counters", name))
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return value * 4
+}
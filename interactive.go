@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Bounds of the sampling interval with --interactive
+const (
+	minInteractiveTick = 50 * time.Millisecond
+	maxInteractiveTick = 10 * time.Second
+)
+
+// keyboardControl reads single keys from the terminal while the command
+// runs (--interactive): p pauses and resumes the measurement, m drops a
+// marker, s takes a snapshot and + and - halve and double the sampling
+// interval. The command's stdin is /dev/null, so the keys are ours. Every
+// action is logged and written to the timeline.
+type keyboardControl struct {
+	gate      *measurementGate
+	ticker    *time.Ticker
+	snapshots *snapshotter
+	events    *timeline
+	stamps    *timestampFormat
+	logPrintf func(format string, a ...interface{})
+
+	mu      sync.Mutex
+	tick    time.Duration
+	markers int
+	restore func()
+}
+
+// startKeyboardControl puts the terminal into cbreak mode (keys without
+// enter and without echo) and reads the keys in the background, it returns
+// nil if stdin is not a terminal. stop restores the terminal.
+func startKeyboardControl(gate *measurementGate, ticker *time.Ticker, tick time.Duration, snapshots *snapshotter, events *timeline, stamps *timestampFormat, logPrintf func(format string, a ...interface{})) *keyboardControl {
+	if !isTerminal(os.Stdin) {
+		logPrintf("WARNING: --interactive needs a terminal on stdin")
+		return nil
+	}
+	restore, err := cbreakMode(os.Stdin)
+	if err != nil {
+		logPrintf("WARNING: --interactive can not set up the terminal: %s", err)
+		return nil
+	}
+	k := &keyboardControl{gate: gate, ticker: ticker, tick: tick, snapshots: snapshots, events: events, stamps: stamps, logPrintf: logPrintf, restore: restore}
+	logPrintf("Interactive: p pauses/resumes the measurement, m drops a marker, s takes a snapshot, + and - sample faster and slower")
+	go k.read()
+	return k
+}
+
+func (k *keyboardControl) read() {
+	key := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(key); err != nil || n == 0 {
+			return
+		}
+		k.press(time.Now(), key[0])
+	}
+}
+
+func (k *keyboardControl) press(now time.Time, key byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	elapsed := k.stamps.since(now).Round(time.Millisecond)
+	switch key {
+	case 'p', 'P', ' ':
+		if k.gate.pause(now) {
+			k.action("pause", "Measurement paused at +%s", elapsed)
+		} else {
+			k.action("resume", "Measurement resumed at +%s", elapsed)
+		}
+	case 'm', 'M':
+		k.markers++
+		k.action(fmt.Sprintf("marker %d", k.markers), "Marker %d at +%s", k.markers, elapsed)
+	case 's', 'S':
+		k.events.record("interactive", "snapshot", nil)
+		k.snapshots.take("key s")
+	case '+', '=':
+		k.setTick(k.tick / 2)
+	case '-', '_':
+		k.setTick(k.tick * 2)
+	}
+}
+
+func (k *keyboardControl) setTick(tick time.Duration) {
+	tick = min(max(tick, minInteractiveTick), maxInteractiveTick)
+	if tick == k.tick {
+		return
+	}
+	k.tick = tick
+	k.ticker.Reset(tick)
+	k.action("interval "+tick.String(), "Sampling interval changed to %s", tick)
+}
+
+// action logs the message and records the action in the timeline
+func (k *keyboardControl) action(name string, format string, a ...interface{}) {
+	k.events.record("interactive", name, nil)
+	k.logPrintf(format, a...)
+}
+
+// stop restores the terminal, nothing happens on a nil control
+func (k *keyboardControl) stop() {
+	if k == nil {
+		return
+	}
+	k.restore()
+}
+
+// cbreakMode turns off the line buffering and the echo of the terminal,
+// the returned function turns them back on
+func cbreakMode(file *os.File) (func(), error) {
+	fd := file.Fd()
+	var saved syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&saved))); errno != 0 {
+		return nil, errno
+	}
+	cbreak := saved
+	cbreak.Lflag &^= syscall.ICANON | syscall.ECHO
+	cbreak.Cc[syscall.VMIN] = 1
+	cbreak.Cc[syscall.VTIME] = 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&cbreak))); errno != 0 {
+		return nil, errno
+	}
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&saved)))
+	}, nil
+}
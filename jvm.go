@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// JVMStats are the JMX metrics of a Java command (--jmx)
+type JVMStats = profileio.JVMStats
+
+// JVMSummary aggregates the JMX metrics over the run
+type JVMSummary struct {
+	HeapUsed Aggregate     `json:"heap_used"`
+	HeapMax  uint64        `json:"heap_max"`
+	GCCount  uint64        `json:"gc_count"`
+	GCTime   time.Duration `json:"gc_time"`
+}
+
+// jvmMetrics reads the MBeans of a JVM through a Jolokia agent, the
+// HTTP/JSON bridge to JMX (JMX itself is Java RMI)
+type jvmMetrics struct {
+	base   string
+	client *http.Client
+
+	gcCount, gcTime counter
+
+	heapAgg      aggregator
+	heapMax      uint64
+	totalGCCount uint64
+	totalGCTime  time.Duration
+}
+
+// newJVMMetrics accepts host:port of the Jolokia agent or its full URL
+func newJVMMetrics(address string) *jvmMetrics {
+	base := strings.TrimSuffix(address, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base + "/jolokia"
+	}
+	return &jvmMetrics{base: base, client: &http.Client{Timeout: 200 * time.Millisecond}}
+}
+
+// read fetches an MBean attribute from Jolokia into value
+func (j *jvmMetrics) read(path string, value interface{}) error {
+	resp, err := j.client.Get(j.base + "/read/" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status int             `json:"status"`
+		Error  string          `json:"error"`
+		Value  json.RawMessage `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Status != http.StatusOK {
+		return fmt.Errorf("jolokia: %s", result.Error)
+	}
+	return json.Unmarshal(result.Value, value)
+}
+
+// sample returns the JVM metrics, the agent may not be serving yet
+func (j *jvmMetrics) sample() (*JVMStats, error) {
+	var heap struct {
+		Used uint64 `json:"used"`
+		Max  int64  `json:"max"`
+	}
+	if err := j.read("java.lang:type=Memory/HeapMemoryUsage", &heap); err != nil {
+		return nil, err
+	}
+
+	// Every collector (e.g. young and old generation) is a separate MBean
+	var collectors map[string]struct {
+		CollectionCount uint64 `json:"CollectionCount"`
+		CollectionTime  uint64 `json:"CollectionTime"`
+	}
+	if err := j.read("java.lang:type=GarbageCollector,name=*/CollectionCount,CollectionTime", &collectors); err != nil {
+		return nil, err
+	}
+	var gcCount, gcTime uint64
+	for _, collector := range collectors {
+		gcCount += collector.CollectionCount
+		gcTime += collector.CollectionTime
+	}
+
+	stats := &JVMStats{HeapUsed: heap.Used}
+	// The maximum is -1 when it is undefined
+	if heap.Max > 0 {
+		stats.HeapMax = uint64(heap.Max)
+	}
+	gcCount, countOK := j.gcCount.delta(gcCount)
+	gcTime, timeOK := j.gcTime.delta(gcTime)
+	if countOK && timeOK {
+		stats.GCCount = gcCount
+		stats.GCTime = time.Duration(gcTime) * time.Millisecond
+	}
+
+	j.heapAgg.add(float64(stats.HeapUsed))
+	j.heapMax = max(j.heapMax, stats.HeapMax)
+	j.totalGCCount += stats.GCCount
+	j.totalGCTime += stats.GCTime
+	return stats, nil
+}
+
+// result returns nil if the JVM was never sampled
+func (j *jvmMetrics) result() *JVMSummary {
+	if j == nil || !j.gcCount.sampled {
+		return nil
+	}
+	return &JVMSummary{
+		HeapUsed: j.heapAgg.result(),
+		HeapMax:  j.heapMax,
+		GCCount:  j.totalGCCount,
+		GCTime:   j.totalGCTime,
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+	Nothing the command started may outlive go-profile:
+
+	- the command runs in its own process group, which is killed when the
+	  command exits (and the signals go-profile gets are forwarded to it)
+	- go-profile is a child subreaper (PR_SET_CHILD_SUBREAPER), so processes
+	  that left the group (setsid, daemons) are re-parented to it instead of
+	  init when their parent exits, and are killed as well (with
+	  --wait-for-tree once they exited by themselves)
+	- the command gets SIGKILL when go-profile itself is killed (PDEATHSIG),
+	  this only reaches the command itself, --unshare pid covers the rest
+*/
+
+// Time the leftover processes get to exit after SIGTERM before SIGKILL
+const killGracePeriod = 2 * time.Second
+
+// commandGroups are the process groups of the running commands
+var commandGroups sync.Map
+
+// subreaper is set once go-profile adopts the orphans of its commands, only
+// when it runs a single command (not in serve)
+var subreaper bool
+
+// setupProcessGroup makes the command the leader of a new process group
+func setupProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
+
+// becomeSubreaper adopts the orphaned descendants of go-profile
+func becomeSubreaper() error {
+	const PR_SET_CHILD_SUBREAPER = 36
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_CHILD_SUBREAPER, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	subreaper = true
+	return nil
+}
+
+// interrupted is set once go-profile got a signal, --runs stops then
+var interrupted atomic.Bool
+
+// forwardSignals passes SIGINT, SIGTERM and SIGHUP on to the commands, so
+// they can shut down and go-profile still prints the summary. A second
+// signal kills them.
+func forwardSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		forwarded := false
+		for sig := range signals {
+			interrupted.Store(true)
+			groups := 0
+			commandGroups.Range(func(key, _ interface{}) bool {
+				groups++
+				if forwarded {
+					syscall.Kill(-key.(int), syscall.SIGKILL)
+				} else {
+					syscall.Kill(-key.(int), sig.(syscall.Signal))
+				}
+				return true
+			})
+			if groups == 0 {
+				// The command did not start yet
+				os.Exit(128 + int(sig.(syscall.Signal)))
+			}
+			if !forwarded {
+				fmt.Fprintf(os.Stderr, "[go-profile] Forwarded %s to the command, repeat to kill it\n", sig)
+			}
+			forwarded = true
+		}
+	}()
+}
+
+// leftoverProcesses returns the processes left in the process group and,
+// as a subreaper, the adopted orphans (children of go-profile outside of
+// its own process group)
+//
+// This reads the real /proc and not --proc-root: the pids are compared with
+// go-profile's own pid and process group and then signaled, which only means
+// something in go-profile's pid namespace.
+func leftoverProcesses(pgid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self, ownGroup := os.Getpid(), syscall.Getpgrp()
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		group, _ := strconv.Atoi(fields[2])
+		if group == pgid || (subreaper && ppid == self && group != ownGroup) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// waitForLeftovers waits until the processes the command left running
+// (daemons) exited, or go-profile got a signal (--wait-for-tree)
+func waitForLeftovers(pgid int, logPrintf func(format string, a ...interface{})) {
+	pids := leftoverProcesses(pgid)
+	if len(pids) == 0 {
+		return
+	}
+	logPrintf("Waiting for %d processes the command left running", len(pids))
+	adopted := map[int]bool{}
+	for ; len(pids) > 0 && !interrupted.Load(); pids = leftoverProcesses(pgid) {
+		for _, pid := range pids {
+			adopted[pid] = true
+		}
+		// Reap the adopted orphans that exited
+		for pid := range adopted {
+			if reaped, _ := syscall.Wait4(pid, nil, syscall.WNOHANG, nil); reaped == pid {
+				delete(adopted, pid)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for pid := range adopted {
+		syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+	}
+	if len(pids) == 0 {
+		logPrintf("The processes the command left running exited")
+	}
+}
+
+// reapOrphans reaps the orphans that exited, for go-profile exec as pid 1
+// of a container: every orphan of the container is re-parented to it. The
+// commands are left to exec.Cmd.Wait and the tools go-profile runs itself
+// (in its own process group) to theirs.
+func reapOrphans() {
+	self, ownGroup := os.Getpid(), syscall.Getpgrp()
+	for range time.Tick(time.Second) {
+		entries, _ := os.ReadDir("/proc")
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			if err != nil {
+				continue
+			}
+			data, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+			if err != nil {
+				continue
+			}
+			stat := string(data)
+			fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+			if len(fields) < 3 || fields[0] != "Z" {
+				continue
+			}
+			ppid, _ := strconv.Atoi(fields[1])
+			group, _ := strconv.Atoi(fields[2])
+			if _, command := commandGroups.Load(pid); ppid != self || group == ownGroup || command {
+				continue
+			}
+			syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+		}
+	}
+}
+
+// killLeftovers terminates what the command left running after it exited.
+// Killing a process can orphan its children, so the processes are scanned
+// again until none are left.
+func killLeftovers(pgid int, logPrintf func(format string, a ...interface{})) {
+	pids := leftoverProcesses(pgid)
+	if len(pids) == 0 {
+		return
+	}
+	logPrintf("Terminating %d leftover processes of the command", len(pids))
+	signaled := map[int]bool{}
+	deadline := time.Now().Add(killGracePeriod)
+	killing := false
+	for ; len(pids) > 0; pids = leftoverProcesses(pgid) {
+		if !killing && time.Now().After(deadline) {
+			logPrintf("Killing %d leftover processes of the command", len(pids))
+			killing = true
+		}
+		for _, pid := range pids {
+			if killing {
+				syscall.Kill(pid, syscall.SIGKILL)
+			} else if !signaled[pid] {
+				syscall.Kill(pid, syscall.SIGTERM)
+			}
+			signaled[pid] = true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Reap the orphans that were adopted by us (waiting for any child would
+	// steal the exit status of the tools go-profile runs itself)
+	for pid := range signaled {
+		syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// The first part of the run is the warm-up and not used for the trend
+	leakWarmupFraction = 0.2
+
+	// Minimum number of samples in the steady state for a trend
+	leakMinSamples = 8
+
+	// Minimum duration of the steady state for a probable leak, over
+	// shorter ones the consecutive samples are too alike for the interval
+	leakMinSteadyState = 5 * time.Minute
+
+	// A leak is probable when the growth is above zero with 95% confidence
+	// and at least this fraction of the average RSS over the steady state
+	leakMinGrowth = 0.01
+)
+
+// MemoryTrend is the linear growth of the command's RSS in bytes/hour
+type MemoryTrend struct {
+	Slope        float64       `json:"slope"`
+	Low          float64       `json:"low"`
+	High         float64       `json:"high"`
+	SteadyState  time.Duration `json:"steady_state"`
+	ProbableLeak bool          `json:"probable_leak"`
+}
+
+// rssPoint is the RSS of the process tree at a point in time
+type rssPoint struct {
+	time time.Time
+	rss  uint64
+	// The pids of the tree, the RSS steps when they change
+	processes string
+}
+
+// leakEstimator collects the RSS of the command for the trend
+type leakEstimator struct {
+	points []rssPoint
+	// The pids of the tree at the next sample
+	processes string
+}
+
+// setProcesses records the pids of the process tree for the next sample
+func (e *leakEstimator) setProcesses(pids []int) {
+	sorted := append([]int(nil), pids...)
+	sort.Ints(sorted)
+	e.processes = fmt.Sprint(sorted)
+}
+
+func (e *leakEstimator) add(now time.Time, rss uint64) {
+	e.points = append(e.points, rssPoint{time: now, rss: rss, processes: e.processes})
+}
+
+// rssSegment is a stretch of the run with the same processes
+type rssSegment struct {
+	points       []rssPoint
+	meanX, meanY float64
+}
+
+// tQuantile975 approximates the 97.5% quantile of Student's t distribution
+func tQuantile975(df float64) float64 {
+	return 1.96 + 2.37/df + 2.8/(df*df)
+}
+
+// result fits a line through the RSS after the warm-up, nil if there are
+// too few samples. The RSS steps when a process starts or exits, which is
+// not growth: every stretch of the run with the same processes gets its own
+// level and the slope is fitted within them (pooled within the segments).
+func (e *leakEstimator) result() *MemoryTrend {
+	points := e.points[int(float64(len(e.points))*leakWarmupFraction):]
+	if len(points) < leakMinSamples {
+		return nil
+	}
+
+	start := points[0].time
+	hours := func(point rssPoint) float64 {
+		return point.time.Sub(start).Hours()
+	}
+	var segments []rssSegment
+	for i := 0; i < len(points); {
+		j := i
+		for j < len(points) && points[j].processes == points[i].processes {
+			j++
+		}
+		segment := rssSegment{points: points[i:j]}
+		n := float64(j - i)
+		for _, point := range segment.points {
+			segment.meanX += hours(point) / n
+			segment.meanY += float64(point.rss) / n
+		}
+		segments = append(segments, segment)
+		i = j
+	}
+
+	n := float64(len(points))
+	var meanY, sxx, sxy float64
+	for _, segment := range segments {
+		meanY += segment.meanY * float64(len(segment.points)) / n
+		for _, point := range segment.points {
+			dx := hours(point) - segment.meanX
+			sxx += dx * dx
+			sxy += dx * (float64(point.rss) - segment.meanY)
+		}
+	}
+	// A level per segment and the slope
+	df := n - float64(len(segments)) - 1
+	if sxx == 0 || meanY == 0 || df < 1 {
+		return nil
+	}
+	slope := sxy / sxx
+
+	// Standard error of the slope from the residuals
+	var residuals float64
+	for _, segment := range segments {
+		for _, point := range segment.points {
+			residual := float64(point.rss) - segment.meanY - slope*(hours(point)-segment.meanX)
+			residuals += residual * residual
+		}
+	}
+	margin := tQuantile975(df) * math.Sqrt(residuals/df/sxx)
+
+	steadyState := points[len(points)-1].time.Sub(start)
+	growth := slope * steadyState.Hours()
+	return &MemoryTrend{
+		Slope:        slope,
+		Low:          slope - margin,
+		High:         slope + margin,
+		SteadyState:  steadyState,
+		ProbableLeak: slope-margin > 0 && growth >= meanY*leakMinGrowth && steadyState >= leakMinSteadyState,
+	}
+}
+
+// formatRate formats a signed rate in bytes/hour
+func formatRate(rate float64) string {
+	if rate < 0 {
+		return "-" + formatBytes(uint64(-rate)) + "/h"
+	}
+	return formatBytes(uint64(rate)) + "/h"
+}
+
+func (t *MemoryTrend) String() string {
+	s := fmt.Sprintf("%s (95%% CI: %s to %s, over %s)",
+		formatRate(t.Slope),
+		formatRate(t.Low),
+		formatRate(t.High),
+		t.SteadyState.Round(time.Second))
+	if t.ProbableLeak {
+		s += ", PROBABLE LEAK"
+	}
+	return s
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The sidecar index of a log has a JSON line per run with the offsets of its
+// sections, so a run can be read from a multi-GB log without scanning it
+const logIndexSuffix = ".idx"
+
+// logIndexEntry holds the byte offsets of a run in the log
+type logIndexEntry struct {
+	RunID string `json:"run_id"`
+	// Start of the run (the ===== line), of the summary (the ----- line) and
+	// the end of the FINISHED line
+	Start   int64 `json:"start"`
+	Summary int64 `json:"summary"`
+	End     int64 `json:"end"`
+	// Sample lines of the run
+	Samples []int64 `json:"samples,omitempty"`
+}
+
+// mark returns the current size of the log including the buffered lines
+func (w *logWriter) mark() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.offset
+}
+
+// appendLogIndex adds the run to the index of the log
+func appendLogIndex(log string, entry logIndexEntry) error {
+	file, err := os.OpenFile(log+logIndexSuffix, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONLine(file, entry); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readLogIndex reads the index of the log, it returns nil if there is no
+// index or it does not match the log (e.g. it was truncated or rotated)
+func readLogIndex(log *os.File) []logIndexEntry {
+	data, err := os.ReadFile(log.Name() + logIndexSuffix)
+	if err != nil {
+		return nil
+	}
+	info, err := log.Stat()
+	if err != nil {
+		return nil
+	}
+	var entries []logIndexEntry
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry logIndexEntry
+		if err := json.Unmarshal(line, &entry); err != nil || entry.End > info.Size() {
+			return nil
+		}
+		entries = append(entries, entry)
+	}
+	// The start of the last run must be a run marker
+	if len(entries) > 0 {
+		marker := make([]byte, 128)
+		n, _ := log.ReadAt(marker, entries[len(entries)-1].Start)
+		if !bytes.Contains(marker[:n], []byte("[go-profile] "+runMarker)) {
+			return nil
+		}
+	}
+	return entries
+}
+
+// runMarker starts a run in the log, summaryMarker its summary and
+// finishedMarker ends it
+const (
+	runMarker      = "========================================="
+	summaryMarker  = "-----------------------------------------"
+	finishedMarker = "=============== FINISHED ================"
+)
+
+// scanLog finds the runs in a log without an index, the sample lines are
+// not recognized
+func scanLog(r io.Reader) ([]logIndexEntry, error) {
+	var entries []logIndexEntry
+	var current *logIndexEntry
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadSlice('\n')
+		for err == bufio.ErrBufferFull {
+			// Lines longer than the buffer can not be markers
+			var more []byte
+			more, err = reader.ReadSlice('\n')
+			offset += int64(len(line))
+			line = more
+		}
+		if len(line) > 0 {
+			switch {
+			case bytes.Contains(line, []byte("[go-profile] "+runMarker)):
+				entries = append(entries, logIndexEntry{Start: offset})
+				current = &entries[len(entries)-1]
+			case current == nil:
+			case current.RunID == "" && bytes.Contains(line, []byte("[go-profile] Run ID: ")):
+				_, id, _ := bytes.Cut(line, []byte("Run ID: "))
+				current.RunID = string(bytes.TrimSpace(id))
+			case bytes.Contains(line, []byte("[go-profile] "+summaryMarker)):
+				current.Summary = offset
+			case bytes.Contains(line, []byte("[go-profile] "+finishedMarker)):
+				current.End = offset + int64(len(line))
+				current = nil
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Runs that did not finish (killed go-profile) have no summary
+	finished := entries[:0]
+	for _, entry := range entries {
+		if entry.End > 0 {
+			finished = append(finished, entry)
+		}
+	}
+	return finished, nil
+}
+
+// findRun returns the last run with the id, or the last run if id is empty
+func findRun(entries []logIndexEntry, id string) (logIndexEntry, error) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if id == "" || entries[i].RunID == id {
+			return entries[i], nil
+		}
+	}
+	if id == "" {
+		return logIndexEntry{}, fmt.Errorf("no finished runs in the log")
+	}
+	return logIndexEntry{}, fmt.Errorf("run %s is not in the log", id)
+}
+
+// readLogLines reads the line at every offset of the log
+func readLogLines(log *os.File, offsets []int64, w io.Writer) error {
+	reader := bufio.NewReader(nil)
+	for _, offset := range offsets {
+		reader.Reset(io.NewSectionReader(log, offset, 1<<62))
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		io.WriteString(w, line)
+	}
+	return nil
+}
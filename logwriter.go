@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFlushInterval is how often buffered log lines are written to disk
+const logFlushInterval = time.Second
+
+// logWriter buffers writes to the log file and flushes them periodically
+// from a background goroutine. Every Write is atomic with respect to other
+// writers, so lines from different goroutines never interleave.
+type logWriter struct {
+	mu     sync.Mutex
+	file   io.WriteCloser
+	buffer *bufio.Writer // nil when writing through (--sync-log)
+	offset int64         // size of the (uncompressed) file including the buffered lines
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// openLogWriter opens path for appending, with sync every write goes straight
+// to disk (O_SYNC) instead of being buffered. The log is compressed with
+// compress (--compress), the offsets then count from the start of this run.
+func openLogWriter(path string, sync bool, compress string) (*logWriter, error) {
+	flags := os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	if sync {
+		flags |= os.O_SYNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	if info, err := file.Stat(); err == nil && compress == "" {
+		offset = info.Size()
+	}
+	compressed, err := compressFile(file, compress)
+	if err != nil {
+		return nil, err
+	}
+	w := newLogWriter(compressed, sync)
+	w.offset = offset
+	return w, nil
+}
+
+// newLogWriter takes ownership of file, with sync every write goes directly
+// to the file instead of being buffered
+func newLogWriter(file io.WriteCloser, sync bool) *logWriter {
+	w := &logWriter{file: file, done: make(chan struct{}), closed: make(chan struct{})}
+	if sync {
+		close(w.closed)
+		return w
+	}
+
+	w.buffer = bufio.NewWriterSize(file, 64*1024)
+	go func() {
+		defer close(w.closed)
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Flush()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	_, n, err := w.writeAt(p)
+	return n, err
+}
+
+// writeAt writes p and returns the offset in the file it was written at
+func (w *logWriter) writeAt(p []byte) (int64, int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	offset := w.offset
+	var n int
+	var err error
+	if w.buffer == nil {
+		n, err = w.file.Write(p)
+	} else {
+		n, err = w.buffer.Write(p)
+	}
+	w.offset += int64(n)
+	return offset, n, err
+}
+
+func (w *logWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush writes the buffered lines to the file
+func (w *logWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buffer == nil {
+		return nil
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	// Compressors hold back data until they are flushed
+	if flusher, ok := w.file.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close stops the background flushing, flushes and closes the file
+func (w *logWriter) Close() error {
+	if w.buffer != nil {
+		close(w.done)
+	}
+	<-w.closed
+	if err := w.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
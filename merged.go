@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// mergedColors tell the runs of a merged report apart (tab10)
+var mergedColors = []color.RGBA{
+	{0x1f, 0x77, 0xb4, 0xff},
+	{0xff, 0x7f, 0x0e, 0xff},
+	{0x2c, 0xa0, 0x2c, 0xff},
+	{0xd6, 0x27, 0x28, 0xff},
+	{0x94, 0x67, 0xbd, 0xff},
+	{0x8c, 0x56, 0x4b, 0xff},
+	{0xe3, 0x77, 0xc2, 0xff},
+	{0x7f, 0x7f, 0x7f, 0xff},
+	{0xbc, 0xbd, 0x22, 0xff},
+	{0x17, 0xbe, 0xcf, 0xff},
+}
+
+// recordedRun is a run read back from its run directory
+type recordedRun struct {
+	label   string
+	summary *profileio.Summary
+	samples []Sample
+	// Time the chart of the run starts at, the first sample if not set
+	// (runs of several hosts share one)
+	origin time.Time
+}
+
+// readRunDir reads the samples (metrics.jsonl, possibly compressed) and the
+// summary of a run directory, the summary is optional
+func readRunDir(dir string) (*recordedRun, error) {
+	recorded, err := profileio.ReadRunDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(recorded.Samples) == 0 {
+		return nil, fmt.Errorf("%s has no samples", dir)
+	}
+	run := &recordedRun{label: filepath.Base(filepath.Clean(dir)), summary: recorded.Summary, samples: recorded.Samples}
+	if target, err := filepath.EvalSymlinks(dir); err == nil {
+		run.label = filepath.Base(target)
+	}
+	if run.summary != nil && len(run.summary.Tags) > 0 {
+		run.label += " (" + formatTags(run.summary.Tags) + ")"
+	}
+	return run, nil
+}
+
+// duration is the time from the first to the last sample
+func (r *recordedRun) duration() time.Duration {
+	return r.samples[len(r.samples)-1].Time.Sub(r.samples[0].Time)
+}
+
+// start is the origin of the run in the charts
+func (r *recordedRun) start() time.Time {
+	if r.origin.IsZero() {
+		return r.samples[0].Time
+	}
+	return r.origin
+}
+
+// mergedPanel is a chart panel with a line per run
+type mergedPanel struct {
+	title string
+	value func(sample Sample) float64
+}
+
+// renderMergedSVG overlays the CPU, memory and GPU usage of the runs, the
+// x axis is the time since the start of each run
+func renderMergedSVG(runs []*recordedRun) string {
+	panels := []mergedPanel{
+		{"CPU %", func(s Sample) float64 { return s.CpuPercent }},
+		{"Memory %", func(s Sample) float64 { return s.MemPercent }},
+	}
+	var longest time.Duration
+	hasGpu := false
+	for _, run := range runs {
+		longest = max(longest, run.samples[len(run.samples)-1].Time.Sub(run.start()))
+		for _, sample := range run.samples {
+			hasGpu = hasGpu || sample.GpuCount > 0
+		}
+	}
+	if hasGpu {
+		panels = append(panels, mergedPanel{"GPU %", func(s Sample) float64 { return s.GpuPercent }})
+	}
+
+	height := len(panels) * chartPanelHeight
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`+"\n", chartWidth, height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="white"/>`+"\n", chartWidth, height)
+	for p, panel := range panels {
+		left, top := chartPoint(p, 0, 1, 100)
+		right, bottom := chartPoint(p, 1, 2, 0)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f">%s</text>`+"\n", left, top-4, panel.title)
+		for _, percent := range []float64{0, 50, 100} {
+			_, y := chartPoint(p, 0, 1, percent)
+			fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", left, y, right, y)
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="end">%.0f</text>`+"\n", left-4, y+4, percent)
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="end">%s</text>`+"\n", right, bottom+14, longest.Round(time.Millisecond))
+
+		for r, run := range runs {
+			points := make([]string, len(run.samples))
+			for i, sample := range run.samples {
+				_, y := chartPoint(p, 0, 1, panel.value(sample))
+				x := left
+				if longest > 0 {
+					x += (right - left) * float64(sample.Time.Sub(run.start())) / float64(longest)
+				}
+				points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+			}
+			c := mergedColors[r%len(mergedColors)]
+			fmt.Fprintf(&b, `<polyline fill="none" stroke="#%02x%02x%02x" stroke-width="1.5" points="%s"/>`+"\n",
+				c.R, c.G, c.B, strings.Join(points, " "))
+		}
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+var mergedReportTemplate = template.Must(template.New("merged").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-profile: {{len .Runs}} runs</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td, th { padding: 2px 12px 2px 0; text-align: left; }
+.swatch { display: inline-block; width: 1em; height: 1em; vertical-align: middle; }
+</style>
+</head>
+<body>
+<h1>{{len .Runs}} runs</h1>
+<table>
+<tr><th>Run</th><th>Command</th><th>Duration</th><th>Exit code</th><th>CPU avg / max</th><th>Memory max</th><th>GPU avg / max</th></tr>
+{{range .Runs}}<tr><td><span class="swatch" style="background: {{.Color}}"></span> {{.Label}}</td>{{range .Cells}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+<h2>Usage</h2>
+{{.Chart}}
+</body>
+</html>
+`))
+
+// writeMergedReport writes an HTML page that compares the runs and overlays
+// their usage on the same charts
+func writeMergedReport(path string, runs []*recordedRun) error {
+	type row struct {
+		Label string
+		Color template.CSS
+		Cells []string
+	}
+	rows := make([]row, len(runs))
+	for i, run := range runs {
+		c := mergedColors[i%len(mergedColors)]
+		rows[i] = row{Label: run.label, Color: template.CSS(fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B))}
+		if s := run.summary; s != nil {
+			rows[i].Cells = []string{
+				strings.Join(s.Command, " "),
+				s.Duration.Round(time.Millisecond).String(),
+				fmt.Sprint(s.ExitCode),
+				fmt.Sprintf("%.2f%% / %.2f%%", s.CPU.Avg, s.CPU.Max),
+				formatBytes(uint64(s.Memory.Max)),
+				fmt.Sprintf("%.2f%% / %.2f%%", s.GPU.Avg, s.GPU.Max),
+			}
+		} else {
+			rows[i].Cells = []string{"", run.duration().Round(time.Millisecond).String(), "", "", "", ""}
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = mergedReportTemplate.Execute(file, map[string]interface{}{
+		"Runs": rows,
+		// Generated by go-profile and contains no user input
+		"Chart": template.HTML(renderMergedSVG(runs)),
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	Derived metrics are arithmetic expressions over the summary:
+
+	expr   = term { ("+" | "-") term }
+	term   = factor { ("*" | "/") factor }
+	factor = number | name | "(" expr ")" | "-" factor
+	name   = identifier { "." identifier }
+*/
+
+// metricExpr is a parsed --metric-expr
+type metricExpr struct {
+	name   string
+	source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type exprNumber float64
+
+type exprVariable string
+
+type exprNegate struct {
+	operand exprNode
+}
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n exprNumber) eval(vars map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n exprVariable) eval(vars map[string]float64) (float64, error) {
+	value, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("unknown variable: %s", string(n))
+	}
+	return value, nil
+}
+
+func (n exprNegate) eval(vars map[string]float64) (float64, error) {
+	value, err := n.operand.eval(vars)
+	return -value, err
+}
+
+func (n exprBinary) eval(vars map[string]float64) (float64, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	}
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// exprParser is a recursive descent parser for the grammar above
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, 0 at the end of the input
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *exprParser) expr() (exprNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) term() (exprNode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) factor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("expected ) at position %d", p.pos)
+		}
+		p.pos++
+		return node, nil
+	case c == '-':
+		p.pos++
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return exprNegate{operand: operand}, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] == '.' || p.input[p.pos] == 'e' ||
+			(p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", p.input[start:p.pos])
+		}
+		return exprNumber(value), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] == '.' || p.input[p.pos] == '_' ||
+			unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		return exprVariable(p.input[start:p.pos]), nil
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+}
+
+// parseMetricExpr parses "name = expression"
+func parseMetricExpr(value string) (metricExpr, error) {
+	name, source, ok := strings.Cut(value, "=")
+	name, source = strings.TrimSpace(name), strings.TrimSpace(source)
+	if !ok || !isIdentifier(name) {
+		return metricExpr{}, fmt.Errorf("expected name = expression, got %q", value)
+	}
+	parser := &exprParser{input: source}
+	root, err := parser.expr()
+	if err != nil {
+		return metricExpr{}, err
+	}
+	if parser.peek() != 0 {
+		return metricExpr{}, fmt.Errorf("unexpected %q at position %d", parser.input[parser.pos], parser.pos)
+	}
+	return metricExpr{name: name, source: source, root: root}, nil
+}
+
+// metricExprList is a flag value for the repeated --metric-expr
+type metricExprList []metricExpr
+
+func (m *metricExprList) String() string {
+	var values []string
+	for _, expr := range *m {
+		values = append(values, expr.name+" = "+expr.source)
+	}
+	return strings.Join(values, ",")
+}
+
+func (m *metricExprList) Set(value string) error {
+	expr, err := parseMetricExpr(value)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, expr)
+	return nil
+}
+
+// Metric is the value of a derived metric, Error is set if it could not be
+// calculated
+type Metric struct {
+	Name       string  `json:"name"`
+	Expression string  `json:"expression"`
+	Value      float64 `json:"value"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// metricVariables returns the values of the summary the expressions can use
+func metricVariables(s *Summary) map[string]float64 {
+	vars := map[string]float64{
+		"duration":  s.Duration.Seconds(),
+		"exit_code": float64(s.ExitCode),
+	}
+	aggregates := map[string]Aggregate{"cpu": s.CPU, "memory": s.Memory, "gpu": s.GPU}
+	if s.ChildGPU != nil {
+		aggregates["child_gpu"] = *s.ChildGPU
+		aggregates["child_gpu_memory"] = *s.ChildGPUMemory
+	}
+	for name, aggregate := range aggregates {
+		vars[name+".min"] = aggregate.Min
+		vars[name+".max"] = aggregate.Max
+		vars[name+".avg"] = aggregate.Avg
+	}
+	if s.CPUTime != nil {
+		vars["cpu_time.user"] = s.CPUTime.User.Seconds()
+		vars["cpu_time.system"] = s.CPUTime.System.Seconds()
+		vars["parallelism"] = s.CPUTime.Parallelism
+	}
+	if s.ChildNetwork != nil {
+		vars["net.received"] = float64(s.ChildNetwork.Received)
+		vars["net.transmitted"] = float64(s.ChildNetwork.Transmitted)
+	}
+	if s.Energy != nil {
+		vars["energy.cpu"] = s.Energy.CPU
+		vars["energy.gpu"] = s.Energy.GPU
+		vars["energy.total"] = s.Energy.Total
+	}
+	if s.Carbon != nil {
+		vars["carbon"] = s.Carbon.Grams
+	}
+	if s.Cost != nil {
+		vars["cost"] = s.Cost.Cost
+		vars["cost.idle"] = s.Cost.IdleCost
+	}
+	for _, event := range s.Events {
+		vars["events."+event.Name] = float64(event.Count)
+		vars["events."+event.Name+".sum"] = event.Sum
+		vars["events."+event.Name+".last"] = event.Last
+	}
+	return vars
+}
+
+// evaluateMetrics calculates the expressions over the summary
+func evaluateMetrics(exprs []metricExpr, s *Summary) []Metric {
+	vars := metricVariables(s)
+	var metrics []Metric
+	for _, expr := range exprs {
+		metric := Metric{Name: expr.name, Expression: expr.source}
+		value, err := expr.root.eval(vars)
+		if err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+			err = fmt.Errorf("result is not a number")
+		}
+		if err != nil {
+			metric.Error = err.Error()
+		} else {
+			metric.Value = value
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// mpiLaunchers are the commands that start MPI ranks as their children.
+// srun is not one of them: the ranks of a step are children of slurmstepd.
+var mpiLaunchers = map[string]bool{
+	"mpirun":  true,
+	"mpiexec": true,
+	"orterun": true,
+	"prterun": true,
+}
+
+// mpiRankVariables hold the rank in the environment of a rank process
+// (Open MPI, MPICH/Intel MPI, PMIx and MVAPICH)
+var mpiRankVariables = [][]byte{
+	[]byte("OMPI_COMM_WORLD_RANK="),
+	[]byte("PMI_RANK="),
+	[]byte("PMIX_RANK="),
+	[]byte("MV2_COMM_WORLD_RANK="),
+}
+
+// MPIRank is the usage of a rank on this host
+type MPIRank struct {
+	Rank int   `json:"rank"`
+	Pids []int `json:"pids"`
+	// User and system CPU time of the processes of the rank
+	CPUTime time.Duration `json:"cpu_time"`
+	RSS     Aggregate     `json:"rss"`
+}
+
+// MPISummary is the per-rank breakdown of an MPI job, the ranks on other
+// hosts are not seen
+type MPISummary struct {
+	Ranks []MPIRank `json:"ranks"`
+
+	MinCPUTime time.Duration `json:"min_cpu_time"`
+	MaxCPUTime time.Duration `json:"max_cpu_time"`
+	MinRank    int           `json:"min_rank"`
+	MaxRank    int           `json:"max_rank"`
+	// Load imbalance: how much longer the busiest rank computed than the
+	// average rank, in percent
+	Imbalance float64 `json:"imbalance"`
+}
+
+func (s *MPISummary) String() string {
+	return fmt.Sprintf("%d ranks, CPU time min: %s (rank %d), max: %s (rank %d), imbalance: %.1f%%",
+		len(s.Ranks),
+		s.MinCPUTime.Round(time.Millisecond), s.MinRank,
+		s.MaxCPUTime.Round(time.Millisecond), s.MaxRank,
+		s.Imbalance)
+}
+
+// mpiTracker finds the rank processes in the command's process tree by
+// their environment and follows their CPU time and RSS
+type mpiTracker struct {
+	// Rank of every pid seen, -1 for processes that are not ranks
+	ranks map[int]int
+	// Last CPU time of the rank processes in clock ticks, it stays when the
+	// process exits
+	ticks map[int]uint64
+	rss   map[int]*aggregator
+}
+
+// newMPITracker returns nil unless the command is an MPI launcher
+func newMPITracker(command []string) *mpiTracker {
+	if !mpiLaunchers[filepath.Base(command[0])] {
+		return nil
+	}
+	return &mpiTracker{ranks: map[int]int{}, ticks: map[int]uint64{}, rss: map[int]*aggregator{}}
+}
+
+func (t *mpiTracker) sample(pids []int) {
+	rssByRank := map[int]uint64{}
+	// The launcher itself can have a rank variable (started by another
+	// launcher)
+	for _, pid := range pids[1:] {
+		rank, seen := t.ranks[pid]
+		if !seen {
+			rank = readMPIRank(pid)
+			t.ranks[pid] = rank
+		}
+		if rank < 0 {
+			continue
+		}
+		if ticks := getProcessCPUTicks([]int{pid}); ticks > 0 {
+			t.ticks[pid] = ticks
+		}
+		rssByRank[rank] += getProcessRSS([]int{pid})
+	}
+	for rank, rss := range rssByRank {
+		if t.rss[rank] == nil {
+			t.rss[rank] = &aggregator{}
+		}
+		t.rss[rank].add(float64(rss))
+	}
+}
+
+// readMPIRank returns the rank from the environment of the process, -1 if
+// it is not a rank (or its environment can not be read)
+func readMPIRank(pid int) int {
+	environ, err := os.ReadFile(pidPath(pid, "environ"))
+	if err != nil {
+		return -1
+	}
+	for _, variable := range bytes.Split(environ, []byte{0}) {
+		for _, name := range mpiRankVariables {
+			if value, ok := bytes.CutPrefix(variable, name); ok {
+				if rank, err := strconv.Atoi(string(value)); err == nil {
+					return rank
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// result returns nil if no rank was found
+func (t *mpiTracker) result() *MPISummary {
+	if t == nil || len(t.rss) == 0 {
+		return nil
+	}
+	byRank := map[int]*MPIRank{}
+	for pid, rank := range t.ranks {
+		if rank < 0 {
+			continue
+		}
+		if byRank[rank] == nil {
+			byRank[rank] = &MPIRank{Rank: rank}
+			if rss := t.rss[rank]; rss != nil {
+				byRank[rank].RSS = rss.result()
+			}
+		}
+		byRank[rank].Pids = append(byRank[rank].Pids, pid)
+		byRank[rank].CPUTime += time.Duration(t.ticks[pid]) * time.Second / clockTicks
+	}
+
+	summary := &MPISummary{}
+	var total time.Duration
+	for _, rank := range byRank {
+		sort.Ints(rank.Pids)
+		summary.Ranks = append(summary.Ranks, *rank)
+		total += rank.CPUTime
+	}
+	sort.Slice(summary.Ranks, func(i, j int) bool { return summary.Ranks[i].Rank < summary.Ranks[j].Rank })
+
+	idlest, busiest := summary.Ranks[0], summary.Ranks[0]
+	for _, rank := range summary.Ranks[1:] {
+		if rank.CPUTime < idlest.CPUTime {
+			idlest = rank
+		}
+		if rank.CPUTime > busiest.CPUTime {
+			busiest = rank
+		}
+	}
+	summary.MinCPUTime, summary.MinRank = idlest.CPUTime, idlest.Rank
+	summary.MaxCPUTime, summary.MaxRank = busiest.CPUTime, busiest.Rank
+	if mean := total / time.Duration(len(summary.Ranks)); mean > 0 {
+		summary.Imbalance = (float64(busiest.CPUTime)/float64(mean) - 1) * 100
+	}
+	return summary
+}
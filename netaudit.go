@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+)
+
+// netAudit counts the DNS lookups and HTTP(S) connections made by the
+// command, based on the outgoing packets seen by netCapture
+type netAudit struct {
+	mu           sync.Mutex
+	lookups      map[string]uint64
+	destinations map[string]uint64
+}
+
+func newNetAudit() *netAudit {
+	return &netAudit{lookups: map[string]uint64{}, destinations: map[string]uint64{}}
+}
+
+func destinationPort(transport []byte) uint16 {
+	return binary.BigEndian.Uint16(transport[2:4])
+}
+
+// interesting returns true for DNS queries and the first packet (SYN) of
+// HTTP(S) connections
+func (a *netAudit) interesting(protocol byte, transport []byte) bool {
+	port := destinationPort(transport)
+	switch protocol {
+	case syscall.IPPROTO_UDP:
+		return port == 53
+	case syscall.IPPROTO_TCP:
+		if len(transport) < 14 {
+			return false
+		}
+		flags := transport[13]
+		syn := flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0
+		return syn && (port == 53 || port == 80 || port == 443)
+	}
+	return false
+}
+
+func (a *netAudit) record(protocol byte, remote net.IP, transport []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	port := destinationPort(transport)
+	if port == 53 {
+		name := "(unknown)"
+		if protocol == syscall.IPPROTO_UDP && len(transport) > 8 {
+			if question, ok := parseDNSQuestion(transport[8:]); ok {
+				name = question
+			}
+		}
+		a.lookups[name]++
+		return
+	}
+	a.destinations[net.JoinHostPort(remote.String(), strconv.Itoa(int(port)))]++
+}
+
+// parseDNSQuestion returns the name of the first question of a DNS query
+func parseDNSQuestion(message []byte) (string, bool) {
+	// Skip the header
+	if len(message) < 12 || binary.BigEndian.Uint16(message[4:6]) == 0 {
+		return "", false
+	}
+	var labels []string
+	for offset := 12; offset < len(message); {
+		length := int(message[offset])
+		if length == 0 {
+			return strings.Join(labels, "."), len(labels) > 0
+		}
+		// Queries don't use compression, anything else is malformed
+		if length&0xc0 != 0 || offset+1+length > len(message) {
+			return "", false
+		}
+		labels = append(labels, string(message[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	return "", false
+}
+
+type NetworkAuditEntry struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type NetworkAudit struct {
+	DNSLookups       uint64              `json:"dns_lookups"`
+	HTTPConnections  uint64              `json:"http_connections"`
+	HTTPSConnections uint64              `json:"https_connections"`
+	Lookups          []NetworkAuditEntry `json:"lookups,omitempty"`
+	Destinations     []NetworkAuditEntry `json:"destinations,omitempty"`
+}
+
+// sortedEntries returns the entries with the highest count first
+func sortedEntries(counts map[string]uint64) []NetworkAuditEntry {
+	var entries []NetworkAuditEntry
+	for name, count := range counts {
+		entries = append(entries, NetworkAuditEntry{Name: name, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+func (a *netAudit) result() *NetworkAudit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	audit := &NetworkAudit{
+		Lookups:      sortedEntries(a.lookups),
+		Destinations: sortedEntries(a.destinations),
+	}
+	for _, entry := range audit.Lookups {
+		audit.DNSLookups += entry.Count
+	}
+	for _, entry := range audit.Destinations {
+		if strings.HasSuffix(entry.Name, ":443") {
+			audit.HTTPSConnections += entry.Count
+		} else {
+			audit.HTTPConnections += entry.Count
+		}
+	}
+	return audit
+}
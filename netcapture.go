@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	ethPAll        = 0x0003
+	packetOutgoing = 4
+)
+
+// netCapture attributes network traffic to the command like nethogs does:
+// every packet on the machine is read from a packet socket and counted when
+// its local port belongs to one of the command's sockets. This requires
+// CAP_NET_RAW (or root).
+type netCapture struct {
+	fd        int
+	loopbacks map[int]bool
+	closed    atomic.Bool
+	done      chan struct{}
+
+	mu       sync.Mutex
+	pids     []int
+	tcpPorts map[uint16]bool
+	udpPorts map[uint16]bool
+
+	// audit records DNS lookups and HTTP(S) connections, nil if disabled
+	audit *netAudit
+
+	rxBytes atomic.Uint64
+	txBytes atomic.Uint64
+}
+
+func startNetCapture(audit bool) (*netCapture, error) {
+	// SOCK_DGRAM strips the link layer header, packets start at the IP header
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(ethPAll)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Bursts of packets are dropped when the receive buffer is full, try to
+	// get a big one (SO_RCVBUFFORCE ignores rmem_max but needs CAP_NET_ADMIN)
+	if syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, 32<<20) != nil {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 32<<20)
+	}
+
+	// Wake up regularly so the capture can be stopped
+	timeout := syscall.NsecToTimeval((250 * time.Millisecond).Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// Traffic over loopback would be counted in both directions, skip it like nethogs
+	c := &netCapture{
+		fd:        fd,
+		loopbacks: map[int]bool{},
+		done:      make(chan struct{}),
+		tcpPorts:  map[uint16]bool{},
+		udpPorts:  map[uint16]bool{},
+	}
+	if audit {
+		c.audit = newNetAudit()
+	}
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				c.loopbacks[iface.Index] = true
+			}
+		}
+	}
+
+	go c.run()
+	return c, nil
+}
+
+func htons(value uint16) uint16 {
+	return value<<8 | value>>8
+}
+
+// update sets the ports of the command's sockets
+func (c *netCapture) update(pids []int) {
+	tcpPorts, udpPorts := getSocketPorts(pids)
+	c.mu.Lock()
+	c.pids, c.tcpPorts, c.udpPorts = pids, tcpPorts, udpPorts
+	c.mu.Unlock()
+}
+
+// owns checks if the local port belongs to the command. If refresh is set
+// unknown ports are looked up immediately, for sockets that were created
+// after the last update.
+func (c *netCapture) owns(protocol byte, port uint16, refresh bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ports := c.udpPorts
+	if protocol == syscall.IPPROTO_TCP {
+		ports = c.tcpPorts
+	}
+	if ports[port] || !refresh || c.pids == nil {
+		return ports[port]
+	}
+	c.tcpPorts, c.udpPorts = getSocketPorts(c.pids)
+	if protocol == syscall.IPPROTO_TCP {
+		return c.tcpPorts[port]
+	}
+	return c.udpPorts[port]
+}
+
+// totals returns the bytes received and transmitted by the command so far
+func (c *netCapture) totals() (uint64, uint64) {
+	return c.rxBytes.Load(), c.txBytes.Load()
+}
+
+func (c *netCapture) close() {
+	c.closed.Store(true)
+	<-c.done
+	syscall.Close(c.fd)
+}
+
+func (c *netCapture) run() {
+	defer close(c.done)
+	// Only the headers (and DNS questions) are needed, the rest of the
+	// packet is truncated
+	buffer := make([]byte, 512)
+	for !c.closed.Load() {
+		n, from, err := syscall.Recvfrom(c.fd, buffer, 0)
+		if err != nil {
+			// Timeouts (EAGAIN) and interruptions, check if we should stop
+			continue
+		}
+		link, ok := from.(*syscall.SockaddrLinklayer)
+		if !ok || c.loopbacks[link.Ifindex] {
+			continue
+		}
+		c.count(buffer[:n], link.Pkttype == packetOutgoing)
+	}
+}
+
+// count adds the packet to the totals if it belongs to the command
+func (c *netCapture) count(packet []byte, outgoing bool) {
+	if len(packet) < 1 {
+		return
+	}
+
+	var protocol byte
+	var length uint64
+	var transport []byte
+	var remote net.IP
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		headerLength := int(packet[0]&0x0f) * 4
+		if len(packet) < headerLength {
+			return
+		}
+		protocol = packet[9]
+		length = uint64(binary.BigEndian.Uint16(packet[2:4]))
+		transport = packet[headerLength:]
+		remote = net.IP(packet[16:20])
+	case 6:
+		// Extension headers are not followed
+		if len(packet) < 40 {
+			return
+		}
+		protocol = packet[6]
+		length = uint64(binary.BigEndian.Uint16(packet[4:6])) + 40
+		transport = packet[40:]
+		remote = net.IP(packet[24:40])
+	default:
+		return
+	}
+	if len(transport) < 4 {
+		return
+	}
+
+	// The local port is the source port of outgoing packets
+	port := binary.BigEndian.Uint16(transport[2:4])
+	if outgoing {
+		port = binary.BigEndian.Uint16(transport[0:2])
+	}
+
+	// Lookups and new connections are usually too short-lived to be seen
+	// by the periodic update
+	interesting := false
+	if c.audit != nil && outgoing {
+		interesting = c.audit.interesting(protocol, transport)
+	}
+	if !c.owns(protocol, port, interesting) {
+		return
+	}
+	if interesting {
+		c.audit.record(protocol, remote, transport)
+	}
+
+	if outgoing {
+		c.txBytes.Add(length)
+	} else {
+		c.rxBytes.Add(length)
+	}
+}
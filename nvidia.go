@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	nvidiasmijson "github.com/fffaraz/nvidia-smi-json"
+)
+
+type nvidiaAccelerator struct {
+	filter gpuFilter
+	nvlink nvlinkCounters
+}
+
+func newNvidiaAccelerator(opts *Options) Accelerator {
+	if !nvidiasmijson.HasNvidiaSmi() {
+		return nil
+	}
+	return &nvidiaAccelerator{filter: opts.GPUs}
+}
+
+func (n *nvidiaAccelerator) Name() string {
+	return "nvidia"
+}
+
+func (n *nvidiaAccelerator) Sample(pids []int) (AcceleratorReading, error) {
+	gpus, err := getGPUUsage(n.filter)
+	if err != nil {
+		return AcceleratorReading{}, err
+	}
+
+	reading := AcceleratorReading{
+		Util:   gpus.Util,
+		Count:  gpus.Count,
+		HostTx: gpus.PcieTx,
+		HostRx: gpus.PcieRx,
+		Power:  gpus.Power,
+	}
+	if tx, rx, err := n.nvlink.sample(n.filter); err == nil {
+		reading.PeerTx = tx
+		reading.PeerRx = rx
+	}
+	if pids != nil {
+		util, memory, err := getGPUProcessUsage(pids, n.filter, gpus.Count)
+		if err == nil {
+			reading.ChildUtil = util
+			reading.ChildMemUsed = memory
+		}
+	}
+	return reading, nil
+}
+
+// gpuFilter selects GPUs by nvidia-smi index or UUID, an empty filter selects all GPUs
+type gpuFilter []string
+
+func parseGPUFilter(list string) gpuFilter {
+	var filter gpuFilter
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			filter = append(filter, id)
+		}
+	}
+	return filter
+}
+
+func (f gpuFilter) matches(index int, uuid string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, id := range f {
+		// CUDA_VISIBLE_DEVICES allows (unique) prefixes of the UUID
+		if id == strconv.Itoa(index) || (strings.HasPrefix(id, "GPU-") && strings.HasPrefix(uuid, id)) {
+			return true
+		}
+	}
+	return false
+}
+
+type gpuReading struct {
+	Util  float64
+	Count int
+	// PCIe throughput in bytes/s, summed over the GPUs
+	PcieTx float64
+	PcieRx float64
+	// Power draw in watts, summed over the GPUs
+	Power float64
+}
+
+// getGPUUsage returns the utilization averaged over the selected GPUs
+func getGPUUsage(filter gpuFilter) (gpuReading, error) {
+	reading := gpuReading{}
+
+	log := nvidiasmijson.XmlToObject(nvidiasmijson.RunNvidiaSmi())
+	if log == nil || len(log.GPUS) == 0 {
+		return reading, errors.New("no GPUs reported by nvidia-smi")
+	}
+
+	for index, gpu := range log.GPUS {
+		if !filter.matches(index, gpu.UUID) {
+			continue
+		}
+		s := strings.Split(gpu.GpuUtil, " ")
+		util, err := strconv.ParseFloat(s[0], 64)
+		if err != nil {
+			// Pretend the GPU is at 0% utilization
+			util = 0.0
+		}
+		reading.Util += util
+		reading.PcieTx += parseThroughput(gpu.PciTxUtil)
+		// "250.12 W", "[N/A]" on GPUs without power readings
+		if power, err := strconv.ParseFloat(strings.TrimSuffix(gpu.PowerDraw, " W"), 64); err == nil {
+			reading.Power += power
+		}
+		reading.PcieRx += parseThroughput(gpu.PciRxUtil)
+		reading.Count++
+	}
+	if reading.Count == 0 {
+		return reading, errors.New("none of the selected GPUs are present")
+	}
+	reading.Util /= float64(reading.Count)
+	return reading, nil
+}
+
+// parseThroughput parses nvidia-smi values like "1200 KB/s" into bytes/s
+func parseThroughput(value string) float64 {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0
+	}
+	number, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	switch fields[1] {
+	case "KB/s":
+		return number * 1024
+	case "MB/s":
+		return number * 1024 * 1024
+	case "GB/s":
+		return number * 1024 * 1024 * 1024
+	}
+	return number
+}
+
+// nvlinkCounters turns the cumulative NVLink data counters into throughput
+type nvlinkCounters struct {
+	unsupported bool
+	last        time.Time
+	tx, rx      uint64
+}
+
+// sample parses the output of `nvidia-smi nvlink -gt d`, which looks like:
+//
+//	GPU 0: NVIDIA A100-SXM4-40GB (UUID: GPU-...)
+//		 Link 0: Data Tx: 1234 KiB
+//		 Link 0: Data Rx: 5678 KiB
+func (c *nvlinkCounters) sample(filter gpuFilter) (float64, float64, error) {
+	if c.unsupported {
+		return 0, 0, errors.New("NVLink counters are not available")
+	}
+
+	out, err := exec.Command("nvidia-smi", "nvlink", "-gt", "d").Output()
+	if err != nil {
+		// Systems without NVLink don't support the query, stop asking
+		c.unsupported = true
+		return 0, 0, err
+	}
+	now := time.Now()
+
+	tx, rx := uint64(0), uint64(0)
+	selected := false
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "GPU ") {
+			index, _ := strconv.Atoi(strings.TrimSuffix(strings.Fields(line)[1], ":"))
+			uuid := ""
+			if i := strings.Index(line, "UUID: "); i != -1 {
+				uuid = strings.TrimSuffix(line[i+len("UUID: "):], ")")
+			}
+			selected = filter.matches(index, uuid)
+			continue
+		}
+		if !selected {
+			continue
+		}
+		_, counter, ok := strings.Cut(line, "Data ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(counter)
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "Tx:":
+			tx += value * 1024
+		case "Rx:":
+			rx += value * 1024
+		}
+	}
+
+	// The first sample only establishes the starting point
+	txRate, rxRate := 0.0, 0.0
+	if !c.last.IsZero() && tx >= c.tx && rx >= c.rx {
+		elapsed := now.Sub(c.last).Seconds()
+		txRate = float64(tx-c.tx) / elapsed
+		rxRate = float64(rx-c.rx) / elapsed
+	}
+	c.last, c.tx, c.rx = now, tx, rx
+	return txRate, rxRate, nil
+}
+
+/*
+	Per-process GPU usage:
+
+- utilization comes from `nvidia-smi pmon` (SM % per process, per GPU)
+- memory comes from `nvidia-smi --query-compute-apps`
+*/
+func getGPUProcessUsage(pids []int, filter gpuFilter, gpuCount int) (float64, uint64, error) {
+	wanted := map[string]bool{}
+	for _, pid := range pids {
+		wanted[strconv.Itoa(pid)] = true
+	}
+
+	uuids, err := getGPUUUIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+	indices := map[int]string{}
+	for uuid, index := range uuids {
+		indices[index] = uuid
+	}
+
+	util := 0.0
+	out, err := exec.Command("nvidia-smi", "pmon", "-c", "1", "-s", "u").Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	gpuColumn, pidColumn, smColumn := -1, -1, -1
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "#" {
+			// The first header line names the columns
+			if pidColumn == -1 {
+				for i, name := range fields[1:] {
+					switch name {
+					case "gpu":
+						gpuColumn = i
+					case "pid":
+						pidColumn = i
+					case "sm":
+						smColumn = i
+					}
+				}
+			}
+			continue
+		}
+		if gpuColumn == -1 || pidColumn == -1 || smColumn == -1 || len(fields) <= max(gpuColumn, pidColumn, smColumn) {
+			continue
+		}
+		if !wanted[fields[pidColumn]] {
+			continue
+		}
+		if index, err := strconv.Atoi(fields[gpuColumn]); err != nil || !filter.matches(index, indices[index]) {
+			continue
+		}
+		// Idle processes are reported as "-"
+		if sm, err := strconv.ParseFloat(fields[smColumn], 64); err == nil {
+			util += sm
+		}
+	}
+
+	memory := uint64(0)
+	out, err = exec.Command("nvidia-smi", "--query-compute-apps=pid,gpu_uuid,used_memory", "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 || !wanted[strings.TrimSpace(fields[0])] {
+			continue
+		}
+		uuid := strings.TrimSpace(fields[1])
+		if !filter.matches(uuids[uuid], uuid) {
+			continue
+		}
+		if mib, err := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 64); err == nil {
+			memory += mib * 1024 * 1024
+		}
+	}
+
+	// Keep the utilization comparable with the average over all GPUs
+	return util / float64(max(gpuCount, 1)), memory, nil
+}
+
+// getGPUUUIDs maps the UUID of every GPU to its nvidia-smi index
+func getGPUUUIDs() (map[string]int, error) {
+	out, err := exec.Command("nvidia-smi", "--query-gpu=index,uuid", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, err
+	}
+	uuids := map[string]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			continue
+		}
+		if index, err := strconv.Atoi(strings.TrimSpace(fields[0])); err == nil {
+			uuids[strings.TrimSpace(fields[1])] = index
+		}
+	}
+	return uuids, nil
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// tagList collects repeated --tag key=value flags in the order they were given
+type tagList []Tag
+
+func (t *tagList) String() string {
+	pairs := make([]string, 0, len(*t))
+	for _, tag := range *t {
+		pairs = append(pairs, tag.Key+"="+tag.Value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t *tagList) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	*t = append(*t, Tag{Key: key, Value: val})
+	return nil
+}
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+type Options struct {
+	Tags     tagList
+	Stream   string
+	Outputs  outputList
+	Grafana  string
+	LogPath  string
+	NoMirror bool
+	GPUs     gpuFilter
+
+	// The samples go to the metrics log, with CombinedLog also to the log
+	MetricsLog  string
+	CombinedLog bool
+	Compress    string
+	// At most one sample per Downsample goes to the metrics log and outputs
+	Downsample time.Duration
+
+	// Every run gets a directory for its outputs in RunsDir
+	RunsDir  string
+	RunDir   string
+	KeepRuns int
+	KeepDays int
+	Upload   string
+
+	// Benchmark mode: the command is profiled Runs times
+	Runs            int
+	BenchmarkJSON   string
+	DiscardOutliers bool
+
+	CombineOutput bool
+	Quiet         bool
+	Heartbeat     time.Duration
+	SummaryOnly   bool
+	SummaryJSON   string
+
+	Filesystems   stringList
+	FsWarnPercent float64
+
+	WatchDirs     stringList
+	WatchDepth    int
+	WatchInterval time.Duration
+
+	NetCapture bool
+	NetAudit   bool
+
+	Syscalls bool
+	Unshare  namespaceList
+
+	Redact regexpList
+	Drop   regexpList
+
+	Severity         bool
+	SeverityPatterns severityPatternList
+	Color            string
+
+	MaxOutputLinesPerSec int
+	MaxLogOutputBytes    byteSize
+
+	SyncLog  bool
+	Timeline string
+	Chart    string
+	HTML     string
+	Bucket   time.Duration
+	Parquet  string
+
+	ExpectFiles      expectFileList
+	Budgets          string
+	Budget           *budget
+	GoMetrics        string
+	JMX              string
+	PySpy            bool
+	StackOnCPU       float64
+	ProcessBreakdown bool
+	Events           eventPatternList
+	Phases           regexpList
+	Alerts           alertRuleList
+	MetricExprs      metricExprList
+
+	// The statistics cover only the workload, from when it begins until it
+	// is done
+	StartWhen  startCondition
+	StartAfter time.Duration
+	StopWhen   startCondition
+
+	// SIGUSR1 and SIGUSR2 turn the measurement on and off
+	SignalControl bool
+	// Keys on the terminal pause the measurement, drop markers and change
+	// the sampling interval
+	Interactive bool
+
+	// Keep sampling until the processes the command left running exited
+	WaitForTree bool
+
+	// Interval of the interim summaries of a long-lived command
+	RollingSummary time.Duration
+
+	// Hook commands run with sh -c
+	OnStart   string
+	OnFinish  string
+	OnAlert   string
+	OnFailure string
+
+	// Email with the summary and the HTML report after the run
+	EmailTo   stringList
+	EmailFrom string
+	EmailOn   string
+	SMTP      string
+	SMTPUser  string
+
+	SteadyState      steadyStateWindow
+	CarbonIntensity  carbonIntensity
+	HourlyCost       hourlyCost
+	StealWarnPercent float64
+
+	// Where the system and process statistics are read from
+	ProcRoot string
+
+	Governor string
+	Turbo    string
+
+	GpuIdleGap       time.Duration
+	GpuIdleThreshold float64
+
+	DryRun bool
+	Units  string
+
+	// Rounding of the total execution time in the summary, 0 keeps it exact
+	DurationPrecision time.Duration
+
+	// Samples fed through the aggregation and reports instead of running
+	// the command
+	Replay string
+
+	TimestampFormat string
+	UTC             bool
+	Elapsed         bool
+	Format          string
+
+	Command []string
+	// Added to the environment of the command
+	Env      envList
+	EnvFiles envFileList
+	// Working directory and umask of the command, go-profile's otherwise
+	Chdir string
+	Umask umaskValue
+	// User and group the command runs as, resolved into RunAs
+	User  string
+	Group string
+	RunAs *commandUser
+	// Restrictions of the command, Seccomp is "default" or a profile file
+	NoNewPrivs bool
+	Seccomp    string
+
+	// Run ID chosen by `go-profile exec`, so the command it executes has it
+	// in its environment, or recorded in the run directory of --replay,
+	// generated per run otherwise
+	RunID string
+
+	// Pid of the command started by `go-profile exec`, it is watched
+	// instead of started
+	AttachPid int
+}
+
+// TagMap returns the tags as a map, later tags override earlier ones
+func (o *Options) TagMap() map[string]string {
+	if len(o.Tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(o.Tags))
+	for _, tag := range o.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+func parseOptions(args []string) *Options {
+	opts := &Options{}
+
+	flags := flag.NewFlagSet("go-profile", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile [options] <command> [arguments]\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Var(&opts.Tags, "tag", "attach a `key=value` label to the run (repeatable)")
+	flags.StringVar(&opts.Stream, "stream", "", "print every tick to stdout in a machine `format` (json)")
+	flags.Var(&opts.Outputs, "output", "write the samples as `format:target` (log:path, jsonl:path, csv:path, parquet:path or prometheus:addr, - is stdout), repeat it to enable several at once")
+	flags.StringVar(&opts.Grafana, "grafana-dashboard", "grafana-dashboard.json", "with a prometheus output, write a Grafana dashboard with a panel per metric of the run to `file`, empty disables")
+	flags.StringVar(&opts.RunsDir, "runs-dir", "go-profile-runs", "write the logs and outputs with relative paths to a new directory per run in `dir` (with a latest symlink), empty writes them to the working directory")
+	flags.IntVar(&opts.Runs, "runs", 1, "profile the command `n` times and report the mean duration and peak RSS with bootstrap confidence intervals")
+	flags.BoolVar(&opts.DiscardOutliers, "discard-outliers", false, "leave the runs of --runs with an outlying duration or peak RSS out of the estimates, they are listed either way")
+	flags.StringVar(&opts.BenchmarkJSON, "benchmark-json", "", "write the summary of --runs as JSON to `file`")
+	flags.IntVar(&opts.KeepRuns, "keep-runs", 0, "remove the oldest runs from --runs-dir so at most `n` remain, including this one (0: keep all)")
+	flags.IntVar(&opts.KeepDays, "keep-days", 0, "remove the runs older than `days` from --runs-dir (0: keep all)")
+	flags.StringVar(&opts.Upload, "upload", "", "copy the run directory to object storage at `url`/<run id>/ after the run, s3://bucket/prefix (aws CLI) or gs://bucket/prefix (gsutil)")
+	flags.StringVar(&opts.MetricsLog, "metrics-log", "metrics.jsonl", "append the samples as JSON lines to `file`, empty disables it")
+	flags.DurationVar(&opts.Downsample, "downsample", 0, "write at most one sample per `interval` to the metrics log, the outputs, the chart and the report, the summary still covers every sample (0: all samples)")
+	flags.StringVar(&opts.Compress, "compress", "", "compress the log and the metrics log with `method` gzip or zstd (requires the zstd command), the extension is appended to their names")
+	flags.BoolVar(&opts.CombinedLog, "combined-log", false, "also write the sample lines to the log, annotating the command's output (the log defaults to go-profile.log then)")
+	flags.BoolVar(&opts.NoMirror, "no-mirror", false, "do not mirror the command's output to the terminal (it is still logged)")
+	flags.BoolVar(&opts.CombineOutput, "combine-output", false, "capture the command's stdout and stderr through a single pipe, which keeps their lines in order (logged as cmd-output, mirrored to stdout)")
+	flags.BoolVar(&opts.Quiet, "quiet", false, "do not print the samples to the terminal every tick (they are still written to the metrics log)")
+	flags.DurationVar(&opts.Heartbeat, "heartbeat", 0, "print a status line (elapsed time, CPU and memory of the command) at this `interval`, also with --quiet, e.g. 5m")
+	flags.BoolVar(&opts.SummaryOnly, "summary-only", false, "only print the summary to the terminal, the summary JSON is in the run directory (summary.json), or go-profile-summary.json with --runs-dir '' and no --summary-json")
+	flags.StringVar(&opts.SummaryJSON, "summary-json", "", "write the summary of the run as JSON to `file`")
+	flags.Var(&opts.Filesystems, "fs", "track the disk usage of the filesystem mounted at `path` (repeatable)")
+	flags.Float64Var(&opts.FsWarnPercent, "fs-warn", 90, "warn when a tracked filesystem is fuller than this `percentage`")
+	flags.Var(&opts.WatchDirs, "watch-dir", "periodically measure the size of the directory at `path` (repeatable)")
+	flags.IntVar(&opts.WatchDepth, "watch-depth", 16, "maximum `depth` of subdirectories to include in --watch-dir sizes")
+	flags.DurationVar(&opts.WatchInterval, "watch-interval", 5*time.Second, "`interval` between --watch-dir measurements")
+	flags.BoolVar(&opts.NetCapture, "net-capture", false, "attribute network traffic to the command by capturing packets (requires CAP_NET_RAW)")
+	flags.BoolVar(&opts.NetAudit, "net-audit", false, "count the DNS lookups and HTTP(S) connections of the command (implies --net-capture)")
+	flags.BoolVar(&opts.Syscalls, "syscalls", false, "run the command under strace and report the top syscalls by count and time (slows the command down)")
+	flags.Var(&opts.Redact, "redact", "replace matches of this `regex` in the command's output with [REDACTED], only groups are replaced if it has any (repeatable)")
+	flags.Var(&opts.Drop, "drop", "do not write output lines matching this `regex` to the log, they are still mirrored (repeatable)")
+	flags.BoolVar(&opts.Severity, "severity", false, "classify the command's output lines as error, warn or info, count them in the summary and color the mirrored errors and warnings")
+	flags.Var(&opts.SeverityPatterns, "severity-pattern", "replace the pattern of a severity with `level=regex` (error, warn or info, implies --severity, repeatable)")
+	flags.StringVar(&opts.Color, "color", "auto", "color the mirrored output with --severity: `mode` auto (if stdout is a terminal), always or never")
+	flags.IntVar(&opts.MaxOutputLinesPerSec, "max-output-lines-per-sec", 0, "log at most this many `lines` of the command's output per second (0: unlimited)")
+	flags.Var(&opts.MaxLogOutputBytes, "max-log-output-bytes", "stop logging the command's output after this `size` (e.g. 100MiB)")
+	flags.BoolVar(&opts.SyncLog, "sync-log", false, "write every log line straight to disk (O_SYNC) instead of buffering")
+	flags.StringVar(&opts.Timeline, "timeline", "", "write the command's output, the samples and go-profile's messages as one time-ordered JSON lines `file`")
+	flags.StringVar(&opts.Chart, "chart", "", "render the CPU, memory and GPU usage over time to an SVG or PNG `file`")
+	flags.StringVar(&opts.HTML, "html", "", "write an HTML report with the summary, the usage chart and a per-core heatmap to `file`")
+	flags.Var(&opts.SteadyState, "steady-state", "compute the CPU, memory, GPU and RSS aggregates over the `window` start..end of the run only, as percentages or durations since the start (negative: before the end), e.g. 10%..90% or 30s..-10s")
+	flags.DurationVar(&opts.Bucket, "bucket", time.Minute, "`interval` of the average/maximum table in the --html report (0 disables)")
+	flags.Var(&opts.CarbonIntensity, "carbon-intensity", "estimate the CO2 emissions of the measured energy at `gCO2e/kWh` or the average intensity of a region ("+carbonRegionNames()+")")
+	flags.Var(&opts.HourlyCost, "hourly-cost", "report the cost of the run and the part wasted on idle GPUs (or CPUs) at `dollars` per hour or the on-demand price of an instance type ("+instanceTypeNames()+")")
+	flags.Var(&opts.Env, "env", "set `KEY=VALUE` in the environment of the command, can be repeated (GO_PROFILE_RUN_ID is always set)")
+	flags.Var(&opts.EnvFiles, "env-file", "set the KEY=VALUE lines of `file` in the environment of the command, can be repeated, --env takes precedence")
+	flags.StringVar(&opts.Chdir, "chdir", "", "run the command in `dir` (the relative paths of go-profile's outputs stay relative to the working directory)")
+	flags.Var(&opts.Umask, "umask", "run the command with the file mode creation `mask` (octal, e.g. 022)")
+	flags.StringVar(&opts.User, "user", "", "run the command as `user` (name or uid) with its groups, go-profile has to run as root")
+	flags.StringVar(&opts.Group, "group", "", "run the command with the primary `group` (name or gid), the user's primary group by default")
+	flags.BoolVar(&opts.NoNewPrivs, "no-new-privs", false, "run the command with no-new-privs, setuid binaries and file capabilities do not raise its privileges")
+	flags.StringVar(&opts.Seccomp, "seccomp", "", "restrict the syscalls of the command with a seccomp `profile`: default (deny administering the machine, ptrace, bpf...) or a Docker seccomp profile file")
+	flags.Float64Var(&opts.StealWarnPercent, "steal-warn", 5, "warn in the summary when the average CPU steal time of a VM exceeds this `percentage` (0 disables)")
+	flags.StringVar(&opts.ProcRoot, "proc-root", "/proc", "read the system and process statistics from the proc filesystem at `dir` (e.g. the host's /proc mounted into a container)")
+	flags.StringVar(&opts.Governor, "governor", "", "set the CPU frequency scaling `governor` (e.g. performance) for the run and restore it afterwards (requires root)")
+	flags.StringVar(&opts.Turbo, "turbo", "", "turn turbo boost `on` or off for the run and restore it afterwards (requires root)")
+	flags.DurationVar(&opts.GpuIdleGap, "gpu-idle-gap", 10*time.Second, "report GPU idle stretches longer than `duration` as anomalies (0 disables)")
+	flags.Float64Var(&opts.GpuIdleThreshold, "gpu-idle-threshold", 5, "GPU utilization in `percent` below which the GPUs count as idle")
+	flags.StringVar(&opts.Budgets, "budgets", defaultBudgets, "fail the run if it exceeds the budget for the command in the budget `file` (if it exists), empty disables")
+	flags.Var(&opts.ExpectFiles, "expect-file", "fail unless the command writes `path[:size]` (at least size bytes), can be repeated")
+	flags.Var(&opts.Events, "event", "count the output lines matching `name=regex`, the first group is summed as a number, can be repeated")
+	flags.Var(&opts.StartWhen, "start-when", "leave the samples before a line of the command's output matches out of the statistics (they are still logged), `'output matches \"regex\"'` or just the regex")
+	flags.DurationVar(&opts.StartAfter, "start-after", 0, "leave the samples of the first `duration` of the command out of the statistics (they are still logged)")
+	flags.Var(&opts.StopWhen, "stop-when", "freeze the statistics at the first line of the command's output that matches, the rest of the run is still logged, `'output matches \"regex\"'` or just the regex")
+	flags.DurationVar(&opts.RollingSummary, "rolling-summary", 0, "print a summary of the CPU, memory, GPU and RSS of the last `interval` while a long-lived command keeps running (0 disables)")
+	flags.BoolVar(&opts.WaitForTree, "wait-for-tree", false, "for commands that daemonize, keep sampling until the processes the command left running (in its process group or adopted by go-profile) exited instead of terminating them")
+	flags.BoolVar(&opts.Interactive, "interactive", false, "control the run from the terminal: p pauses and resumes the measurement, m drops a marker, s logs a snapshot of the process tree, + and - sample faster and slower (logged and written to the --timeline)")
+	flags.BoolVar(&opts.SignalControl, "signal-control", false, "measure only while turned on by SIGUSR1 to go-profile, SIGUSR2 turns it off again (can be repeated), the rest of the run is still logged")
+	flags.Var(&opts.Phases, "phase", "start a new phase of the run at the output lines matching `regex`, named after its first group, and report the efficiency per phase, can be repeated")
+	flags.Var(&opts.Alerts, "alert", "report the stretches in which a metric is beyond a threshold, `metric>value[,exit=value][,for=duration][,clear=duration]` (or metric<value), can be repeated")
+	flags.StringVar(&opts.OnStart, "on-start", "", "run the shell `command` before the command starts, with the run metadata as JSON on stdin")
+	flags.StringVar(&opts.OnFinish, "on-finish", "", "run the shell `command` after the run, with the summary as JSON on stdin")
+	flags.StringVar(&opts.OnAlert, "on-alert", "", "run the shell `command` when an --alert starts or ends, with the alert as JSON on stdin")
+	flags.StringVar(&opts.OnFailure, "on-failure", "", "run the shell `command` when the command fails (before --on-finish), with the summary as JSON on stdin")
+	flags.Var(&opts.EmailTo, "email-to", "mail the summary and the --html report to `address` after the run, can be repeated")
+	flags.StringVar(&opts.EmailFrom, "email-from", "", "sender `address` of the email (default go-profile@<hostname>)")
+	flags.StringVar(&opts.EmailOn, "email-on", "always", "send the email `always` or only on failure")
+	flags.StringVar(&opts.SMTP, "smtp", "localhost:25", "SMTP server `host:port` for --email-to")
+	flags.StringVar(&opts.SMTPUser, "smtp-user", "", "SMTP `user`, the password is read from "+smtpPasswordEnv)
+	flags.Var(&opts.MetricExprs, "metric-expr", "report a derived metric `name = expression` over the summary and events, can be repeated")
+	flags.StringVar(&opts.Parquet, "parquet", "", "write the samples to a Parquet `file` for analysis tools")
+	flags.StringVar(&opts.GoMetrics, "go-metrics", "", "sample the runtime metrics of a Go command from its expvar (and pprof) endpoint at `url`, e.g. http://localhost:6060")
+	flags.StringVar(&opts.JMX, "jmx", "", "sample the heap and GC time of a Java command from the Jolokia agent at `host:port` (or its URL)")
+	flags.BoolVar(&opts.PySpy, "py-spy", false, "dump the Python stack of the command with py-spy when its CPU usage spikes")
+	flags.BoolVar(&opts.ProcessBreakdown, "process-breakdown", false, "list the CPU time, storage I/O and largest RSS of the command's processes by name in the summary")
+	flags.Float64Var(&opts.StackOnCPU, "stack-on-cpu", 0, "capture the stack of the command's busiest process (py-spy, eu-stack or the kernel stack) when it uses more than this `percentage` of a core (0 disables)")
+	flags.Var(&opts.Unshare, "unshare", "run the command in new `namespaces` (comma-separated: pid, mount), pid kills everything it started when it exits, mount gives it a private /tmp")
+	flags.StringVar(&opts.Replay, "replay", "", "feed the samples recorded in `file` (metrics.jsonl, --stream json) through the aggregation, alerts and reports instead of running a command")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "check the options and that the collectors are available, print what would be collected and exit without running the command")
+	flags.DurationVar(&opts.DurationPrecision, "duration-precision", 0, "round the total execution time in the summary to a multiple of `precision` (e.g. 1ms), 0 prints it exactly")
+	flags.StringVar(&opts.Units, "units", "iec", "`units` of the sizes in the log and the reports: iec (GiB), si (GB) or raw (bytes)")
+	flags.StringVar(&opts.TimestampFormat, "timestamp-format", "stamp", "`format` of the log timestamps: stamp (Jan  2 15:04:05.000), rfc3339, unix (seconds) or relative (+00:03:12.450 since the command started)")
+	flags.BoolVar(&opts.Elapsed, "elapsed", false, "prefix the command's output lines and the samples in the log with the time since the command started ([+00:03:12.450])")
+	flags.StringVar(&opts.Format, "format", "", "Go `template` of the sample lines in the log and the terminal, e.g. '{{.CPU}}% {{.RSS}}' (fields: CPU, Memory, GPU, ChildCPU, RSS, Used, Total, Elapsed, Time, RunID and those of the JSON samples, functions: bytes, percent)")
+	flags.BoolVar(&opts.UTC, "utc", false, "use UTC instead of the local time zone for the log timestamps and the times in the outputs")
+	preset := flags.String("preset", "", "apply the options of a `preset` ("+presetNames()+"), options on the command line take precedence")
+	gpus := flags.String("gpus", "", "comma-separated `list` of GPU indices or UUIDs to sample (default: $CUDA_VISIBLE_DEVICES or all)")
+
+	// Parsing stops at the first non-flag argument, which is the command
+	flags.Parse(args)
+	opts.Command = flags.Args()
+	if *preset != "" {
+		if err := applyPreset(flags, *preset); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if opts.Replay != "" {
+		replayMetadata(opts)
+	}
+	if len(opts.Command) == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	// The command sees the same CUDA_VISIBLE_DEVICES as we do
+	if *gpus == "" {
+		*gpus = os.Getenv("CUDA_VISIBLE_DEVICES")
+	}
+	opts.GPUs = parseGPUFilter(*gpus)
+
+	if opts.NetAudit {
+		opts.NetCapture = true
+	}
+
+	// The budget file is optional unless it was given explicitly
+	if opts.Budgets != "" {
+		budgets, err := readBudgets(opts.Budgets)
+		if err != nil && !(os.IsNotExist(err) && opts.Budgets == defaultBudgets) {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to read the budgets: %s\n", err)
+			os.Exit(1)
+		}
+		opts.Budget = matchBudget(budgets, opts.Command)
+	}
+
+	if len(opts.SeverityPatterns) > 0 {
+		opts.Severity = true
+	}
+	if opts.Color != "auto" && opts.Color != "always" && opts.Color != "never" {
+		fmt.Fprintf(os.Stderr, "[go-profile] Unsupported color mode: %s (auto, always, never)\n", opts.Color)
+		os.Exit(1)
+	}
+
+	if opts.Runs < 1 {
+		fmt.Fprintf(os.Stderr, "[go-profile] --runs must be at least 1\n")
+		os.Exit(1)
+	}
+	if opts.Replay != "" && opts.Runs > 1 {
+		fmt.Fprintf(os.Stderr, "[go-profile] --replay can not be combined with --runs\n")
+		os.Exit(1)
+	}
+
+	if opts.KeepRuns < 0 || opts.KeepDays < 0 {
+		fmt.Fprintf(os.Stderr, "[go-profile] --keep-runs and --keep-days can not be negative\n")
+		os.Exit(1)
+	}
+	if (opts.KeepRuns > 0 || opts.KeepDays > 0) && opts.RunsDir == "" {
+		fmt.Fprintf(os.Stderr, "[go-profile] --keep-runs and --keep-days need --runs-dir\n")
+		os.Exit(1)
+	}
+	if opts.Upload != "" {
+		if err := validUpload(opts.Upload); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+			os.Exit(1)
+		}
+		if opts.RunsDir == "" {
+			fmt.Fprintf(os.Stderr, "[go-profile] --upload needs --runs-dir\n")
+			os.Exit(1)
+		}
+	}
+
+	// The run directory always has the summary
+	if opts.RunsDir != "" && opts.SummaryJSON == "" {
+		opts.SummaryJSON = "summary.json"
+	}
+	if opts.SummaryOnly && opts.SummaryJSON == "" {
+		opts.SummaryJSON = "go-profile-summary.json"
+	}
+
+	// strace would write its counts to the private /tmp
+	if opts.Syscalls && opts.Unshare.has("mount") {
+		fmt.Fprintf(os.Stderr, "[go-profile] --syscalls can not be combined with --unshare mount\n")
+		os.Exit(1)
+	}
+
+	if opts.Chdir != "" {
+		if info, err := os.Stat(opts.Chdir); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "[go-profile] --chdir %s is not a directory\n", opts.Chdir)
+			os.Exit(1)
+		}
+	}
+
+	if opts.Seccomp != "" {
+		profile, err := loadSeccompProfile(opts.Seccomp)
+		if err == nil {
+			_, err = profile.compile()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Invalid --seccomp profile: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	runAs, err := lookupCommandUser(opts.User, opts.Group)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+		os.Exit(1)
+	}
+	opts.RunAs = runAs
+
+	if err := validTimestampFormat(opts.TimestampFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+		os.Exit(1)
+	}
+
+	if opts.Format != "" {
+		if _, err := parseTickFormat(opts.Format); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Invalid --format: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.Turbo != turboUnchanged && opts.Turbo != turboOn && opts.Turbo != turboOff {
+		fmt.Fprintf(os.Stderr, "[go-profile] Unsupported turbo setting: %s (on, off)\n", opts.Turbo)
+		os.Exit(1)
+	}
+
+	if err := validUnits(opts.Units); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+		os.Exit(1)
+	}
+
+	if opts.Stream != "" && opts.Stream != "json" {
+		fmt.Fprintf(os.Stderr, "[go-profile] Unsupported stream format: %s\n", opts.Stream)
+		os.Exit(1)
+	}
+
+	// --stream and --parquet are shorthands for outputs
+	if opts.Stream == "json" {
+		opts.Outputs = append(opts.Outputs, outputSpec{format: "jsonl", target: "-"})
+	}
+	if opts.Parquet != "" {
+		opts.Outputs = append(opts.Outputs, outputSpec{format: "parquet", target: opts.Parquet})
+	}
+	opts.LogPath = "output.log"
+	if opts.CombinedLog {
+		opts.LogPath = "go-profile.log"
+	}
+	for _, output := range opts.Outputs {
+		if output.format == "log" {
+			opts.LogPath = output.target
+		}
+	}
+
+	if opts.EmailOn != "always" && opts.EmailOn != "failure" {
+		fmt.Fprintf(os.Stderr, "[go-profile] unsupported --email-on %q (always, failure)\n", opts.EmailOn)
+		os.Exit(1)
+	}
+	if _, _, err := net.SplitHostPort(opts.SMTP); len(opts.EmailTo) > 0 && err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] invalid --smtp %q: %s\n", opts.SMTP, err)
+		os.Exit(1)
+	}
+
+	if _, err := os.Stat(filepath.Join(opts.ProcRoot, "stat")); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] --proc-root %q is not a proc filesystem: %s\n", opts.ProcRoot, err)
+		os.Exit(1)
+	}
+	procRoot = opts.ProcRoot
+
+	if err := validCompression(opts.Compress); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+		os.Exit(1)
+	}
+	if opts.Compress != "" {
+		// Compressed lines only reach the disk when the compressor flushes
+		if opts.SyncLog {
+			fmt.Fprintf(os.Stderr, "[go-profile] --sync-log can not be combined with --compress\n")
+			os.Exit(1)
+		}
+		opts.LogPath = compressedPath(opts.LogPath, opts.Compress)
+		if opts.MetricsLog != "" {
+			opts.MetricsLog = compressedPath(opts.MetricsLog, opts.Compress)
+		}
+	}
+
+	return opts
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const redacted = "[REDACTED]"
+
+// regexpList collects the compiled patterns of a repeated flag
+type regexpList []*regexp.Regexp
+
+func (r *regexpList) String() string {
+	patterns := make([]string, 0, len(*r))
+	for _, re := range *r {
+		patterns = append(patterns, re.String())
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (r *regexpList) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// outputFilter redacts secrets from the command's output and drops noisy
+// lines from the log
+type outputFilter struct {
+	redact regexpList
+	drop   regexpList
+}
+
+// redactLine replaces every match of the redact patterns. When a pattern
+// has groups only the groups are replaced, so `password=(\S+)` keeps the key.
+func (f *outputFilter) redactLine(line string) string {
+	for _, re := range f.redact {
+		if re.NumSubexp() == 0 {
+			line = re.ReplaceAllLiteralString(line, redacted)
+			continue
+		}
+
+		var result strings.Builder
+		last := 0
+		for _, match := range re.FindAllStringSubmatchIndex(line, -1) {
+			for group := 1; group <= re.NumSubexp(); group++ {
+				start, end := match[2*group], match[2*group+1]
+				// Skip groups that didn't participate or are nested in a previous one
+				if start < 0 || start < last {
+					continue
+				}
+				result.WriteString(line[last:start])
+				result.WriteString(redacted)
+				last = end
+			}
+		}
+		result.WriteString(line[last:])
+		line = result.String()
+	}
+	return line
+}
+
+// dropped returns true if the line should not be written to the log
+func (f *outputFilter) dropped(line string) bool {
+	for _, re := range f.drop {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// byteSize is a flag value accepting sizes like 100MiB or 1GB
+type byteSize uint64
+
+func (b *byteSize) String() string {
+	return humanize.IBytes(uint64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+// outputLimiter limits how many of the command's output lines end up in the
+// log, zero limits are disabled
+type outputLimiter struct {
+	mu             sync.Mutex
+	maxLinesPerSec int
+	maxBytes       uint64
+
+	window           time.Time
+	windowLines      int
+	windowSuppressed uint64
+	bytes            uint64
+	suppressed       uint64
+}
+
+// allow returns if a line of size bytes may be logged. When a new one-second
+// window starts, the number of lines suppressed in the previous window is
+// returned as well so it can be noted in the log.
+func (l *outputLimiter) allow(now time.Time, size int) (bool, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	previous := uint64(0)
+	if now.Sub(l.window) >= time.Second {
+		previous = l.windowSuppressed
+		l.window = now
+		l.windowLines = 0
+		l.windowSuppressed = 0
+	}
+
+	overRate := l.maxLinesPerSec > 0 && l.windowLines >= l.maxLinesPerSec
+	overSize := l.maxBytes > 0 && l.bytes+uint64(size) > l.maxBytes
+	if overRate || overSize {
+		l.windowSuppressed++
+		l.suppressed++
+		return false, previous
+	}
+	l.windowLines++
+	l.bytes += uint64(size)
+	return true, previous
+}
+
+// total returns the number of suppressed lines
+func (l *outputLimiter) total() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.suppressed
+}
+
+// outputCapture writes the command's output to the mirror, the log and the
+// timeline
+type outputCapture struct {
+	log      *logWriter
+	filter   *outputFilter
+	limiter  *outputLimiter
+	timeline *timeline
+	events   *eventCounter
+	phases   *phaseTracker
+	gate     *measurementGate
+	severity *severityClassifier
+	stamps   *timestampFormat
+	// The last lines for snapshots
+	tail *outputTail
+
+	// Time of the first line of output
+	firstLine     time.Time
+	firstLineOnce sync.Once
+}
+
+func (c *outputCapture) handle(output io.Reader, name string, mirror io.Writer) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := c.filter.redactLine(scanner.Text())
+		c.events.match(line)
+		level := c.severity.classify(line)
+
+		now := time.Now()
+		timestamp := c.stamps.format(now)
+		elapsed := c.stamps.prefix(now)
+		c.phases.match(now, line)
+		c.gate.match(now, line)
+		c.firstLineOnce.Do(func() { c.firstLine = now })
+
+		c.tail.add(fmt.Sprintf("[%s][cmd-%s] %s", timestamp, name, line))
+
+		// Log to original output
+		if mirror != nil {
+			fmt.Fprintln(mirror, c.severity.colorize(level, fmt.Sprintf("[%s][cmd-%s] %s%s", timestamp, name, elapsed, line)))
+		}
+
+		// Write to the log
+		if !c.filter.dropped(line) {
+			allowed, suppressed := c.limiter.allow(now, len(line))
+			if suppressed > 0 {
+				fmt.Fprintf(c.log, "[%s][go-profile] Suppressed %d output lines\n", timestamp, suppressed)
+			}
+			if allowed {
+				offset, _, _ := c.log.writeAt([]byte(fmt.Sprintf("[%s][cmd-%s] %s%s\n", timestamp, name, elapsed, line)))
+				c.severity.located(level, now, line, offset)
+				c.timeline.record(name, line, nil)
+				continue
+			}
+		}
+		c.severity.located(level, now, line, -1)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(c.log, "[go-profile] Error reading %s: %v\n", name, err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"sync"
+)
+
+/*
+	A minimal Parquet writer: flat REQUIRED columns, PLAIN encoding, no
+	compression, one data page per column chunk. The metadata is Thrift
+	compact protocol, see parquet.thrift in apache/parquet-format.
+
+	"PAR1" <row group>... <FileMetaData> <length of FileMetaData> "PAR1"
+*/
+
+// Rows per row group, a row group is kept in memory until it is written
+const parquetRowGroupSize = 65536
+
+// Parquet physical types
+var parquetTypes = map[columnType]int32{
+	columnInt32:  1,
+	columnInt64:  2,
+	columnDouble: 5,
+	columnString: 6,
+}
+
+// Parquet converted types
+const (
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+)
+
+// appendPlain appends the PLAIN encoding of the column's value
+func appendPlain(values *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case int32:
+		binary.Write(values, binary.LittleEndian, v)
+	case int64:
+		binary.Write(values, binary.LittleEndian, v)
+	case float64:
+		binary.Write(values, binary.LittleEndian, math.Float64bits(v))
+	case string:
+		binary.Write(values, binary.LittleEndian, uint32(len(v)))
+		values.WriteString(v)
+	}
+}
+
+// parquetChunk is the metadata of a written column chunk
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+// parquetRowGroup is the metadata of a written row group
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// parquetWriter streams samples to a Parquet file, the file is only valid
+// after close
+type parquetWriter struct {
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	offset    int64
+	columns   []sampleColumn
+	values    []bytes.Buffer
+	rows      int64
+	rowGroups []parquetRowGroup
+}
+
+func createParquetWriter(path string) (*parquetWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	columns := sampleColumns()
+	p := &parquetWriter{file: file, w: bufio.NewWriter(file), columns: columns, values: make([]bytes.Buffer, len(columns))}
+	p.writeBytes([]byte("PAR1"))
+	return p, nil
+}
+
+// writeBytes writes to the buffer, errors are returned by the flush in close
+func (p *parquetWriter) writeBytes(data []byte) {
+	p.w.Write(data)
+	p.offset += int64(len(data))
+}
+
+func (p *parquetWriter) write(sample Sample) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.columns {
+		appendPlain(&p.values[i], p.columns[i].value(sample))
+	}
+	p.rows++
+	if p.rows == parquetRowGroupSize {
+		p.flushRowGroup()
+	}
+}
+
+// flushRowGroup writes every column as a single data page
+func (p *parquetWriter) flushRowGroup() {
+	if p.rows == 0 {
+		return
+	}
+	group := parquetRowGroup{rows: p.rows}
+	for i := range p.columns {
+		values := &p.values[i]
+		var header thriftWriter
+		header.i32(1, 0) // type: DATA_PAGE
+		header.i32(2, int32(values.Len()))
+		header.i32(3, int32(values.Len()))
+		header.structBegin(5) // data_page_header
+		header.i32(1, int32(p.rows))
+		header.i32(2, 0) // encoding: PLAIN
+		header.i32(3, 3) // definition_level_encoding: RLE
+		header.i32(4, 3) // repetition_level_encoding: RLE
+		header.structEnd()
+		header.stop()
+
+		chunk := parquetChunk{offset: p.offset, size: int64(header.buf.Len() + values.Len())}
+		p.writeBytes(header.buf.Bytes())
+		p.writeBytes(values.Bytes())
+		values.Reset()
+		group.chunks = append(group.chunks, chunk)
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	p.rows = 0
+}
+
+// close writes the footer of the Parquet file
+func (p *parquetWriter) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushRowGroup()
+
+	var meta thriftWriter
+	meta.i32(1, 1) // version
+	meta.listBegin(2, thriftStruct, len(p.columns)+1)
+	meta.elemBegin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(p.columns)))
+	meta.elemEnd()
+	for _, column := range p.columns {
+		meta.elemBegin()
+		meta.i32(1, parquetTypes[column.typ])
+		meta.i32(3, 0) // repetition_type: REQUIRED
+		meta.binary(4, column.name)
+		switch {
+		case column.name == "time":
+			meta.i32(6, parquetTimestampMicros)
+		case column.typ == columnString:
+			meta.i32(6, parquetUTF8)
+		}
+		meta.elemEnd()
+	}
+	var rows int64
+	for _, group := range p.rowGroups {
+		rows += group.rows
+	}
+	meta.i64(3, rows)
+	meta.listBegin(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		var size int64
+		meta.elemBegin()
+		meta.listBegin(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			size += chunk.size
+			meta.elemBegin()
+			meta.i64(2, chunk.offset)
+			meta.structBegin(3) // meta_data
+			meta.i32(1, parquetTypes[column.typ])
+			meta.listBegin(2, thriftI32, 1)
+			meta.elemI32(0) // PLAIN
+			meta.listBegin(3, thriftBinary, 1)
+			meta.elemBinary(column.name)
+			meta.i32(4, 0) // codec: UNCOMPRESSED
+			meta.i64(5, group.rows)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.structEnd()
+			meta.elemEnd()
+		}
+		meta.i64(2, size)
+		meta.i64(3, group.rows)
+		meta.elemEnd()
+	}
+	meta.binary(6, "go-profile")
+	meta.stop()
+
+	p.writeBytes(meta.buf.Bytes())
+	binary.Write(p.w, binary.LittleEndian, uint32(meta.buf.Len()))
+	p.w.WriteString("PAR1")
+	if err := p.w.Flush(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol, field ids are
+// written as deltas to the previous field of the same struct
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemBinary(s)
+}
+
+func (t *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) elemI32(v int32) {
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) elemBinary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// structBegin starts a struct field, elemBegin a struct in a list
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) elemBegin() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// stop ends the fields of the current struct
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// startPhase is the name of the phase before the first marker
+const startPhase = "start"
+
+// PhaseSummary is the efficiency of a phase of the run, the phases start at
+// the output lines matching --phase
+type PhaseSummary struct {
+	Name string `json:"name"`
+	// Since the start of the command
+	Start    time.Duration `json:"start"`
+	Duration time.Duration `json:"duration"`
+
+	// Average system CPU and GPU utilization and CPU usage of the command's
+	// process tree (in percent of one core)
+	CPU      float64 `json:"cpu_avg"`
+	ChildCPU float64 `json:"child_cpu_avg"`
+	GPU      float64 `json:"gpu_avg"`
+
+	// Bytes the command's process tree read from and wrote to storage
+	IOBytes uint64 `json:"io_bytes"`
+
+	// The phase with the lowest GPU utilization (CPU usage of the command
+	// without GPUs)
+	LeastEfficient bool `json:"least_efficient,omitempty"`
+}
+
+// phaseTracker splits the run into phases at the marker lines of the output
+// and aggregates the samples per phase
+type phaseTracker struct {
+	mu       sync.Mutex
+	patterns regexpList
+	stamps   *timestampFormat
+	phases   []PhaseSummary
+	cpu      []aggregator
+	childCPU []aggregator
+	gpu      []aggregator
+	io       counter
+}
+
+// newPhaseTracker returns nil if there are no patterns
+func newPhaseTracker(patterns regexpList, stamps *timestampFormat) *phaseTracker {
+	if len(patterns) == 0 {
+		return nil
+	}
+	p := &phaseTracker{patterns: patterns, stamps: stamps}
+	p.begin(startPhase, 0)
+	// The I/O of the command counts from 0
+	p.io.delta(0)
+	return p
+}
+
+func (p *phaseTracker) begin(name string, start time.Duration) {
+	p.phases = append(p.phases, PhaseSummary{Name: name, Start: start})
+	p.cpu = append(p.cpu, aggregator{})
+	p.childCPU = append(p.childCPU, aggregator{})
+	p.gpu = append(p.gpu, aggregator{})
+}
+
+// match starts a new phase at a marker line, the phase is named after the
+// first group of the pattern or the matched text
+func (p *phaseTracker) match(now time.Time, line string) {
+	if p == nil {
+		return
+	}
+	for _, re := range p.patterns {
+		match := re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		name := match[0]
+		if len(match) > 1 {
+			name = match[1]
+		}
+		p.mu.Lock()
+		p.begin(name, p.stamps.since(now))
+		p.mu.Unlock()
+		return
+	}
+}
+
+// add aggregates a sample of the running command into the current phase,
+// ioBytes is the total I/O of the process tree so far
+func (p *phaseTracker) add(stats Stats, ioBytes uint64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := len(p.phases) - 1
+	p.cpu[i].add(stats.CpuPercent)
+	p.childCPU[i].add(stats.ChildCpuPercent)
+	p.gpu[i].add(stats.GpuPercent)
+	delta, _ := p.io.delta(ioBytes)
+	p.phases[i].IOBytes += delta
+}
+
+// result returns nil if no marker was seen, end is the duration of the run
+func (p *phaseTracker) result(end time.Duration, gpus bool) []PhaseSummary {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.phases) < 2 {
+		return nil
+	}
+	phases := append([]PhaseSummary(nil), p.phases...)
+	least := -1
+	var lowest float64
+	for i := range phases {
+		next := end
+		if i+1 < len(phases) {
+			next = phases[i+1].Start
+		}
+		phases[i].Duration = max(next-phases[i].Start, 0)
+		phases[i].CPU = p.cpu[i].result().Avg
+		phases[i].ChildCPU = p.childCPU[i].result().Avg
+		phases[i].GPU = p.gpu[i].result().Avg
+
+		// Phases without samples say nothing about their efficiency
+		if p.cpu[i].count == 0 {
+			continue
+		}
+		efficiency := phases[i].ChildCPU
+		if gpus {
+			efficiency = phases[i].GPU
+		}
+		if least < 0 || efficiency < lowest {
+			least, lowest = i, efficiency
+		}
+	}
+	if least >= 0 {
+		phases[least].LeastEfficient = true
+	}
+	// Nothing happened before the first marker
+	if p.cpu[0].count == 0 {
+		phases = phases[1:]
+	}
+	return phases
+}
+
+// String is e.g. "epoch 1 (+1.2s, 30s): CPU 45.00%, command CPU 180.00%, I/O 1.2 GiB"
+func (p PhaseSummary) String(gpus bool) string {
+	s := fmt.Sprintf("%s (+%s, %s): CPU %s, command CPU %s",
+		p.Name,
+		p.Start.Round(time.Millisecond),
+		p.Duration.Round(time.Millisecond),
+		unitPercent.format(p.CPU),
+		unitPercent.format(p.ChildCPU))
+	if gpus {
+		s += ", GPU " + unitPercent.format(p.GPU)
+	}
+	s += ", I/O " + formatBytes(p.IOBytes)
+	if p.LeastEfficient {
+		s += ", LEAST EFFICIENT"
+	}
+	return s
+}
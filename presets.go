@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// presetOption is a flag set by a preset, unless it is on the command line
+type presetOption struct {
+	flag  string
+	value string
+}
+
+// presets bundle the options that suit a kind of workload
+var presets = map[string][]presetOption{
+	// GPU utilization, PCIe/NVLink throughput and the GPU stalls where the
+	// CPU is busy (data loading) are always sampled, report short stalls
+	"ml-training": {
+		{"gpu-idle-gap", "5s"},
+		{"gpu-idle-threshold", "10"},
+		{"html", "go-profile.html"},
+	},
+	// CPU time and storage I/O per compiler/linker, the disk usage of the
+	// build directory and the compiler diagnostics
+	"build": {
+		{"process-breakdown", "true"},
+		{"fs", "."},
+		{"event", `warnings=\bwarning\b`},
+		{"event", `errors=\berror\b`},
+		{"html", "go-profile.html"},
+	},
+	// Long runs: the leak estimate is always computed, keep the log and the
+	// outputs small
+	"soak": {
+		{"downsample", "10s"},
+		{"max-output-lines-per-sec", "100"},
+		{"max-log-output-bytes", "100MiB"},
+		{"chart", "go-profile.svg"},
+		{"parquet", "go-profile.parquet"},
+	},
+}
+
+func presetNames() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyPreset sets the options of the preset that were not set explicitly
+func applyPreset(flags *flag.FlagSet, name string) error {
+	options, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q (%s)", name, presetNames())
+	}
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, option := range options {
+		if explicit[option.flag] {
+			continue
+		}
+		if err := flags.Set(option.flag, option.value); err != nil {
+			return fmt.Errorf("preset %s: %w", name, err)
+		}
+	}
+	return nil
+}
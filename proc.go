@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getParentPid returns the parent pid from /proc/<pid>/stat
+func getParentPid(pid int) (int, error) {
+	data, err := os.ReadFile(pidPath(pid, "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name can contain spaces and parentheses, skip past it
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed %s", pidPath(pid, "stat"))
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed %s", pidPath(pid, "stat"))
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// getProcessTree returns pid and all of its (transitive) children
+func getProcessTree(pid int) []int {
+	return getProcessForest([]int{pid})
+}
+
+// getProcessForest returns the roots and all of their (transitive)
+// children, the roots that exited are left out unless all of them did
+func getProcessForest(roots []int) []int {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return roots[:1]
+	}
+
+	children := map[int][]int{}
+	present := map[int]bool{}
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		parent, err := getParentPid(child)
+		if err != nil {
+			// The process exited while we were scanning (or its stat is
+			// malformed)
+			continue
+		}
+		present[child] = true
+		children[parent] = append(children[parent], child)
+	}
+
+	var tree []int
+	seen := map[int]bool{}
+	for _, root := range roots {
+		if present[root] && !seen[root] {
+			tree = append(tree, root)
+			seen[root] = true
+		}
+	}
+	if len(tree) == 0 {
+		return roots[:1]
+	}
+	for i := 0; i < len(tree); i++ {
+		for _, child := range children[tree[i]] {
+			if !seen[child] {
+				tree = append(tree, child)
+				seen[child] = true
+			}
+		}
+	}
+	return tree
+}
+
+// getProcessRSS returns the total resident memory of the pids in bytes
+func getProcessRSS(pids []int) uint64 {
+	pageSize := uint64(os.Getpagesize())
+	var total uint64
+	for _, pid := range pids {
+		data, err := os.ReadFile(pidPath(pid, "statm"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) < 2 {
+			continue
+		}
+		resident, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		total += resident * pageSize
+	}
+	return total
+}
+
+// getProcessMemory returns the proportional (PSS) and unique (USS) set size
+// of the pids in bytes from /proc/<pid>/smaps_rollup. Unlike the RSS, the
+// PSS splits the pages shared between the processes (e.g. the workers of a
+// forking server) so the totals add up. Both are zero when smaps_rollup can
+// not be read (Linux < 4.14 or processes of other users).
+func getProcessMemory(pids []int) (pss uint64, uss uint64) {
+	for _, pid := range pids {
+		data, err := os.ReadFile(pidPath(pid, "smaps_rollup"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, _ := strings.Cut(line, ":")
+			if key != "Pss" && key != "Private_Clean" && key != "Private_Dirty" {
+				continue
+			}
+			// The values are in kB
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			if key == "Pss" {
+				pss += kb * 1024
+			} else {
+				uss += kb * 1024
+			}
+		}
+	}
+	return pss, uss
+}
+
+// getProcessIO returns the bytes the pids read from and wrote to storage,
+// processes of other users can not be read
+func getProcessIO(pids []int) uint64 {
+	var total uint64
+	for _, pid := range pids {
+		data, err := os.ReadFile(pidPath(pid, "io"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, _ := strings.Cut(line, ":")
+			if key == "read_bytes" || key == "write_bytes" {
+				bytes, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+				total += bytes
+			}
+		}
+	}
+	return total
+}
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat
+const clockTicks = 100
+
+// getProcessCPUTicks returns the total user and system CPU time of the pids
+// in clock ticks
+func getProcessCPUTicks(pids []int) uint64 {
+	var total uint64
+	for _, pid := range pids {
+		data, err := os.ReadFile(pidPath(pid, "stat"))
+		if err != nil {
+			continue
+		}
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 13 {
+			continue
+		}
+		// utime and stime are fields 14 and 15 of the stat file
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		total += utime + stime
+	}
+	return total
+}
+
+// processCPU calculates the CPU usage of a process tree between samples
+type processCPU struct {
+	ticks counter
+}
+
+// seconds returns the CPU time the process tree used up to the last sample
+func (p *processCPU) seconds() float64 {
+	return float64(p.ticks.total) / clockTicks
+}
+
+// sample returns the CPU usage of the pids since the last sample in percent
+// of one core, CPU time of children that exited in between is lost
+func (p *processCPU) sample(now time.Time, pids []int) float64 {
+	rate, _ := p.ticks.rate(now, getProcessCPUTicks(pids))
+	return rate / clockTicks * 100.0
+}
+
+// processRunning returns false once the process exited, zombies (exited but
+// not yet reaped by their parent) count as exited
+func processRunning(pid int) bool {
+	data, err := os.ReadFile(pidPath(pid, "stat"))
+	if err != nil {
+		return false
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
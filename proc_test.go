@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mrexodia/go-profile/proctest"
+)
+
+// fakeProc points the collectors at a fake /proc tree for the test
+func fakeProc(t *testing.T, processes ...proctest.Process) *proctest.Proc {
+	t.Helper()
+	proc, err := proctest.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, process := range processes {
+		if err := proc.SetProcess(process); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := procRoot
+	procRoot = proc.Root
+	t.Cleanup(func() { procRoot = previous })
+	return proc
+}
+
+func TestGetParentPid(t *testing.T) {
+	proc := fakeProc(t,
+		proctest.Process{PID: 10, PPID: 1},
+		// The command name can contain spaces and parentheses
+		proctest.Process{PID: 11, PPID: 10, Comm: "a) (b c"},
+	)
+	for pid, want := range map[int]int{10: 1, 11: 10} {
+		got, err := getParentPid(pid)
+		if err != nil || got != want {
+			t.Errorf("getParentPid(%d) = %d, %v, want %d", pid, got, err, want)
+		}
+	}
+
+	if _, err := getParentPid(12); err == nil {
+		t.Errorf("getParentPid of a missing process succeeded")
+	}
+	for name, stat := range map[string]string{
+		"truncated":   "13 (sh) S",
+		"no paren":    "13 sh S 1 13 13",
+		"empty":       "",
+		"bad ppid":    "13 (sh) S x 13 13",
+		"only a name": "13 (sh)",
+	} {
+		if err := os.MkdirAll(filepath.Join(proc.Root, "13"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(proc.Root, "13", "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getParentPid(13); err == nil {
+			t.Errorf("getParentPid of a %s stat succeeded", name)
+		}
+	}
+}
+
+func TestGetProcessForest(t *testing.T) {
+	proc := fakeProc(t,
+		proctest.Process{PID: 1, PPID: 0},
+		proctest.Process{PID: 100, PPID: 1},
+		proctest.Process{PID: 101, PPID: 100},
+		proctest.Process{PID: 102, PPID: 100},
+		proctest.Process{PID: 103, PPID: 101},
+		proctest.Process{PID: 200, PPID: 1},
+		proctest.Process{PID: 201, PPID: 200},
+	)
+	set := func(pids []int) map[int]bool {
+		set := map[int]bool{}
+		for _, pid := range pids {
+			set[pid] = true
+		}
+		return set
+	}
+
+	tree := getProcessTree(100)
+	if tree[0] != 100 {
+		t.Errorf("the tree starts with %d, want the root 100", tree[0])
+	}
+	if want := set([]int{100, 101, 102, 103}); !reflect.DeepEqual(set(tree), want) || len(tree) != len(want) {
+		t.Errorf("getProcessTree(100) = %v", tree)
+	}
+
+	forest := getProcessForest([]int{100, 200, 201, 999})
+	if want := set([]int{100, 101, 102, 103, 200, 201}); !reflect.DeepEqual(set(forest), want) || len(forest) != len(want) {
+		t.Errorf("getProcessForest = %v", forest)
+	}
+
+	// An exited root is left out, unless all of them exited
+	if err := proc.RemoveProcess(100); err != nil {
+		t.Fatal(err)
+	}
+	if forest := getProcessForest([]int{100, 200}); !reflect.DeepEqual(set(forest), set([]int{200, 201})) {
+		t.Errorf("getProcessForest without the first root = %v", forest)
+	}
+	if forest := getProcessForest([]int{100}); !reflect.DeepEqual(forest, []int{100}) {
+		t.Errorf("getProcessForest of an exited root = %v", forest)
+	}
+
+	// A malformed process is skipped instead of failing the scan
+	if err := os.WriteFile(filepath.Join(proc.Root, "201", "stat"), []byte("201 (x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if forest := getProcessForest([]int{200}); !reflect.DeepEqual(forest, []int{200}) {
+		t.Errorf("getProcessForest with a malformed child = %v", forest)
+	}
+}
+
+func TestProcessCounters(t *testing.T) {
+	fakeProc(t,
+		proctest.Process{PID: 10, UTime: 150, STime: 50, RSSPages: 256, PSS: 600 << 10, USS: 400 << 10, ReadBytes: 4096, WriteBytes: 1024},
+		proctest.Process{PID: 11, UTime: 10, STime: 5, RSSPages: 256, PSS: 200 << 10, USS: 100 << 10, ReadBytes: 1, WriteBytes: 2},
+	)
+	pids := []int{10, 11, 12}
+
+	if ticks := getProcessCPUTicks(pids); ticks != 215 {
+		t.Errorf("getProcessCPUTicks = %d, want 215", ticks)
+	}
+	if rss, want := getProcessRSS(pids), uint64(512*os.Getpagesize()); rss != want {
+		t.Errorf("getProcessRSS = %d, want %d", rss, want)
+	}
+	if pss, uss := getProcessMemory(pids); pss != 800<<10 || uss != 500<<10 {
+		t.Errorf("getProcessMemory = %d, %d, want %d, %d", pss, uss, 800<<10, 500<<10)
+	}
+	if io := getProcessIO(pids); io != 4096+1024+1+2 {
+		t.Errorf("getProcessIO = %d, want %d", io, 4096+1024+1+2)
+	}
+}
+
+func TestProcessRunning(t *testing.T) {
+	fakeProc(t,
+		proctest.Process{PID: 10},
+		proctest.Process{PID: 11, State: "Z"},
+	)
+	for pid, want := range map[int]bool{10: true, 11: false, 12: false} {
+		if got := processRunning(pid); got != want {
+			t.Errorf("processRunning(%d) = %v, want %v", pid, got, want)
+		}
+	}
+}
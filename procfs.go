@@ -0,0 +1,21 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// procRoot is where the collectors read /proc from (--proc-root), e.g. the
+// host's /proc mounted into a container or a fake tree of the proctest
+// package. Controlling processes (killing the tree) always uses /proc.
+var procRoot = "/proc"
+
+// procPath returns the path of a file below procRoot
+func procPath(parts ...string) string {
+	return filepath.Join(append([]string{procRoot}, parts...)...)
+}
+
+// pidPath returns the path of a file below the /proc directory of pid
+func pidPath(pid int, parts ...string) string {
+	return procPath(append([]string{strconv.Itoa(pid)}, parts...)...)
+}
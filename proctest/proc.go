@@ -0,0 +1,188 @@
+// Package proctest builds fake /proc trees for the collector tests of
+// go-profile, and for tools that run the go-profile binary (--proc-root)
+// against a known system to test what they do with the samples
+// deterministically. The sampler itself is not importable. Only the files
+// go-profile reads are written: stat, meminfo and per process stat, statm,
+// comm, smaps_rollup, io, fd and net/{tcp,udp}.
+package proctest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CPUTime is a cpu line of /proc/stat, in clock ticks (USER_HZ, 100/s)
+type CPUTime struct {
+	User, Nice, System, Idle, IOWait, IRQ, SoftIRQ, Steal uint64
+}
+
+func (t CPUTime) add(other CPUTime) CPUTime {
+	return CPUTime{
+		User:    t.User + other.User,
+		Nice:    t.Nice + other.Nice,
+		System:  t.System + other.System,
+		Idle:    t.Idle + other.Idle,
+		IOWait:  t.IOWait + other.IOWait,
+		IRQ:     t.IRQ + other.IRQ,
+		SoftIRQ: t.SoftIRQ + other.SoftIRQ,
+		Steal:   t.Steal + other.Steal,
+	}
+}
+
+// Memory is /proc/meminfo in bytes
+type Memory struct {
+	Total, Free, Available, Buffers, Cached uint64
+}
+
+// Socket is a socket of a process
+type Socket struct {
+	Inode     uint64
+	UDP       bool
+	LocalPort uint16
+	// TCP state as in /proc/net/tcp, e.g. 01 (established) or 0A (listen)
+	State string
+}
+
+// Process is a process below /proc/<pid>
+type Process struct {
+	PID, PPID int
+	Comm      string
+	// State as in /proc/<pid>/stat, R (running) if empty, Z for zombies
+	State string
+	// CPU time in clock ticks (USER_HZ, 100/s)
+	UTime, STime uint64
+	// Resident memory in pages
+	RSSPages uint64
+	// Proportional and unique set size in bytes (smaps_rollup), the rest
+	// of the RSS is shared
+	PSS, USS uint64
+	// Bytes read from and written to storage (io)
+	ReadBytes, WriteBytes uint64
+	Sockets               []Socket
+}
+
+// Proc is a fake /proc tree in a directory, the files are rewritten by
+// every setter so a test can change the system between samples
+type Proc struct {
+	Root string
+}
+
+// New returns a fake /proc tree in dir, which is created if needed. The
+// system starts with a single idle core and 1 GiB of free memory.
+func New(dir string) (*Proc, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &Proc{Root: dir}
+	if err := p.SetCPU(CPUTime{Idle: 100}); err != nil {
+		return nil, err
+	}
+	if err := p.SetMemory(Memory{Total: 1 << 30, Free: 1 << 30, Available: 1 << 30}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetCPU writes /proc/stat with a line per core, the times are totals since
+// boot so they have to grow between samples
+func (p *Proc) SetCPU(cores ...CPUTime) error {
+	var total CPUTime
+	for _, core := range cores {
+		total = total.add(core)
+	}
+	var b strings.Builder
+	line := func(name string, t CPUTime) {
+		fmt.Fprintf(&b, "%s %d %d %d %d %d %d %d %d 0 0\n", name, t.User, t.Nice, t.System, t.Idle, t.IOWait, t.IRQ, t.SoftIRQ, t.Steal)
+	}
+	line("cpu ", total)
+	for i, core := range cores {
+		line("cpu"+strconv.Itoa(i), core)
+	}
+	b.WriteString("btime 0\nprocs_running 1\nprocs_blocked 0\n")
+	return p.write("stat", b.String())
+}
+
+// SetMemory writes /proc/meminfo
+func (p *Proc) SetMemory(m Memory) error {
+	return p.write("meminfo", fmt.Sprintf("MemTotal: %d kB\nMemFree: %d kB\nMemAvailable: %d kB\nBuffers: %d kB\nCached: %d kB\n",
+		m.Total/1024, m.Free/1024, m.Available/1024, m.Buffers/1024, m.Cached/1024))
+}
+
+// SetProcess writes the directory of a process, replacing what was there
+func (p *Proc) SetProcess(process Process) error {
+	dir := strconv.Itoa(process.PID)
+	if err := os.RemoveAll(filepath.Join(p.Root, dir)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(p.Root, dir, "fd"), 0755); err != nil {
+		return err
+	}
+	comm, state := process.Comm, process.State
+	if comm == "" {
+		comm = "fake"
+	}
+	if state == "" {
+		state = "R"
+	}
+	stat := fmt.Sprintf("%d (%s) %s %d 0 0 0 -1 0 0 0 0 0 %d %d 0 0 20 0 1 0 0 0 %d\n",
+		process.PID, comm, state, process.PPID, process.UTime, process.STime, process.RSSPages)
+	rss := process.RSSPages * uint64(os.Getpagesize())
+	files := map[string]string{
+		"stat":  stat,
+		"statm": fmt.Sprintf("%d %d 0 0 0 0 0\n", process.RSSPages, process.RSSPages),
+		"comm":  comm + "\n",
+		"smaps_rollup": fmt.Sprintf("00400000-7ffd1000 ---p 00000000 00:00 0 [rollup]\nRss: %d kB\nPss: %d kB\nShared_Clean: %d kB\nShared_Dirty: 0 kB\nPrivate_Clean: 0 kB\nPrivate_Dirty: %d kB\nAnonymous: %d kB\nSwap: 0 kB\n",
+			rss/1024, process.PSS/1024, (rss-min(process.USS, rss))/1024, process.USS/1024, process.USS/1024),
+		"io": fmt.Sprintf("rchar: %d\nwchar: %d\nsyscr: 0\nsyscw: 0\nread_bytes: %d\nwrite_bytes: %d\ncancelled_write_bytes: 0\n",
+			process.ReadBytes, process.WriteBytes, process.ReadBytes, process.WriteBytes),
+	}
+
+	// The socket tables are those of the network namespace, with the
+	// sockets of the process
+	tables := map[string]*strings.Builder{}
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		tables[table] = &strings.Builder{}
+		tables[table].WriteString("  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n")
+	}
+	for i, socket := range process.Sockets {
+		table, state := "tcp", socket.State
+		if socket.UDP {
+			table, state = "udp", "07"
+		}
+		fmt.Fprintf(tables[table], "%4d: 0100007F:%04X 00000000:0000 %s 00000000:00000000 00:00000000 00000000  1000        0 %d\n", i, socket.LocalPort, state, socket.Inode)
+		if err := os.Symlink(fmt.Sprintf("socket:[%d]", socket.Inode), filepath.Join(p.Root, dir, "fd", strconv.Itoa(i+3))); err != nil {
+			return err
+		}
+	}
+	for table, b := range tables {
+		files[filepath.Join("net", table)] = b.String()
+	}
+
+	for name, content := range files {
+		if err := p.write(filepath.Join(dir, name), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveProcess removes the directory of a process, like when it was reaped
+func (p *Proc) RemoveProcess(pid int) error {
+	return os.RemoveAll(filepath.Join(p.Root, strconv.Itoa(pid)))
+}
+
+// write replaces a file atomically, so a sample never sees half of it
+func (p *Proc) write(name, content string) error {
+	path := filepath.Join(p.Root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
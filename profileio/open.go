@@ -0,0 +1,57 @@
+package profileio
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Open returns a reader of the contents of path, decompressed based on its
+// extension: .gz, or .zst with the zstd command (--compress)
+func Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: gz, close: file.Close}, nil
+	case strings.HasSuffix(path, ".zst"):
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = file
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: stdout, close: func() error {
+			file.Close()
+			// Killed if the caller stops reading early
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil
+		}}, nil
+	}
+	return file, nil
+}
+
+// readCloser closes a reader with a function
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
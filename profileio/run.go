@@ -0,0 +1,108 @@
+package profileio
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunMetadata describes a run, it is written to the run directory before
+// the command starts
+type RunMetadata struct {
+	Schema  int               `json:"schema"`
+	RunID   string            `json:"run_id"`
+	Command []string          `json:"command"`
+	Args    []string          `json:"args"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Start   time.Time         `json:"start"`
+	Host    string            `json:"host"`
+	Dir     string            `json:"dir"`
+
+	// The SLURM job the run is part of
+	Slurm *SlurmJob `json:"slurm,omitempty"`
+}
+
+// SlurmJob is the SLURM job and the resources it requested, from the
+// SLURM_* environment variables
+type SlurmJob struct {
+	JobID     string `json:"job_id"`
+	StepID    string `json:"step_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	// Compressed node list, e.g. "node[01-04]"
+	NodeList string `json:"node_list,omitempty"`
+	Nodes    int    `json:"nodes,omitempty"`
+	Tasks    int    `json:"tasks,omitempty"`
+
+	CPUsPerTask int `json:"cpus_per_task,omitempty"`
+	CPUsOnNode  int `json:"cpus_on_node,omitempty"`
+	// Requested memory in bytes
+	MemPerNode uint64 `json:"mem_per_node,omitempty"`
+	MemPerCPU  uint64 `json:"mem_per_cpu,omitempty"`
+	// GPUs allocated on this node
+	GPUs string `json:"gpus,omitempty"`
+}
+
+// Run is a run read back from its run directory (--runs-dir), the metadata
+// and the summary are nil if the directory doesn't have them
+type Run struct {
+	Dir      string
+	Metadata *RunMetadata
+	Summary  *Summary
+	Samples  []Sample
+}
+
+// ReadRunMetadata reads the metadata.json of a run directory
+func ReadRunMetadata(dir string) (*RunMetadata, error) {
+	path := filepath.Join(dir, "metadata.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata RunMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if metadata.Schema, err = UpgradeSchema(metadata.Schema); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &metadata, nil
+}
+
+// ReadRunDir reads the samples (metrics.jsonl, possibly compressed), the
+// summary and the metadata of a run directory
+func ReadRunDir(dir string) (*Run, error) {
+	run := &Run{Dir: dir}
+
+	var metrics string
+	for _, name := range []string{"metrics.jsonl", "metrics.jsonl.gz", "metrics.jsonl.zst"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			metrics = filepath.Join(dir, name)
+			break
+		}
+	}
+	if metrics == "" {
+		return nil, fmt.Errorf("%s has no metrics.jsonl", dir)
+	}
+	file, err := Open(metrics)
+	if err != nil {
+		return nil, err
+	}
+	run.Samples, err = ReadSamples(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", metrics, err)
+	}
+
+	run.Summary, err = ReadSummary(filepath.Join(dir, "summary.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	run.Metadata, err = ReadRunMetadata(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return run, nil
+}
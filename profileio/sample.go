@@ -0,0 +1,176 @@
+// Package profileio reads and writes the artifacts of go-profile: the
+// samples (--stream json and the metrics.jsonl of a run directory), the
+// summary JSON and the run directories, so other Go tools can consume runs
+// without their own parsers.
+package profileio
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Sample is a single tick of statistics in machine-readable form
+type Sample struct {
+	Schema int               `json:"schema"`
+	Time   time.Time         `json:"time"`
+	RunID  string            `json:"run_id"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Stats
+}
+
+type Stats struct {
+	CpuPercent float64 `json:"cpu_percent"`
+	MemUsed    uint64  `json:"mem_used"`
+	MemTotal   uint64  `json:"mem_total"`
+	MemPercent float64 `json:"mem_percent"`
+	GpuPercent float64 `json:"gpu_percent"`
+	GpuCount   int     `json:"gpu_count"`
+
+	// GPU usage attributed to the command's process tree
+	ChildGpuPercent float64 `json:"child_gpu_percent"`
+	ChildGpuMemUsed uint64  `json:"child_gpu_mem_used"`
+
+	// GPU interconnect throughput in bytes/s
+	GpuPcieTx   uint64 `json:"gpu_pcie_tx"`
+	GpuPcieRx   uint64 `json:"gpu_pcie_rx"`
+	GpuNvlinkTx uint64 `json:"gpu_nvlink_tx"`
+	GpuNvlinkRx uint64 `json:"gpu_nvlink_rx"`
+
+	// Power draw in watts of the CPU packages (RAPL) and the GPUs
+	CpuPower float64 `json:"cpu_power,omitempty"`
+	GpuPower float64 `json:"gpu_power,omitempty"`
+
+	// InfiniBand/RDMA throughput of the host in bytes/s
+	IbTx uint64 `json:"ib_tx,omitempty"`
+	IbRx uint64 `json:"ib_rx,omitempty"`
+
+	Filesystems []FilesystemUsage `json:"filesystems,omitempty"`
+	Directories []DirectoryUsage  `json:"directories,omitempty"`
+
+	// Sockets of the command's process tree
+	Sockets *SocketCounts `json:"sockets,omitempty"`
+
+	// CPU usage (in percent of one core) and resident memory of the
+	// command's process tree
+	ChildCpuPercent float64 `json:"child_cpu_percent,omitempty"`
+	ChildRSS        uint64  `json:"child_rss,omitempty"`
+
+	// Proportional and unique set size of the command's process tree, the
+	// pages shared between its processes are counted once
+	ChildPSS uint64 `json:"child_pss,omitempty"`
+	ChildUSS uint64 `json:"child_uss,omitempty"`
+
+	// CPU time (user and system) in seconds and the bytes read from and
+	// written to storage by the command's process tree since it started.
+	// Both only increase, what exited processes used is kept.
+	ChildCpuSeconds float64 `json:"child_cpu_seconds,omitempty"`
+	ChildIOBytes    uint64  `json:"child_io_bytes,omitempty"`
+
+	// Network throughput of the command in bytes/s (--net-capture)
+	ChildNetRx uint64 `json:"child_net_rx,omitempty"`
+	ChildNetTx uint64 `json:"child_net_tx,omitempty"`
+
+	// Runtime metrics of a Go command (--go-metrics)
+	GoRuntime *GoRuntimeStats `json:"go_runtime,omitempty"`
+
+	// JMX metrics of a Java command (--jmx)
+	JVM *JVMStats `json:"jvm,omitempty"`
+
+	// Utilization of every core in percent
+	CpuCores []float64 `json:"cpu_cores,omitempty"`
+
+	// Part of the time the hypervisor ran other guests (virtual machines)
+	CpuStealPercent float64 `json:"cpu_steal_percent,omitempty"`
+}
+
+type FilesystemUsage struct {
+	Path    string  `json:"path"`
+	Total   uint64  `json:"total"`
+	Used    uint64  `json:"used"`
+	Percent float64 `json:"percent"`
+}
+
+type DirectoryUsage struct {
+	Path  string `json:"path"`
+	Size  uint64 `json:"size"`
+	Files uint64 `json:"files"`
+}
+
+type SocketCounts struct {
+	TCP         uint64 `json:"tcp"`
+	UDP         uint64 `json:"udp"`
+	Established uint64 `json:"established"`
+	Listen      uint64 `json:"listen"`
+	CloseWait   uint64 `json:"close_wait"`
+	// Sockets in TIME_WAIT are no longer owned by a process, this counts
+	// all of them in the command's network namespace
+	TimeWait uint64 `json:"time_wait"`
+}
+
+// Open returns the number of sockets owned by the processes
+func (c SocketCounts) Open() uint64 {
+	return c.TCP + c.UDP
+}
+
+// GoRuntimeStats are the runtime metrics of a Go command (--go-metrics)
+type GoRuntimeStats struct {
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapSys    uint64 `json:"heap_sys"`
+	Goroutines int    `json:"goroutines,omitempty"`
+
+	// Garbage collections and the time paused for them since the last tick
+	NumGC   uint32        `json:"num_gc"`
+	GCPause time.Duration `json:"gc_pause"`
+}
+
+// JVMStats are the JMX metrics of a Java command (--jmx)
+type JVMStats struct {
+	HeapUsed uint64 `json:"heap_used"`
+	HeapMax  uint64 `json:"heap_max"`
+
+	// Garbage collections and the time spent in them since the last tick
+	GCCount uint64        `json:"gc_count"`
+	GCTime  time.Duration `json:"gc_time"`
+}
+
+// ReadSamples reads the samples written by --stream json, other lines (the
+// mirrored output of the command) are skipped
+func ReadSamples(r io.Reader) ([]Sample, error) {
+	var samples []Sample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var sample Sample
+		if err := json.Unmarshal(line, &sample); err != nil || sample.Time.IsZero() {
+			continue
+		}
+		var err error
+		if sample.Schema, err = UpgradeSchema(sample.Schema); err != nil {
+			return nil, fmt.Errorf("sample of run %s %w", sample.RunID, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+// WriteSample writes the sample as a line of JSON with a single write, so
+// lines written from several goroutines don't interleave. Samples without a
+// schema version get the current one.
+func WriteSample(w io.Writer, sample Sample) error {
+	if sample.Schema == 0 {
+		sample.Schema = SchemaVersion
+	}
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
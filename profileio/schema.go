@@ -0,0 +1,24 @@
+package profileio
+
+import "fmt"
+
+// SchemaVersion is the version of the samples, summaries, run metadata and
+// benchmark summaries in the machine outputs. It is increased when a field
+// changes its meaning or goes away, new fields don't need it. Outputs
+// written before the version was recorded have none and are read as
+// version 1.
+const SchemaVersion = 1
+
+// UpgradeSchema checks the version of a machine output that is read back
+// and returns the version it was upgraded to. Outputs of a newer go-profile
+// can not be read, because fields may mean something else.
+func UpgradeSchema(version int) (int, error) {
+	if version > SchemaVersion {
+		return version, fmt.Errorf("written with schema version %d, this go-profile reads up to version %d", version, SchemaVersion)
+	}
+	// Unversioned outputs are version 1
+	if version == 0 {
+		version = 1
+	}
+	return version, nil
+}
@@ -0,0 +1,97 @@
+package profileio
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type Aggregate struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// Summary holds the fields of the summary JSON that every run has, the
+// optional parts depend on the options of the run and are kept as raw JSON
+// in Sections by ReadSummary
+type Summary struct {
+	Schema   int               `json:"schema"`
+	RunID    string            `json:"run_id"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Command  []string          `json:"command"`
+	Start    time.Time         `json:"start"`
+	Duration time.Duration     `json:"duration"`
+
+	// The duration in forms that need no Go duration parser, the text is
+	// rounded to --duration-precision
+	DurationSeconds float64 `json:"duration_seconds"`
+	DurationMillis  int64   `json:"duration_ms"`
+	DurationText    string  `json:"duration_text"`
+
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	CPU      Aggregate `json:"cpu"`
+	Memory   Aggregate `json:"memory"`
+	GPU      Aggregate `json:"gpu"`
+
+	// Resident memory of the command's process tree
+	ChildRSS *Aggregate `json:"child_rss,omitempty"`
+
+	// Proportional and unique set size of the command's process tree
+	ChildPSS *Aggregate `json:"child_pss,omitempty"`
+	ChildUSS *Aggregate `json:"child_uss,omitempty"`
+
+	// The other fields of the summary JSON by name, e.g. "anomalies"
+	Sections map[string]json.RawMessage `json:"-"`
+}
+
+// ReadSummary reads a summary JSON file (--summary-json)
+func ReadSummary(path string) (*Summary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var summary Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if summary.Schema, err = UpgradeSchema(summary.Schema); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// Summaries written before the other forms of the duration existed
+	if summary.DurationText == "" {
+		summary.DurationSeconds = summary.Duration.Seconds()
+		summary.DurationMillis = summary.Duration.Milliseconds()
+		summary.DurationText = summary.Duration.String()
+	}
+	if err := json.Unmarshal(data, &summary.Sections); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, name := range []string{"schema", "run_id", "tags", "command", "start", "duration", "duration_seconds", "duration_ms", "duration_text", "exit_code", "error", "cpu", "memory", "gpu", "child_rss"} {
+		delete(summary.Sections, name)
+	}
+	return &summary, nil
+}
+
+// WriteSummary writes the summary, with its sections, as an indented JSON
+// file
+func WriteSummary(path string, summary *Summary) error {
+	fields := map[string]json.RawMessage{}
+	for name, value := range summary.Sections {
+		fields[name] = value
+	}
+	core, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(core, &fields); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A CPU spike is the command using this percentage of one core or more
+	pySpySpikePercent = 80.0
+
+	// Minimum time between two stack dumps
+	pySpyInterval = 5 * time.Second
+
+	// Frames kept of the dumped stack, and stacks kept for the summary
+	pySpyMaxFrames = 10
+	pySpyMaxStacks = 50
+)
+
+// PythonStack is the stack of the busiest Python thread during a CPU spike
+type PythonStack struct {
+	Time       time.Time `json:"time"`
+	Pid        int       `json:"pid"`
+	CpuPercent float64   `json:"cpu_percent"`
+	Frames     []string  `json:"frames"`
+}
+
+// pySpy dumps the Python stacks of the command with py-spy during CPU spikes
+type pySpy struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	last   time.Time
+	stacks []PythonStack
+}
+
+// findPythonProcess returns the first Python process of the tree, 0 if none
+func findPythonProcess(pids []int) int {
+	for _, pid := range pids {
+		comm, err := os.ReadFile(pidPath(pid, "comm"))
+		if err == nil && strings.HasPrefix(string(comm), "python") {
+			return pid
+		}
+	}
+	return 0
+}
+
+// parsePySpyDump returns the frames of the first active thread (or the first
+// thread) of `py-spy dump` output
+func parsePySpyDump(output string) []string {
+	var frames []string
+	inThread, active := false, false
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Thread ") {
+			// Prefer an active thread over the first one
+			if inThread && (active || !strings.Contains(line, "(active")) {
+				break
+			}
+			inThread = true
+			active = strings.Contains(line, "(active")
+			frames = frames[:0]
+			continue
+		}
+		frame := strings.TrimSpace(line)
+		if inThread && frame != "" && len(frames) < pySpyMaxFrames {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// dumpPythonStack returns the frames of the busiest Python thread of the
+// process with `py-spy dump`, for --py-spy and --stack-on-cpu
+func dumpPythonStack(ctx context.Context, pid int) ([]string, error) {
+	output, err := exec.CommandContext(ctx, "py-spy", "dump", "--pid", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parsePySpyDump(string(output)), nil
+}
+
+// sample starts a stack dump in the background when the CPU usage of the
+// command spikes, at most once per pySpyInterval
+func (p *pySpy) sample(now time.Time, cpuPercent float64, pids []int, logPrintf func(format string, a ...interface{})) {
+	if p == nil || cpuPercent < pySpySpikePercent {
+		return
+	}
+	p.mu.Lock()
+	if now.Sub(p.last) < pySpyInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.last = now
+	p.mu.Unlock()
+
+	pid := findPythonProcess(pids)
+	if pid == 0 {
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), stackTimeout)
+		defer cancel()
+		frames, err := dumpPythonStack(ctx, pid)
+		if err != nil {
+			logPrintf("Failed to dump the Python stack of %d: %s", pid, err)
+			return
+		}
+		stack := PythonStack{Time: now, Pid: pid, CpuPercent: cpuPercent, Frames: frames}
+		if len(stack.Frames) == 0 {
+			return
+		}
+
+		logPrintf("Python stack of %d at CPU %.0f%%:", pid, cpuPercent)
+		for _, frame := range stack.Frames {
+			logPrintf("  %s", frame)
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if len(p.stacks) < pySpyMaxStacks {
+			p.stacks = append(p.stacks, stack)
+		}
+	}()
+}
+
+// result waits for running dumps and returns the stacks
+func (p *pySpy) result() []PythonStack {
+	if p == nil {
+		return nil
+	}
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stacks
+}
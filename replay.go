@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// readReplay reads the samples to replay (--replay), possibly compressed,
+// and the summary recorded with them if they are in a run directory (nil
+// otherwise)
+func readReplay(path string) ([]Sample, *profileio.Summary, error) {
+	file, err := profileio.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	samples, err := profileio.ReadSamples(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(samples) == 0 {
+		return nil, nil, fmt.Errorf("%s has no samples", path)
+	}
+	// Runs that did not finish have no summary
+	recorded, _ := profileio.ReadSummary(filepath.Join(filepath.Dir(path), "summary.json"))
+	return samples, recorded, nil
+}
+
+// replayMetadata takes the run ID and, when none is given, the command of a
+// replayed run from the metadata of the run directory the samples are in.
+// Outside a run directory the command is the file.
+func replayMetadata(opts *Options) {
+	metadata, err := profileio.ReadRunMetadata(filepath.Dir(opts.Replay))
+	if err == nil {
+		opts.RunID = metadata.RunID
+		if len(opts.Command) == 0 {
+			opts.Command = metadata.Command
+		}
+	}
+	if len(opts.Command) == 0 {
+		opts.Command = []string{opts.Replay}
+	}
+}
+
+// replaySamples feeds the samples to record as fast as possible, with their
+// recorded times. The command started and exited as in the recorded summary,
+// without one it counts as started at the first sample with statistics of
+// its process tree and as exited at the last sample.
+func replaySamples(samples []Sample, recorded *profileio.Summary, record func(now time.Time, stats Stats, running bool, stolen time.Duration), stamps *timestampFormat, logPrintf func(format string, a ...interface{})) commandResult {
+	start, end := samples[0].Time, samples[len(samples)-1].Time
+	if recorded != nil {
+		start, end = recorded.Start, recorded.Start.Add(recorded.Duration)
+	} else {
+		for _, sample := range samples {
+			if commandRunning(sample.Stats) {
+				start = sample.Time
+				break
+			}
+		}
+	}
+	stamps.commandStarted(start)
+	logPrintf("Replaying %d samples recorded from %s", len(samples), start.Format(time.RFC3339))
+
+	previous := samples[0].Time
+	for _, sample := range samples {
+		// Only the steal percentage was recorded, the CPU time it took is
+		// estimated from the interval and the number of cores
+		cores := max(len(sample.CpuCores), 1)
+		stolen := time.Duration(sample.CpuStealPercent / 100 * float64(sample.Time.Sub(previous)) * float64(cores))
+		previous = sample.Time
+		running := !sample.Time.Before(start) && !sample.Time.After(end) && commandRunning(sample.Stats)
+		record(sample.Time, sample.Stats, running, stolen)
+	}
+	return commandResult{start: start, end: end}
+}
+
+// commandRunning returns whether the sample has statistics of the command's
+// process tree, which it has from the first tick after the command started
+func commandRunning(stats Stats) bool {
+	return stats.ChildRSS > 0 || stats.ChildCpuPercent > 0
+}
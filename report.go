@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// brailleDots are the bits of a braille character (U+2800) by column and row
+var brailleDots = [2][4]rune{
+	{0x01, 0x02, 0x04, 0x40},
+	{0x08, 0x10, 0x20, 0x80},
+}
+
+// plotBraille draws values (0-100%) as a braille line chart of width by
+// height characters, every character holds 2x4 dots
+func plotBraille(values []float64, width, height int) []string {
+	cells := make([][]rune, height)
+	for row := range cells {
+		cells[row] = make([]rune, width)
+	}
+
+	dotsX, dotsY := width*2, height*4
+	prevY := -1
+	for x := 0; x < dotsX; x++ {
+		// Resample to the width of the chart
+		i := 0
+		if dotsX > 1 {
+			i = x * (len(values) - 1) / (dotsX - 1)
+		}
+		value := min(max(values[i], 0), 100)
+		y := dotsY - 1 - int(value/100*float64(dotsY-1)+0.5)
+
+		// Connect to the previous column so steps are drawn as lines
+		from, to := y, y
+		if prevY >= 0 {
+			from, to = min(y, prevY), max(y, prevY)
+		}
+		for dy := from; dy <= to; dy++ {
+			cells[dy/4][x/2] |= brailleDots[x%2][dy%4]
+		}
+		prevY = y
+	}
+
+	lines := make([]string, height)
+	for row, cell := range cells {
+		var b strings.Builder
+		for _, dots := range cell {
+			b.WriteRune(0x2800 + dots)
+		}
+		lines[row] = b.String()
+	}
+	return lines
+}
+
+// plotSamples writes a braille chart for every panel of the samples
+func plotSamples(w io.Writer, samples []Sample, width, height int) {
+	end := samples[len(samples)-1].Time.Sub(samples[0].Time).Round(time.Millisecond).String()
+	for _, panel := range chartPanels(samples) {
+		fmt.Fprintf(w, "%s\n", panel.title)
+		for row, line := range plotBraille(panel.values, width, height) {
+			label := ""
+			switch row {
+			case 0:
+				label = "100"
+			case height - 1:
+				label = "0"
+			}
+			fmt.Fprintf(w, "%4s ┤%s\n", label, line)
+		}
+		fmt.Fprintf(w, "     └%s\n", strings.Repeat("─", width))
+		fmt.Fprintf(w, "      %-*s%s\n\n", width-len(end), "0s", end)
+	}
+}
+
+func reportMain(args []string) {
+	flags := flag.NewFlagSet("go-profile report", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile report [options] [run directories]\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	plot := flags.String("plot", "", "draw the samples `file` (written with --stream json) as charts in the terminal")
+	width := flags.Int("width", 80, "width of the charts in characters")
+	height := flags.Int("height", 8, "height of the charts in characters")
+	logPath := flags.String("log", "", "print the summary of a run from the log `file` (e.g. output.log)")
+	run := flags.String("run", "", "`id` of the run in the log (default: the last run)")
+	samples := flags.Bool("samples", false, "with --log, print the sample lines of the run instead of its summary")
+	merged := flags.String("merged", "", "write an HTML `file` that overlays the usage of the run directories given as arguments")
+
+	// The run directories may come before the options
+	var dirs []string
+	for flags.Parse(args); flags.NArg() > 0; flags.Parse(args) {
+		dirs = append(dirs, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if *merged != "" {
+		if len(dirs) == 0 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		var runs []*recordedRun
+		for _, dir := range dirs {
+			run, err := readRunDir(dir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[go-profile] Failed to read run: %s\n", err)
+				os.Exit(1)
+			}
+			runs = append(runs, run)
+		}
+		if err := writeMergedReport(*merged, runs); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write merged report: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *logPath != "" {
+		if err := reportLog(os.Stdout, *logPath, *run, *samples); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *plot == "" || *width < 1 || *height < 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	file, err := profileio.Open(*plot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to open samples: %s\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	plotted, err := profileio.ReadSamples(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to read samples: %s\n", err)
+		os.Exit(1)
+	}
+	if len(plotted) == 0 {
+		fmt.Fprintf(os.Stderr, "[go-profile] No samples in %s\n", *plot)
+		os.Exit(1)
+	}
+
+	plotSamples(os.Stdout, plotted, *width, *height)
+}
+
+// reportLog prints the summary (or the sample lines) of a run in the log,
+// the run is found with the index of the log and, without one, by scanning
+func reportLog(w io.Writer, path string, id string, samples bool) error {
+	if strings.HasSuffix(path, compressionSuffixes["gzip"]) || strings.HasSuffix(path, compressionSuffixes["zstd"]) {
+		return reportCompressedLog(w, path, id, samples)
+	}
+
+	log, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	entries := readLogIndex(log)
+	indexed := entries != nil
+	if !indexed {
+		if entries, err = scanLog(log); err != nil {
+			return err
+		}
+	}
+	entry, err := findRun(entries, id)
+	if err != nil {
+		return err
+	}
+
+	if samples {
+		if !indexed {
+			return fmt.Errorf("the sample lines are only known with the index (%s%s)", path, logIndexSuffix)
+		}
+		if len(entry.Samples) == 0 {
+			return fmt.Errorf("the log has no sample lines, they are in the metrics log unless --combined-log is set")
+		}
+		return readLogLines(log, entry.Samples, w)
+	}
+	_, err = io.Copy(w, io.NewSectionReader(log, entry.Summary, entry.End-entry.Summary))
+	return err
+}
+
+// reportCompressedLog prints the summary of a run in a log written with
+// --compress, it has no index so the log is decompressed twice: to find the
+// run and to copy its summary
+func reportCompressedLog(w io.Writer, path string, id string, samples bool) error {
+	if samples {
+		return fmt.Errorf("the sample lines are only known with the index, compressed logs have none")
+	}
+	log, err := profileio.Open(path)
+	if err != nil {
+		return err
+	}
+	entries, err := scanLog(log)
+	log.Close()
+	if err != nil {
+		return err
+	}
+	entry, err := findRun(entries, id)
+	if err != nil {
+		return err
+	}
+
+	log, err = profileio.Open(path)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	if _, err := io.CopyN(io.Discard, log, entry.Summary); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, log, entry.End-entry.Summary)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Bucket is the rollup of the samples of a run in an interval (--bucket),
+// it keeps hours-long runs readable in the reports and exports
+type Bucket struct {
+	RunID   string    `json:"run_id"`
+	Start   time.Time `json:"start"`
+	Samples int       `json:"samples"`
+	CPU     Aggregate `json:"cpu"`
+	Memory  Aggregate `json:"memory"`
+	GPU     Aggregate `json:"gpu"`
+	// Resident memory of the command
+	ChildRSS Aggregate `json:"child_rss"`
+}
+
+// rollupSamples groups the samples of every run into buckets of interval,
+// counted from the first sample of the run
+func rollupSamples(samples []Sample, interval time.Duration) []Bucket {
+	var buckets []Bucket
+	type state struct {
+		first                 time.Time
+		bucket                int
+		index                 int
+		cpu, memory, gpu, rss aggregator
+	}
+	runs := map[string]*state{}
+	flush := func(s *state) {
+		bucket := &buckets[s.index]
+		bucket.CPU = s.cpu.result()
+		bucket.Memory = s.memory.result()
+		bucket.GPU = s.gpu.result()
+		bucket.ChildRSS = s.rss.result()
+	}
+	for _, sample := range samples {
+		s, ok := runs[sample.RunID]
+		if !ok {
+			s = &state{first: sample.Time, bucket: -1}
+			runs[sample.RunID] = s
+		}
+		if bucket := int(sample.Time.Sub(s.first) / interval); bucket != s.bucket {
+			if s.bucket >= 0 {
+				flush(s)
+			}
+			*s = state{first: s.first, bucket: bucket, index: len(buckets)}
+			buckets = append(buckets, Bucket{RunID: sample.RunID, Start: s.first.Add(time.Duration(bucket) * interval)})
+		}
+		buckets[s.index].Samples++
+		s.cpu.add(sample.CpuPercent)
+		s.memory.add(float64(sample.MemUsed))
+		s.gpu.add(sample.GpuPercent)
+		s.rss.add(float64(sample.ChildRSS))
+	}
+	for _, s := range runs {
+		flush(s)
+	}
+	return buckets
+}
+
+// bucketTable returns the rows of the buckets for the HTML report, the time
+// is the offset from the start of the run
+func bucketTable(buckets []Bucket, start time.Time) [][]string {
+	rows := make([][]string, len(buckets))
+	for i, bucket := range buckets {
+		rows[i] = []string{
+			formatOffset(bucket.Start, start),
+			fmt.Sprint(bucket.Samples),
+			unitPercent.format(bucket.CPU.Avg) + " / " + unitPercent.format(bucket.CPU.Max),
+			unitBytes.format(bucket.Memory.Avg) + " / " + unitBytes.format(bucket.Memory.Max),
+			unitPercent.format(bucket.GPU.Avg) + " / " + unitPercent.format(bucket.GPU.Max),
+			unitBytes.format(bucket.ChildRSS.Avg) + " / " + unitBytes.format(bucket.ChildRSS.Max),
+		}
+	}
+	return rows
+}
+
+// writeSqliteBuckets writes the statements that (re)import the buckets
+func writeSqliteBuckets(w io.Writer, buckets []Bucket) {
+	io.WriteString(w, "CREATE TABLE IF NOT EXISTS buckets (run_id TEXT, start_time INTEGER, samples INTEGER, cpu_avg REAL, cpu_max REAL, mem_used_avg REAL, mem_used_max REAL, gpu_avg REAL, gpu_max REAL, child_rss_avg REAL, child_rss_max REAL);\n")
+	io.WriteString(w, "CREATE INDEX IF NOT EXISTS buckets_run_id ON buckets (run_id, start_time);\n")
+	deleted := map[string]bool{}
+	for _, bucket := range buckets {
+		if !deleted[bucket.RunID] {
+			deleted[bucket.RunID] = true
+			fmt.Fprintf(w, "DELETE FROM buckets WHERE run_id = %s;\n", sqlLiteral(bucket.RunID))
+		}
+		fmt.Fprintf(w, "INSERT INTO buckets VALUES (%s, %d, %d, %s, %s, %s, %s, %s, %s, %s, %s);\n",
+			sqlLiteral(bucket.RunID),
+			bucket.Start.UnixMicro(),
+			bucket.Samples,
+			sqlLiteral(bucket.CPU.Avg), sqlLiteral(bucket.CPU.Max),
+			sqlLiteral(bucket.Memory.Avg), sqlLiteral(bucket.Memory.Max),
+			sqlLiteral(bucket.GPU.Avg), sqlLiteral(bucket.GPU.Max),
+			sqlLiteral(bucket.ChildRSS.Avg), sqlLiteral(bucket.ChildRSS.Max))
+	}
+}
+
+// rollingSummary emits a summary of the last interval of a long-lived
+// command without stopping the run (--rolling-summary)
+type rollingSummary struct {
+	interval time.Duration
+	runID    string
+	start    time.Time
+	bucket   Bucket
+
+	cpu, memory, gpu, rss aggregator
+	buckets               []Bucket
+}
+
+// newRollingSummary returns nil if interval is 0
+func newRollingSummary(interval time.Duration, runID string) *rollingSummary {
+	if interval <= 0 {
+		return nil
+	}
+	return &rollingSummary{interval: interval, runID: runID}
+}
+
+// add aggregates a sample of the running command and prints the summary of
+// the interval once it is over, the intervals count from the first sample
+func (r *rollingSummary) add(now time.Time, stats Stats, logPrintf func(format string, a ...interface{})) {
+	if r == nil {
+		return
+	}
+	if r.start.IsZero() {
+		r.start = now
+		r.bucket = Bucket{RunID: r.runID, Start: now}
+	}
+	if now.Sub(r.bucket.Start) >= r.interval {
+		r.bucket.CPU = r.cpu.result()
+		r.bucket.Memory = r.memory.result()
+		r.bucket.GPU = r.gpu.result()
+		r.bucket.ChildRSS = r.rss.result()
+		r.buckets = append(r.buckets, r.bucket)
+		logPrintf("Rolling summary %s to %s (%d samples): CPU avg %s max %s | Memory avg %s max %s | GPU avg %s max %s | Command RSS avg %s max %s",
+			formatOffset(r.bucket.Start, r.start),
+			formatOffset(r.bucket.Start.Add(r.interval), r.start),
+			r.bucket.Samples,
+			unitPercent.format(r.bucket.CPU.Avg), unitPercent.format(r.bucket.CPU.Max),
+			unitBytes.format(r.bucket.Memory.Avg), unitBytes.format(r.bucket.Memory.Max),
+			unitPercent.format(r.bucket.GPU.Avg), unitPercent.format(r.bucket.GPU.Max),
+			unitBytes.format(r.bucket.ChildRSS.Avg), unitBytes.format(r.bucket.ChildRSS.Max))
+		// Intervals without samples (--signal-control) are skipped
+		next := r.bucket.Start.Add(now.Sub(r.bucket.Start) / r.interval * r.interval)
+		r.bucket = Bucket{RunID: r.runID, Start: next}
+		r.cpu, r.memory, r.gpu, r.rss = aggregator{}, aggregator{}, aggregator{}, aggregator{}
+	}
+	r.bucket.Samples++
+	r.cpu.add(stats.CpuPercent)
+	r.memory.add(float64(stats.MemUsed))
+	r.gpu.add(stats.GpuPercent)
+	r.rss.add(float64(stats.ChildRSS))
+}
+
+// result returns the summaries of the intervals that were over
+func (r *rollingSummary) result() []Bucket {
+	if r == nil {
+		return nil
+	}
+	return r.buckets
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// newRunID returns an identifier that is sortable by start time and unique
+// across concurrent runs on the same machine.
+func newRunID(start time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		// Fall back to the sub-second part of the timestamp
+		return start.Format("20060102-150405.000000")
+	}
+	return start.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// formatTags renders tags as key=value pairs sorted by key
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// latestRun is the symlink to the newest run directory
+const latestRun = "latest"
+
+// createRunDir creates the directory of a run in the runs directory, named
+// after the start time and the command (2024-06-01T12-00-00_make), and
+// points the latest symlink to it
+func createRunDir(runs string, start time.Time, command string) (string, error) {
+	if err := os.MkdirAll(runs, 0755); err != nil {
+		return "", err
+	}
+	name := start.Format("2006-01-02T15-04-05") + "_" + sanitizeName(filepath.Base(command))
+	dir := filepath.Join(runs, name)
+	// Runs of the same command that start in the same second
+	for i := 2; ; i++ {
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		dir = filepath.Join(runs, name+"_"+strconv.Itoa(i))
+	}
+
+	// Replace the symlink atomically, concurrent runs may race for it
+	temp := filepath.Join(runs, "."+latestRun+"-"+filepath.Base(dir))
+	if err := os.Symlink(filepath.Base(dir), temp); err != nil {
+		return dir, err
+	}
+	if err := os.Rename(temp, filepath.Join(runs, latestRun)); err != nil {
+		os.Remove(temp)
+		return dir, err
+	}
+	return dir, nil
+}
+
+// sanitizeName keeps the characters of a name that are safe in paths
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(name, ".") == "" {
+		return "command"
+	}
+	return name
+}
+
+// RunMetadata describes a run, it is written to the run directory before
+// the command starts
+type RunMetadata = profileio.RunMetadata
+
+// newRunMetadata describes the run of the command in opts
+func newRunMetadata(opts *Options, runID string, start time.Time) RunMetadata {
+	wd, _ := os.Getwd()
+	host, _ := os.Hostname()
+	return RunMetadata{Schema: profileio.SchemaVersion, RunID: runID, Command: opts.Command, Args: os.Args, Tags: opts.TagMap(), Start: start, Host: host, Dir: wd, Slurm: getSlurmJob()}
+}
+
+// writeRunMetadata writes metadata.json to the run directory
+func writeRunMetadata(dir string, metadata RunMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "metadata.json"), append(data, '\n'), 0644)
+}
+
+// inRunDir moves the relative output paths of the options into the run
+// directory
+func (o *Options) inRunDir(dir string) {
+	o.RunDir = dir
+	resolve := func(path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	resolve(&o.LogPath)
+	resolve(&o.MetricsLog)
+	resolve(&o.SummaryJSON)
+	resolve(&o.Timeline)
+	resolve(&o.Chart)
+	resolve(&o.HTML)
+	resolve(&o.Grafana)
+	for i := range o.Outputs {
+		if o.Outputs[i].format != "prometheus" && o.Outputs[i].target != "-" {
+			resolve(&o.Outputs[i].target)
+		}
+	}
+}
+
+// pruneRuns removes the oldest runs beyond keep (0: no limit) and the runs
+// older than maxAge (0: no limit) from the runs directory, except current.
+// Only directories with a metadata.json are considered runs, so nothing else
+// in the directory is ever removed. It returns the removed runs.
+func pruneRuns(runs string, current string, keep int, maxAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(runs)
+	if err != nil {
+		return nil, err
+	}
+	type run struct {
+		dir   string
+		start time.Time
+	}
+	var found []run
+	for _, entry := range entries {
+		dir := filepath.Join(runs, entry.Name())
+		if !entry.IsDir() || dir == filepath.Clean(current) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
+		if err != nil {
+			continue
+		}
+		var metadata RunMetadata
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			continue
+		}
+		found = append(found, run{dir: dir, start: metadata.Start})
+	}
+	// Newest first, the current run counts towards keep
+	sort.Slice(found, func(i, j int) bool { return found[i].start.After(found[j].start) })
+
+	var removed []string
+	for i, run := range found {
+		tooMany := keep > 0 && i+1 >= keep
+		tooOld := maxAge > 0 && time.Since(run.start) > maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.RemoveAll(run.dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, run.dir)
+	}
+	return removed, nil
+}
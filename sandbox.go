@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+	--unshare runs the command in new namespaces through a small init process
+	(go-profile sandbox-init) which sets them up, runs the command as its
+	child and exits with its exit code:
+
+	- pid: the init is pid 1 of a new PID namespace, when it exits the kernel
+	  kills every process left in the namespace, including daemons that
+	  double-forked out of the session
+	- mount: the command gets a private /tmp (tmpfs) that is discarded with
+	  the namespace, and its own /proc when combined with pid
+
+	Without root a user namespace is created as well, with our uid and gid
+	mapped to themselves. The init keeps CAP_SYS_ADMIN in it (as an ambient
+	capability) for the mounts, the command does not.
+*/
+
+// namespaceList is the comma-separated value of --unshare
+type namespaceList []string
+
+func (n *namespaceList) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *namespaceList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "pid", "mount":
+			if !n.has(name) {
+				*n = append(*n, name)
+			}
+		default:
+			return fmt.Errorf("unsupported namespace %q (pid, mount)", name)
+		}
+	}
+	return nil
+}
+
+func (n namespaceList) has(name string) bool {
+	for _, ns := range n {
+		if ns == name {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	capSysAdmin = 21
+
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+// sandboxCommand returns the command that runs command in the namespaces
+// (as runAs if set) and the attributes to create them with
+func sandboxCommand(command []string, namespaces namespaceList, runAs *commandUser) ([]string, *syscall.SysProcAttr, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	args := []string{self, "sandbox-init"}
+	attr := &syscall.SysProcAttr{}
+	if namespaces.has("pid") {
+		args = append(args, "--pid")
+		attr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	if namespaces.has("mount") {
+		args = append(args, "--mount")
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if os.Geteuid() != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+		// The capabilities in the user namespace are lost on execve for
+		// a uid other than 0, keep CAP_SYS_ADMIN for the mounts
+		attr.AmbientCaps = []uintptr{capSysAdmin}
+	}
+	// The init needs root for the mounts, it starts the command as the user
+	args = append(args, runAs.args()...)
+	args = append(args, "--")
+	return append(args, command...), attr, nil
+}
+
+// setupMounts gives the sandbox a private /tmp and, in a PID namespace, a
+// /proc that only shows its processes
+func setupMounts(pidNamespace bool) error {
+	// Keep our mounts from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount /tmp: %w", err)
+	}
+	if pidNamespace {
+		if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("mount /proc: %w", err)
+		}
+	}
+	return nil
+}
+
+// sandboxInitMain is the init process of the sandbox, it forwards signals
+// to the command and reaps the orphans re-parented to it
+func sandboxInitMain(args []string) {
+	flags := flag.NewFlagSet("go-profile sandbox-init", flag.ExitOnError)
+	pidNamespace := flags.Bool("pid", false, "running in a new PID namespace")
+	mountNamespace := flags.Bool("mount", false, "running in a new mount namespace")
+	uid := flags.Int("uid", -1, "start the command as `uid`")
+	gid := flags.Int("gid", -1, "start the command with the primary `gid`")
+	groups := flags.String("groups", "", "comma-separated supplementary `gids` of the command")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile sandbox-init [--pid] [--mount] [--uid uid --gid gid [--groups gids]] -- <command> [arguments]\n")
+		os.Exit(1)
+	}
+
+	if *mountNamespace {
+		if err := setupMounts(*pidNamespace); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to set up the sandbox: %s\n", err)
+			os.Exit(126)
+		}
+	}
+
+	// The command runs without the capabilities the init needed. These are
+	// per thread, the command is started from this one.
+	runtime.LockOSThread()
+	syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	cmd := exec.Command(flags.Arg(0), flags.Args()[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if *uid >= 0 {
+		credential := &syscall.Credential{Uid: uint32(*uid), Gid: uint32(*gid), NoSetGroups: true}
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "groups" {
+				credential.NoSetGroups = false
+			}
+		})
+		for _, group := range strings.Split(*groups, ",") {
+			if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to start command: %s\n", err)
+		os.Exit(127)
+	}
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	// Reap every child (cmd.Wait would only reap the command) until the
+	// command itself exits
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+		os.Exit(status.ExitStatus())
+	}
+}
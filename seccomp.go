@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+/*
+	--no-new-privs and --seccomp start the command through go-profile harden,
+	which restricts itself and then executes the command (execve, so it keeps
+	the pid and stays in the process tree):
+
+	- no-new-privs: setuid binaries and file capabilities no longer raise
+	  the privileges of the command and its children
+	- seccomp: a filter of the syscalls, inherited by every child. A profile
+	  is "default" (a denylist of the syscalls that administer the machine)
+	  or a file in the format of Docker's seccomp profiles
+
+	Without root a filter can only be installed with no-new-privs, it is set
+	along with the filter then.
+
+	go-profile harden also sets the umask of --umask: the umask is
+	process-wide and only inherited, setting it in the command's own process
+	keeps the files go-profile creates meanwhile at go-profile's umask.
+*/
+
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// defaultSeccompDenied are the syscalls the default profile fails with
+// EPERM: they administer the machine (modules, mounts, clock, reboot),
+// inspect other processes or widen the kernel's attack surface (io_uring
+// also bypasses the filter, its operations are not syscalls)
+var defaultSeccompDenied = []string{
+	"acct", "add_key", "bpf", "chroot", "clock_adjtime", "clock_settime",
+	"create_module", "delete_module", "finit_module", "fsconfig", "fsmount",
+	"fsopen", "fspick", "get_kernel_syms", "init_module", "io_uring_enter",
+	"io_uring_register", "io_uring_setup", "ioperm", "iopl", "kcmp", "kexec_file_load", "kexec_load", "keyctl", "lookup_dcookie",
+	"mount", "mount_setattr", "move_mount", "name_to_handle_at",
+	"nfsservctl", "open_by_handle_at", "open_tree", "perf_event_open",
+	"pivot_root", "process_vm_readv", "process_vm_writev", "ptrace",
+	"query_module", "quotactl", "quotactl_fd", "reboot", "request_key",
+	"setdomainname", "sethostname", "setns", "settimeofday", "swapoff",
+	"swapon", "_sysctl", "syslog", "umount2", "unshare", "uselib",
+	"userfaultfd", "vhangup",
+}
+
+// seccompProfile is the part of a Docker seccomp profile that is applied
+type seccompProfile struct {
+	DefaultAction   string        `json:"defaultAction"`
+	DefaultErrnoRet *uint32       `json:"defaultErrnoRet"`
+	Syscalls        []seccompRule `json:"syscalls"`
+}
+
+type seccompRule struct {
+	Names    []string        `json:"names"`
+	Name     string          `json:"name"`
+	Action   string          `json:"action"`
+	ErrnoRet *uint32         `json:"errnoRet"`
+	Args     []seccompArg    `json:"args"`
+	Includes json.RawMessage `json:"includes"`
+}
+
+// seccompArg is a condition on an argument of the syscall, all of them
+// have to hold for the rule to apply
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// loadSeccompProfile reads the profile "default" or a file
+func loadSeccompProfile(name string) (*seccompProfile, error) {
+	if name == "default" {
+		return &seccompProfile{
+			DefaultAction: "SCMP_ACT_ALLOW",
+			Syscalls:      []seccompRule{{Names: defaultSeccompDenied, Action: "SCMP_ACT_ERRNO"}},
+		}, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	profile := &seccompProfile{}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return profile, nil
+}
+
+// seccompAction returns the filter's return value of an SCMP_ACT_* action
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return seccompRetAllow, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return seccompRetErrno | errno&0xffff, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return seccompRetKillThread, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return seccompRetKillProcess, nil
+	case "SCMP_ACT_TRAP":
+		return seccompRetTrap, nil
+	case "SCMP_ACT_LOG":
+		return seccompRetLog, nil
+	}
+	return 0, fmt.Errorf("unsupported seccomp action %q", action)
+}
+
+// compile translates the profile into a BPF program. The rules of a
+// syscall are checked in order and the first one whose argument conditions
+// hold applies, like with libseccomp. Rules that only apply with
+// capabilities or on some architectures (includes) are skipped, and so are
+// syscalls this architecture does not have.
+func (p *seccompProfile) compile() ([]syscall.SockFilter, error) {
+	if syscallNumbers == nil {
+		return nil, fmt.Errorf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	defaultAction, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	program := []syscall.SockFilter{
+		// struct seccomp_data: int nr, __u32 arch
+		statement(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, seccompArch, 1, 0),
+		statement(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		statement(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+	}
+	if seccompX32Bit != 0 {
+		program = append(program,
+			jump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, seccompX32Bit, 0, 1),
+			statement(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess))
+	}
+
+	// The rules after one without conditions are never reached
+	unconditional := map[uint32]bool{}
+	for _, rule := range p.Syscalls {
+		if len(rule.Includes) > 0 && string(rule.Includes) != "{}" && string(rule.Includes) != "null" {
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		conditions, err := compileSeccompArgs(rule.Args)
+		if err != nil {
+			return nil, err
+		}
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		for _, name := range names {
+			number, ok := syscallNumbers[name]
+			if !ok || unconditional[number] {
+				continue
+			}
+			unconditional[number] = len(rule.Args) == 0
+			// The conditions load the arguments, so every rule loads the
+			// syscall number again
+			block := []seccompInstruction{
+				{filter: statement(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0)},
+				{filter: jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, number, 0, 0), failFalse: true},
+			}
+			block = append(block, conditions...)
+			block = append(block, seccompInstruction{filter: statement(syscall.BPF_RET|syscall.BPF_K, action)})
+			filters, err := resolveSeccompBlock(block)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			program = append(program, filters...)
+		}
+	}
+	program = append(program, statement(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+	if len(program) > 4096 {
+		return nil, fmt.Errorf("the seccomp profile has too many rules")
+	}
+	return program, nil
+}
+
+// seccompInstruction is an instruction of a rule, the jumps marked fail go
+// to the end of the rule (the next rule)
+type seccompInstruction struct {
+	filter              syscall.SockFilter
+	failTrue, failFalse bool
+}
+
+// resolveSeccompBlock sets the offsets of the fail jumps
+func resolveSeccompBlock(block []seccompInstruction) ([]syscall.SockFilter, error) {
+	filters := make([]syscall.SockFilter, len(block))
+	for i, instruction := range block {
+		filters[i] = instruction.filter
+		offset := len(block) - i - 1
+		if offset > 255 {
+			return nil, fmt.Errorf("too many argument conditions")
+		}
+		if instruction.failTrue {
+			filters[i].Jt = uint8(offset)
+		}
+		if instruction.failFalse {
+			filters[i].Jf = uint8(offset)
+		}
+	}
+	return filters, nil
+}
+
+// compileSeccompArgs translates the argument conditions of a rule. The
+// arguments are 64 bits, compared as two 32 bit halves (little-endian):
+// the high halves decide unless they are equal.
+func compileSeccompArgs(args []seccompArg) ([]seccompInstruction, error) {
+	var code []seccompInstruction
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("seccomp argument index %d out of range", arg.Index)
+		}
+		// struct seccomp_data: int nr, __u32 arch, __u64 ip, __u64 args[6]
+		offset := uint32(16 + 8*arg.Index)
+		loadHigh := seccompInstruction{filter: syscall.SockFilter{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: offset + 4}}
+		loadLow := seccompInstruction{filter: syscall.SockFilter{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: offset}}
+		high, low := uint32(arg.Value>>32), uint32(arg.Value)
+		compare := func(op uint16, k uint32, jt, jf uint8, failTrue, failFalse bool) seccompInstruction {
+			return seccompInstruction{filter: syscall.SockFilter{Code: syscall.BPF_JMP | op | syscall.BPF_K, K: k, Jt: jt, Jf: jf}, failTrue: failTrue, failFalse: failFalse}
+		}
+		and := func(k uint32) seccompInstruction {
+			return seccompInstruction{filter: syscall.SockFilter{Code: syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K, K: k}}
+		}
+
+		switch arg.Op {
+		case "SCMP_CMP_EQ":
+			code = append(code,
+				loadHigh, compare(syscall.BPF_JEQ, high, 0, 0, false, true),
+				loadLow, compare(syscall.BPF_JEQ, low, 0, 0, false, true))
+		case "SCMP_CMP_NE":
+			// Holds if either half differs
+			code = append(code,
+				loadHigh, compare(syscall.BPF_JEQ, high, 0, 2, false, false),
+				loadLow, compare(syscall.BPF_JEQ, low, 0, 0, true, false))
+		case "SCMP_CMP_MASKED_EQ":
+			// value is the mask, valueTwo the masked value
+			code = append(code,
+				loadHigh, and(high), compare(syscall.BPF_JEQ, uint32(arg.ValueTwo>>32), 0, 0, false, true),
+				loadLow, and(low), compare(syscall.BPF_JEQ, uint32(arg.ValueTwo), 0, 0, false, true))
+		case "SCMP_CMP_GT", "SCMP_CMP_GE":
+			op := uint16(syscall.BPF_JGT)
+			if arg.Op == "SCMP_CMP_GE" {
+				op = syscall.BPF_JGE
+			}
+			code = append(code,
+				loadHigh,
+				compare(syscall.BPF_JGT, high, 3, 0, false, false),
+				compare(syscall.BPF_JEQ, high, 0, 0, false, true),
+				loadLow, compare(op, low, 0, 0, false, true))
+		case "SCMP_CMP_LT", "SCMP_CMP_LE":
+			// The low halves are compared the other way around: LT fails
+			// if low >= value, LE if low > value
+			op := uint16(syscall.BPF_JGE)
+			if arg.Op == "SCMP_CMP_LE" {
+				op = syscall.BPF_JGT
+			}
+			code = append(code,
+				loadHigh,
+				compare(syscall.BPF_JGE, high, 0, 3, false, false),
+				compare(syscall.BPF_JEQ, high, 0, 0, false, true),
+				loadLow, compare(op, low, 0, 0, true, false))
+		default:
+			return nil, fmt.Errorf("unsupported seccomp argument condition %q", arg.Op)
+		}
+	}
+	return code, nil
+}
+
+// harden restricts the calling thread, it has to execute the command
+// right after (with the thread still locked)
+func harden(noNewPrivs bool, seccomp string) error {
+	var program []syscall.SockFilter
+	if seccomp != "" {
+		profile, err := loadSeccompProfile(seccomp)
+		if err != nil {
+			return err
+		}
+		if program, err = profile.compile(); err != nil {
+			return err
+		}
+		noNewPrivs = noNewPrivs || os.Geteuid() != 0
+	}
+	if noNewPrivs {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+			return fmt.Errorf("set no-new-privs: %w", errno)
+		}
+	}
+	if program != nil {
+		fprog := syscall.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&fprog)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("install the seccomp filter: %w", errno)
+		}
+	}
+	return nil
+}
+
+// hardenCommand returns the command that runs command through go-profile
+// harden
+func hardenCommand(command []string, noNewPrivs bool, seccomp string, umask umaskValue) ([]string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{self, "harden"}
+	if noNewPrivs {
+		args = append(args, "--no-new-privs")
+	}
+	if umask.isSet {
+		args = append(args, "--umask", umask.String())
+	}
+	if seccomp != "" {
+		// The command may run in another directory (--chdir)
+		if seccomp != "default" {
+			if seccomp, err = filepath.Abs(seccomp); err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, "--seccomp", seccomp)
+	}
+	args = append(args, "--")
+	return append(args, command...), nil
+}
+
+// hardenMain restricts itself and executes the command
+func hardenMain(args []string) {
+	flags := flag.NewFlagSet("go-profile harden", flag.ExitOnError)
+	noNewPrivs := flags.Bool("no-new-privs", false, "set no-new-privs")
+	seccomp := flags.String("seccomp", "", "install the seccomp `profile`")
+	var umask umaskValue
+	flags.Var(&umask, "umask", "set the file mode creation `mask` (octal)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile harden [--no-new-privs] [--seccomp profile] [--umask mask] -- <command> [arguments]\n")
+		os.Exit(1)
+	}
+	if umask.isSet {
+		syscall.Umask(umask.mask)
+	}
+
+	path, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to find command: %s\n", err)
+		os.Exit(127)
+	}
+	// The filter is per thread, the command is executed from this one
+	runtime.LockOSThread()
+	if err := harden(*noNewPrivs, *seccomp); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to harden the command: %s\n", err)
+		os.Exit(126)
+	}
+	err = syscall.Exec(path, flags.Args(), os.Environ())
+	fmt.Fprintf(os.Stderr, "[go-profile] Failed to execute command: %s\n", err)
+	os.Exit(126)
+}
@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+
+package main
+
+// --seccomp is only supported on x86-64 and arm64
+const (
+	seccompArch   = 0
+	seccompX32Bit = 0
+)
+
+var syscallNumbers map[string]uint32
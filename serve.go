@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	The Profiler gRPC service uses JSON instead of protobuf for its messages,
+	so no code generation is needed on either side. Clients have to select
+	the codec, in Go that is grpc.ForceCodec with a codec named "json".
+
+	service goprofile.Profiler {
+		rpc StartRun(StartRunRequest) returns (StartRunResponse);
+		rpc StreamSamples(RunRequest) returns (stream Sample);
+		rpc GetSummary(RunRequest) returns (Summary);
+	}
+*/
+
+type StartRunRequest struct {
+	Command []string          `json:"command"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+type StartRunResponse struct {
+	RunID string `json:"run_id"`
+}
+
+type RunRequest struct {
+	RunID string `json:"run_id"`
+}
+
+// ProfilerServer is the server API of the Profiler service
+type ProfilerServer interface {
+	StartRun(context.Context, *StartRunRequest) (*StartRunResponse, error)
+	StreamSamples(*RunRequest, grpc.ServerStream) error
+	GetSummary(context.Context, *RunRequest) (*Summary, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// A served run keeps its last servedSampleLimit samples (up to twice as
+// many between the trims) for StreamSamples, a client that falls further
+// behind misses the older ones. They are all in the metrics.jsonl of the run
+// directory.
+const servedSampleLimit = 10000
+
+// servedRun tracks the samples and the result of a run started over gRPC
+type servedRun struct {
+	mu      sync.Mutex
+	samples []Sample
+	// Samples trimmed from the start of samples
+	dropped  int
+	summary  *Summary
+	err      error
+	finished bool
+	// changed is closed (and replaced) whenever a sample arrives or the run finishes
+	changed chan struct{}
+}
+
+func (r *servedRun) update(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f()
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+type profilerServer struct {
+	// Every run gets a directory for its log and summary in runsDir
+	runsDir string
+	// Finished runs are forgotten after ttl
+	ttl time.Duration
+
+	mu   sync.Mutex
+	runs map[string]*servedRun
+}
+
+func (s *profilerServer) lookup(runID string) (*servedRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, ok := s.runs[runID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown run: %s", runID)
+	}
+	return run, nil
+}
+
+func (s *profilerServer) StartRun(ctx context.Context, req *StartRunRequest) (*StartRunResponse, error) {
+	if len(req.Command) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "command is empty")
+	}
+
+	// The samples are only in the metrics log and StreamSamples, the server's
+	// terminal is not the run's
+	opts := &Options{Command: req.Command, NoMirror: true, Quiet: true, LogPath: "output.log", MetricsLog: "metrics.jsonl"}
+	keys := make([]string, 0, len(req.Tags))
+	for key := range req.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opts.Tags = append(opts.Tags, Tag{Key: key, Value: req.Tags[key]})
+	}
+
+	// Concurrent runs must not share the log
+	start := time.Now()
+	runID := newRunID(start)
+	dir, err := createRunDir(s.runsDir, start, req.Command[0])
+	if dir == "" {
+		return nil, status.Errorf(codes.Internal, "failed to create the run directory: %s", err)
+	}
+	opts.inRunDir(dir)
+	if err := writeRunMetadata(dir, newRunMetadata(opts, runID, start)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to write the run metadata: %s", err)
+	}
+	metrics, err := openMetricsLog(opts.MetricsLog, opts.Compress)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to open the metrics log: %s", err)
+	}
+
+	run := &servedRun{changed: make(chan struct{})}
+	s.mu.Lock()
+	s.runs[runID] = run
+	s.mu.Unlock()
+
+	go func() {
+		summary, err := profile(opts, runID, func(sample Sample) {
+			metrics.write(sample)
+			run.update(func() {
+				run.samples = append(run.samples, sample)
+				if len(run.samples) >= 2*servedSampleLimit {
+					trim := len(run.samples) - servedSampleLimit
+					run.samples = append([]Sample(nil), run.samples[trim:]...)
+					run.dropped += trim
+				}
+			})
+		})
+		if err := metrics.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to write the metrics log: %s\n", err)
+		}
+		if summary != nil {
+			if err := writeSummaryJSON(filepath.Join(dir, "summary.json"), summary); err != nil {
+				fmt.Fprintf(os.Stderr, "[go-profile] Failed to write summary: %s\n", err)
+			}
+		}
+		run.update(func() {
+			run.summary = summary
+			run.err = err
+			run.finished = true
+		})
+		time.AfterFunc(s.ttl, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.runs, runID)
+		})
+	}()
+
+	return &StartRunResponse{RunID: runID}, nil
+}
+
+func (s *profilerServer) StreamSamples(req *RunRequest, stream grpc.ServerStream) error {
+	run, err := s.lookup(req.RunID)
+	if err != nil {
+		return err
+	}
+
+	// Send the samples recorded so far, then follow the run until it
+	// finishes. sent counts from the start of the run, including the
+	// samples that were trimmed.
+	sent := 0
+	for {
+		run.mu.Lock()
+		start := max(sent, run.dropped)
+		pending := run.samples[start-run.dropped:]
+		finished := run.finished
+		changed := run.changed
+		run.mu.Unlock()
+
+		for i := range pending {
+			if err := stream.SendMsg(&pending[i]); err != nil {
+				return err
+			}
+		}
+		sent = start + len(pending)
+
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *profilerServer) GetSummary(ctx context.Context, req *RunRequest) (*Summary, error) {
+	run, err := s.lookup(req.RunID)
+	if err != nil {
+		return nil, err
+	}
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if !run.finished {
+		return nil, status.Errorf(codes.FailedPrecondition, "run %s is still in progress", req.RunID)
+	}
+	if run.summary == nil {
+		return nil, status.Errorf(codes.Aborted, "run %s failed to start: %s", req.RunID, run.err)
+	}
+	return run.summary, nil
+}
+
+var profilerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "goprofile.Profiler",
+	HandlerType: (*ProfilerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StartRun",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(StartRunRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(ProfilerServer).StartRun(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/goprofile.Profiler/StartRun"}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(ProfilerServer).StartRun(ctx, req.(*StartRunRequest))
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+		{
+			MethodName: "GetSummary",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(RunRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(ProfilerServer).GetSummary(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/goprofile.Profiler/GetSummary"}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(ProfilerServer).GetSummary(ctx, req.(*RunRequest))
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "StreamSamples",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(RunRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(ProfilerServer).StreamSamples(req, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+}
+
+func serveMain(args []string) {
+	flags := flag.NewFlagSet("go-profile serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile serve [options]\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	listen := flags.String("listen", "localhost:50051", "`address` to serve the gRPC API on, addresses other than loopback need TLS and client authentication")
+	var security serveSecurity
+	flags.StringVar(&security.certFile, "tls-cert", "", "serve over TLS with the certificate in `file` (PEM)")
+	flags.StringVar(&security.keyFile, "tls-key", "", "private key `file` of --tls-cert (PEM)")
+	flags.StringVar(&security.clientCA, "tls-client-ca", "", "require client certificates signed by the CAs in `file` (PEM)")
+	runsDir := flags.String("runs-dir", "go-profile-runs", "write the log, metadata and summary of every run to a new directory in `dir`")
+	ttl := flags.Duration("run-ttl", time.Hour, "forget finished runs after this `duration`, their samples and summary stay in the run directory")
+	flags.Parse(args)
+	security.token = os.Getenv(serveTokenEnv)
+	if *runsDir == "" {
+		fmt.Fprintf(os.Stderr, "[go-profile] --runs-dir can not be empty, concurrent runs need a directory each\n")
+		os.Exit(1)
+	}
+
+	options, err := security.serverOptions(*listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] %s\n", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to listen: %s\n", err)
+		os.Exit(1)
+	}
+
+	server := grpc.NewServer(append(options, grpc.ForceServerCodec(jsonCodec{}))...)
+	server.RegisterService(&profilerServiceDesc, &profilerServer{runsDir: *runsDir, ttl: *ttl, runs: map[string]*servedRun{}})
+
+	fmt.Fprintf(os.Stderr, "[go-profile] Serving gRPC on %s\n", listener.Addr())
+	if err := server.Serve(listener); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to serve: %s\n", err)
+		os.Exit(1)
+	}
+}
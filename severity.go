@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity levels of the command's output lines, in the order they are
+// matched
+const (
+	severityError = iota
+	severityWarn
+	severityInfo
+	severityNone
+)
+
+var severityNames = []string{"error", "warn", "info"}
+
+// defaultSeverityPatterns classify the common log formats (ERROR, [warn],
+// level=info, Traceback, ...)
+var defaultSeverityPatterns = []string{
+	`(?i)\b(error|err|fatal|critical|panic|exception|traceback)\b`,
+	`(?i)\b(warn|warning)\b`,
+	`(?i)\binfo\b`,
+}
+
+// ANSI colors of the mirrored lines per level
+var severityColors = []string{"\x1b[31m", "\x1b[33m", ""}
+
+// severityPatternList is a flag value for the repeated --severity-pattern
+// level=regex, it replaces the default pattern of the level
+type severityPatternList map[int]*regexp.Regexp
+
+func (s *severityPatternList) String() string {
+	var values []string
+	for level, re := range *s {
+		values = append(values, severityNames[level]+"="+re.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (s *severityPatternList) Set(value string) error {
+	name, pattern, ok := strings.Cut(value, "=")
+	level := severityLevel(name)
+	if !ok || level == severityNone {
+		return fmt.Errorf("expected level=regex with a level of error, warn or info, got %q", value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	if *s == nil {
+		*s = severityPatternList{}
+	}
+	(*s)[level] = re
+	return nil
+}
+
+func severityLevel(name string) int {
+	for level, levelName := range severityNames {
+		if name == levelName {
+			return level
+		}
+	}
+	return severityNone
+}
+
+// SeveritySummary counts the output lines of the command per severity
+type SeveritySummary struct {
+	Error uint64 `json:"error"`
+	Warn  uint64 `json:"warn"`
+	Info  uint64 `json:"info"`
+
+	// First and last error line, to jump to the failure in the log
+	Log        string     `json:"log"`
+	FirstError *ErrorLine `json:"first_error,omitempty"`
+	LastError  *ErrorLine `json:"last_error,omitempty"`
+}
+
+// ErrorLine is an error line of the command's output
+type ErrorLine struct {
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+	// Byte offset of the line in the log, -1 if it was not logged (--drop,
+	// --max-output-lines-per-sec)
+	Offset int64 `json:"offset"`
+}
+
+// location is the time of the line relative to the start of the run and,
+// if it was logged, its byte offset in the log (tail -c +<offset+1> log)
+func (e *ErrorLine) location(start time.Time, log string) string {
+	if e.Offset < 0 {
+		return formatOffset(e.Time, start) + " (not logged)"
+	}
+	return fmt.Sprintf("%s (%s, byte %d)", formatOffset(e.Time, start), log, e.Offset)
+}
+
+// severityClassifier classifies the lines of stdout and stderr
+type severityClassifier struct {
+	patterns []*regexp.Regexp
+	color    bool
+	log      string
+
+	mu         sync.Mutex
+	counts     [severityNone]uint64
+	firstError *ErrorLine
+	lastError  *ErrorLine
+}
+
+// newSeverityClassifier returns nil unless --severity is set, color is
+// "always", "never" or "auto" (when stdout is a terminal)
+func newSeverityClassifier(enabled bool, overrides severityPatternList, color string, log string) *severityClassifier {
+	if !enabled {
+		return nil
+	}
+	c := &severityClassifier{color: color == "always" || (color == "auto" && isTerminal(os.Stdout)), log: log}
+	for level, pattern := range defaultSeverityPatterns {
+		re, ok := overrides[level]
+		if !ok {
+			re = regexp.MustCompile(pattern)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	return c
+}
+
+// isTerminal returns whether the file is a character device
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// classify returns the level of the line and counts it
+func (c *severityClassifier) classify(line string) int {
+	if c == nil {
+		return severityNone
+	}
+	for level, re := range c.patterns {
+		if re.MatchString(line) {
+			c.mu.Lock()
+			c.counts[level]++
+			c.mu.Unlock()
+			return level
+		}
+	}
+	return severityNone
+}
+
+// located records where an error line was written to the log
+func (c *severityClassifier) located(level int, t time.Time, line string, offset int64) {
+	if c == nil || level != severityError {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastError = &ErrorLine{Time: t, Line: line, Offset: offset}
+	if c.firstError == nil {
+		c.firstError = c.lastError
+	}
+}
+
+// colorize colors a mirrored line of the level
+func (c *severityClassifier) colorize(level int, line string) string {
+	if c == nil || !c.color || level == severityNone || severityColors[level] == "" {
+		return line
+	}
+	return severityColors[level] + line + "\x1b[0m"
+}
+
+func (c *severityClassifier) result() *SeveritySummary {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &SeveritySummary{
+		Error:      c.counts[severityError],
+		Warn:       c.counts[severityWarn],
+		Info:       c.counts[severityInfo],
+		Log:        c.log,
+		FirstError: c.firstError,
+		LastError:  c.lastError,
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sampleSink receives every sample of a run
+type sampleSink interface {
+	write(sample Sample)
+	close() error
+}
+
+// outputSpec is the value of --output: format:target
+type outputSpec struct {
+	format string
+	target string
+}
+
+func (o outputSpec) String() string {
+	return o.format + ":" + o.target
+}
+
+// outputFormats are the formats of --output
+var outputFormats = map[string]bool{"log": true, "jsonl": true, "csv": true, "parquet": true, "prometheus": true}
+
+// outputList collects the repeated --output flag
+type outputList []outputSpec
+
+func (o *outputList) String() string {
+	specs := make([]string, len(*o))
+	for i, spec := range *o {
+		specs[i] = spec.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (o *outputList) Set(value string) error {
+	format, target, found := strings.Cut(value, ":")
+	if !outputFormats[format] || !found || target == "" {
+		return fmt.Errorf("expected format:target with a format of log, jsonl, csv, parquet or prometheus")
+	}
+	*o = append(*o, outputSpec{format: format, target: target})
+	return nil
+}
+
+// openSink creates the sink of an output, log outputs have no sink
+func openSink(spec outputSpec) (sampleSink, error) {
+	switch spec.format {
+	case "jsonl":
+		w, file, err := openSinkFile(spec.target)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonlSink{w: w, file: file}, nil
+	case "csv":
+		w, file, err := openSinkFile(spec.target)
+		if err != nil {
+			return nil, err
+		}
+		return newCSVSink(w, file), nil
+	case "parquet":
+		parquet, err := createParquetWriter(spec.target)
+		if err != nil {
+			return nil, err
+		}
+		return parquet, nil
+	case "prometheus":
+		prometheus, err := startPrometheusSink(spec.target)
+		if err != nil {
+			return nil, err
+		}
+		return prometheus, nil
+	}
+	return nil, nil
+}
+
+// openSinkFile returns stdout for "-", the file is nil then
+func openSinkFile(path string) (io.Writer, io.Closer, error) {
+	if path == "-" {
+		return stdoutWriter, nil, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, file, nil
+}
+
+// openMetricsLog appends the samples to the metrics log (--metrics-log),
+// compressed with compress (--compress)
+func openMetricsLog(path string, compress string) (sampleSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressFile(file, compress)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{w: compressed, file: compressed}, nil
+}
+
+// sinkMux passes every sample to each of the sinks
+type sinkMux []sampleSink
+
+func (m sinkMux) write(sample Sample) {
+	for _, sink := range m {
+		sink.write(sample)
+	}
+}
+
+// close closes all sinks and returns the first error
+func (m sinkMux) close() error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// downsampleSink passes on the first sample of every interval and the last
+// one of the run (--downsample), the counter columns stay exact while the
+// gauges in between are left out
+type downsampleSink struct {
+	sink     sampleSink
+	interval time.Duration
+	last     time.Time
+	// The latest sample that was left out
+	skipped *Sample
+}
+
+func (d *downsampleSink) write(sample Sample) {
+	if !d.last.IsZero() && sample.Time.Sub(d.last) < d.interval {
+		d.skipped = &sample
+		return
+	}
+	d.last, d.skipped = sample.Time, nil
+	d.sink.write(sample)
+}
+
+func (d *downsampleSink) close() error {
+	if d.skipped != nil {
+		d.sink.write(*d.skipped)
+	}
+	return d.sink.close()
+}
+
+// memorySink keeps the samples for the chart and the report
+type memorySink struct {
+	samples []Sample
+}
+
+func (m *memorySink) write(sample Sample) {
+	m.samples = append(m.samples, sample)
+}
+
+func (m *memorySink) close() error {
+	return nil
+}
+
+// jsonlSink writes a sample per line (--stream json)
+type jsonlSink struct {
+	w    io.Writer
+	file io.Closer
+}
+
+func (j *jsonlSink) write(sample Sample) {
+	if err := writeJSONLine(j.w, sample); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to stream sample: %s\n", err)
+	}
+}
+
+func (j *jsonlSink) close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// csvSink writes the flat sample columns with a header
+type csvSink struct {
+	w       *csv.Writer
+	file    io.Closer
+	columns []sampleColumn
+}
+
+func newCSVSink(w io.Writer, file io.Closer) *csvSink {
+	c := &csvSink{w: csv.NewWriter(w), file: file, columns: sampleColumns()}
+	header := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		header[i] = column.name
+	}
+	c.w.Write(header)
+	return c
+}
+
+// formatColumnValue formats a column value as text
+func formatColumnValue(value interface{}) string {
+	switch v := value.(type) {
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	}
+	return ""
+}
+
+func (c *csvSink) write(sample Sample) {
+	record := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		record[i] = formatColumnValue(column.value(sample))
+	}
+	c.w.Write(record)
+	// Flush every tick, so the file can be followed during the run
+	c.w.Flush()
+}
+
+func (c *csvSink) close() error {
+	c.w.Flush()
+	err := c.w.Error()
+	if c.file != nil {
+		if closeErr := c.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// prometheusSink serves the latest sample as gauges on /metrics
+type prometheusSink struct {
+	server  *http.Server
+	columns []sampleColumn
+
+	mu     sync.Mutex
+	latest *Sample
+}
+
+func startPrometheusSink(address string) (*prometheusSink, error) {
+	p := &prometheusSink{columns: sampleColumns()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.serveMetrics)
+	p.server = &http.Server{Addr: address, Handler: mux}
+
+	// Listen first, so a port in use is reported before the run
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go p.server.Serve(listener)
+	return p, nil
+}
+
+func (p *prometheusSink) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	latest := p.latest
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if latest == nil {
+		return
+	}
+	labels := fmt.Sprintf("run_id=%q", latest.RunID)
+	for key, value := range latest.Tags {
+		labels += fmt.Sprintf(",%s=%q", prometheusName(key), value)
+	}
+	for _, column := range p.columns {
+		if column.kind == metricLabel {
+			continue
+		}
+		name := prometheusMetric(column)
+		fmt.Fprintf(w, "# HELP %s %s", name, column.description)
+		if column.unit != unitNone {
+			fmt.Fprintf(w, " (%s)", column.unit)
+		}
+		fmt.Fprintf(w, "\n# TYPE %s %s\n%s{%s} %s\n", name, column.kind, name, labels, formatColumnValue(column.value(*latest)))
+	}
+}
+
+// prometheusMetric returns the Prometheus name of the metric, counters end
+// in _total by convention
+func prometheusMetric(column sampleColumn) string {
+	if column.kind == metricCounter {
+		return "go_profile_" + column.name + "_total"
+	}
+	return "go_profile_" + column.name
+}
+
+// prometheusName replaces the characters that are not allowed in label names
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (p *prometheusSink) write(sample Sample) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latest = &sample
+}
+
+func (p *prometheusSink) close() error {
+	return p.server.Close()
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// Peaks of go-profile and sacct further apart than this are flagged
+const slurmDiscrepancy = 0.2
+
+// sacct records a step when it finished, give it this long
+const (
+	sacctAttempts = 3
+	sacctDelay    = time.Second
+)
+
+type SlurmJob = profileio.SlurmJob
+
+// SlurmSummary reconciles the usage go-profile saw with the accounting of
+// the SLURM job (sacct). sacct accounts per task and the tasks of a step run
+// under slurmstepd, so only the steps whose tasks were in the command's
+// process tree are compared.
+type SlurmSummary struct {
+	JobID string `json:"job_id"`
+	// The steps that ran during the command (e.g. started by srun in the
+	// command), sacct has no usage of the step go-profile runs in until it
+	// finished
+	Steps []string `json:"steps,omitempty"`
+
+	// Largest RSS of a task and the CPU time of the steps according to sacct
+	MaxRSS   uint64        `json:"max_rss,omitempty"`
+	TotalCPU time.Duration `json:"total_cpu,omitempty"`
+
+	// The same according to go-profile, for the tasks of the steps it saw
+	// in the process tree (the CPU time only of steps on this node)
+	PeakRSS uint64        `json:"peak_rss,omitempty"`
+	CPUTime time.Duration `json:"cpu_time,omitempty"`
+
+	Discrepancies []string `json:"discrepancies,omitempty"`
+	// Why the usage could not be reconciled
+	Problem string `json:"problem,omitempty"`
+}
+
+// getSlurmJob returns nil outside of a SLURM job
+func getSlurmJob() *SlurmJob {
+	jobID := os.Getenv("SLURM_JOB_ID")
+	if jobID == "" {
+		return nil
+	}
+	number := func(name string) int {
+		value, _ := strconv.Atoi(os.Getenv(name))
+		return value
+	}
+	megabytes := func(name string) uint64 {
+		value, _ := strconv.ParseUint(os.Getenv(name), 10, 64)
+		return value * 1024 * 1024
+	}
+	gpus := os.Getenv("SLURM_JOB_GPUS")
+	if gpus == "" {
+		gpus = os.Getenv("SLURM_GPUS_ON_NODE")
+	}
+	return &SlurmJob{
+		JobID:       jobID,
+		StepID:      os.Getenv("SLURM_STEP_ID"),
+		Name:        os.Getenv("SLURM_JOB_NAME"),
+		Partition:   os.Getenv("SLURM_JOB_PARTITION"),
+		NodeList:    os.Getenv("SLURM_JOB_NODELIST"),
+		Nodes:       number("SLURM_JOB_NUM_NODES"),
+		Tasks:       number("SLURM_NTASKS"),
+		CPUsPerTask: number("SLURM_CPUS_PER_TASK"),
+		CPUsOnNode:  number("SLURM_CPUS_ON_NODE"),
+		MemPerNode:  megabytes("SLURM_MEM_PER_NODE"),
+		MemPerCPU:   megabytes("SLURM_MEM_PER_CPU"),
+		GPUs:        gpus,
+	}
+}
+
+// describeSlurmJob formats the job and its resources for the log
+func describeSlurmJob(j *SlurmJob) string {
+	parts := []string{"job " + j.JobID}
+	if j.Name != "" {
+		parts = append(parts, "name "+j.Name)
+	}
+	if j.Partition != "" {
+		parts = append(parts, "partition "+j.Partition)
+	}
+	if j.NodeList != "" {
+		parts = append(parts, fmt.Sprintf("nodes %s (%d)", j.NodeList, j.Nodes))
+	}
+	if j.Tasks > 0 {
+		parts = append(parts, fmt.Sprintf("%d tasks", j.Tasks))
+	}
+	if j.CPUsOnNode > 0 {
+		parts = append(parts, fmt.Sprintf("%d CPUs on this node", j.CPUsOnNode))
+	}
+	if j.MemPerNode > 0 {
+		parts = append(parts, formatBytes(j.MemPerNode)+" per node")
+	} else if j.MemPerCPU > 0 {
+		parts = append(parts, formatBytes(j.MemPerCPU)+" per CPU")
+	}
+	if j.GPUs != "" {
+		parts = append(parts, "GPUs "+j.GPUs)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// srunStep returns true for the id of a step started by srun, the batch
+// script and the extern step have reserved ids
+func srunStep(id string) bool {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return err == nil && n < 0xfffffff0
+}
+
+// slurmTracker finds the tasks of the job's steps in the command's process
+// tree by their environment and follows their CPU time and RSS, like sacct
+// accounts them
+type slurmTracker struct {
+	jobID string
+	// Task of every pid seen, the zero task for processes that are not one
+	tasks map[int]slurmTask
+	// Last CPU time of the task processes in clock ticks, it stays when the
+	// process exits
+	ticks map[int]uint64
+	// Largest RSS of a task of every step
+	maxRSS map[string]uint64
+}
+
+type slurmTask struct {
+	step string
+	task int
+}
+
+// newSlurmTracker returns nil outside of a SLURM job and inside a step, the
+// command's processes are then the tasks of go-profile's own step
+func newSlurmTracker(job *SlurmJob) *slurmTracker {
+	if job == nil || srunStep(job.StepID) {
+		return nil
+	}
+	return &slurmTracker{jobID: job.JobID, tasks: map[int]slurmTask{}, ticks: map[int]uint64{}, maxRSS: map[string]uint64{}}
+}
+
+func (t *slurmTracker) sample(pids []int) {
+	if t == nil {
+		return
+	}
+	rss := map[slurmTask]uint64{}
+	for _, pid := range pids {
+		task, seen := t.tasks[pid]
+		if !seen {
+			task = t.readTask(pid)
+			t.tasks[pid] = task
+		}
+		if task.step == "" {
+			continue
+		}
+		if ticks := getProcessCPUTicks([]int{pid}); ticks > 0 {
+			t.ticks[pid] = ticks
+		}
+		rss[task] += getProcessRSS([]int{pid})
+	}
+	for task, value := range rss {
+		t.maxRSS[task.step] = max(t.maxRSS[task.step], value)
+	}
+}
+
+// readTask returns the step (job.step) and task of the process from its
+// environment, the zero task if it is no task of a step of the job
+func (t *slurmTracker) readTask(pid int) slurmTask {
+	environ, err := os.ReadFile(pidPath(pid, "environ"))
+	if err != nil {
+		return slurmTask{}
+	}
+	var job string
+	var task slurmTask
+	for _, variable := range bytes.Split(environ, []byte{0}) {
+		name, value, _ := bytes.Cut(variable, []byte("="))
+		switch string(name) {
+		case "SLURM_JOB_ID":
+			job = string(value)
+		case "SLURM_STEP_ID":
+			task.step = string(value)
+		case "SLURM_PROCID":
+			task.task, _ = strconv.Atoi(string(value))
+		}
+	}
+	if job != t.jobID || !srunStep(task.step) {
+		return slurmTask{}
+	}
+	task.step = job + "." + task.step
+	return task
+}
+
+// cpuTime returns the CPU time of the task processes of the step
+func (t *slurmTracker) cpuTime(step string) time.Duration {
+	var ticks uint64
+	for pid, task := range t.tasks {
+		if task.step == step {
+			ticks += t.ticks[pid]
+		}
+	}
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// sacctStep is the accounting of a finished step
+type sacctStep struct {
+	id       string
+	maxRSS   uint64
+	totalCPU time.Duration
+	nodes    int
+}
+
+// reconcileSlurm compares the usage of the tasks go-profile saw with sacct
+// for the steps of the job that started during the command
+func reconcileSlurm(job *SlurmJob, start time.Time, tracker *slurmTracker) *SlurmSummary {
+	result := &SlurmSummary{JobID: job.JobID}
+	if srunStep(job.StepID) {
+		step := job.JobID + "." + job.StepID
+		result.Problem = fmt.Sprintf("go-profile runs inside step %s, which finishes after it, sacct --jobs %s has its usage then", step, step)
+		return result
+	}
+
+	var steps []sacctStep
+	for attempt := 1; ; attempt++ {
+		out, err := exec.Command("sacct", "--jobs", job.JobID, "--noheader", "--parsable2",
+			"--format=JobID,Start,End,MaxRSS,TotalCPU,NNodes").Output()
+		if err != nil {
+			result.Problem = fmt.Sprintf("sacct failed: %s", err)
+			return result
+		}
+		steps = parseSacct(string(out), start)
+		if len(steps) > 0 || attempt == sacctAttempts {
+			break
+		}
+		time.Sleep(sacctDelay)
+	}
+	if len(steps) == 0 {
+		result.Problem = "no step of the job finished during the command, sacct only has the usage of finished steps (start them with srun in the command)"
+		return result
+	}
+
+	differs := func(ours, theirs float64) bool {
+		return theirs > 0 && (ours < theirs*(1-slurmDiscrepancy) || ours > theirs*(1+slurmDiscrepancy))
+	}
+	compared := 0
+	for _, step := range steps {
+		result.Steps = append(result.Steps, step.id)
+		result.MaxRSS = max(result.MaxRSS, step.maxRSS)
+		result.TotalCPU += step.totalCPU
+
+		rss, seen := tracker.maxRSS[step.id]
+		if !seen {
+			continue
+		}
+		compared++
+		result.PeakRSS = max(result.PeakRSS, rss)
+		if differs(float64(rss), float64(step.maxRSS)) {
+			result.Discrepancies = append(result.Discrepancies, fmt.Sprintf("step %s: largest task RSS %s, sacct MaxRSS %s",
+				step.id, formatBytes(rss), formatBytes(step.maxRSS)))
+		}
+		// The tasks on the other nodes are not seen
+		if step.nodes != 1 {
+			continue
+		}
+		cpu := tracker.cpuTime(step.id)
+		result.CPUTime += cpu
+		if differs(float64(cpu), float64(step.totalCPU)) {
+			result.Discrepancies = append(result.Discrepancies, fmt.Sprintf("step %s: CPU time %s, sacct TotalCPU %s",
+				step.id, cpu.Round(time.Millisecond), step.totalCPU.Round(time.Millisecond)))
+		}
+	}
+	if compared == 0 {
+		result.Problem = "the tasks of the steps ran under slurmstepd, outside of the command's process tree, so go-profile did not see them to compare (srun go-profile -- ./app measures the tasks themselves)"
+	}
+	return result
+}
+
+// parseSacct returns the finished steps that started at or after start. The
+// lines look like
+// "1234.0|2024-01-02T03:04:05|2024-01-02T03:14:05|1024K|00:09:58.123|2".
+func parseSacct(out string, start time.Time) []sacctStep {
+	var steps []sacctStep
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 6 || !strings.Contains(fields[0], ".") {
+			continue
+		}
+		// extern and batch are not started by the command
+		if strings.HasSuffix(fields[0], ".extern") || strings.HasSuffix(fields[0], ".batch") {
+			continue
+		}
+		// sacct prints local time with a resolution of a second
+		stepStart, err := time.ParseInLocation("2006-01-02T15:04:05", fields[1], time.Local)
+		if err != nil || stepStart.Before(start.Truncate(time.Second)) {
+			continue
+		}
+		if _, err := time.ParseInLocation("2006-01-02T15:04:05", fields[2], time.Local); err != nil {
+			// Still running ("Unknown")
+			continue
+		}
+		nodes, _ := strconv.Atoi(fields[5])
+		steps = append(steps, sacctStep{
+			id:       fields[0],
+			maxRSS:   parseSlurmMemory(fields[3]),
+			totalCPU: parseSlurmDuration(fields[4]),
+			nodes:    nodes,
+		})
+	}
+	return steps
+}
+
+// parseSlurmMemory parses sizes like "1024K" or "1.50G" (powers of 1024)
+func parseSlurmMemory(value string) uint64 {
+	if value == "" {
+		return 0
+	}
+	multiplier := 1.0
+	switch value[len(value)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	case 'T':
+		multiplier = 1 << 40
+	}
+	number, err := strconv.ParseFloat(strings.TrimRight(value, "KMGT"), 64)
+	if err != nil {
+		return 0
+	}
+	return uint64(number * multiplier)
+}
+
+// parseSlurmDuration parses durations like "1-02:03:04", "02:03:04" or
+// "03:04.567"
+func parseSlurmDuration(value string) time.Duration {
+	var days time.Duration
+	if d, rest, ok := strings.Cut(value, "-"); ok {
+		n, _ := strconv.Atoi(d)
+		days = time.Duration(n) * 24 * time.Hour
+		value = rest
+	}
+	parts := strings.Split(value, ":")
+	var total float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0
+		}
+		total = total*60 + n
+	}
+	return days + time.Duration(total*float64(time.Second))
+}
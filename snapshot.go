@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// The CPU usage of the processes in a snapshot is measured over this
+	// window
+	snapshotCPUWindow = 500 * time.Millisecond
+	// Open files listed per process, the rest is counted
+	snapshotMaxFds = 20
+	// Largest memory mappings listed per process
+	snapshotMaxMappings = 5
+	// Lines of the command's output at the end of a snapshot
+	snapshotOutputLines = 100
+	snapshotTimeout     = 5 * time.Second
+)
+
+// snapshotter writes a detailed snapshot of the command to the log on
+// demand, to debug a run that hangs: the process tree with the state, CPU
+// usage, RSS, threads, kernel wait channel, memory breakdown (smaps) and
+// open files of every process, the state of the GPUs and the last lines of
+// the output. SIGQUIT to go-profile (Ctrl+\) and s with --interactive take
+// one, SIGQUIT is not forwarded to the command then, and so does every
+// --alert that starts.
+type snapshotter struct {
+	childPid  *atomic.Int64
+	output    *outputTail
+	stamps    *timestampFormat
+	logPrintf func(format string, a ...interface{})
+
+	mu    sync.Mutex
+	count int
+	// Snapshots taken in the background
+	pending sync.WaitGroup
+}
+
+func newSnapshotter(childPid *atomic.Int64, output *outputTail, stamps *timestampFormat, logPrintf func(format string, a ...interface{})) *snapshotter {
+	return &snapshotter{childPid: childPid, output: output, stamps: stamps, logPrintf: logPrintf}
+}
+
+// outputTail keeps the last lines of the command's output
+type outputTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+func newOutputTail(size int) *outputTail {
+	return &outputTail{lines: make([]string, 0, size)}
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) < cap(t.lines) {
+		t.lines = append(t.lines, line)
+		return
+	}
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+}
+
+// last returns the lines, oldest first
+func (t *outputTail) last() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append(append([]string(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// listen takes a snapshot at every SIGQUIT until stop is called
+func (s *snapshotter) listen() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGQUIT)
+	go func() {
+		for range signals {
+			s.take("SIGQUIT")
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+// background takes a snapshot without blocking the caller (the samples go
+// on meanwhile)
+func (s *snapshotter) background(reason string) {
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.take(reason)
+	}()
+}
+
+// wait waits for the snapshots taken in the background
+func (s *snapshotter) wait() {
+	s.pending.Wait()
+}
+
+// snapshotProcess is a process of the tree in a snapshot
+type snapshotProcess struct {
+	pid, ppid int
+	depth     int
+	state     string
+	threads   int
+	ticks     uint64
+	rss       uint64
+	cpu       float64
+	wchan     string
+	command   string
+	fds       []string
+	fdCount   int
+	// Totals of smaps_rollup and the largest mappings
+	memory   string
+	mappings []string
+}
+
+// take writes a snapshot to the log, reason is what triggered it
+func (s *snapshotter) take(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	now := time.Now()
+	// Measured before the section starts, so the samples of the window do
+	// not end up in it
+	pid := int(s.childPid.Load())
+	var processes []*snapshotProcess
+	if pid != 0 {
+		processes = readSnapshotProcesses(getProcessTree(pid))
+	}
+
+	s.logPrintf("----- Snapshot %d at +%s (%s) -----", s.count, s.stamps.since(now).Round(time.Millisecond), reason)
+	if pid == 0 {
+		s.logPrintf("The command is not running")
+	} else {
+		s.logPrintf("Process tree (%d processes):", len(processes))
+	}
+	for _, process := range processes {
+		indent := strings.Repeat("  ", process.depth)
+		s.logPrintf("%spid %d [%s] CPU: %.1f%%, RSS: %s, threads: %d, wchan: %s, fds: %d | %s",
+			indent, process.pid, process.state, process.cpu, formatBytes(process.rss), process.threads, process.wchan, process.fdCount, process.command)
+		if process.memory != "" {
+			s.logPrintf("%s    memory: %s", indent, process.memory)
+		}
+		for _, mapping := range process.mappings {
+			s.logPrintf("%s    mapping %s", indent, mapping)
+		}
+		for _, fd := range process.fds {
+			s.logPrintf("%s    fd %s", indent, fd)
+		}
+		if more := process.fdCount - len(process.fds); more > 0 {
+			s.logPrintf("%s    ... %d more fds", indent, more)
+		}
+	}
+	s.gpus()
+	if lines := s.output.last(); len(lines) > 0 {
+		s.logPrintf("Last %d lines of output:", len(lines))
+		for _, line := range lines {
+			s.logPrintf("  %s", line)
+		}
+	}
+	s.logPrintf("----- End of snapshot %d -----", s.count)
+}
+
+// readSnapshotProcesses returns the processes of the tree in tree order,
+// with their CPU usage over snapshotCPUWindow
+func readSnapshotProcesses(pids []int) []*snapshotProcess {
+	processes := map[int]*snapshotProcess{}
+	for _, pid := range pids {
+		if process := readSnapshotProcess(pid); process != nil {
+			processes[pid] = process
+		}
+	}
+	// The CPU usage right now tells a busy loop from a process that waits
+	time.Sleep(snapshotCPUWindow)
+	for pid, process := range processes {
+		if ticks := getProcessCPUTicks([]int{pid}); ticks >= process.ticks {
+			process.cpu = float64(ticks-process.ticks) / clockTicks / snapshotCPUWindow.Seconds() * 100
+		}
+	}
+
+	// In tree order, the children indented under their parent
+	children := map[int][]int{}
+	for _, pid := range pids {
+		if process := processes[pid]; process != nil {
+			children[process.ppid] = append(children[process.ppid], pid)
+		}
+	}
+	var order []*snapshotProcess
+	var visit func(pid, depth int)
+	visit = func(pid, depth int) {
+		process := processes[pid]
+		process.depth = depth
+		order = append(order, process)
+		sort.Ints(children[pid])
+		for _, child := range children[pid] {
+			visit(child, depth+1)
+		}
+	}
+	if len(pids) > 0 && processes[pids[0]] != nil {
+		visit(pids[0], 0)
+	}
+	return order
+}
+
+// readSnapshotProcess returns nil if the process exited
+func readSnapshotProcess(pid int) *snapshotProcess {
+	data, err := os.ReadFile(pidPath(pid, "stat"))
+	if err != nil {
+		return nil
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 22 {
+		return nil
+	}
+	process := &snapshotProcess{pid: pid, state: fields[0]}
+	process.ppid, _ = strconv.Atoi(fields[1])
+	process.threads, _ = strconv.Atoi(fields[17])
+	process.ticks = getProcessCPUTicks([]int{pid})
+	process.rss = getProcessRSS([]int{pid})
+
+	if wchan, err := os.ReadFile(pidPath(pid, "wchan")); err == nil && len(wchan) > 0 && string(wchan) != "0" {
+		process.wchan = string(wchan)
+	} else {
+		process.wchan = "-"
+	}
+	if cmdline, err := os.ReadFile(pidPath(pid, "cmdline")); err == nil {
+		process.command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if process.command == "" {
+		// Kernel threads and zombies have no command line
+		process.command = stat[strings.IndexByte(stat, '(') : strings.LastIndexByte(stat, ')')+1]
+	}
+
+	process.memory, process.mappings = readSmaps(pid)
+
+	entries, _ := os.ReadDir(pidPath(pid, "fd"))
+	process.fdCount = len(entries)
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.Atoi(entries[i].Name())
+		b, _ := strconv.Atoi(entries[j].Name())
+		return a < b
+	})
+	for _, entry := range entries {
+		if len(process.fds) == snapshotMaxFds {
+			break
+		}
+		target, err := os.Readlink(filepath.Join(pidPath(pid, "fd"), entry.Name()))
+		if err != nil {
+			continue
+		}
+		process.fds = append(process.fds, entry.Name()+" -> "+target)
+	}
+	return process
+}
+
+// readSmaps summarizes the memory of the process from smaps_rollup and
+// returns its largest mappings by RSS from smaps, the mappings of a file
+// are added up. Both are empty for processes of other users.
+func readSmaps(pid int) (string, []string) {
+	var summary []string
+	if data, err := os.ReadFile(pidPath(pid, "smaps_rollup")); err == nil {
+		values := map[string]uint64{}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+			values[key] = kb * 1024
+		}
+		summary = append(summary,
+			"PSS "+formatBytes(values["Pss"]),
+			"private "+formatBytes(values["Private_Clean"]+values["Private_Dirty"]),
+			"shared "+formatBytes(values["Shared_Clean"]+values["Shared_Dirty"]),
+			"anonymous "+formatBytes(values["Anonymous"]),
+			"swap "+formatBytes(values["Swap"]))
+	}
+
+	data, err := os.ReadFile(pidPath(pid, "smaps"))
+	if err != nil {
+		return strings.Join(summary, ", "), nil
+	}
+	rss := map[string]uint64{}
+	name := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// A mapping starts with its address range, e.g. 7f12a000-7f12b000
+		if !strings.HasSuffix(fields[0], ":") {
+			name = "[anonymous]"
+			if len(fields) >= 6 {
+				name = strings.Join(fields[5:], " ")
+			}
+			continue
+		}
+		if fields[0] == "Rss:" && len(fields) >= 2 {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			rss[name] += kb * 1024
+		}
+	}
+	var names []string
+	for name, size := range rss {
+		if size > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return rss[names[i]] > rss[names[j]] })
+	var mappings []string
+	for _, name := range names[:min(len(names), snapshotMaxMappings)] {
+		mappings = append(mappings, fmt.Sprintf("%s: RSS %s", name, formatBytes(rss[name])))
+	}
+	return strings.Join(summary, ", "), mappings
+}
+
+// gpus logs the state of the NVIDIA GPUs and the processes using them
+func (s *snapshotter) gpus() {
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "nvidia-smi",
+		"--query-gpu=index,name,utilization.gpu,memory.used,memory.total,temperature.gpu,power.draw,clocks_throttle_reasons.active",
+		"--format=csv,noheader").Output()
+	if err != nil {
+		s.logPrintf("GPUs: nvidia-smi failed: %s", err)
+		return
+	}
+	s.logPrintf("GPUs (index, name, utilization, memory used, memory total, temperature, power, throttle reasons):")
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		s.logPrintf("  %s", line)
+	}
+	out, err = exec.CommandContext(ctx, "nvidia-smi", "--query-compute-apps=gpu_uuid,pid,used_memory", "--format=csv,noheader").Output()
+	if err == nil && len(strings.TrimSpace(string(out))) > 0 {
+		s.logPrintf("GPU processes (GPU, pid, memory):")
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			s.logPrintf("  %s", line)
+		}
+	}
+}
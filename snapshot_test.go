@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mrexodia/go-profile/proctest"
+)
+
+func TestReadSmaps(t *testing.T) {
+	proc := fakeProc(t, proctest.Process{PID: 10, RSSPages: 1024, PSS: 3 << 20, USS: 2 << 20})
+	smaps := `55d0c1a00000-55d0c1a4b000 r-xp 00000000 fd:01 1234   /usr/bin/python3.11
+Rss:                 200 kB
+Pss:                 100 kB
+7f2b1c000000-7f2b1c100000 rw-p 00000000 00:00 0        [heap]
+Rss:                1024 kB
+7f2b1d000000-7f2b1d100000 rw-p 00000000 00:00 0
+Rss:                  64 kB
+7f2b1e000000-7f2b1e040000 r--p 00000000 fd:01 5678   /usr/lib/lib with spaces.so
+Rss:                 300 kB
+7f2b1e040000-7f2b1e080000 r-xp 00040000 fd:01 5678   /usr/lib/lib with spaces.so
+Rss:                 300 kB
+7f2b1f000000-7f2b1f001000 r--p 00000000 00:00 0        [vvar]
+Rss:                   0 kB
+`
+	if err := os.WriteFile(filepath.Join(proc.Root, "10", "smaps"), []byte(smaps), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	memory, mappings := readSmaps(10)
+	wantMemory := "PSS " + formatBytes(3<<20) + ", private " + formatBytes(2<<20) + ", shared " + formatBytes(uint64(1024*os.Getpagesize())-2<<20) + ", anonymous " + formatBytes(2<<20) + ", swap " + formatBytes(0)
+	if memory != wantMemory {
+		t.Errorf("memory = %q, want %q", memory, wantMemory)
+	}
+	// The mappings of a file are added up, empty ones are left out
+	want := []string{
+		"[heap]: RSS " + formatBytes(1024<<10),
+		"/usr/lib/lib with spaces.so: RSS " + formatBytes(600<<10),
+		"/usr/bin/python3.11: RSS " + formatBytes(200<<10),
+		"[anonymous]: RSS " + formatBytes(64<<10),
+	}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Errorf("mappings = %q, want %q", mappings, want)
+	}
+
+	if memory, mappings := readSmaps(11); memory != "" || mappings != nil {
+		t.Errorf("readSmaps of a missing process = %q, %q", memory, mappings)
+	}
+}
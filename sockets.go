@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+const (
+	// Thresholds for the warnings in the summary
+	socketLeakThreshold  = 100
+	socketStormThreshold = 1000
+)
+
+type SocketCounts = profileio.SocketCounts
+
+// getSocketInodes returns the inodes of all sockets the processes have open
+func getSocketInodes(pids []int) map[string]bool {
+	inodes := map[string]bool{}
+	for _, pid := range pids {
+		dir := pidPath(pid, "fd")
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			target, err := os.Readlink(dir + "/" + entry.Name())
+			if err != nil {
+				continue
+			}
+			// The link target looks like socket:[12345]
+			if inode, ok := strings.CutPrefix(target, "socket:["); ok {
+				inodes[strings.TrimSuffix(inode, "]")] = true
+			}
+		}
+	}
+	return inodes
+}
+
+type socketEntry struct {
+	State     string
+	Inode     string
+	LocalPort uint16
+}
+
+/*
+	References:
+
+- https://www.kernel.org/doc/Documentation/networking/proc_net_tcp.txt
+*/
+func readSocketTable(pid int, table string) ([]socketEntry, error) {
+	data, err := os.ReadFile(pidPath(pid, "net", table))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []socketEntry
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		// The local address looks like 0100007F:1F90
+		_, portHex, _ := strings.Cut(fields[1], ":")
+		port, _ := strconv.ParseUint(portHex, 16, 16)
+		entries = append(entries, socketEntry{
+			State:     fields[3],
+			Inode:     fields[9],
+			LocalPort: uint16(port),
+		})
+	}
+	return entries, nil
+}
+
+func getSocketCounts(pids []int) (SocketCounts, error) {
+	counts := SocketCounts{}
+	if len(pids) == 0 {
+		return counts, nil
+	}
+	inodes := getSocketInodes(pids)
+
+	// The tables of the first process reflect its network namespace
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		entries, err := readSocketTable(pids[0], table)
+		if err != nil {
+			// IPv6 can be disabled
+			continue
+		}
+		tcp := strings.HasPrefix(table, "tcp")
+		for _, entry := range entries {
+			if tcp && entry.State == "06" {
+				counts.TimeWait++
+			}
+			if !inodes[entry.Inode] {
+				continue
+			}
+			if !tcp {
+				counts.UDP++
+				continue
+			}
+			counts.TCP++
+			switch entry.State {
+			case "01":
+				counts.Established++
+			case "08":
+				counts.CloseWait++
+			case "0A":
+				counts.Listen++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// getSocketPorts returns the local TCP and UDP ports of the processes' sockets
+func getSocketPorts(pids []int) (map[uint16]bool, map[uint16]bool) {
+	tcpPorts, udpPorts := map[uint16]bool{}, map[uint16]bool{}
+	if len(pids) == 0 {
+		return tcpPorts, udpPorts
+	}
+	inodes := getSocketInodes(pids)
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		entries, err := readSocketTable(pids[0], table)
+		if err != nil {
+			continue
+		}
+		ports := udpPorts
+		if strings.HasPrefix(table, "tcp") {
+			ports = tcpPorts
+		}
+		for _, entry := range entries {
+			if inodes[entry.Inode] {
+				ports[entry.LocalPort] = true
+			}
+		}
+	}
+	return tcpPorts, udpPorts
+}
+
+type SocketSummary struct {
+	Start           uint64   `json:"start"`
+	End             uint64   `json:"end"`
+	Peak            uint64   `json:"peak"`
+	PeakEstablished uint64   `json:"peak_established"`
+	PeakCloseWait   uint64   `json:"peak_close_wait"`
+	PeakTimeWait    uint64   `json:"peak_time_wait"`
+	Warnings        []string `json:"warnings,omitempty"`
+}
+
+type socketTracker struct {
+	summary SocketSummary
+	sampled bool
+}
+
+func (t *socketTracker) add(counts SocketCounts) {
+	s := &t.summary
+	if !t.sampled {
+		s.Start = counts.Open()
+		t.sampled = true
+	}
+	s.End = counts.Open()
+	s.Peak = max(s.Peak, counts.Open())
+	s.PeakEstablished = max(s.PeakEstablished, counts.Established)
+	s.PeakCloseWait = max(s.PeakCloseWait, counts.CloseWait)
+	s.PeakTimeWait = max(s.PeakTimeWait, counts.TimeWait)
+}
+
+func (t *socketTracker) result() *SocketSummary {
+	if !t.sampled {
+		return nil
+	}
+	s := t.summary
+	if s.End >= s.Start+socketLeakThreshold {
+		s.Warnings = append(s.Warnings, "possible socket leak: open sockets grew from "+
+			strconv.FormatUint(s.Start, 10)+" to "+strconv.FormatUint(s.End, 10))
+	}
+	if s.PeakCloseWait >= socketLeakThreshold {
+		s.Warnings = append(s.Warnings, "possible socket leak: "+
+			strconv.FormatUint(s.PeakCloseWait, 10)+" sockets in CLOSE_WAIT (closed by the peer but not by the command)")
+	}
+	if s.PeakTimeWait >= socketStormThreshold {
+		s.Warnings = append(s.Warnings, "possible connection storm: "+
+			strconv.FormatUint(s.PeakTimeWait, 10)+" sockets in TIME_WAIT")
+	}
+	return &s
+}
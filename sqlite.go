@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+// SQLite is driven through the sqlite3 command line tool (like nvidia-smi
+// and strace), so go-profile itself does not need cgo
+
+// sqliteTypes are the SQL types of the sample columns
+var sqliteTypes = map[columnType]string{
+	columnInt32:  "INTEGER",
+	columnInt64:  "INTEGER",
+	columnDouble: "REAL",
+	columnString: "TEXT",
+}
+
+// sqlLiteral formats a column value for an INSERT statement, NaN and the
+// infinities have no SQL literal and are NULL
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "NULL"
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	default:
+		return "NULL"
+	}
+}
+
+// writeSqliteImport writes the statements that (re)import the samples of
+// every run in the samples, and their rollup into buckets of interval
+// (unless it is 0), as one transaction
+func writeSqliteImport(w io.Writer, samples []Sample, interval time.Duration) {
+	columns := sampleColumns()
+	io.WriteString(w, "BEGIN;\n")
+	fmt.Fprintf(w, "PRAGMA user_version = %d;\n", profileio.SchemaVersion)
+	io.WriteString(w, "CREATE TABLE IF NOT EXISTS runs (run_id TEXT PRIMARY KEY, start_time INTEGER, end_time INTEGER, tags TEXT, samples INTEGER);\n")
+	definitions := make([]string, len(columns))
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		definitions[i] = column.name + " " + sqliteTypes[column.typ]
+		names[i] = column.name
+	}
+	fmt.Fprintf(w, "CREATE TABLE IF NOT EXISTS samples (%s);\n", strings.Join(definitions, ", "))
+	io.WriteString(w, "CREATE INDEX IF NOT EXISTS samples_run_id ON samples (run_id, time);\n")
+
+	// The metrics table describes the columns of the samples
+	io.WriteString(w, "CREATE TABLE IF NOT EXISTS metrics (name TEXT PRIMARY KEY, type TEXT, unit TEXT, description TEXT);\n")
+	for _, column := range columns {
+		fmt.Fprintf(w, "INSERT OR REPLACE INTO metrics VALUES (%s, %s, %s, %s);\n",
+			sqlLiteral(column.name),
+			sqlLiteral(column.kind.String()),
+			sqlLiteral(string(column.unit)),
+			sqlLiteral(column.description))
+	}
+
+	// Runs in the order they appear, with their first and last sample
+	type run struct {
+		first, last Sample
+		count       int
+	}
+	var order []string
+	runs := map[string]*run{}
+	for _, sample := range samples {
+		r, ok := runs[sample.RunID]
+		if !ok {
+			r = &run{first: sample}
+			runs[sample.RunID] = r
+			order = append(order, sample.RunID)
+			fmt.Fprintf(w, "DELETE FROM samples WHERE run_id = %s;\n", sqlLiteral(sample.RunID))
+		}
+		r.last = sample
+		r.count++
+
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = sqlLiteral(column.value(sample))
+		}
+		fmt.Fprintf(w, "INSERT INTO samples (%s) VALUES (%s);\n", strings.Join(names, ", "), strings.Join(values, ", "))
+	}
+	for _, runID := range order {
+		r := runs[runID]
+		tags := "NULL"
+		if len(r.first.Tags) > 0 {
+			data, _ := json.Marshal(r.first.Tags)
+			tags = sqlLiteral(string(data))
+		}
+		fmt.Fprintf(w, "INSERT OR REPLACE INTO runs VALUES (%s, %d, %d, %s, %d);\n",
+			sqlLiteral(runID),
+			r.first.Time.UnixMicro(),
+			r.last.Time.UnixMicro(),
+			tags,
+			r.count)
+	}
+	if interval > 0 {
+		writeSqliteBuckets(w, rollupSamples(samples, interval))
+	}
+	io.WriteString(w, "COMMIT;\n")
+}
+
+func exportMain(args []string) {
+	flags := flag.NewFlagSet("go-profile export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile export [options] <samples file>...\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	database := flags.String("sqlite", "go-profile.db", "SQLite database `file` to import the samples (written with --stream json) into")
+	bucket := flags.Duration("bucket", time.Minute, "also import the average and maximum of the samples per `interval` into the buckets table (0 disables)")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var samples []Sample
+	for _, path := range flags.Args() {
+		// The metrics log of a run with --compress is compressed
+		file, err := profileio.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to open samples: %s\n", err)
+			os.Exit(1)
+		}
+		fileSamples, err := profileio.ReadSamples(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to read samples: %s\n", err)
+			os.Exit(1)
+		}
+		// ReadSamples skips the lines that are not samples, a file of
+		// nothing else is not a samples file
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 && len(fileSamples) == 0 {
+			fmt.Fprintf(os.Stderr, "[go-profile] Failed to read samples: %s has none\n", path)
+			os.Exit(1)
+		}
+		samples = append(samples, fileSamples...)
+	}
+
+	upgrade, err := sqliteUpgrade(*database)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to import into %s: %s\n", *database, err)
+		os.Exit(1)
+	}
+
+	// The statements are streamed to sqlite3 instead of built in memory,
+	// they are several times the size of the samples
+	cmd := exec.Command("sqlite3", "-bail", *database)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to import into %s: %s\n", *database, err)
+		os.Exit(1)
+	}
+	w := bufio.NewWriter(stdin)
+	io.WriteString(w, upgrade)
+	writeSqliteImport(w, samples, *bucket)
+	// A write error is sqlite3 bailing out, its own error says why
+	w.Flush()
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to import into %s: %s\n", *database, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "[go-profile] Imported %d samples into %s\n", len(samples), *database)
+}
+
+// sqliteUpgrade returns the statements that bring a database written by an
+// older go-profile to the current schema, the version is the user_version
+// of the database (0 before it was recorded). The columns of metrics added
+// since are added to the samples table, NULL in the samples imported before.
+func sqliteUpgrade(database string) (string, error) {
+	if _, err := os.Stat(database); os.IsNotExist(err) {
+		return "", nil
+	}
+	out, err := exec.Command("sqlite3", "-readonly", database,
+		"SELECT user_version FROM pragma_user_version; SELECT name FROM pragma_table_info('samples')").Output()
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Fields(string(out))
+	if len(lines) == 0 {
+		return "", fmt.Errorf("unexpected schema query result %q", out)
+	}
+	version, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return "", fmt.Errorf("unexpected schema query result %q", out)
+	}
+	if _, err := profileio.UpgradeSchema(version); err != nil {
+		return "", err
+	}
+	existing := map[string]bool{}
+	for _, name := range lines[1:] {
+		existing[name] = true
+	}
+	// No samples table yet, the import creates it
+	if len(existing) == 0 {
+		return "", nil
+	}
+	var b strings.Builder
+	for _, column := range sampleColumns() {
+		if existing[column.name] {
+			continue
+		}
+		fmt.Fprintf(&b, "ALTER TABLE samples ADD COLUMN %s %s;\n", column.name, sqliteTypes[column.typ])
+		// The samples of version 0 have no schema column
+		if column.name == "schema" {
+			b.WriteString("UPDATE samples SET schema = 1;\n")
+		}
+	}
+	return b.String(), nil
+}
+
+func queryMain(args []string) {
+	flags := flag.NewFlagSet("go-profile query", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-profile query [options] <sql>\n\nTables:\n")
+		fmt.Fprintf(os.Stderr, "  runs (run_id, start_time, end_time, tags, samples)\n")
+		fmt.Fprintf(os.Stderr, "  samples (run_id, time, cpu_percent, mem_used, ...)\n")
+		fmt.Fprintf(os.Stderr, "  metrics (name, type, unit, description)\n")
+		fmt.Fprintf(os.Stderr, "  buckets (run_id, start_time, samples, cpu_avg, cpu_max, mem_used_avg, ...)\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	database := flags.String("sqlite", "go-profile.db", "SQLite database `file` to query")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if _, err := os.Stat(*database); err != nil {
+		fmt.Fprintf(os.Stderr, "[go-profile] Failed to open database: %s\n", err)
+		os.Exit(1)
+	}
+
+	cmd := exec.Command("sqlite3", "-readonly", "-header", "-column", *database, flags.Arg(0))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Minimum time between two stack captures of --stack-on-cpu
+	stackInterval = 5 * time.Second
+
+	// Frames kept of a stack, and stacks kept for the summary
+	stackMaxFrames = 20
+	stackMaxStacks = 50
+
+	stackTimeout = 5 * time.Second
+)
+
+// ProcessStack is the stack of the busiest thread of the hottest process of
+// the command during a CPU spike (--stack-on-cpu)
+type ProcessStack struct {
+	Time       time.Time `json:"time"`
+	Pid        int       `json:"pid"`
+	Tid        int       `json:"tid"`
+	Command    string    `json:"command"`
+	CpuPercent float64   `json:"cpu_percent"`
+	// Source is py-spy (Python frames), eu-stack (native frames) or kernel
+	// (/proc/<pid>/stack, where the thread is in the kernel)
+	Source string   `json:"source"`
+	Frames []string `json:"frames"`
+}
+
+// stackSampler captures the stack of the process of the tree that uses the
+// most CPU when it is above the threshold, with the best tool available:
+// py-spy for Python, eu-stack (elfutils) for native code and the kernel
+// stack otherwise. Every stack is logged and written to the timeline.
+type stackSampler struct {
+	threshold float64
+	events    *timeline
+	logPrintf func(format string, a ...interface{})
+
+	// CPU usage of every process of the tree
+	processes map[int]*processCPU
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	last   time.Time
+	stacks []ProcessStack
+}
+
+// newStackSampler returns nil if threshold is 0
+func newStackSampler(threshold float64, events *timeline, logPrintf func(format string, a ...interface{})) *stackSampler {
+	if threshold <= 0 {
+		return nil
+	}
+	return &stackSampler{threshold: threshold, events: events, logPrintf: logPrintf}
+}
+
+// sample measures the CPU usage of every process of the tree since the
+// previous sample and starts a capture in the background when the hottest
+// one is above the threshold, at most once per stackInterval
+func (s *stackSampler) sample(now time.Time, pids []int) {
+	if s == nil {
+		return
+	}
+	processes := make(map[int]*processCPU, len(pids))
+	hottest, hottestPercent := 0, 0.0
+	for _, pid := range pids {
+		cpu, ok := s.processes[pid]
+		if !ok {
+			cpu = &processCPU{}
+		}
+		processes[pid] = cpu
+		if percent := cpu.sample(now, []int{pid}); percent > hottestPercent {
+			hottest, hottestPercent = pid, percent
+		}
+	}
+	s.processes = processes
+	if hottest == 0 || hottestPercent < s.threshold {
+		return
+	}
+
+	s.mu.Lock()
+	if now.Sub(s.last) < stackInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.last = now
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		stack, err := captureStack(hottest)
+		if err != nil {
+			s.logPrintf("Failed to capture the stack of %d: %s", hottest, err)
+			return
+		}
+		if len(stack.Frames) == 0 {
+			return
+		}
+		stack.Time = now
+		stack.CpuPercent = hottestPercent
+
+		line := fmt.Sprintf("Stack of thread %d of %d (%s) at CPU %.0f%% (%s)", stack.Tid, stack.Pid, stack.Command, hottestPercent, stack.Source)
+		s.logPrintf("%s:", line)
+		for _, frame := range stack.Frames {
+			s.logPrintf("  %s", frame)
+		}
+		s.events.recordStack(line, stack)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.stacks) < stackMaxStacks {
+			s.stacks = append(s.stacks, *stack)
+		}
+	}()
+}
+
+// result waits for running captures and returns the stacks
+func (s *stackSampler) result() []ProcessStack {
+	if s == nil {
+		return nil
+	}
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stacks
+}
+
+// captureStack returns the stack of the busiest thread of the process
+func captureStack(pid int) (*ProcessStack, error) {
+	stack := &ProcessStack{Pid: pid, Tid: runningThread(pid)}
+	if comm, err := os.ReadFile(pidPath(pid, "comm")); err == nil {
+		stack.Command = strings.TrimSpace(string(comm))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stackTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(stack.Command, "python") {
+		if _, err := exec.LookPath("py-spy"); err == nil {
+			frames, err := dumpPythonStack(ctx, pid)
+			if err != nil {
+				return nil, err
+			}
+			stack.Source = "py-spy"
+			stack.Frames = frames
+			return stack, nil
+		}
+	}
+	if _, err := exec.LookPath("eu-stack"); err == nil {
+		output, err := exec.CommandContext(ctx, "eu-stack", "-p", strconv.Itoa(pid)).Output()
+		if err != nil {
+			return nil, err
+		}
+		stack.Source = "eu-stack"
+		stack.Frames = parseEuStack(string(output), stack.Tid)
+		return stack, nil
+	}
+	data, err := os.ReadFile(filepath.Join(pidPath(pid, "task"), strconv.Itoa(stack.Tid), "stack"))
+	if err != nil {
+		return nil, err
+	}
+	stack.Source = "kernel"
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// [<0>] do_wait+0x1c3/0x230, the address is hidden without root
+		if _, frame, ok := strings.Cut(line, "] "); ok && len(stack.Frames) < stackMaxFrames {
+			stack.Frames = append(stack.Frames, frame)
+		}
+	}
+	return stack, nil
+}
+
+// runningThread returns the first thread of the process that is running
+// (state R), the main thread if none is
+func runningThread(pid int) int {
+	entries, _ := os.ReadDir(pidPath(pid, "task"))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(pidPath(pid, "task"), entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) > 0 && fields[0] == "R" {
+			tid, _ := strconv.Atoi(entry.Name())
+			return tid
+		}
+	}
+	return pid
+}
+
+// parseEuStack returns the frames of the thread in `eu-stack -p` output,
+// those of the first thread if it is missing:
+//
+//	TID 4711:
+//	#0  0x00007f2b1c2e5d3f __memmove_avx_unaligned_erms
+//	#1  0x000055d0c1a4b2c0 compress_block
+func parseEuStack(output string, tid int) []string {
+	var frames, first []string
+	inThread, found := false, false
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "TID ") {
+			if inThread && first == nil {
+				first = frames
+			}
+			if found {
+				break
+			}
+			inThread = true
+			found = strings.TrimSuffix(strings.TrimPrefix(line, "TID "), ":") == strconv.Itoa(tid)
+			frames = nil
+			continue
+		}
+		fields := strings.Fields(line)
+		if !inThread || len(fields) < 2 || !strings.HasPrefix(fields[0], "#") || len(frames) == stackMaxFrames {
+			continue
+		}
+		// The address is dropped, it differs between runs
+		frame := strings.Join(fields[2:], " ")
+		if frame == "" {
+			frame = fields[1]
+		}
+		frames = append(frames, frame)
+	}
+	if found || first == nil {
+		return frames
+	}
+	return first
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// The command is active once its CPU usage reaches this percentage of
+	// one core
+	startupCPUPercent = 10.0
+
+	// The command is in its steady state once the CPU usage over this many
+	// samples varies less than startupSteadyPercent (or 10% of the mean)
+	startupSteadySamples = 8
+	startupSteadyPercent = 5.0
+)
+
+// StartupSummary separates the startup of the command from the main
+// workload, the durations are relative to the start and absent if the
+// point was never reached
+type StartupSummary struct {
+	FirstOutput time.Duration `json:"first_output,omitempty"`
+	FirstCPU    time.Duration `json:"first_cpu,omitempty"`
+	SteadyState time.Duration `json:"steady_state,omitempty"`
+}
+
+// startupTracker records when the command became active and steady
+type startupTracker struct {
+	firstCPU    time.Time
+	steadyState time.Time
+	window      []cpuPoint
+}
+
+// cpuPoint is the CPU usage of the command at a point in time
+type cpuPoint struct {
+	time    time.Time
+	percent float64
+}
+
+// add records the CPU usage of the command's process tree
+func (t *startupTracker) add(now time.Time, cpuPercent float64) {
+	if t.firstCPU.IsZero() && cpuPercent >= startupCPUPercent {
+		t.firstCPU = now
+	}
+	if t.firstCPU.IsZero() || !t.steadyState.IsZero() {
+		return
+	}
+
+	t.window = append(t.window, cpuPoint{time: now, percent: cpuPercent})
+	if len(t.window) > startupSteadySamples {
+		t.window = t.window[1:]
+	}
+	if len(t.window) < startupSteadySamples {
+		return
+	}
+
+	var mean, variance float64
+	for _, point := range t.window {
+		mean += point.percent / startupSteadySamples
+	}
+	for _, point := range t.window {
+		variance += (point.percent - mean) * (point.percent - mean) / startupSteadySamples
+	}
+	if mean >= startupCPUPercent && math.Sqrt(variance) <= max(startupSteadyPercent, mean*0.1) {
+		// The steady state started with the window
+		t.steadyState = t.window[0].time
+	}
+}
+
+func (t *startupTracker) result(start, firstOutput time.Time) *StartupSummary {
+	offset := func(point time.Time) time.Duration {
+		if point.IsZero() {
+			return 0
+		}
+		return max(point.Sub(start), 0)
+	}
+	return &StartupSummary{
+		FirstOutput: offset(firstOutput),
+		FirstCPU:    offset(t.firstCPU),
+		SteadyState: offset(t.steadyState),
+	}
+}
+
+// formatStartup formats an offset of the startup summary, zero is never
+func formatStartup(offset time.Duration) string {
+	if offset == 0 {
+		return "never"
+	}
+	return "+" + offset.Round(time.Millisecond).String()
+}
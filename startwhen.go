@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// startCondition is a flag value for --start-when and --stop-when,
+// `output matches "regex"` or just the regex
+type startCondition struct {
+	re *regexp.Regexp
+}
+
+func (c *startCondition) String() string {
+	if c.re == nil {
+		return ""
+	}
+	return fmt.Sprintf("output matches %q", c.re.String())
+}
+
+func (c *startCondition) Set(value string) error {
+	pattern := value
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(value), "output matches "); ok {
+		rest = strings.TrimSpace(rest)
+		if unquoted, err := strconv.Unquote(rest); err == nil {
+			pattern = unquoted
+		} else {
+			pattern = unquote(rest)
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	c.re = re
+	return nil
+}
+
+// measurementGate holds back the samples from the statistics until the
+// workload begins: --start-after since the command started and, with
+// --start-when, once a line of its output matched. With --stop-when the
+// statistics are frozen once the workload is done. With --signal-control
+// SIGUSR1 and SIGUSR2 turn the measurement on and off, with --interactive
+// a key pauses and resumes it.
+type measurementGate struct {
+	after     time.Duration
+	re        *regexp.Regexp
+	stopRe    *regexp.Regexp
+	signals   bool
+	stamps    *timestampFormat
+	logPrintf func(format string, a ...interface{})
+
+	mu      sync.Mutex
+	matched bool
+	started bool
+	stopped bool
+	// Since the command started
+	start, stop time.Duration
+
+	// Measurement turned on by SIGUSR1, the time it was measured in the
+	// intervals that ended and since when the current one started
+	on        bool
+	intervals int
+	measured  time.Duration
+	resumed   time.Duration
+
+	// Paused by a key (--interactive), the time paused in the pauses that
+	// ended and since when the current one lasts
+	paused      bool
+	pauses      int
+	pausedFor   time.Duration
+	pausedSince time.Duration
+}
+
+// newMeasurementGate returns nil if the measurement starts with the run
+func newMeasurementGate(opts *Options, stamps *timestampFormat, logPrintf func(format string, a ...interface{})) *measurementGate {
+	if opts.StartAfter <= 0 && opts.StartWhen.re == nil && opts.StopWhen.re == nil && !opts.SignalControl && !opts.Interactive {
+		return nil
+	}
+	return &measurementGate{
+		after:     opts.StartAfter,
+		re:        opts.StartWhen.re,
+		stopRe:    opts.StopWhen.re,
+		signals:   opts.SignalControl,
+		stamps:    stamps,
+		logPrintf: logPrintf,
+	}
+}
+
+// listen turns the measurement on at SIGUSR1 and off at SIGUSR2 until stop
+// is called, the signals are not forwarded to the command
+func (g *measurementGate) listen() (stop func()) {
+	if g == nil || !g.signals {
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			g.toggle(time.Now(), sig == syscall.SIGUSR1)
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+func (g *measurementGate) toggle(now time.Time, on bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if on == g.on {
+		return
+	}
+	g.on = on
+	elapsed := g.stamps.since(now)
+	if on {
+		g.intervals++
+		g.resumed = elapsed
+		g.logPrintf("Measurement turned on at +%s (SIGUSR1)", elapsed.Round(time.Millisecond))
+	} else {
+		g.measured += elapsed - g.resumed
+		g.logPrintf("Measurement turned off at +%s (SIGUSR2)", elapsed.Round(time.Millisecond))
+	}
+}
+
+// pause pauses the measurement or resumes it, it returns whether it is
+// paused now
+func (g *measurementGate) pause(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	elapsed := g.stamps.since(now)
+	g.paused = !g.paused
+	if g.paused {
+		g.pauses++
+		g.pausedSince = elapsed
+	} else {
+		g.pausedFor += elapsed - g.pausedSince
+	}
+	return g.paused
+}
+
+// match checks a line of the command's output for --start-when and
+// --stop-when, the measurement stops at the line even if the sample that
+// would have started it was not taken yet
+func (g *measurementGate) match(now time.Time, line string) {
+	if g == nil {
+		return
+	}
+	start := g.re != nil && g.re.MatchString(line)
+	stop := g.stopRe != nil && g.stopRe.MatchString(line)
+	if !start && !stop {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if start {
+		g.matched = true
+	}
+	if stop && !g.stopped {
+		g.stopped, g.stop = true, g.stamps.since(now)
+		g.logPrintf("Measurement stopped at +%s", g.stop.Round(time.Millisecond))
+	}
+}
+
+// measuring returns whether the sample at now counts, the setup before the
+// measurement started is only logged
+func (g *measurementGate) measuring(now time.Time, running bool) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped || g.paused || (g.signals && !g.on) {
+		return false
+	}
+	if g.started {
+		return true
+	}
+	// With just --stop-when the measurement starts with the run
+	if g.after > 0 || g.re != nil {
+		elapsed := g.stamps.since(now)
+		if !running || elapsed < g.after || (g.re != nil && !g.matched) {
+			return false
+		}
+		g.start = elapsed
+		g.logPrintf("Measurement started at +%s", elapsed.Round(time.Millisecond))
+	}
+	g.started = true
+	return true
+}
+
+// MeasurementSummary is when the statistics started (--start-when,
+// --start-after) and stopped (--stop-when), since the start of the command
+type MeasurementSummary struct {
+	Started bool          `json:"started"`
+	Start   time.Duration `json:"start,omitempty"`
+	Stopped bool          `json:"stopped,omitempty"`
+	Stop    time.Duration `json:"stop,omitempty"`
+
+	// Intervals turned on by SIGUSR1 (--signal-control) and their total
+	// length
+	Intervals int           `json:"intervals,omitempty"`
+	Measured  time.Duration `json:"measured,omitempty"`
+
+	// Pauses from the keyboard (--interactive) and their total length
+	Pauses int           `json:"pauses,omitempty"`
+	Paused time.Duration `json:"paused,omitempty"`
+}
+
+// result returns the measurement of a run that ended at end
+func (g *measurementGate) result(end time.Time) *MeasurementSummary {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	summary := &MeasurementSummary{Started: g.started, Start: g.start, Stopped: g.stopped, Stop: g.stop, Intervals: g.intervals, Measured: g.measured}
+	if g.on {
+		summary.Measured += g.stamps.since(end) - g.resumed
+	}
+	summary.Pauses, summary.Paused = g.pauses, g.pausedFor
+	if g.paused {
+		summary.Paused += g.stamps.since(end) - g.pausedSince
+	}
+	return summary
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// steadyStateBound is one end of the --steady-state window: a percentage
+// of the run, or an offset from its start (from its end if negative)
+type steadyStateBound struct {
+	percent float64
+	offset  time.Duration
+	isSet   bool
+	isRatio bool
+}
+
+func parseSteadyStateBound(value string) (steadyStateBound, error) {
+	if value == "" {
+		return steadyStateBound{}, nil
+	}
+	if number, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return steadyStateBound{}, fmt.Errorf("invalid percentage %q", value)
+		}
+		return steadyStateBound{percent: percent, isSet: true, isRatio: true}, nil
+	}
+	offset, err := time.ParseDuration(value)
+	if err != nil {
+		return steadyStateBound{}, fmt.Errorf("expected a percentage or a duration, got %q", value)
+	}
+	return steadyStateBound{offset: offset, isSet: true}, nil
+}
+
+// at returns the offset of the bound in a run of the duration, unset
+// bounds are at def
+func (b steadyStateBound) at(duration time.Duration, def time.Duration) time.Duration {
+	switch {
+	case !b.isSet:
+		return def
+	case b.isRatio:
+		return time.Duration(float64(duration) * b.percent / 100)
+	case b.offset < 0:
+		return duration + b.offset
+	}
+	return b.offset
+}
+
+// steadyStateWindow is the part of the run the CPU, memory, GPU and RSS
+// aggregates cover (--steady-state start..end)
+type steadyStateWindow struct {
+	text       string
+	start, end steadyStateBound
+}
+
+func (w *steadyStateWindow) String() string {
+	return w.text
+}
+
+func (w *steadyStateWindow) Set(value string) error {
+	from, to, ok := strings.Cut(value, "..")
+	if !ok {
+		return fmt.Errorf("expected start..end, e.g. 10%%..90%% or 30s..-10s")
+	}
+	start, err := parseSteadyStateBound(from)
+	if err != nil {
+		return err
+	}
+	end, err := parseSteadyStateBound(to)
+	if err != nil {
+		return err
+	}
+	*w = steadyStateWindow{text: value, start: start, end: end}
+	return nil
+}
+
+func (w *steadyStateWindow) enabled() bool {
+	return w.start.isSet || w.end.isSet
+}
+
+// SteadyStateSummary is the window of the run the aggregates cover, the
+// offsets are from the start of the command
+type SteadyStateSummary struct {
+	From    time.Duration `json:"from"`
+	To      time.Duration `json:"to"`
+	Samples int           `json:"samples"`
+}
+
+// windowSample holds the values of a tick that are aggregated
+type windowSample struct {
+	offset time.Duration
+	stats  Stats
+	rss    bool
+}
+
+// steadyStateTracker keeps the aggregated values of every tick, so the
+// aggregates can be computed over the window once the duration is known.
+// All methods do nothing on a nil tracker.
+type steadyStateTracker struct {
+	window  steadyStateWindow
+	mu      sync.Mutex
+	samples []windowSample
+}
+
+// newSteadyStateTracker returns nil if the window is not set
+func newSteadyStateTracker(window steadyStateWindow) *steadyStateTracker {
+	if !window.enabled() {
+		return nil
+	}
+	return &steadyStateTracker{window: window}
+}
+
+// add records a tick at offset from the start of the command, rss is set
+// if the RSS of the command was sampled
+func (t *steadyStateTracker) add(offset time.Duration, stats Stats, rss bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples = append(t.samples, windowSample{offset: offset, stats: stats, rss: rss})
+}
+
+// apply replaces the CPU, memory, GPU and RSS aggregates of the summary with
+// those of the window, they are kept if no tick falls into it
+func (t *steadyStateTracker) apply(summary *Summary, logPrintf func(format string, a ...interface{})) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	from := t.window.start.at(summary.Duration, 0)
+	to := t.window.end.at(summary.Duration, summary.Duration)
+	var cpuAgg, ramAgg, gpuAgg, rssAgg, pssAgg, ussAgg aggregator
+	count := 0
+	for _, sample := range t.samples {
+		if sample.offset < from || sample.offset > to {
+			continue
+		}
+		count++
+		cpuAgg.add(sample.stats.CpuPercent)
+		ramAgg.add(float64(sample.stats.MemUsed))
+		if sample.stats.GpuCount > 0 {
+			gpuAgg.add(sample.stats.GpuPercent)
+		}
+		if sample.rss {
+			rssAgg.add(float64(sample.stats.ChildRSS))
+			if sample.stats.ChildPSS > 0 {
+				pssAgg.add(float64(sample.stats.ChildPSS))
+				ussAgg.add(float64(sample.stats.ChildUSS))
+			}
+		}
+	}
+	if count == 0 {
+		logPrintf("WARNING: no samples in the steady state window %s (+%s to +%s), the aggregates cover the whole run",
+			t.window.text, from.Round(time.Millisecond), to.Round(time.Millisecond))
+		return
+	}
+
+	summary.SteadyState = &SteadyStateSummary{From: from, To: to, Samples: count}
+	summary.CPU = cpuAgg.result()
+	summary.Memory = ramAgg.result()
+	summary.GPU = gpuAgg.result()
+	summary.ChildRSS = rssAgg.optional()
+	summary.ChildPSS = pssAgg.optional()
+	summary.ChildUSS = ussAgg.optional()
+}
@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// StealSummary is the CPU time taken by the hypervisor for other guests
+type StealSummary struct {
+	Percent Aggregate     `json:"percent"`
+	Lost    time.Duration `json:"lost"`
+	// Set when the average steal time exceeded --steal-warn
+	Contended bool `json:"contended"`
+}
+
+// stealTracker aggregates the steal time of the ticks
+type stealTracker struct {
+	threshold float64
+	agg       aggregator
+	lost      time.Duration
+}
+
+func (s *stealTracker) add(percent float64, stolen time.Duration) {
+	s.agg.add(percent)
+	s.lost += stolen
+}
+
+// result returns nil if no CPU time was stolen (bare metal)
+func (s *stealTracker) result() *StealSummary {
+	if s.lost == 0 {
+		return nil
+	}
+	percent := s.agg.result()
+	return &StealSummary{
+		Percent:   percent,
+		Lost:      s.lost,
+		Contended: s.threshold > 0 && percent.Avg > s.threshold,
+	}
+}
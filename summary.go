@@ -0,0 +1,484 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mrexodia/go-profile/profileio"
+)
+
+type Aggregate = profileio.Aggregate
+
+// aggregator accumulates min/max/avg over a series of values
+type aggregator struct {
+	min, max, sum float64
+	count         uint64
+}
+
+func (a *aggregator) add(value float64) {
+	if a.count == 0 {
+		a.min, a.max = value, value
+	}
+	a.min = min(a.min, value)
+	a.max = max(a.max, value)
+	a.sum += value
+	a.count++
+}
+
+// optional returns nil if no values were added
+func (a *aggregator) optional() *Aggregate {
+	if a.count == 0 {
+		return nil
+	}
+	result := a.result()
+	return &result
+}
+
+func (a *aggregator) result() Aggregate {
+	if a.count == 0 {
+		return Aggregate{}
+	}
+	return Aggregate{Min: a.min, Max: a.max, Avg: a.sum / float64(a.count)}
+}
+
+// Summary holds the aggregate statistics of a finished run, the fields
+// every run has are in profileio.Summary
+type Summary struct {
+	profileio.Summary
+
+	// Window of the run the CPU, memory, GPU and RSS aggregates cover
+	// (--steady-state), they cover the whole run if it is not set
+	SteadyState *SteadyStateSummary `json:"steady_state,omitempty"`
+
+	// Frequency scaling of the CPUs, only set with cpufreq
+	CPUFreq *CPUFreqInfo `json:"cpufreq,omitempty"`
+
+	// Clock the samples were timed with
+	Clock *ClockInfo `json:"clock,omitempty"`
+
+	// CPU steal time, only set on virtual machines
+	Steal *StealSummary `json:"steal,omitempty"`
+
+	// When the statistics started (--start-when, --start-after), they
+	// cover the whole run if it is not set
+	Measurement *MeasurementSummary `json:"measurement,omitempty"`
+
+	// CPU time of the command (rusage)
+	CPUTime *CPUTimeSummary `json:"cpu_time,omitempty"`
+
+	// Utilization by core type, only set on heterogeneous CPUs
+	CPUClusters []CPUClusterSummary `json:"cpu_clusters,omitempty"`
+
+	// GPU usage of the command's process tree, only set when GPUs are present
+	ChildGPU       *Aggregate `json:"child_gpu,omitempty"`
+	ChildGPUMemory *Aggregate `json:"child_gpu_memory,omitempty"`
+
+	// GPU interconnect throughput in bytes/s
+	PcieTx   *Aggregate `json:"pcie_tx,omitempty"`
+	PcieRx   *Aggregate `json:"pcie_rx,omitempty"`
+	NvlinkTx *Aggregate `json:"nvlink_tx,omitempty"`
+	NvlinkRx *Aggregate `json:"nvlink_rx,omitempty"`
+
+	// InfiniBand/RDMA throughput of the host in bytes/s
+	IbTx *Aggregate `json:"ib_tx,omitempty"`
+	IbRx *Aggregate `json:"ib_rx,omitempty"`
+
+	Filesystems []FilesystemSummary `json:"filesystems,omitempty"`
+	Directories []DirectorySummary  `json:"directories,omitempty"`
+	Sockets     *SocketSummary      `json:"sockets,omitempty"`
+
+	ChildNetwork *NetworkSummary `json:"child_network,omitempty"`
+	NetworkAudit *NetworkAudit   `json:"network_audit,omitempty"`
+
+	// Top syscalls by count (--syscalls)
+	Syscalls []SyscallStat `json:"syscalls,omitempty"`
+
+	// Output lines per severity (--severity)
+	Severity *SeveritySummary `json:"severity,omitempty"`
+
+	// Output events (--event) and derived metrics (--metric-expr)
+	Events  []EventSummary `json:"events,omitempty"`
+	Metrics []Metric       `json:"metrics,omitempty"`
+
+	// Summaries of the intervals of a long-lived command (--rolling-summary)
+	Rolling []Bucket `json:"rolling,omitempty"`
+
+	// Usage of the SLURM job according to sacct
+	Slurm *SlurmSummary `json:"slurm,omitempty"`
+
+	// Energy of the CPU packages and GPUs, per unit of work of the events
+	Energy *EnergySummary `json:"energy,omitempty"`
+	// Estimated emissions of the energy (--carbon-intensity)
+	Carbon *CarbonSummary `json:"carbon,omitempty"`
+	// Cost of the machine for the run (--hourly-cost)
+	Cost *CostSummary `json:"cost,omitempty"`
+
+	// Per-rank usage and load imbalance of an MPI job on this host
+	MPI *MPISummary `json:"mpi,omitempty"`
+
+	// Efficiency of the phases of the run (--phase)
+	Phases []PhaseSummary `json:"phases,omitempty"`
+
+	// Files the command was expected to write (--expect-file)
+	ExpectedFiles []ExpectedFile `json:"expected_files,omitempty"`
+
+	// Budget of the command from the budget file (--budgets)
+	Budget *BudgetResult `json:"budget,omitempty"`
+
+	// Runtime metrics of a Go command (--go-metrics)
+	GoRuntime *GoRuntimeSummary `json:"go_runtime,omitempty"`
+
+	// JMX metrics of a Java command (--jmx)
+	JVM *JVMSummary `json:"jvm,omitempty"`
+
+	// Python stacks dumped during CPU spikes (--py-spy)
+	PythonStacks []PythonStack `json:"python_stacks,omitempty"`
+	// Stacks captured during CPU spikes (--stack-on-cpu)
+	Stacks []ProcessStack `json:"stacks,omitempty"`
+	// The command's processes by name (--process-breakdown)
+	Processes []ProcessGroup `json:"processes,omitempty"`
+
+	// Startup latency of the command
+	Startup *StartupSummary `json:"startup,omitempty"`
+
+	// Time the GPUs were idle, only set when GPUs are present
+	GPUIdle *GPUIdleSummary `json:"gpu_idle,omitempty"`
+
+	// ECC errors and Xid events of the GPUs during the run
+	GPUFaults []GPUFault `json:"gpu_faults,omitempty"`
+
+	// Growth of the command's RSS after the warm-up
+	MemoryTrend *MemoryTrend `json:"memory_trend,omitempty"`
+
+	// Suspicious parts of the run
+	Anomalies []Anomaly `json:"anomalies,omitempty"`
+
+	// Stretches of the run in which an --alert was active
+	Alerts []AlertEvent `json:"alerts,omitempty"`
+
+	// Output lines left out of the log by the rate and size limits
+	SuppressedOutputLines uint64 `json:"suppressed_output_lines,omitempty"`
+}
+
+// NetworkSummary is the network traffic of the command in bytes
+type NetworkSummary struct {
+	Received    uint64    `json:"received"`
+	Transmitted uint64    `json:"transmitted"`
+	RxRate      Aggregate `json:"rx_rate"`
+	TxRate      Aggregate `json:"tx_rate"`
+}
+
+// formatGrowth describes a change in size in bytes
+func formatGrowth(growth int64) string {
+	if growth < 0 {
+		return "shrank by " + formatBytes(uint64(-growth))
+	}
+	return "grew by " + formatBytes(uint64(growth))
+}
+
+// setDuration sets the duration of the run in all its forms
+func (s *Summary) setDuration(duration, precision time.Duration) {
+	s.Duration = duration
+	s.DurationSeconds = duration.Seconds()
+	s.DurationMillis = duration.Milliseconds()
+	if precision > 0 {
+		duration = duration.Round(precision)
+	}
+	s.DurationText = duration.String()
+}
+
+func (s *Summary) print(logPrintf func(format string, a ...interface{})) {
+	if s.SteadyState != nil {
+		logPrintf("Steady state (+%s to +%s, %d samples), the CPU, memory, GPU and RSS aggregates cover only this window",
+			s.SteadyState.From.Round(time.Millisecond),
+			s.SteadyState.To.Round(time.Millisecond),
+			s.SteadyState.Samples)
+	}
+	if m := s.Measurement; m != nil {
+		if !m.Started {
+			logPrintf("WARNING: the measurement never started (--start-when, --start-after, --signal-control), the statistics are empty")
+		} else if m.Intervals > 0 {
+			logPrintf("Measured %s in %d intervals (SIGUSR1 to SIGUSR2), the statistics exclude the rest of the run", m.Measured.Round(time.Millisecond), m.Intervals)
+		} else if m.Stopped {
+			logPrintf("Measurement from +%s to +%s, the statistics exclude the rest of the run", m.Start.Round(time.Millisecond), m.Stop.Round(time.Millisecond))
+		} else if m.Start > 0 {
+			logPrintf("Measurement started at +%s, the statistics exclude the setup before", m.Start.Round(time.Millisecond))
+		}
+		if m.Pauses > 0 {
+			logPrintf("Measurement paused %d times for %s (--interactive), the statistics exclude the pauses", m.Pauses, m.Paused.Round(time.Millisecond))
+		}
+	}
+	logPrintf("CPU (min: %.2f%%, max: %.2f%%, range: %.2f%%, avg: %.2f%%)",
+		s.CPU.Min,
+		s.CPU.Max,
+		s.CPU.Max-s.CPU.Min,
+		s.CPU.Avg)
+	if s.Steal != nil {
+		logPrintf("CPU steal (max: %.2f%%, avg: %.2f%%, lost: %.1f CPU seconds)",
+			s.Steal.Percent.Max,
+			s.Steal.Percent.Avg,
+			s.Steal.Lost.Seconds())
+		if s.Steal.Contended {
+			logPrintf("WARNING: the VM was contended, the hypervisor took %.1f%% of the CPU time on average (%.1f CPU seconds) for other guests, the results are not representative",
+				s.Steal.Percent.Avg,
+				s.Steal.Lost.Seconds())
+		}
+	}
+	for _, cluster := range s.CPUClusters {
+		logPrintf("CPU %s cores %s (min: %.2f%%, max: %.2f%%, avg: %.2f%%)",
+			cluster.Name,
+			cluster.CPUs,
+			cluster.Usage.Min,
+			cluster.Usage.Max,
+			cluster.Usage.Avg)
+	}
+	logPrintf("Memory (min: %s, max: %s, range: %s, avg: %s)",
+		formatBytes(uint64(s.Memory.Min)),
+		formatBytes(uint64(s.Memory.Max)),
+		formatBytes(uint64(s.Memory.Max-s.Memory.Min)),
+		formatBytes(uint64(s.Memory.Avg)))
+	if s.ChildRSS != nil {
+		logPrintf("Command RSS (max: %s, avg: %s)", formatBytes(uint64(s.ChildRSS.Max)), formatBytes(uint64(s.ChildRSS.Avg)))
+	}
+	if s.ChildPSS != nil && s.ChildUSS != nil {
+		logPrintf("Command PSS (max: %s, avg: %s) | USS (max: %s, avg: %s)",
+			formatBytes(uint64(s.ChildPSS.Max)), formatBytes(uint64(s.ChildPSS.Avg)),
+			formatBytes(uint64(s.ChildUSS.Max)), formatBytes(uint64(s.ChildUSS.Avg)))
+	}
+	logPrintf("GPU (min: %.2f%%, max: %.2f%%, range: %.2f%% avg: %.2f%%)",
+		s.GPU.Min,
+		s.GPU.Max,
+		s.GPU.Max-s.GPU.Min,
+		s.GPU.Avg)
+	if s.ChildGPU != nil {
+		logPrintf("GPU child processes (min: %.2f%%, max: %.2f%%, avg: %.2f%%, memory max: %s, memory avg: %s)",
+			s.ChildGPU.Min,
+			s.ChildGPU.Max,
+			s.ChildGPU.Avg,
+			formatBytes(uint64(s.ChildGPUMemory.Max)),
+			formatBytes(uint64(s.ChildGPUMemory.Avg)))
+	}
+	if s.PcieTx != nil {
+		logPrintf("PCIe (TX max: %s/s, TX avg: %s/s, RX max: %s/s, RX avg: %s/s)",
+			formatBytes(uint64(s.PcieTx.Max)),
+			formatBytes(uint64(s.PcieTx.Avg)),
+			formatBytes(uint64(s.PcieRx.Max)),
+			formatBytes(uint64(s.PcieRx.Avg)))
+	}
+	if s.NvlinkTx != nil {
+		logPrintf("NVLink (TX max: %s/s, TX avg: %s/s, RX max: %s/s, RX avg: %s/s)",
+			formatBytes(uint64(s.NvlinkTx.Max)),
+			formatBytes(uint64(s.NvlinkTx.Avg)),
+			formatBytes(uint64(s.NvlinkRx.Max)),
+			formatBytes(uint64(s.NvlinkRx.Avg)))
+	}
+	if s.IbTx != nil {
+		logPrintf("InfiniBand (TX max: %s/s, TX avg: %s/s, RX max: %s/s, RX avg: %s/s)",
+			formatBytes(uint64(s.IbTx.Max)),
+			formatBytes(uint64(s.IbTx.Avg)),
+			formatBytes(uint64(s.IbRx.Max)),
+			formatBytes(uint64(s.IbRx.Avg)))
+	}
+	for _, fs := range s.Filesystems {
+		logPrintf("Filesystem %s (%s, start: %s, end: %s, peak: %s, %.2f%% full)",
+			fs.Path,
+			formatGrowth(fs.Growth),
+			formatBytes(fs.Start),
+			formatBytes(fs.End),
+			formatBytes(fs.Peak),
+			fs.PeakPercent)
+	}
+	for _, dir := range s.Directories {
+		logPrintf("Directory %s (%s, start: %s, end: %s, peak: %s, %d files)",
+			dir.Path,
+			formatGrowth(dir.Growth),
+			formatBytes(dir.Start),
+			formatBytes(dir.End),
+			formatBytes(dir.Peak),
+			dir.Files)
+	}
+	if s.Sockets != nil {
+		logPrintf("Sockets (start: %d, end: %d, peak: %d, peak established: %d, peak TIME_WAIT: %d)",
+			s.Sockets.Start,
+			s.Sockets.End,
+			s.Sockets.Peak,
+			s.Sockets.PeakEstablished,
+			s.Sockets.PeakTimeWait)
+		for _, warning := range s.Sockets.Warnings {
+			logPrintf("WARNING: %s", warning)
+		}
+	}
+	if s.ChildNetwork != nil {
+		logPrintf("Network (received: %s, transmitted: %s, peak RX: %s/s, peak TX: %s/s)",
+			formatBytes(s.ChildNetwork.Received),
+			formatBytes(s.ChildNetwork.Transmitted),
+			formatBytes(uint64(s.ChildNetwork.RxRate.Max)),
+			formatBytes(uint64(s.ChildNetwork.TxRate.Max)))
+	}
+	if s.NetworkAudit != nil {
+		logPrintf("DNS lookups: %d, HTTP connections: %d, HTTPS connections: %d",
+			s.NetworkAudit.DNSLookups,
+			s.NetworkAudit.HTTPConnections,
+			s.NetworkAudit.HTTPSConnections)
+		for _, entry := range s.NetworkAudit.Lookups {
+			logPrintf("  lookup %s (x%d)", entry.Name, entry.Count)
+		}
+		for _, entry := range s.NetworkAudit.Destinations {
+			logPrintf("  connect %s (x%d)", entry.Name, entry.Count)
+		}
+	}
+	if len(s.Syscalls) > 0 {
+		logPrintf("Top syscalls:")
+		for _, syscall := range s.Syscalls {
+			logPrintf("  %s: %d calls, %d errors, %.6fs", syscall.Name, syscall.Calls, syscall.Errors, syscall.Seconds)
+		}
+	}
+	if s.Severity != nil {
+		logPrintf("Output severity (%d ERROR lines, %d WARN lines, %d INFO lines)", s.Severity.Error, s.Severity.Warn, s.Severity.Info)
+		if s.Severity.FirstError != nil {
+			logPrintf("  first error at %s: %s", s.Severity.FirstError.location(s.Start, s.Severity.Log), s.Severity.FirstError.Line)
+			logPrintf("  last error at %s: %s", s.Severity.LastError.location(s.Start, s.Severity.Log), s.Severity.LastError.Line)
+		}
+	}
+	for _, event := range s.Events {
+		logPrintf("Event %s (count: %d, sum: %g, last: %g)", event.Name, event.Count, event.Sum, event.Last)
+	}
+	for _, metric := range s.Metrics {
+		if metric.Error != "" {
+			logPrintf("Metric %s: %s", metric.Name, metric.Error)
+		} else {
+			logPrintf("Metric %s: %g", metric.Name, metric.Value)
+		}
+	}
+	for _, phase := range s.Phases {
+		logPrintf("Phase %s", phase.String(s.ChildGPU != nil))
+	}
+	if s.Energy != nil {
+		logPrintf("Energy: %s", s.Energy)
+		for _, event := range s.Energy.PerEvent {
+			logPrintf("Energy per %s: %s (%g units)", event.Event, formatJoules(event.PerUnit), event.Units)
+		}
+	}
+	if s.Carbon != nil {
+		logPrintf("Carbon: %s", s.Carbon)
+		for _, event := range s.Carbon.PerEvent {
+			logPrintf("Carbon per %s: %s CO2e", event.Event, formatGrams(event.PerUnit))
+		}
+	}
+	if s.Cost != nil {
+		logPrintf("Cost: %s", s.Cost)
+	}
+	if s.Slurm != nil {
+		if len(s.Slurm.Steps) > 0 {
+			logPrintf("SLURM job %s (steps %s): sacct MaxRSS %s, TotalCPU %s",
+				s.Slurm.JobID, strings.Join(s.Slurm.Steps, ","), formatBytes(s.Slurm.MaxRSS), s.Slurm.TotalCPU.Round(time.Millisecond))
+		}
+		if s.Slurm.Problem != "" {
+			logPrintf("SLURM job %s: %s", s.Slurm.JobID, s.Slurm.Problem)
+		}
+		for _, discrepancy := range s.Slurm.Discrepancies {
+			logPrintf("WARNING: go-profile and sacct disagree: %s", discrepancy)
+		}
+	}
+	if s.MPI != nil {
+		logPrintf("MPI: %s", s.MPI)
+		for _, rank := range s.MPI.Ranks {
+			logPrintf("  rank %d: CPU time %s, RSS max %s, avg %s", rank.Rank, rank.CPUTime.Round(time.Millisecond),
+				formatBytes(uint64(rank.RSS.Max)), formatBytes(uint64(rank.RSS.Avg)))
+		}
+	}
+	for _, file := range s.ExpectedFiles {
+		if file.OK {
+			logPrintf("Expected file %s: OK (%s)", file.Path, formatBytes(file.Size))
+		} else {
+			logPrintf("Expected file %s: FAILED, %s", file.Path, file.Problem)
+		}
+	}
+	if s.Budget != nil {
+		if len(s.Budget.Violations) == 0 {
+			logPrintf("Budget %q: OK", s.Budget.Command)
+		}
+		for _, violation := range s.Budget.Violations {
+			logPrintf("Budget %q: EXCEEDED, %s", s.Budget.Command, violation)
+		}
+	}
+	if s.GoRuntime != nil {
+		logPrintf("Go runtime (heap max: %s, heap avg: %s, goroutines max: %.0f, GCs: %d, GC pause total: %s, GC pause max: %s)",
+			formatBytes(uint64(s.GoRuntime.HeapAlloc.Max)),
+			formatBytes(uint64(s.GoRuntime.HeapAlloc.Avg)),
+			s.GoRuntime.Goroutines.Max,
+			s.GoRuntime.NumGC,
+			s.GoRuntime.GCPauseTotal,
+			s.GoRuntime.GCPauseMax)
+	}
+	if s.JVM != nil {
+		logPrintf("JVM (heap max: %s, heap avg: %s, heap limit: %s, GCs: %d, GC time: %s)",
+			formatBytes(uint64(s.JVM.HeapUsed.Max)),
+			formatBytes(uint64(s.JVM.HeapUsed.Avg)),
+			formatBytes(s.JVM.HeapMax),
+			s.JVM.GCCount,
+			s.JVM.GCTime)
+	}
+	if len(s.PythonStacks) > 0 {
+		logPrintf("Python stacks dumped during CPU spikes: %d", len(s.PythonStacks))
+		for _, stack := range s.PythonStacks {
+			logPrintf("  %s (pid %d, CPU %.0f%%): %s", formatOffset(stack.Time, s.Start), stack.Pid, stack.CpuPercent, stack.Frames[0])
+		}
+	}
+	if len(s.Stacks) > 0 {
+		logPrintf("Stacks captured during CPU spikes: %d", len(s.Stacks))
+		for _, stack := range s.Stacks {
+			logPrintf("  %s (%s, pid %d, CPU %.0f%%, %s): %s", formatOffset(stack.Time, s.Start), stack.Command, stack.Pid, stack.CpuPercent, stack.Source, stack.Frames[0])
+		}
+	}
+	if len(s.Processes) > 0 {
+		logPrintf("Processes by CPU time (I/O, largest RSS):")
+		for i, group := range s.Processes {
+			if i == breakdownMaxLines {
+				logPrintf("  ... %d more in the summary JSON", len(s.Processes)-i)
+				break
+			}
+			logPrintf("  %s (%d processes): %s CPU, %s I/O, %s RSS", group.Name, group.Processes,
+				time.Duration(group.CpuSeconds*float64(time.Second)).Round(time.Millisecond),
+				formatBytes(group.IOBytes),
+				formatBytes(group.MaxRSS))
+		}
+	}
+	if s.Startup != nil {
+		logPrintf("Startup (first output: %s, first CPU activity: %s, steady state: %s)",
+			formatStartup(s.Startup.FirstOutput),
+			formatStartup(s.Startup.FirstCPU),
+			formatStartup(s.Startup.SteadyState))
+	}
+	if s.GPUIdle != nil {
+		logPrintf("GPU idle (below %.0f%%: %.1f%% of the run, while the CPU was busy: %.1f%%, longest gap: %s at %s)",
+			s.GPUIdle.Threshold,
+			s.GPUIdle.IdleFraction*100.0,
+			s.GPUIdle.StallFraction*100.0,
+			s.GPUIdle.LongestGap.Round(time.Millisecond),
+			formatOffset(s.GPUIdle.LongestGapStart, s.Start))
+	}
+	for _, fault := range s.GPUFaults {
+		logPrintf("GPU FAULT at %s: %s", formatOffset(fault.Time, s.Start), fault)
+	}
+	if s.MemoryTrend != nil {
+		logPrintf("Memory trend: %s", s.MemoryTrend)
+	}
+	for _, anomaly := range s.Anomalies {
+		logPrintf("ANOMALY at %s: %s", formatOffset(anomaly.Time, s.Start), anomaly.Message)
+	}
+	for _, alert := range s.Alerts {
+		logPrintf("ALERT %s", alert)
+	}
+	if s.SuppressedOutputLines > 0 {
+		logPrintf("Suppressed output lines: %d", s.SuppressedOutputLines)
+	}
+	if s.CPUTime != nil {
+		logPrintf("Command CPU time: %s", s.CPUTime)
+	}
+	logPrintf("Total Execution Time: %s", s.DurationText)
+	logPrintf("Run ID: %s", s.RunID)
+	if len(s.Tags) > 0 {
+		logPrintf("Tags: %s", formatTags(s.Tags))
+	}
+}
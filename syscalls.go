@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// syscallTopCount is the number of syscalls kept in the summary
+const syscallTopCount = 15
+
+type SyscallStat struct {
+	Name    string  `json:"name"`
+	Calls   uint64  `json:"calls"`
+	Errors  uint64  `json:"errors"`
+	Seconds float64 `json:"seconds"`
+}
+
+// straceCommand wraps the command so strace counts its syscalls (following
+// forks) and writes the table to output
+func straceCommand(command []string, output string) ([]string, error) {
+	if _, err := exec.LookPath("strace"); err != nil {
+		return nil, err
+	}
+	return append([]string{"strace", "-f", "-c", "-o", output, "--"}, command...), nil
+}
+
+/*
+	Parses the summary table of `strace -c`:
+
+% time     seconds  usecs/call     calls    errors syscall
+------ ----------- ----------- --------- --------- ----------------
+
+	45.00    0.000450          45        10         2 read
+	30.00    0.000300          30        10           write
+
+------ ----------- ----------- --------- --------- ----------------
+100.00    0.001000                    20         2 total
+*/
+func parseStraceSummary(path string) ([]SyscallStat, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []SyscallStat
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		// The errors column is empty when there were none
+		if len(fields) != 5 && len(fields) != 6 {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			// Header and separator lines
+			continue
+		}
+		name := fields[len(fields)-1]
+		if name == "total" {
+			continue
+		}
+		stat := SyscallStat{Name: name, Seconds: seconds}
+		stat.Calls, _ = strconv.ParseUint(fields[3], 10, 64)
+		if len(fields) == 6 {
+			stat.Errors, _ = strconv.ParseUint(fields[4], 10, 64)
+		}
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Calls != stats[j].Calls {
+			return stats[i].Calls > stats[j].Calls
+		}
+		return stats[i].Seconds > stats[j].Seconds
+	})
+	return stats, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// tickData is what a --format template sees: the shorthands below and
+// every field of Stats (e.g. {{.ChildCpuPercent}})
+type tickData struct {
+	Stats
+
+	// Percentages with two decimals
+	CPU      string
+	Memory   string
+	GPU      string
+	ChildCPU string
+
+	// Memory of the command and of the system in --units
+	RSS     string
+	Used    string
+	Total   string
+	Elapsed string
+	RunID   string
+	Time    string
+}
+
+// tickFuncs are the functions available in --format templates
+var tickFuncs = template.FuncMap{
+	"bytes":   formatBytes,
+	"percent": func(value float64) string { return fmt.Sprintf("%.2f", value) },
+}
+
+// parseTickFormat parses a --format template, it is executed once with an
+// empty tick so unknown fields are reported before the run
+func parseTickFormat(text string) (*template.Template, error) {
+	tmpl, err := template.New("format").Funcs(tickFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(&strings.Builder{}, tickData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// formatTick formats a tick with the --format template, or with
+// formatStats if there is none
+func formatTick(tmpl *template.Template, runID string, stamps *timestampFormat, t time.Time, stats Stats) string {
+	if tmpl == nil {
+		return formatStats(stats)
+	}
+	data := tickData{
+		Stats:    stats,
+		CPU:      fmt.Sprintf("%.2f", stats.CpuPercent),
+		Memory:   fmt.Sprintf("%.2f", stats.MemPercent),
+		GPU:      fmt.Sprintf("%.2f", stats.GpuPercent),
+		ChildCPU: fmt.Sprintf("%.2f", stats.ChildCpuPercent),
+		RSS:      formatBytes(stats.ChildRSS),
+		Used:     formatBytes(stats.MemUsed),
+		Total:    formatBytes(stats.MemTotal),
+		Elapsed:  formatElapsed(stamps.since(t)),
+		RunID:    runID,
+		Time:     stamps.format(t),
+	}
+	var line strings.Builder
+	if err := tmpl.Execute(&line, data); err != nil {
+		return fmt.Sprintf("format error: %s", err)
+	}
+	// A tick is a single log line
+	return strings.ReplaceAll(line.String(), "\n", " ")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// TimelineEvent is a single entry of the combined timeline
+type TimelineEvent struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Kind is stdout, stderr, output (--combine-output), sample, go-profile
+	// interactive (a key of --interactive) or stack (--stack-on-cpu)
+	Kind   string        `json:"kind"`
+	Line   string        `json:"line,omitempty"`
+	Sample *Stats        `json:"sample,omitempty"`
+	Stack  *ProcessStack `json:"stack,omitempty"`
+}
+
+// timeline writes the command's output, the samples and our own messages as
+// one totally ordered JSON lines file. The timestamp and sequence number are
+// taken under the lock, so the file order always matches the time order.
+// All methods do nothing on a nil timeline.
+type timeline struct {
+	mu     sync.Mutex
+	w      *logWriter
+	seq    uint64
+	stamps *timestampFormat
+}
+
+func createTimeline(path string, sync bool, stamps *timestampFormat) (*timeline, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &timeline{w: newLogWriter(file, sync), stamps: stamps}, nil
+}
+
+func (t *timeline) record(kind string, line string, sample *Stats) {
+	t.write(TimelineEvent{Kind: kind, Line: line, Sample: sample})
+}
+
+// recordStack writes a stack captured during a CPU spike
+func (t *timeline) recordStack(line string, stack *ProcessStack) {
+	t.write(TimelineEvent{Kind: "stack", Line: line, Stack: stack})
+}
+
+func (t *timeline) write(event TimelineEvent) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	event.Seq = t.seq
+	event.Time = t.stamps.zone(time.Now())
+	writeJSONLine(t.w, event)
+}
+
+func (t *timeline) close() error {
+	if t == nil {
+		return nil
+	}
+	return t.w.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// timestampFormat formats the timestamps of the log lines
+// (--timestamp-format, --utc)
+type timestampFormat struct {
+	layout string
+	utc    bool
+	// Prefix the output lines and samples with the time since the command
+	// started (--elapsed)
+	elapsed bool
+
+	// The relative timestamps count from the start of go-profile and, once
+	// it started, of the command (UnixNano)
+	start   atomic.Int64
+	started atomic.Bool
+}
+
+func newTimestampFormat(opts *Options) *timestampFormat {
+	f := &timestampFormat{layout: opts.TimestampFormat, utc: opts.UTC, elapsed: opts.Elapsed}
+	f.start.Store(time.Now().UnixNano())
+	return f
+}
+
+// commandStarted makes the relative timestamps count from the command start
+func (f *timestampFormat) commandStarted(t time.Time) {
+	f.start.Store(t.UnixNano())
+	f.started.Store(true)
+}
+
+// since returns the time since the command started
+func (f *timestampFormat) since(t time.Time) time.Duration {
+	return time.Duration(t.UnixNano() - f.start.Load())
+}
+
+// prefix returns the "[+00:03:12.450] " prefix of --elapsed, empty before
+// the command started
+func (f *timestampFormat) prefix(t time.Time) string {
+	if !f.elapsed || !f.started.Load() {
+		return ""
+	}
+	return "[" + formatElapsed(f.since(t)) + "] "
+}
+
+// validTimestampFormat returns an error for an unsupported
+// --timestamp-format value
+func validTimestampFormat(layout string) error {
+	switch layout {
+	case "stamp", "rfc3339", "unix", "relative":
+		return nil
+	}
+	return fmt.Errorf("unsupported timestamp format %q (stamp, rfc3339, unix, relative)", layout)
+}
+
+// zone returns t in UTC with --utc, for the times in machine outputs
+func (f *timestampFormat) zone(t time.Time) time.Time {
+	if f.utc {
+		return t.UTC()
+	}
+	return t
+}
+
+func (f *timestampFormat) format(t time.Time) string {
+	t = f.zone(t)
+	switch f.layout {
+	case "rfc3339":
+		return t.Format("2006-01-02T15:04:05.000Z07:00")
+	case "unix":
+		ms := t.UnixMilli()
+		return fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+	case "relative":
+		return formatElapsed(f.since(t))
+	default:
+		return t.Format(time.StampMilli)
+	}
+}
+
+// formatElapsed formats a duration like +00:03:12.450
+func formatElapsed(d time.Duration) string {
+	sign := "+"
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%s%02d:%02d:%02d.%03d", sign, ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CPUClusterSummary is the utilization of a type of cores on a heterogeneous
+// CPU (big.LITTLE, hybrid x86)
+type CPUClusterSummary struct {
+	Name     string    `json:"name"`
+	CPUs     string    `json:"cpus"`
+	Capacity int       `json:"capacity,omitempty"`
+	Usage    Aggregate `json:"usage"`
+}
+
+// cpuCluster is a set of cores of the same type
+type cpuCluster struct {
+	name     string
+	capacity int
+	cpus     map[int]bool
+}
+
+// clusterTracker aggregates the per-core utilization by core type, all
+// methods do nothing on a nil tracker (homogeneous CPUs)
+type clusterTracker struct {
+	clusters []cpuCluster
+	aggs     []aggregator
+}
+
+// readCPUList parses a kernel CPU list like "0-3,8"
+func readCPUList(path string) (map[int]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cpus := map[int]bool{}
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		first, last, found := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected CPU list: %s", data)
+		}
+		to := from
+		if found {
+			if to, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("unexpected CPU list: %s", data)
+			}
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			cpus[cpu] = true
+		}
+	}
+	return cpus, nil
+}
+
+// formatCPUList formats CPU numbers like the kernel ("0-3,8")
+func formatCPUList(cpus map[int]bool) string {
+	ids := make([]int, 0, len(cpus))
+	for cpu := range cpus {
+		ids = append(ids, cpu)
+	}
+	sort.Ints(ids)
+	var parts []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(ids[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// capacityClusters groups the cores by their relative performance from
+// cpu_capacity (ARM and RISC-V with a capacity-dmips-mhz device tree)
+func capacityClusters() []cpuCluster {
+	paths, _ := filepath.Glob("/sys/devices/system/cpu/cpu[0-9]*/cpu_capacity")
+	byCapacity := map[int]map[int]bool{}
+	for _, path := range paths {
+		cpu, err := strconv.Atoi(strings.TrimPrefix(strings.Split(path, "/")[5], "cpu"))
+		if err != nil {
+			continue
+		}
+		value, err := readSysctl(path)
+		if err != nil {
+			continue
+		}
+		capacity, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		if byCapacity[capacity] == nil {
+			byCapacity[capacity] = map[int]bool{}
+		}
+		byCapacity[capacity][cpu] = true
+	}
+	if len(byCapacity) < 2 {
+		return nil
+	}
+
+	// Fastest cores first
+	capacities := make([]int, 0, len(byCapacity))
+	for capacity := range byCapacity {
+		capacities = append(capacities, capacity)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(capacities)))
+	clusters := make([]cpuCluster, len(capacities))
+	for i, capacity := range capacities {
+		name := fmt.Sprintf("capacity %d", capacity)
+		switch {
+		case i == 0:
+			name = "performance"
+		case i == len(capacities)-1:
+			name = "efficiency"
+		case len(capacities) == 3:
+			name = "mid"
+		}
+		clusters[i] = cpuCluster{name: name, capacity: capacity, cpus: byCapacity[capacity]}
+	}
+	return clusters
+}
+
+// hybridClusters returns the core types of hybrid Intel CPUs, which have a
+// separate perf PMU for each
+func hybridClusters() []cpuCluster {
+	performance, err := readCPUList("/sys/devices/cpu_core/cpus")
+	if err != nil {
+		return nil
+	}
+	efficiency, err := readCPUList("/sys/devices/cpu_atom/cpus")
+	if err != nil {
+		return nil
+	}
+	return []cpuCluster{
+		{name: "performance", cpus: performance},
+		{name: "efficiency", cpus: efficiency},
+	}
+}
+
+// newClusterTracker returns nil if all cores are of the same type
+func newClusterTracker() *clusterTracker {
+	clusters := capacityClusters()
+	if clusters == nil {
+		clusters = hybridClusters()
+	}
+	if clusters == nil {
+		return nil
+	}
+	return &clusterTracker{clusters: clusters, aggs: make([]aggregator, len(clusters))}
+}
+
+// add aggregates the utilization of the cores (from coreUsage) per cluster
+func (t *clusterTracker) add(ids []int, usage []float64) {
+	if t == nil || len(usage) != len(ids) {
+		return
+	}
+	for i, cluster := range t.clusters {
+		total, count := 0.0, 0
+		for j, id := range ids {
+			if cluster.cpus[id] {
+				total += usage[j]
+				count++
+			}
+		}
+		if count > 0 {
+			t.aggs[i].add(total / float64(count))
+		}
+	}
+}
+
+func (t *clusterTracker) result() []CPUClusterSummary {
+	if t == nil {
+		return nil
+	}
+	summaries := make([]CPUClusterSummary, len(t.clusters))
+	for i, cluster := range t.clusters {
+		summaries[i] = CPUClusterSummary{
+			Name:     cluster.name,
+			CPUs:     formatCPUList(cluster.cpus),
+			Capacity: cluster.capacity,
+			Usage:    t.aggs[i].result(),
+		}
+	}
+	return summaries
+}
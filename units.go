@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+)
+
+// byteUnits is how sizes are shown in the log, the summary and the reports
+// (--units), machine outputs always have raw numbers
+var byteUnits = "iec"
+
+// validUnits returns an error for an unsupported --units value
+func validUnits(units string) error {
+	switch units {
+	case "iec", "si", "raw":
+		return nil
+	}
+	return fmt.Errorf("unsupported units %q (iec, si, raw)", units)
+}
+
+// formatBytes formats a size: 1.5 GiB (iec), 1.6 GB (si) or 1610612736 B (raw)
+func formatBytes(size uint64) string {
+	switch byteUnits {
+	case "si":
+		return humanize.Bytes(size)
+	case "raw":
+		return strconv.FormatUint(size, 10) + " B"
+	default:
+		return humanize.IBytes(size)
+	}
+}
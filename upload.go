@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// uploadTools are the command line tools that copy a run directory to
+// object storage, by URL scheme
+var uploadTools = map[string]string{
+	"s3": "aws",
+	"gs": "gsutil",
+}
+
+// validUpload returns an error for an unsupported --upload URL
+func validUpload(url string) error {
+	scheme, rest, ok := strings.Cut(url, "://")
+	if _, known := uploadTools[scheme]; !ok || !known || rest == "" {
+		return fmt.Errorf("unsupported upload URL %q (s3://bucket/prefix, gs://bucket/prefix)", url)
+	}
+	return nil
+}
+
+// uploadDestination is where the run ends up: the run ID below the prefix
+func uploadDestination(url, runID string) string {
+	return strings.TrimSuffix(url, "/") + "/" + runID + "/"
+}
+
+// uploadRun copies the run directory to object storage with the aws or
+// gsutil command line tool, which take their credentials from the
+// environment as usual
+func uploadRun(url, dir, runID string) (string, error) {
+	scheme, _, _ := strings.Cut(url, "://")
+	destination := uploadDestination(url, runID)
+	var cmd *exec.Cmd
+	switch scheme {
+	case "s3":
+		cmd = exec.Command("aws", "s3", "sync", "--only-show-errors", dir, destination)
+	case "gs":
+		cmd = exec.Command("gsutil", "-m", "-q", "rsync", "-r", dir, destination)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return destination, fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+	return destination, nil
+}